@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/mumushuiding/util"
 )
@@ -21,6 +22,7 @@ type Configuration struct {
 	DbPort         string
 	DbUser         string
 	DbPassword     string
+	DbSSLMode      string // postgres 的 sslmode,默认 disable
 	DbMaxIdleConns string
 	DbMaxOpenConns string
 	// redis 设置
@@ -28,9 +30,40 @@ type Configuration struct {
 	RedisHost     string
 	RedisPort     string
 	RedisPassword string
+	RedisInMemory string // 为 true 时使用进程内的 redis,不需要 redis 服务器
 	TLSOpen       string
 	TLSCrt        string
 	TLSKey        string
+	// 采集设置
+	TrustedProxies string // 可信代理ip或CIDR,逗号分隔,只有来自可信代理的请求才读取 X-Forwarded-For
+	IPDBPath       string // 离线ip数据库(mmdb格式)路径,为空时不解析区域
+	JournalDir     string // 采集请求预写日志目录,为空时不写日志,重启或崩溃时丢失未保存到redis的流量
+	JournalSync    string // 每条采集请求写入预写日志后是否 fsync,默认true
+	Workers        string // 处理采集请求的协程数,同一用户的请求由同一协程按顺序处理,默认64
+	QueueSize      string // 每个协程等待处理的请求数上限,默认1000
+	OverloadPolicy string // 队列已满时:reject(默认,返回503)或 sample(丢弃请求)
+	// AcceptUnregisteredDomain 是否统计未注册的域名,默认只统计已注册且启用的域名
+	AcceptUnregisteredDomain string
+	// RequireSiteKey 采集请求是否必须携带正确的站点key,升级统计脚本期间可以暂时关闭
+	RequireSiteKey string
+	// 爬虫过滤
+	BotPatternsPath     string // 爬虫 User-Agent 正则规则文件,每行一条,为空时使用内置规则
+	DatacenterIPPath    string // 数据中心ip或CIDR文件,每行一条
+	BotMaxHitsPerMinute string // 同一用户每分钟访问超过该次数时当天视为爬虫,0为不限制
+	// 今日去重
+	DedupMode      string // set(默认,精确)、hll(ip、uv 使用 HyperLogLog)或 bloom(布隆过滤器)
+	BloomCapacity  string // 布隆过滤器每天预计纪录的成员数
+	BloomErrorRate string // 布隆过滤器误判率
+	// 原始访问纪录写入 ClickHouse
+	ClickHouseOpen      string // 是否写入,默认false
+	ClickHouseURL       string // http 接口地址,如 http://localhost:8123
+	ClickHouseDatabase  string
+	ClickHouseTable     string // 表不存在时启动时创建
+	ClickHouseUser      string
+	ClickHousePassword  string
+	ClickHouseBatchSize string // 每批写入的纪录数,另外每10秒写入一次
+	// AdminToken 超级管理员token,用于管理用户和域名,为空时禁用
+	AdminToken string
 	// 跨域设置
 	AccessControlAllowOrigin  string
 	AccessControlAllowHeaders string
@@ -41,6 +74,10 @@ type Configuration struct {
 var Config = &Configuration{}
 
 func init() {
+	// go test 在包目录中运行,没有 config.json,由测试通过 SetForTest 设置配置
+	if strings.HasSuffix(os.Args[0], ".test") {
+		return
+	}
 	LoadConfig()
 }
 
@@ -86,3 +123,8 @@ func (c *Configuration) getConf() *Configuration {
 	}
 	return c
 }
+
+// SetForTest 替换配置,只用于测试
+func SetForTest(c *Configuration) {
+	*Config = *c
+}
@@ -0,0 +1,164 @@
+package connmgr
+
+import (
+	"github.com/go-redis/redis"
+
+	"github.com/codepository/GoWebAnalytics/model"
+	"github.com/codepository/GoWebAnalytics/service"
+)
+
+// batch 一批请求共用的redis读写
+// 处理前在 read 中一次读取用户的访问纪录和目标进度,处理时使用并更新读取的值,产生的命令写入 write,处理完后一起执行
+// 同一用户的请求在同一个队列中按顺序处理,下一批读取时上一批已经写入
+// 累加到缓存的增量保存在 fx 中,处理完后写入预写日志再合并到缓存
+type batch struct {
+	read   redis.Pipeliner
+	write  redis.Pipeliner
+	hashes map[string]map[string]string         // 读取的hash,key为redis key
+	errs   map[string]error                     // 读取失败的hash
+	cmds   map[string]*redis.StringStringMapCmd // 等待读取的hash
+	pages  []*pendingPageinfo                   // 写入redis的页面信息
+	fx     effects
+}
+
+// pendingPageinfo 写入redis的页面信息,added 为加入当天url集合的结果
+type pendingPageinfo struct {
+	page  model.Pageinfo
+	added *redis.IntCmd
+}
+
+func newBatch() *batch {
+	return &batch{
+		read:   model.RedisCli.Pipeline(),
+		write:  model.RedisCli.Pipeline(),
+		hashes: make(map[string]map[string]string),
+		errs:   make(map[string]error),
+		cmds:   make(map[string]*redis.StringStringMapCmd),
+	}
+}
+
+// prefetch 用户有uid时读取半小时内的访问纪录,域名设置了目标时读取用户当天的目标进度
+func (b *batch) prefetch(domain, date, uid string) {
+	if len(uid) == 0 {
+		return
+	}
+	keys := []string{service.GetRedisVisitKey(domain, uid)}
+	if service.HasGoals(domain) {
+		keys = append(keys, service.GetRedisGoalProgressKey(date, uid))
+	}
+	for _, key := range keys {
+		if _, ok := b.cmds[key]; !ok {
+			b.cmds[key] = b.read.HGetAll(key)
+		}
+	}
+}
+
+// load 执行 read 管道
+func (b *batch) load() error {
+	_, err := b.read.Exec()
+	for key, cmd := range b.cmds {
+		if cmd.Err() != nil {
+			b.errs[key] = cmd.Err()
+		} else {
+			b.hashes[key] = cmd.Val()
+		}
+	}
+	b.cmds = make(map[string]*redis.StringStringMapCmd)
+	return err
+}
+
+// hash 读取的hash,修改后本批之后的请求读取修改后的值;没有预先读取时单独读取
+func (b *batch) hash(key string) (map[string]string, error) {
+	if h, ok := b.hashes[key]; ok {
+		return h, nil
+	}
+	if err, ok := b.errs[key]; ok {
+		return nil, err
+	}
+	h, err := model.RedisCli.HGetAll(key).Result()
+	if err != nil {
+		b.errs[key] = err
+		return nil, err
+	}
+	b.hashes[key] = h
+	return h, nil
+}
+
+// evaluateGoals 使用读取的目标进度判断转化目标
+func (b *batch) evaluateGoals(h *service.GoalHit) error {
+	if len(h.UID) == 0 || !service.HasGoals(h.Domain) {
+		return nil
+	}
+	progress, err := b.hash(service.GetRedisGoalProgressKey(h.Date, h.UID))
+	if err != nil {
+		return err
+	}
+	service.EvaluateGoals(b.write, h, progress)
+	return nil
+}
+
+// exec 执行 write 管道
+func (b *batch) exec() error {
+	_, err := b.write.Exec()
+	return err
+}
+
+// newPageinfos write 管道执行后,当天第一次加入url集合的页面信息
+func (b *batch) newPageinfos() []*model.Pageinfo {
+	var pages []*model.Pageinfo
+	for _, p := range b.pages {
+		if p.added.Err() == nil && p.added.Val() == 1 {
+			pages = append(pages, &p.page)
+		}
+	}
+	return pages
+}
+
+func (b *batch) addWebflow(data *model.WebFlow) {
+	b.fx.Webflows = append(b.fx.Webflows, data)
+}
+
+func (b *batch) addBrowsing(data *model.Browsing) {
+	b.fx.Browsings = append(b.fx.Browsings, data)
+}
+
+func (b *batch) addSource(data *model.Source) {
+	b.fx.Sources = append(b.fx.Sources, data)
+}
+
+func (b *batch) addBot(data *model.Bot) {
+	b.fx.Bots = append(b.fx.Bots, data)
+}
+
+func (b *batch) addEvent(data *model.Event) {
+	b.fx.Events = append(b.fx.Events, data)
+}
+
+func (b *batch) addHourly(incrs []*service.HourlyIncr) {
+	b.fx.Hourly = append(b.fx.Hourly, incrs...)
+}
+
+// effects 一批请求累加到缓存的增量
+// 去重、访问纪录等在处理时已经写入redis,重新处理请求的结果不同,所以重放预写日志时合并增量,不再处理 IDs 中的请求
+type effects struct {
+	IDs       []int64               `json:"ids"` // 已处理的采集请求
+	Webflows  []*model.WebFlow      `json:"w,omitempty"`
+	Browsings []*model.Browsing     `json:"b,omitempty"`
+	Sources   []*model.Source       `json:"s,omitempty"`
+	Bots      []*model.Bot          `json:"bot,omitempty"`
+	Events    []*model.Event        `json:"e,omitempty"`
+	Hourly    []*service.HourlyIncr `json:"h,omitempty"`
+}
+
+// batchItem 一批中的一个请求和处理前得到的信息
+type batchItem struct {
+	req    interface{}
+	seg    int64
+	id     int64
+	date   string
+	skip   bool                             // 未注册的域名或已统计的爬虫,不需要再处理
+	reason string                           // 按 User-Agent 和ip识别的爬虫
+	name   string                           // 爬虫匹配的规则
+	rate   func(write redis.Pipeliner) bool // 按访问频率识别爬虫
+	flow   *webFlowReq                      // 需要统计的页面浏览
+}
@@ -2,12 +2,15 @@ package connmgr
 
 import (
 	"errors"
+	"hash/fnv"
 	"log"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/codepository/GoWebAnalytics/config"
 	"github.com/codepository/GoWebAnalytics/service"
 
 	"github.com/go-redis/redis"
@@ -22,27 +25,70 @@ const maxFailedAttempts = 3
 // CM 连接管理器
 var CM *ConnManager
 
+// 采集请求类型(WebData.Type)
+const (
+	HitPageview = "pageview" // 页面浏览
+	HitEvent    = "event"    // 自定义事件
+)
+
 // handlePerTime 当达到指定数时，批量处理
 const handlePerTime = 500
 
 // 每隔指定时间将缓存保存到redis
 const flushCacheToRedisPeriod = 10
 
+// maxBufferedHits ClickHouse 写入失败时最多缓存的原始访问纪录数
+const maxBufferedHits = 100000
+
 // 每隔指定时间从redis读取域名流量信息
 const getRealtimeWebflowPeriod = 300
 
+// journalWaitTimeout 保存到redis前等待预写日志中的请求处理到缓存的最长时间
+const journalWaitTimeout = 30 * time.Second
+
+// drainTimeout 关闭时等待正在处理的请求完成的最长时间
+const drainTimeout = 10 * time.Second
+
+// batchSize 协程一次最多从队列中取出的请求数
+const batchSize = 100
+
+// 处理采集请求的协程数和每个协程的队列长度,未配置时使用
+const (
+	defaultWorkers   = 64
+	defaultQueueSize = 1000
+)
+
+// 队列已满时的处理方式(OverloadPolicy)
+const (
+	OverloadReject = "reject" // 返回 ErrOverloaded,采集接口返回503
+	OverloadSample = "sample" // 丢弃请求,采集接口正常返回
+)
+
+// ErrOverloaded 队列已满,请求没有统计
+var ErrOverloaded = errors.New("采集请求过多,请稍后重试")
+
+// errStopped 连接管理器已经关闭
+var errStopped = errors.New("连接管理器已经关闭")
+
 // ConnManager 连接管理器
 type ConnManager struct {
 	cfg          *Config
 	start        int32
 	stop         int32
 	connReqCount uint64
-	requests     chan interface{}
+	queues       []chan interface{} // 按 uid 或 url 分片的请求队列,每个队列一个协程按顺序处理
+	queued       []int32            // 每个队列中的请求数,包括正在写入预写日志的请求
+	queueLock    sync.RWMutex       // 关闭队列时不能再写入
+	closed       bool               // 队列是否已关闭
+	overload     string             // 队列已满时的处理方式
+	dropped      uint64             // 队列已满时丢弃的请求数
+	workers      sync.WaitGroup
+	background   sync.WaitGroup // 定时任务和异步保存的协程,Stop 时等待完成
 	// pageinfos                map[string]*model.Pageinfo
 	// pageinfoLock             sync.RWMutex
 	webflows                 map[string]*model.WebFlow //key为url+date
 	webflowsLock             sync.RWMutex
-	browsings                map[string]*model.Browsing //key为url+date
+	browsings                map[string]*model.Browsing //key为uid+date+domain
 	browsingsLock            sync.RWMutex
 	pvrealtime               map[string]int64 // 实时打开页面数
 	pvlock                   sync.RWMutex
@@ -50,6 +96,20 @@ type ConnManager struct {
 	iplock                   sync.RWMutex
 	uvrealtime               map[string]map[string]interface{} // uv实时打开页面数
 	uvlock                   sync.RWMutex
+	sources                  map[string]*model.Source // 流量来源,key为date+field
+	sourcesLock              sync.RWMutex
+	bots                     map[string]*model.Bot // 爬虫访问量,key为date+field
+	botsLock                 sync.RWMutex
+	events                   map[string]*model.Event // 自定义事件,key为date+field
+	eventsLock               sync.RWMutex
+	hourly                   map[string]map[string]int64 // 每小时流量,redis key:field:增量
+	hourlyLock               sync.RWMutex
+	hits                     []*service.Hit // 原始访问纪录,批量写入 ClickHouse
+	hitsLock                 sync.Mutex
+	journal                  *journal     // 采集请求预写日志,为nil时不写日志
+	flushLock                sync.Mutex   // 同一时间只有一个 Flush
+	cacheLock                sync.RWMutex // 合并一批请求的增量时持有读锁,flush 切换缓存时持有写锁
+	flushing                 int32        // 是否已经安排提前保存
 	quit                     chan struct{}
 	flushcacheTicker         *time.Ticker
 	getRealtimeWebflowTicker *time.Ticker
@@ -57,13 +117,16 @@ type ConnManager struct {
 
 // Config Config
 type Config struct {
-	OnWebData func(*WebData)
+	// OnBatch 按顺序处理协程一次从队列中取出的请求
+	OnBatch func([]interface{})
 	// HandleWebFlow 统计流量
-	HandleWebFlow func(*webFlowReq)
+	HandleWebFlow func(*batch, *webFlowReq)
 	// HandleBrowsing 纪录用户习惯
 	HandleBrowsing func(*model.Browsing)
 	// HandleDuration 浏览时长
-	HandleDuration func(*Duration)
+	HandleDuration func(*batch, *Duration)
+	// HandleEvent 统计自定义事件
+	HandleEvent func(*batch, *model.Event)
 }
 
 // WebData 页面信息
@@ -71,11 +134,28 @@ type WebData struct {
 	Pageinfo model.Pageinfo `json:"p"`
 	WebFlow  model.WebFlow  `json:"w"`
 	Browsing model.Browsing `json:"b"`
-	Type     string         `json:"t"`
+	Type     string         `json:"t"` // 类型:pageview(默认)、event
+	Event    model.Event    `json:"e"` // 自定义事件,类型为 event 时有效
+	Referrer string         `json:"r"` // 来源页面
+	SiteKey  string         `json:"k"` // 站点key
+	// UserAgent 由服务端填充,用于识别爬虫
+	UserAgent string `json:"-"`
+	// Time 接收时间,重放预写日志时按接收时间统计
+	Time time.Time `json:"-"`
+	seg  int64     // 所在的预写日志文件
+	id   int64     // 预写日志中的序号
 }
 type webFlowReq struct {
 	webflow  *model.WebFlow
 	browsing *model.Browsing
+	pageinfo *model.Pageinfo // 今天第一次访问url时保存
+	source   *model.Source
+	referrer string
+	time     time.Time            // 接收时间
+	dedup    *service.DedupResult // 去重结果,为nil时单独去重
+	// hourly 去重时判断每小时的新用户和ip,设置 hourlyHit 的访问标记后得到每小时流量的增量
+	hourly    func() []*service.HourlyIncr
+	hourlyHit *service.HourlyHit
 }
 
 // Duration 网页浏览时长
@@ -86,6 +166,13 @@ type Duration struct {
 	UID      string `json:"uid"`
 	URL      string `json:"url"`
 	Date     string `json:"date"`
+	SiteKey  string `json:"k"` // 站点key
+	// UserAgent 由服务端填充,用于识别爬虫
+	UserAgent string `json:"-"`
+	// Time 接收时间,重放预写日志时按接收时间统计会话
+	Time time.Time `json:"-"`
+	seg  int64     // 所在的预写日志文件
+	id   int64     // 预写日志中的序号
 }
 
 // Start 连接管理器初始化
@@ -95,35 +182,37 @@ func (cm *ConnManager) Start() {
 		return
 	}
 	log.Println("启动连接管理器")
-	go cm.connHandler()
-	go func() {
+	for i := range cm.queues {
+		cm.workers.Add(1)
+		go cm.worker(i)
+	}
+	cm.goBackground(func() {
 	out:
 		for {
 			select {
 			case <-cm.flushcacheTicker.C:
-				// 网页流量保存到redis
-				go cm.flushWebflowsToRedis()
-				// 用户访问信息保存到redis
-				go cm.flushBrowsingsToRedis()
-				// 将实时PV、IP、UV保存到redis
-				go cm.flushRealtimeDataToRedis()
+				if err := cm.Flush(); err != nil {
+					cm.log(err)
+				}
+				// 结束超时的会话并保存到数据库
+				cm.goBackground(service.CloseIdleSessions)
 			case <-cm.quit:
 				break out
 			}
 		}
-	}()
-	go func() {
+	})
+	cm.goBackground(func() {
 	out:
 		for {
 			// 保存实时流量
 			select {
 			case <-cm.getRealtimeWebflowTicker.C:
-				go cm.persistRealtimeWebflow()
+				cm.goBackground(cm.persistRealtimeWebflow)
 			case <-cm.quit:
 				break out
 			}
 		}
-	}()
+	})
 	// 关联文件在多个文件夹无法测试，用以下代码进行测试
 	// go func() {
 	// 	println("this is a test func,you must delete it later!!!")
@@ -141,7 +230,7 @@ func (cm *ConnManager) Start() {
 	// 	service.FlushBrowsings2DBFromRedis(date)
 	// }()
 	// 每天0点保存数据到数据库
-	go func() {
+	cm.goBackground(func() {
 	out:
 		for {
 			now := time.Now()
@@ -159,32 +248,223 @@ func (cm *ConnManager) Start() {
 				service.FlushWebflow2DBFromRedis(date)
 				// 保存用户习惯到数据库
 				service.FlushBrowsings2DBFromRedis(date)
+				// 保存流量来源到数据库
+				service.FlushSources2DBFromRedis(date)
+				// 保存爬虫访问量到数据库
+				service.FlushBots2DBFromRedis(date)
+				// 保存自定义事件到数据库
+				service.FlushEvents2DBFromRedis(date)
+				// 保存目标转化到数据库
+				service.FlushGoals2DBFromRedis(date)
+				// 保存每小时流量到数据库
+				service.FlushHourly2DBFromRedis(date)
+				// 保存 HyperLogLog 到数据库并更新每周、每月汇总,需要在流量保存到数据库之后
+				service.FlushSketches2DBFromRedis(date)
 				// 设置 key 过期时间
 				service.RedisKeyWithTongjiAboutTodayExpireAtTomorrow()
 			}
 		}
+	})
+}
+
+// goBackground 启动后台协程,Stop 时等待完成
+func (cm *ConnManager) goBackground(f func()) {
+	cm.background.Add(1)
+	go func() {
+		defer cm.background.Done()
+		f()
 	}()
 }
 
-// Stop gracefully shuts down the connection manager.
+// Flush 将缓存的流量保存到redis,等待保存完成,全部保存成功后删除已处理的预写日志
+// 实时PV、IP、UV和原始访问纪录异步保存,不影响预写日志
+func (cm *ConnManager) Flush() error {
+	if n := atomic.SwapUint64(&cm.dropped, 0); n > 0 {
+		log.Printf("队列已满,丢弃%d条采集请求\n", n)
+	}
+	// 将实时PV、IP、UV保存到redis
+	cm.goBackground(cm.flushRealtimeDataToRedis)
+	// 原始访问纪录写入 ClickHouse
+	cm.goBackground(cm.flushHits)
+	return cm.flush(journalWaitTimeout)
+}
+
+// flush 切换缓存并保存到redis,保存成功且预写日志中的请求在 wait 内处理完成后删除已保存的日志
+func (cm *ConnManager) flush(wait time.Duration) error {
+	cm.flushLock.Lock()
+	defer cm.flushLock.Unlock()
+	// 之后的增量写入新的日志文件,合并到新的缓存
+	cm.cacheLock.Lock()
+	seg, err := cm.journal.rotate()
+	if err != nil {
+		cm.cacheLock.Unlock()
+		return err
+	}
+	flushes := cm.swapCaches()
+	cm.cacheLock.Unlock()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(flushes))
+	for _, flush := range flushes {
+		wg.Add(1)
+		go func(flush func() error) {
+			defer wg.Done()
+			if err := flush(); err != nil {
+				errs <- err
+			}
+		}(flush)
+	}
+	wg.Wait()
+	close(errs)
+	// 保存失败的流量已重新缓存,保留预写日志等待下次保存
+	if err := <-errs; err != nil {
+		return err
+	}
+	// 之前文件中还未处理的请求,增量会写入之后的文件
+	if !cm.journal.waitProcessed(seg, wait) {
+		return errors.New("等待预写日志中的请求处理超时")
+	}
+	return cm.journal.remove(seg)
+}
+
+// swapCaches 切换缓存,返回将切换出来的缓存保存到redis的函数
+func (cm *ConnManager) swapCaches() []func() error {
+	cm.webflowsLock.Lock()
+	webflows := cm.webflows
+	cm.webflows = make(map[string]*model.WebFlow)
+	cm.webflowsLock.Unlock()
+	cm.browsingsLock.Lock()
+	browsings := cm.browsings
+	cm.browsings = make(map[string]*model.Browsing)
+	cm.browsingsLock.Unlock()
+	cm.sourcesLock.Lock()
+	sources := cm.sources
+	cm.sources = make(map[string]*model.Source)
+	cm.sourcesLock.Unlock()
+	cm.botsLock.Lock()
+	bots := cm.bots
+	cm.bots = make(map[string]*model.Bot)
+	cm.botsLock.Unlock()
+	cm.eventsLock.Lock()
+	events := cm.events
+	cm.events = make(map[string]*model.Event)
+	cm.eventsLock.Unlock()
+	cm.hourlyLock.Lock()
+	hourly := cm.hourly
+	cm.hourly = make(map[string]map[string]int64)
+	cm.hourlyLock.Unlock()
+	return []func() error{
+		// 网页流量保存到redis
+		func() error { return cm.flushWebflowsToRedis(webflows) },
+		// 用户访问信息保存到redis
+		func() error { return cm.flushBrowsingsToRedis(browsings) },
+		// 流量来源保存到redis
+		func() error { return cm.flushSourcesToRedis(sources) },
+		// 爬虫访问量保存到redis
+		func() error { return cm.flushBotsToRedis(bots) },
+		// 自定义事件保存到redis
+		func() error { return cm.flushEventsToRedis(events) },
+		// 每小时流量保存到redis
+		func() error { return cm.flushHourlyToRedis(hourly) },
+	}
+}
+
+// flushSoon 缓存达到 handlePerTime 条时提前保存到redis,正在保存时不重复执行
+func (cm *ConnManager) flushSoon() {
+	if !atomic.CompareAndSwapInt32(&cm.flushing, 0, 1) {
+		return
+	}
+	cm.goBackground(func() {
+		defer atomic.StoreInt32(&cm.flushing, 0)
+		if err := cm.Flush(); err != nil {
+			cm.log(err)
+		}
+	})
+}
+
+// Stop 等待正在处理的请求完成,将缓存保存到redis后关闭连接管理器
+// 需要在 http 服务关闭之后、数据库和redis关闭之前调用
 func (cm *ConnManager) Stop() {
 	if atomic.AddInt32(&cm.stop, 1) != 1 {
 		log.Println("连接管理器已经关闭")
 		return
 	}
-	// 将map中缓存的信息缓存到redis
+	// 等待正在处理的请求完成
+	wait := journalWaitTimeout
+	if !cm.drain(drainTimeout) {
+		log.Println("等待请求处理超时,未处理的请求保留在预写日志中,下次启动时重放")
+		wait = 0
+	}
 	close(cm.quit)
-	close(cm.requests)
 	// 暂停定时器
 	cm.flushcacheTicker.Stop()
 	cm.getRealtimeWebflowTicker.Stop()
+	// 等待定时任务和异步保存完成
+	cm.background.Wait()
+	// 将map中缓存的信息保存到redis,等待保存完成
+	if err := cm.flush(wait); err != nil {
+		cm.log(err)
+	}
+	cm.flushRealtimeDataToRedis()
+	cm.flushHits()
+	// 未保存到redis的请求在下次启动时重放
+	if err := cm.journal.close(); err != nil {
+		cm.log(err)
+	}
 	log.Println("连接管理器关闭成功")
 }
 
-// New 返回一个连接管理器
-func New() {
-	cm := ConnManager{
-		requests: make(chan interface{}, 10),
+// drain 关闭队列,等待队列中的请求处理完成,超时返回false
+func (cm *ConnManager) drain(timeout time.Duration) bool {
+	cm.queueLock.Lock()
+	if !cm.closed {
+		cm.closed = true
+		for _, q := range cm.queues {
+			close(q)
+		}
+	}
+	cm.queueLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		cm.workers.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// New 创建并启动连接管理器,重放上次关闭时未保存到redis的采集请求
+func New() error {
+	overload := config.Config.OverloadPolicy
+	if len(overload) == 0 {
+		overload = OverloadReject
+	}
+	if overload != OverloadReject && overload != OverloadSample {
+		return errors.New("OverloadPolicy 只能是 reject 或 sample:" + overload)
+	}
+	j, records, err := openJournal(config.Config.JournalDir, config.Config.JournalSync != "false")
+	if err != nil {
+		return err
+	}
+	CM = newConnManager()
+	CM.setQueues(atoiOr(config.Config.Workers, defaultWorkers), atoiOr(config.Config.QueueSize, defaultQueueSize))
+	CM.overload = overload
+	CM.journal = j
+	records = CM.replayEffects(records)
+	CM.Start()
+	CM.replay(records)
+	return nil
+}
+
+// newConnManager 返回一个未启动的连接管理器
+func newConnManager() *ConnManager {
+	cm := &ConnManager{
+		overload: OverloadReject,
 		quit:     make(chan struct{}),
 		// pageinfos:                make(map[string]*model.Pageinfo),
 		webflows:                 make(map[string]*model.WebFlow),
@@ -192,89 +472,403 @@ func New() {
 		pvrealtime:               make(map[string]int64),
 		iprealtime:               make(map[string]map[string]interface{}),
 		uvrealtime:               make(map[string]map[string]interface{}),
+		sources:                  make(map[string]*model.Source),
+		bots:                     make(map[string]*model.Bot),
+		events:                   make(map[string]*model.Event),
+		hourly:                   make(map[string]map[string]int64),
 		flushcacheTicker:         time.NewTicker(time.Second * flushCacheToRedisPeriod),
 		getRealtimeWebflowTicker: time.NewTicker(time.Second * getRealtimeWebflowPeriod),
 	}
 	cfg := &Config{
-		OnWebData:      cm.inWebData,
+		OnBatch:        cm.handleBatch,
 		HandleWebFlow:  cm.handleWebFlow,
 		HandleDuration: cm.handleDuration,
+		HandleEvent:    cm.handleEvent,
 	}
 	cm.cfg = cfg
-	CM = &cm
-	CM.Start()
+	cm.setQueues(defaultWorkers, defaultQueueSize)
+	return cm
+}
+
+// setQueues 设置处理请求的协程数和每个协程的队列长度,需要在 Start 之前调用
+func (cm *ConnManager) setQueues(workers, size int) {
+	cm.queues = make([]chan interface{}, workers)
+	cm.queued = make([]int32, workers)
+	for i := range cm.queues {
+		cm.queues[i] = make(chan interface{}, size)
+	}
 }
 
-// connHandler handle all connection related request
-func (cm *ConnManager) connHandler() {
-out:
-	for {
-		select {
-		case req := <-cm.requests:
-			switch msg := req.(type) {
+// atoiOr 配置为空或不是正整数时返回默认值
+func atoiOr(s string, def int) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+// worker 按顺序处理一个队列中的请求,每次取出队列中已有的请求,最多 batchSize 个
+func (cm *ConnManager) worker(i int) {
+	defer cm.workers.Done()
+	q := cm.queues[i]
+	for req := range q {
+		atomic.AddInt32(&cm.queued[i], -1)
+		reqs := []interface{}{req}
+	more:
+		for len(reqs) < batchSize {
+			select {
+			case req, ok := <-q:
+				if !ok {
+					break more
+				}
+				atomic.AddInt32(&cm.queued[i], -1)
+				reqs = append(reqs, req)
+			default:
+				break more
+			}
+		}
+		cm.cfg.OnBatch(reqs)
+	}
+}
+
+// handleBatch 按顺序处理一批请求,redis 读取、去重、写入各一次往返
+// 读取:按访问频率识别爬虫,用户的访问纪录和目标进度;去重:页面浏览的 IP、UV 和每小时的新用户、ip;写入:处理时产生的其它命令
+func (cm *ConnManager) handleBatch(reqs []interface{}) {
+	b := newBatch()
+	items := make([]*batchItem, len(reqs))
+	for i, req := range reqs {
+		items[i] = cm.prepare(b, req)
+		if items[i].id > 0 {
+			b.fx.IDs = append(b.fx.IDs, items[i].id)
+		}
+	}
+	if err := b.load(); err != nil {
+		cm.log(err)
+	}
+	// 统计爬虫,得到需要去重的页面浏览
+	var flows []*webFlowReq
+	for _, it := range items {
+		if w, ok := it.req.(*WebData); ok && !it.skip {
+			if it.flow = cm.handleWebData(b, w, it); it.flow != nil {
+				flows = append(flows, it.flow)
+			}
+		}
+	}
+	cm.dedupBatch(flows)
+	// 页面浏览、自定义事件和浏览时长按顺序统计,转化目标的步骤保持顺序
+	for _, it := range items {
+		switch {
+		case it.skip:
+		case it.flow != nil:
+			cm.cfg.HandleWebFlow(b, it.flow)
+		default:
+			switch msg := it.req.(type) {
 			case *WebData:
-				go cm.cfg.OnWebData(msg)
-			case *webFlowReq:
-				go cm.cfg.HandleWebFlow(msg)
+				cm.handleWebEvent(b, msg, it.date)
 			case *Duration:
-				go cm.cfg.HandleDuration(msg)
+				cm.cfg.HandleDuration(b, msg)
 			}
-		case <-cm.quit:
-			break out
 		}
 	}
+	if err := b.exec(); err != nil {
+		cm.log(err)
+	}
+	cm.savePageinfos(b)
+	cm.commit(&b.fx)
+	// 增量写入预写日志并添加到缓存后请求处理完成
+	for _, it := range items {
+		cm.journal.done(it.seg)
+	}
 }
 
-// NewWebData 新建连接
-func (cm *ConnManager) NewWebData(w *WebData) {
-	select {
-	case cm.requests <- w:
-		atomic.AddUint64(&cm.connReqCount, 1)
-	case <-cm.quit:
-		return
+// commit 将一批请求的增量写入预写日志后合并到缓存,与 flush 切换缓存互斥
+// 增量和合并到的缓存在同一个日志文件之前 rotate,缓存保存到redis后删除的文件只包含已保存的增量
+func (cm *ConnManager) commit(fx *effects) {
+	cm.cacheLock.RLock()
+	defer cm.cacheLock.RUnlock()
+	if len(fx.IDs) > 0 {
+		// 写入失败时重放请求,redis中已经去重的ip、uv可能少算
+		if _, err := cm.journal.append(&journalRecord{Type: journalEffects, Effects: fx, Time: time.Now()}); err != nil {
+			cm.log(err)
+		}
 	}
+	cm.mergeEffects(fx)
 }
 
-// CloseWeb 关闭网页
-func (cm *ConnManager) CloseWeb(d *Duration) {
-	select {
-	case cm.requests <- d:
-		atomic.AddUint64(&cm.connReqCount, 1)
-	case <-cm.quit:
+// mergeEffects 将增量合并到缓存
+func (cm *ConnManager) mergeEffects(fx *effects) {
+	for _, w := range fx.Webflows {
+		cm.addWebflow(w)
+	}
+	for _, b := range fx.Browsings {
+		cm.addBrowsing(b)
+	}
+	for _, s := range fx.Sources {
+		cm.addSource(s)
+	}
+	for _, b := range fx.Bots {
+		cm.addBot(b)
+	}
+	for _, e := range fx.Events {
+		cm.addEvent(e)
+	}
+	cm.addHourly(fx.Hourly)
+}
+
+// prepare 只统计已注册的域名,在读取管道中加入爬虫访问频率、用户的访问纪录和目标进度
+func (cm *ConnManager) prepare(b *batch, req interface{}) *batchItem {
+	it := &batchItem{req: req}
+	switch msg := req.(type) {
+	case *WebData:
+		it.seg, it.id = msg.seg, msg.id
+		it.date = util.FormatDate(msg.Time, util.YYYY_MM_DD)
+		// 别名转换为注册的域名
+		domain, ok := service.ResolveDomain(it.date, msg.Browsing.Domain)
+		if !ok {
+			it.skip = true
+			return it
+		}
+		msg.Browsing.Domain = domain
+		// 爬虫不计入流量,单独统计
+		if it.reason, it.name = service.DetectBot(msg.UserAgent, msg.Browsing.IP); len(it.reason) > 0 {
+			return it
+		}
+		it.rate = service.IsBotRate(b.read, it.date, msg.Browsing.UID)
+		b.prefetch(domain, it.date, msg.Browsing.UID)
+	case *Duration:
+		it.seg, it.id = msg.seg, msg.id
+		domain, ok := service.ResolveDomain(msg.Date, msg.Domain)
+		if !ok {
+			it.skip = true
+			return it
+		}
+		msg.Domain = domain
+		b.prefetch(domain, msg.Date, msg.UID)
+	}
+	return it
+}
+
+// dedupBatch 在一个redis事务中为一批页面浏览去重,并判断每小时的新用户和ip
+func (cm *ConnManager) dedupBatch(reqs []*webFlowReq) {
+	if len(reqs) == 0 {
 		return
 	}
+	pipe := model.RedisCli.TxPipeline()
+	hits := make([]*service.DedupHit, len(reqs))
+	for i, req := range reqs {
+		hits[i] = &service.DedupHit{
+			Date:   req.webflow.Date,
+			Domain: req.webflow.Domain,
+			URL:    req.webflow.URL,
+			UID:    req.browsing.UID,
+			IP:     req.browsing.IP,
+			Time:   req.time,
+		}
+		req.hourlyHit = &service.HourlyHit{
+			Domain: req.webflow.Domain,
+			URL:    req.webflow.URL,
+			UID:    req.browsing.UID,
+			IP:     req.browsing.IP,
+			Date:   req.webflow.Date,
+			Hour:   req.time.Hour(),
+		}
+		req.hourly = service.CountHourly(pipe, req.hourlyHit)
+	}
+	results := service.DedupBatch(pipe, hits)
+	if _, err := pipe.Exec(); err != nil {
+		cm.log(err)
+	}
+	for i, r := range results() {
+		reqs[i].dedup = r
+	}
 }
-func (cm *ConnManager) inWebData(w *WebData) {
-	// 判断url地址是否已经存在
-	w.Pageinfo.Dm = w.Browsing.Domain
-	date := util.GetDateAsDefaultStr()
-	if !model.RedisCli.SIsMember(service.GetRedisURLKey(date), w.Pageinfo.URL).Val() {
-		go cm.addPageinfo(w)
+
+// shard 请求所在的队列,同一用户的请求按顺序处理,没有uid时按url分片
+func (cm *ConnManager) shard(uid, url string) int {
+	h := fnv.New32a()
+	if len(uid) > 0 {
+		h.Write([]byte(uid))
+	} else {
+		h.Write([]byte(url))
+	}
+	return int(h.Sum32() % uint32(len(cm.queues)))
+}
+
+// submit 占用队列位置,write 写入预写日志后放入队列
+// 队列已满时按 overload 处理,block 为true时等待队列有空位
+func (cm *ConnManager) submit(i int, req interface{}, write func() error, block bool) error {
+	cm.queueLock.RLock()
+	defer cm.queueLock.RUnlock()
+	if cm.closed {
+		return errStopped
 	}
+	if n := atomic.AddInt32(&cm.queued[i], 1); !block && int(n) > cap(cm.queues[i]) {
+		atomic.AddInt32(&cm.queued[i], -1)
+		if cm.overload == OverloadSample {
+			atomic.AddUint64(&cm.dropped, 1)
+			return nil
+		}
+		return ErrOverloaded
+	}
+	if err := write(); err != nil {
+		atomic.AddInt32(&cm.queued[i], -1)
+		return err
+	}
+	// 已占用位置,队列已满时只有 block 为true时等待
+	cm.queues[i] <- req
+	return nil
+}
+
+// NewWebData 新建连接,写入预写日志后返回,写入失败或队列已满时返回错误
+func (cm *ConnManager) NewWebData(w *WebData) error {
+	if w.Time.IsZero() {
+		w.Time = time.Now()
+	}
+	atomic.AddUint64(&cm.connReqCount, 1)
+	return cm.submit(cm.shard(w.Browsing.UID, w.Pageinfo.URL), w, func() error {
+		rec := &journalRecord{Type: journalWebData, WebData: w, UserAgent: w.UserAgent, Time: w.Time}
+		seg, err := cm.journal.append(rec)
+		w.seg, w.id = seg, rec.ID
+		return err
+	}, false)
+}
+
+// CloseWeb 关闭网页,写入预写日志后返回,写入失败或队列已满时返回错误
+func (cm *ConnManager) CloseWeb(d *Duration) error {
+	if d.Time.IsZero() {
+		d.Time = time.Now()
+	}
+	atomic.AddUint64(&cm.connReqCount, 1)
+	return cm.submit(cm.shard(d.UID, d.URL), d, func() error {
+		rec := &journalRecord{Type: journalDuration, Duration: d, UserAgent: d.UserAgent, Time: d.Time}
+		seg, err := cm.journal.append(rec)
+		d.seg, d.id = seg, rec.ID
+		return err
+	}, false)
+}
+
+// replayEffects 合并预写日志中已处理请求的增量,返回需要重新处理的请求,需要在 Start 之前调用
+func (cm *ConnManager) replayEffects(records []*journalRecord) []*journalRecord {
+	cm.cacheLock.RLock()
+	defer cm.cacheLock.RUnlock()
+	processed := make(map[int64]bool)
+	for _, r := range records {
+		if r.Type == journalEffects && r.Effects != nil {
+			cm.mergeEffects(r.Effects)
+			for _, id := range r.Effects.IDs {
+				processed[id] = true
+			}
+		}
+	}
+	var reqs []*journalRecord
+	for _, r := range records {
+		switch {
+		case r.Type == journalEffects:
+		case r.ID > 0 && processed[r.ID]:
+			cm.journal.done(r.seg)
+		default:
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+// replay 重放预写日志中未处理的采集请求,队列已满时等待
+func (cm *ConnManager) replay(records []*journalRecord) {
+	written := func() error { return nil }
+	for _, r := range records {
+		var err error
+		switch {
+		case r.Type == journalWebData && r.WebData != nil:
+			w := r.WebData
+			w.UserAgent, w.Time, w.seg, w.id = r.UserAgent, r.Time, r.seg, r.ID
+			err = cm.submit(cm.shard(w.Browsing.UID, w.Pageinfo.URL), w, written, true)
+		case r.Type == journalDuration && r.Duration != nil:
+			d := r.Duration
+			d.UserAgent, d.Time, d.seg, d.id = r.UserAgent, r.Time, r.seg, r.ID
+			err = cm.submit(cm.shard(d.UID, d.URL), d, written, true)
+		default:
+			cm.journal.done(r.seg)
+		}
+		// 已关闭时保留在预写日志中,下次启动时重放
+		if err != nil {
+			cm.log(err)
+			return
+		}
+	}
+}
+
+// handleWebData 统计爬虫,页面浏览时返回需要统计的流量,自定义事件由 handleWebEvent 按顺序统计
+func (cm *ConnManager) handleWebData(b *batch, w *WebData, it *batchItem) *webFlowReq {
+	date := it.date
+	if len(it.reason) == 0 && it.rate(b.write) {
+		it.reason = model.BotReasonRate
+	}
+	if len(it.reason) > 0 {
+		it.skip = true
+		cm.addHit(webDataHit(w, it.reason))
+		b.addBot(&model.Bot{Domain: w.Browsing.Domain, Date: date, Reason: it.reason, Name: it.name, PV: 1})
+		return nil
+	}
+	// 自定义事件不计入页面流量
+	if w.Type == HitEvent {
+		return nil
+	}
+	cm.addHit(webDataHit(w, ""))
+	w.Pageinfo.Dm = w.Browsing.Domain
 	// 将uid保存至redis
-	go service.AddUID2Redis(date, w.Browsing.UID)
+	service.AddUID2Redis(b.write, date, w.Browsing.UID)
 	w.WebFlow.Date = date
 	w.WebFlow.URL = w.Pageinfo.URL
 	w.WebFlow.Domain = w.Browsing.Domain
 	w.Browsing.Date = date
-	f := webFlowReq{
+	// 流量来源
+	source := service.ClassifySource(w.Pageinfo.URL, w.Referrer)
+	source.Domain = w.Browsing.Domain
+	source.Date = date
+	return &webFlowReq{
 		webflow:  &w.WebFlow,
 		browsing: &w.Browsing,
+		pageinfo: &w.Pageinfo,
+		source:   source,
+		referrer: w.Referrer,
+		time:     w.Time,
 	}
+}
 
-	select {
-	case cm.requests <- &f:
-	case <-cm.quit:
+// handleWebEvent 统计自定义事件和转化目标
+func (cm *ConnManager) handleWebEvent(b *batch, w *WebData, date string) {
+	e := &w.Event
+	if err := service.CheckEvent(e); err != nil {
+		cm.log(err)
 		return
 	}
+	cm.addHit(webDataHit(w, ""))
+	e.Domain = w.Browsing.Domain
+	e.Date = date
+	e.URL = w.Pageinfo.URL
+	e.Count = 1
+	if err := b.evaluateGoals(&service.GoalHit{
+		Type:   model.GoalStepEvent,
+		Domain: e.Domain,
+		Date:   date,
+		UID:    w.Browsing.UID,
+		URL:    e.URL,
+		Event:  e.Category + "/" + e.Action,
+	}); err != nil {
+		cm.log(err)
+	}
+	cm.cfg.HandleEvent(b, e)
 }
+
 func (cm *ConnManager) log(err error) {
 	log.Println(err)
 }
 
-func (cm *ConnManager) addPageinfo(w *WebData) {
+func (cm *ConnManager) addPageinfo(b *batch, date string, p *model.Pageinfo) {
 	// cm.pageinfos[w.Pageinfo.URL] = &w.Pageinfo
-	go cm.handlePageinfo(w.Pageinfo)
+	cm.handlePageinfo(b, date, *p)
 }
 func (cm *ConnManager) addPVRealtime(domain string, num int64) {
 	cm.pvlock.Lock()
@@ -285,6 +879,8 @@ func (cm *ConnManager) addIPRealtime(domain, ip string, num int) {
 	cm.iplock.Lock()
 	if cm.iprealtime[domain] == nil {
 		cm.iprealtime[domain] = make(map[string]interface{})
+	}
+	if cm.iprealtime[domain][ip] == nil {
 		cm.iprealtime[domain][ip] = 0
 	}
 	cm.iprealtime[domain][ip] = cm.iprealtime[domain][ip].(int) + num
@@ -302,9 +898,16 @@ func (cm *ConnManager) addUVRealtime(domain, uid string, num int) {
 	cm.uvlock.Unlock()
 }
 
-// handleWebFlow 统计网络流量
-func (cm *ConnManager) handleWebFlow(req *webFlowReq) {
-
+// handleWebFlow 统计网络流量,redis 命令写入 b.write
+func (cm *ConnManager) handleWebFlow(b *batch, req *webFlowReq) {
+	if req.dedup == nil {
+		cm.dedupBatch([]*webFlowReq{req})
+	}
+	d := req.dedup
+	// 判断url地址是否已经存在
+	if req.pageinfo != nil && !d.KnownURL {
+		cm.addPageinfo(b, req.webflow.Date, req.pageinfo)
+	}
 	// 时段分析
 	cm.addPVRealtime(req.browsing.Domain, 1)
 	cm.addIPRealtime(req.browsing.Domain, req.browsing.IP, 1)
@@ -313,80 +916,119 @@ func (cm *ConnManager) handleWebFlow(req *webFlowReq) {
 	req.webflow.PV++
 	req.browsing.PV++
 	// ip今天是否已经访问过了,
-	if len(req.browsing.IP) > 0 && !isIPVisited(req.browsing.IP, req.webflow.URL, req.webflow.Date) {
-		req.webflow.IP++
-	}
+	req.webflow.IP += int(d.IP)
 	if len(req.browsing.UID) > 0 {
 		// uv
-		if !cm.isUVVisitedToday(req.browsing.UID, req.webflow.URL, req.webflow.Date) {
-			req.webflow.UV++
+		if d.UV > 0 {
+			req.webflow.UV += int(d.UV)
 			req.browsing.Depth++
 		}
-		// visits
-		if !cm.isUVVisitedInHalfHour(req.browsing.UID, req.webflow.URL, req.webflow.Date) {
+		// visits,用户半小时内是否已经访问过了
+		if !d.Visited {
 			req.webflow.Visits++
 			req.browsing.Visits++
 		}
 		// NV 是否为新客户,默认为旧
-		if cm.isNewVisitor(req.browsing.UID, req.webflow.Domain, req.webflow.Date) {
+		if cm.isNewVisitor(req.browsing.UID, req.webflow.Domain, d.Visitor) {
 			req.browsing.NV = 1
 		}
+		// 入口页、退出页和跳出
+		cm.trackVisitPages(b, req)
+		// 转化目标
+		if err := b.evaluateGoals(&service.GoalHit{
+			Type:   model.GoalStepURL,
+			Domain: req.webflow.Domain,
+			Date:   req.webflow.Date,
+			UID:    req.browsing.UID,
+			URL:    req.webflow.URL,
+		}); err != nil {
+			cm.log(err)
+		}
 	}
 	// Pageopend
 
+	// 每小时流量
+	cm.countHourly(b, req)
+	// 用于计算每周、每月去重后的 UV、IP
+	service.AddSketches(b.write, req.webflow.Date, req.webflow.Domain, req.webflow.URL, req.browsing.UID, req.browsing.IP)
+	// 流量来源
+	if req.source != nil {
+		req.source.PV = 1
+		req.source.Visits = req.webflow.Visits
+		b.addSource(req.source)
+	}
 	// 添加webflow到map
 	// log.Printf("handleWebflow:%v\n", req.webflow)
-	go cm.addWebflow(req.webflow)
+	b.addWebflow(req.webflow)
 	// 添加browsing 到 map
-	go cm.addBrowsing(req.browsing)
-}
-func isIPVisited(ip, url, date string) bool {
-	// 无需锁，因为同一个ip正常访问不存在并发问题
-	key := service.GetRedisIPKey(date, ip)
-	r := model.RedisCli.SIsMember(key, url)
-	if !r.Val() {
-		model.RedisCli.SAdd(key, url)
-		// 明日凌晨过期
-		model.RedisCli.ExpireAt(key, getTimeOfTomorrowZero(date))
-	}
-	return r.Val()
-}
-func (cm *ConnManager) isUVVisitedToday(uid, url, date string) bool {
-	key := service.GetRedisVisitorKey(date, uid)
-	r := model.RedisCli.SIsMember(key, url)
-	if !r.Val() {
-		model.RedisCli.SAdd(key, url)
-		// 明日凌晨过期
-		model.RedisCli.ExpireAt(key, getTimeOfTomorrowZero(date))
-	}
-	return r.Val()
-}
-
-// isUVVisited 查看用户半小时内是否已经访问过了
-func (cm *ConnManager) isUVVisitedInHalfHour(uid, url, date string) bool {
-	key := service.GetRedisVisitNumbersKey(date, uid)
-	r := model.RedisCli.SIsMember(key, url)
-	if !r.Val() {
-		model.RedisCli.SAdd(key, url)
-		err := model.RedisCli.Expire(key, 30*60*time.Second).Err()
+	b.addBrowsing(req.browsing)
+}
+
+// trackVisitPages 纪录用户半小时内访问的入口页和最后访问页面,并更新会话
+// 新的访问:当前页面 Entries、Exits、Bounce 加1,开始新的会话
+// 继续访问:上一个页面 Exits 减1、当前页面 Exits 加1,访问第二个页面时入口页 Bounce 减1
+// 减少的计数和当前页面的计数算在同一天,访问跨过0点时前一天的流量已经保存到数据库,不再修改
+func (cm *ConnManager) trackVisitPages(b *batch, req *webFlowReq) {
+	webflow, browsing := req.webflow, req.browsing
+	key := service.GetRedisVisitKey(webflow.Domain, browsing.UID)
+	visit, err := b.hash(key)
+	if err != nil {
+		cm.log(err)
+		return
+	}
+	fields := map[string]string{
+		"last": webflow.URL,
+	}
+	if len(visit["entry"]) == 0 {
+		webflow.Entries++
+		webflow.Exits++
+		webflow.Bounce++
+		fields["entry"] = webflow.URL
+		fields["pages"] = "1"
+		sid, err := service.NewSession(b.write, &model.Session{
+			UID:        browsing.UID,
+			Domain:     webflow.Domain,
+			EntryURL:   webflow.URL,
+			Referrer:   req.referrer,
+			StartTime:  req.time,
+			IP:         browsing.IP,
+			Region:     browsing.Region,
+			Platform:   browsing.Platform,
+			Browser:    browsing.Browser,
+			DeviceType: browsing.DeviceType,
+		})
 		if err != nil {
 			cm.log(err)
 		}
+		fields["sid"] = sid
+	} else {
+		pages, _ := strconv.Atoi(visit["pages"])
+		if pages == 1 {
+			b.addWebflow(&model.WebFlow{URL: visit["entry"], Date: webflow.Date, Domain: webflow.Domain, Bounce: -1})
+		}
+		b.addWebflow(&model.WebFlow{URL: visit["last"], Date: webflow.Date, Domain: webflow.Domain, Exits: -1})
+		webflow.Exits++
+		fields["pages"] = strconv.Itoa(pages + 1)
+		service.TouchSession(b.write, visit["sid"], webflow.URL, req.time)
+	}
+	// 本批之后的请求读取更新后的访问纪录
+	values := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		visit[k] = v
+		values[k] = v
 	}
-	return r.Val()
+	b.write.HMSet(key, values)
+	b.write.Expire(key, 30*60*time.Second)
 }
 
-// isNewVisitor 访问历史数据库查询是否是新客户
-func (cm *ConnManager) isNewVisitor(uid, domain, date string) bool {
-	key := service.GetredisNewVisitorKey(date, domain)
-	if !model.RedisCli.SIsMember(key, uid).Val() {
+// isNewVisitor 访问历史数据库查询是否是新客户,first 为去重时用户今天是否第一次访问域名
+func (cm *ConnManager) isNewVisitor(uid, domain string, first int64) bool {
+	// 今天第一次访问域名时查询数据库
+	if first > 0 {
 		b, err := service.IsNewVisitor(domain, uid)
 		if err != nil {
 			cm.log(err)
 		}
-		// 将新用户缓存至redis
-		model.RedisCli.SAdd(key, uid)
-		model.RedisCli.ExpireAt(key, getTimeOfTomorrowZero(date))
 		return b
 	}
 	return true
@@ -405,6 +1047,9 @@ func (cm *ConnManager) addWebflow(data *model.WebFlow) {
 		wb.UV += data.UV
 		wb.Visits += data.Visits
 		wb.Duration += data.Duration
+		wb.Bounce += data.Bounce
+		wb.Entries += data.Entries
+		wb.Exits += data.Exits
 		if len(data.Domain) > 0 {
 			wb.Domain = data.Domain
 		}
@@ -417,459 +1062,590 @@ func (cm *ConnManager) addWebflow(data *model.WebFlow) {
 	}
 	// s, _ := util.ToJSONStr(wb)
 	// fmt.Printf("key:%s,val:%v\n", (data.URL + data.Date), s)
+	n := len(cm.webflows)
 	// 释放表
 	cm.webflowsLock.Unlock()
-	if len(cm.webflows) >= handlePerTime {
-		cm.flushWebflowsToRedis()
+	if n >= handlePerTime {
+		cm.flushSoon()
 	}
 }
 
 // addBrowsing 添加browsing
 func (cm *ConnManager) addBrowsing(data *model.Browsing) {
+	key := data.UID + data.Date + data.Domain
 	cm.browsingsLock.Lock()
-	b := cm.browsings[data.UID+data.Date]
+	b := cm.browsings[key]
 	// s1, _ := util.ToJSONStr(data)
 	// fmt.Printf("data-key:%s,val:%v\n", (data.UID + util.FormatDate(data.CreateDate, util.YYYY_MM_DD)), s1)
 	if b != nil {
 		b.Depth += data.Depth
 		b.PV += data.PV
 		b.Visits += data.Visits
+		b.Duration += data.Duration
 		b.Pageopend += data.Pageopend
 	} else {
-		cm.browsings[data.UID+data.Date] = data
+		cm.browsings[key] = data
 	}
+	n := len(cm.browsings)
 	cm.browsingsLock.Unlock()
 	// s, _ := util.ToJSONStr(b)
 	// fmt.Printf("key:%s,val:%v\n", (data.UID + util.FormatDate(data.CreateDate, util.YYYY_MM_DD)), s)
-	if len(cm.browsings) >= handlePerTime {
-		cm.flushBrowsingsToRedis()
+	if n >= handlePerTime {
+		cm.flushSoon()
 	}
 }
 
-// flushWebflowToRedis 流量累加到redis
-func (cm *ConnManager) flushWebflowsToRedis() {
-	if len(cm.webflows) == 0 {
-		return
+// flushWebflowToRedis 流量在一个事务管道中累加到redis,失败的流量重新缓存
+func (cm *ConnManager) flushWebflowsToRedis(result map[string]*model.WebFlow) error {
+	if len(result) == 0 {
+		return nil
 	}
-	// 加锁
-	cm.webflowsLock.Lock()
-	// 提取需要处理的数据
-	result := make(map[string]*model.WebFlow)
-	i := 0
-	for k, v := range cm.webflows {
-		i++
-		x := new(model.WebFlow)
-		*x = *v
-		result[v.URL] = x
-		delete(cm.webflows, k)
-		if i >= handlePerTime {
-			break
-		}
-	}
-	// 解锁
-	cm.webflowsLock.Unlock()
+	pipe := model.RedisCli.TxPipeline()
 	for _, webflow := range result {
-		go cm.freshWebflow(webflow)
+		freshWebflow(pipe, webflow)
 	}
+	// 事务中的命令全部执行或全部不执行,重新缓存不会重复累加
+	if _, err := pipe.Exec(); err != nil {
+		for _, webflow := range result {
+			cm.addWebflow(webflow)
+		}
+		return err
+	}
+	return nil
 }
-func (cm *ConnManager) freshWebflow(webflow *model.WebFlow) {
-	// 保存原值，当失败时可以返回
-	temp := new(model.WebFlow)
-	*temp = *webflow
+
+// freshWebflow 将流量的增量加入管道,多个实例同时累加同一个页面不会冲突
+func freshWebflow(pipe redis.Pipeliner, webflow *model.WebFlow) {
 	key := service.GetRedisWebflowKey(webflow.Domain, webflow.Date, webflow.URL)
-	// 要处理的事务
-	txf := func(tx *redis.Tx) error {
-		// 获取并更新值
-		r := tx.HMGet(key, "PV", "IP", "UV", "Visits", "Duration")
-		// 第二天凌晨过期
-		tx.ExpireAt(key, getTimeOfTomorrowZero(webflow.Date))
-		if r.Err() != nil && r.Err() != redis.Nil {
-			return r.Err()
-		}
-		if r.Val()[0] != nil {
-			var vals []int
-			for _, v := range r.Val() {
-				switch v.(type) {
-				case string:
-					x, _ := strconv.Atoi(v.(string))
-					vals = append(vals, x)
-				case int:
-					vals = append(vals, v.(int))
-				}
+	for field, v := range service.WebflowRedisValues(webflow) {
+		if n := v.(int); n != 0 {
+			pipe.HIncrBy(key, field, int64(n))
+		}
+	}
+	// 每日0点保存到数据库后删除,保留至第二天24点,key不存在时设置过期时间无效,需要在写入之后
+	pipe.ExpireAt(key, service.GetTimeOfTomorrowZero(webflow.Date).Add(time.Hour*24))
+}
+
+// 用户浏览情况在一个事务管道中累加到redis,失败的数据重新缓存
+func (cm *ConnManager) flushBrowsingsToRedis(result map[string]*model.Browsing) error {
+	if len(result) == 0 {
+		return nil
+	}
+	pipe := model.RedisCli.TxPipeline()
+	for _, browsing := range result {
+		freshBrowsing(pipe, browsing)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		for _, browsing := range result {
+			cm.addBrowsing(browsing)
+		}
+		return err
+	}
+	return nil
+}
+
+// freshBrowsing 将用户浏览习惯的计数累加到 <计数>_<domain>,并更新页面浏览时的属性
+func freshBrowsing(pipe redis.Pipeliner, data *model.Browsing) {
+	key := service.GetRedisBrowsingKey(data.Date, data.UID)
+	for field, n := range service.BrowsingRedisIncrs(data) {
+		pipe.HIncrBy(key, field, n)
+	}
+	if attrs := service.BrowsingRedisAttrs(data); attrs != nil {
+		pipe.HMSet(key, attrs)
+	}
+	// 每日0点保存到数据库后删除,保留至第二天24点
+	pipe.ExpireAt(key, service.GetTimeOfTomorrowZero(data.Date).Add(time.Hour*24))
+}
+
+// addSource 添加流量来源
+func (cm *ConnManager) addSource(data *model.Source) {
+	if cm.mergeSource(data) >= handlePerTime {
+		cm.flushSoon()
+	}
+}
+
+// mergeSource 合并流量来源到map,返回map长度
+func (cm *ConnManager) mergeSource(data *model.Source) int {
+	key := data.Date + service.GetRedisSourceField("", data)
+	cm.sourcesLock.Lock()
+	defer cm.sourcesLock.Unlock()
+	s := cm.sources[key]
+	if s != nil {
+		s.PV += data.PV
+		s.Visits += data.Visits
+	} else {
+		cm.sources[key] = data
+	}
+	return len(cm.sources)
+}
+
+// flushSourcesToRedis 流量来源在一个事务管道中累加到redis,失败的计数重新缓存
+func (cm *ConnManager) flushSourcesToRedis(r map[string]*model.Source) error {
+	if len(r) == 0 {
+		return nil
+	}
+	pipe := model.RedisCli.TxPipeline()
+	pvs := make(map[*model.Source]*redis.IntCmd, len(r))
+	visits := make(map[*model.Source]*redis.IntCmd)
+	for _, s := range r {
+		key := service.GetRedisSourceKey(s.Date)
+		pvs[s] = pipe.HIncrBy(key, service.GetRedisSourceField("pv", s), int64(s.PV))
+		if s.Visits > 0 {
+			visits[s] = pipe.HIncrBy(key, service.GetRedisSourceField("visits", s), int64(s.Visits))
+		}
+		// 每日0点保存到数据库后删除,保留至第二天24点
+		pipe.ExpireAt(key, service.GetTimeOfTomorrowZero(s.Date).Add(time.Hour*24))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		cm.log(err)
+		// 事务没有执行时全部命令失败,执行时出错的命令不会回滚其它命令,只重新缓存失败的计数
+		for _, s := range r {
+			failed := *s
+			if pvs[s].Err() == nil {
+				failed.PV = 0
 			}
-			// log.Println("vals", vals)
-			webflow.PV += vals[0]
-			webflow.IP += vals[1]
-			webflow.UV += vals[2]
-			webflow.Visits += vals[3]
-			webflow.Duration += vals[4]
-		}
-		// s1, _ := util.ToJSONStr(webflow)
-		// log.Printf("webflow-after-val:%s\n", s1)
-
-		// 存储到redis
-		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
-			fields := map[string]interface{}{
-				"PV":       webflow.PV,
-				"IP":       webflow.IP,
-				"UV":       webflow.UV,
-				"Visits":   webflow.Visits,
-				"Duration": webflow.Duration,
+			if c := visits[s]; c == nil || c.Err() == nil {
+				failed.Visits = 0
 			}
-			return pipe.HMSet(key, fields).Err()
-		})
+			if failed.PV != 0 || failed.Visits != 0 {
+				cm.mergeSource(&failed)
+			}
+		}
 		return err
 	}
-	// 监测锁
-	i := 0
-	j := 0
-	for {
-		// 每隔1秒连续尝试100次
-		i++
-		if i > 100 { // 连续获取100次锁失败之后，隔1秒再获取
-			time.Sleep(1 * time.Second)
-			j++
-			if j > 10 {
-				log.Println("无法获取锁,10秒后将数据重新缓存")
-				time.Sleep(10 * time.Second)
-				cm.addWebflow(webflow)
-				break
-			}
-			i = 0
+	return nil
+}
+
+// countHourly 统计每小时流量,新的用户和ip在去重时已经查询
+func (cm *ConnManager) countHourly(b *batch, req *webFlowReq) {
+	req.hourlyHit.NewVisit = req.webflow.Entries > 0
+	req.hourlyHit.NewURLVisit = req.webflow.Visits > 0
+	b.addHourly(req.hourly())
+}
+
+// addHourly 添加每小时流量的增量
+func (cm *ConnManager) addHourly(incrs []*service.HourlyIncr) {
+	if len(incrs) > 0 && cm.mergeHourly(incrs) >= handlePerTime {
+		cm.flushSoon()
+	}
+}
+
+// mergeHourly 合并每小时流量的增量到map,返回map长度
+func (cm *ConnManager) mergeHourly(incrs []*service.HourlyIncr) int {
+	cm.hourlyLock.Lock()
+	defer cm.hourlyLock.Unlock()
+	for _, i := range incrs {
+		fields := cm.hourly[i.Key]
+		if fields == nil {
+			fields = make(map[string]int64)
+			cm.hourly[i.Key] = fields
 		}
-		err := model.RedisCli.Watch(txf, key)
-		if err != redis.TxFailedErr {
-			return
+		fields[i.Field] += i.N
+	}
+	n := 0
+	for _, fields := range cm.hourly {
+		n += len(fields)
+	}
+	return n
+}
+
+// flushHourlyToRedis 每小时流量在一个事务管道中累加到redis,失败的增量重新缓存
+func (cm *ConnManager) flushHourlyToRedis(r map[string]map[string]int64) error {
+	if len(r) == 0 {
+		return nil
+	}
+	pipe := model.RedisCli.TxPipeline()
+	cmds := make(map[*service.HourlyIncr]*redis.IntCmd)
+	for key, fields := range r {
+		for field, n := range fields {
+			cmds[&service.HourlyIncr{Key: key, Field: field, N: n}] = pipe.HIncrBy(key, field, n)
 		}
+		// 每日0点保存到数据库后删除,最后一次写入后保留48小时
+		pipe.ExpireAt(key, time.Now().Add(time.Hour*48))
 	}
-	cm.log(errors.New("达到最大重试次数"))
-	return
+	if _, err := pipe.Exec(); err != nil {
+		cm.log(err)
+		// 事务没有执行时全部命令失败,执行时出错的命令不会回滚其它命令,只重新缓存失败的增量
+		var failed []*service.HourlyIncr
+		for incr, c := range cmds {
+			if c.Err() != nil {
+				failed = append(failed, incr)
+			}
+		}
+		cm.mergeHourly(failed)
+		return err
+	}
+	return nil
 }
 
-// 用户浏览情况累加到redis
-func (cm *ConnManager) flushBrowsingsToRedis() {
-	if len(cm.browsings) == 0 {
-		return
+// handleEvent 统计自定义事件
+func (cm *ConnManager) handleEvent(b *batch, data *model.Event) {
+	b.addEvent(data)
+}
+
+// addEvent 添加自定义事件
+func (cm *ConnManager) addEvent(data *model.Event) {
+	if cm.mergeEvent(data) >= handlePerTime {
+		cm.flushSoon()
 	}
-	// 加锁
-	cm.browsingsLock.Lock()
-	// 提取需要处理的数据
-	result := make(map[string]*model.Browsing)
-	i := 0
-	for k, v := range cm.browsings {
-		i++
-		x := new(model.Browsing)
-		*x = *v
-		result[v.UID] = x
-		delete(cm.browsings, k)
-		if i >= handlePerTime {
-			break
-		}
-	}
-	// 解锁
-	cm.browsingsLock.Unlock()
-	for _, browsing := range result {
-		go cm.freshBrowsing(browsing)
+}
+
+// mergeEvent 合并自定义事件到map,返回map长度
+func (cm *ConnManager) mergeEvent(data *model.Event) int {
+	key := data.Date + service.GetRedisEventField("", data)
+	cm.eventsLock.Lock()
+	defer cm.eventsLock.Unlock()
+	if e := cm.events[key]; e != nil {
+		e.Count += data.Count
+		e.Value += data.Value
+	} else {
+		cm.events[key] = data
 	}
+	return len(cm.events)
 }
-func (cm *ConnManager) freshBrowsing(browsing *model.Browsing) {
-	// 保存原值，当失败时可以返回
-	temp := new(model.Browsing)
-	*temp = *browsing
 
-	key := service.GetRedisBrowsingKey(browsing.Date, browsing.UID)
-	// 要处理的事务
-	txf := func(tx *redis.Tx) error {
-		// 获取并更新值
-		b, err := service.GetBrowsingFromRedis(key, browsing.Domain)
-		if err != nil {
-			return err
+// flushEventsToRedis 自定义事件在一个事务管道中累加到redis,失败的计数重新缓存
+func (cm *ConnManager) flushEventsToRedis(r map[string]*model.Event) error {
+	if len(r) == 0 {
+		return nil
+	}
+	pipe := model.RedisCli.TxPipeline()
+	counts := make(map[*model.Event]*redis.IntCmd, len(r))
+	values := make(map[*model.Event]*redis.IntCmd)
+	for _, e := range r {
+		key := service.GetRedisEventKey(e.Date)
+		counts[e] = pipe.HIncrBy(key, service.GetRedisEventField("count", e), int64(e.Count))
+		if e.Value != 0 {
+			values[e] = pipe.HIncrBy(key, service.GetRedisEventField("value", e), e.Value)
 		}
-		browsing.Depth += b.Depth
-		browsing.PV += b.PV
-		browsing.Visits += b.Visits
-		browsing.Duration += b.Duration
-		// 存储到redis
-		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
-			// fields := map[string]interface{}{
-			// 	"Depth":    browsing.Depth,
-			// 	"PV":       browsing.PV,
-			// 	"Visits":   browsing.Visits,
-			// 	"Duration": browsing.Duration,
-			// }
-			// return pipe.HMSet(key, fields).Err()
-			s, _ := util.ToJSONStr(browsing)
-			err := pipe.HSet(key, browsing.Domain, s).Err()
-			if err != nil {
-				return err
+		// 每日0点保存到数据库后删除,保留至第二天24点
+		pipe.ExpireAt(key, service.GetTimeOfTomorrowZero(e.Date).Add(time.Hour*24))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		cm.log(err)
+		// 事务没有执行时全部命令失败,执行时出错的命令不会回滚其它命令,只重新缓存失败的计数
+		for _, e := range r {
+			failed := *e
+			if counts[e].Err() == nil {
+				failed.Count = 0
 			}
-
-			return pipe.ExpireAt(key, getTimeOfTomorrowZero(browsing.Date)).Err()
-		})
+			if c := values[e]; c == nil || c.Err() == nil {
+				failed.Value = 0
+			}
+			if failed.Count != 0 || failed.Value != 0 {
+				cm.mergeEvent(&failed)
+			}
+		}
 		return err
 	}
-	// 监测锁
-	i, j := 0, 0
-	for { // 每隔1秒连续尝试100次
-		i++
-		if i > 100 { // 连续获取100次锁失败之后，隔1秒再获取
-			time.Sleep(1 * time.Second)
-			j++
-			if j > 10 {
-				log.Println("无法获取锁,10秒后将数据重新缓存")
-				time.Sleep(10 * time.Second)
-				cm.addBrowsing(browsing)
-				break
+	return nil
+}
+
+// addBot 添加爬虫访问量
+func (cm *ConnManager) addBot(data *model.Bot) {
+	if cm.mergeBot(data) >= handlePerTime {
+		cm.flushSoon()
+	}
+}
+
+// mergeBot 合并爬虫访问量到map,返回map长度
+func (cm *ConnManager) mergeBot(data *model.Bot) int {
+	key := data.Date + service.GetRedisBotField(data)
+	cm.botsLock.Lock()
+	defer cm.botsLock.Unlock()
+	if b := cm.bots[key]; b != nil {
+		b.PV += data.PV
+	} else {
+		cm.bots[key] = data
+	}
+	return len(cm.bots)
+}
+
+// flushBotsToRedis 爬虫访问量在一个事务管道中累加到redis,失败的访问量重新缓存
+func (cm *ConnManager) flushBotsToRedis(r map[string]*model.Bot) error {
+	if len(r) == 0 {
+		return nil
+	}
+	pipe := model.RedisCli.TxPipeline()
+	cmds := make(map[*model.Bot]*redis.IntCmd, len(r))
+	for _, b := range r {
+		key := service.GetRedisBotKey(b.Date)
+		cmds[b] = pipe.HIncrBy(key, service.GetRedisBotField(b), int64(b.PV))
+		// 每日0点保存到数据库后删除,保留至第二天24点
+		pipe.ExpireAt(key, service.GetTimeOfTomorrowZero(b.Date).Add(time.Hour*24))
+	}
+	if _, err := pipe.Exec(); err != nil {
+		cm.log(err)
+		// 事务没有执行时全部命令失败,执行时出错的命令不会回滚其它命令,只重新缓存失败的访问量
+		for b, c := range cmds {
+			if c.Err() != nil {
+				cm.mergeBot(b)
 			}
-			i = 0
-		}
-		err := model.RedisCli.Watch(txf, key)
-		if err != redis.TxFailedErr {
-			return
 		}
-
+		return err
 	}
-	cm.log(errors.New("达到最大重试次数"))
+	return nil
 }
+
+// flushRealtimeDataToRedis 将实时PV、IP、UV保存到redis,等待保存完成
 func (cm *ConnManager) flushRealtimeDataToRedis() {
-	// pv
-	go cm.flushPVRealtime2Redis()
-	// ip
-	go cm.flushIPRealtime2Redis()
-	// uv
-	go cm.flushUVRealtime2Redis()
+	var wg sync.WaitGroup
+	for _, flush := range []func(){
+		// pv
+		cm.flushPVRealtime2Redis,
+		// ip
+		cm.flushIPRealtime2Redis,
+		// uv
+		cm.flushUVRealtime2Redis,
+	} {
+		wg.Add(1)
+		go func(flush func()) {
+			defer wg.Done()
+			flush()
+		}(flush)
+	}
+	wg.Wait()
 }
+
+// flushPVRealtime2Redis 实时pv累加到redis,失败时重新缓存
 func (cm *ConnManager) flushPVRealtime2Redis() {
-	if len(cm.pvrealtime) == 0 {
-		return
-	}
 	cm.pvlock.Lock()
 	r := cm.pvrealtime
 	cm.pvrealtime = make(map[string]int64)
 	cm.pvlock.Unlock()
-	for k, v := range r {
-		go cm.persistPVRealtimeToRedis(k, v)
+	if len(r) == 0 {
+		return
+	}
+	failed, err := persistPVRealtimeToRedis(r)
+	if err != nil {
+		cm.log(err)
+	}
+	for domain, val := range failed {
+		cm.addPVRealtime(domain, val)
 	}
 }
 
-// persistPVRealtimeToRedis 将实时pv缓存到redis
-func (cm *ConnManager) persistPVRealtimeToRedis(domain string, val int64) {
-	key := service.GetRedisTimePVKey(domain)
-	txf := func(tx *redis.Tx) error {
-		// 获取旧值
-		n, err := tx.Get(key).Int64()
-		if err != nil && err != redis.Nil {
-			return err
-		}
-		n += val
-		if n < 0 {
-			n = 0
-		}
-		// 更新新值
-		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
-			return pipe.Set(key, n, 0).Err()
-		})
-		return err
+// pvRealtimeScript 累加实时pv,小于0时归0
+var pvRealtimeScript = redis.NewScript(`
+local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if n < 0 then
+	redis.call('SET', KEYS[1], 0)
+	return 0
+end
+return n`)
+
+// persistPVRealtimeToRedis 每个域名执行一次 pvRealtimeScript,返回没有执行的pv
+func persistPVRealtimeToRedis(vals map[string]int64) (map[string]int64, error) {
+	var domains []string
+	var calls []*scriptCall
+	for domain, val := range vals {
+		domains = append(domains, domain)
+		calls = append(calls, &scriptCall{keys: []string{service.GetRedisTimePVKey(domain)}, args: []interface{}{val}})
 	}
-	// 获取锁并更新值
-	i, j := 0, 0
-	for {
-		i++
-		if i > 10 {
-			time.Sleep(1 * time.Second)
-			j++
-			if j > 10 {
-				break
-			}
-			i = 0
-		}
-		err := model.RedisCli.Watch(txf, key)
-		if err != redis.TxFailedErr {
-			return
+	failed := make(map[string]int64)
+	errs := runScript(pvRealtimeScript, calls)
+	for i, err := range errs {
+		if err != nil {
+			failed[domains[i]] = vals[domains[i]]
 		}
 	}
-	cm.log(errors.New("increment reached maximum number of retries"))
+	return failed, firstError(errs)
 }
+
+// flushIPRealtime2Redis 在线ip打开的页面数累加到redis,失败时重新缓存
 func (cm *ConnManager) flushIPRealtime2Redis() {
-	if len(cm.iprealtime) == 0 {
-		return
-	}
 	cm.iplock.Lock()
 	r := cm.iprealtime
 	cm.iprealtime = make(map[string]map[string]interface{})
 	cm.iplock.Unlock()
-	for domain, vals := range r {
-		go cm.persistIPRealtimeToRedis(domain, vals)
-	}
-}
-func (cm *ConnManager) persistIPRealtimeToRedis(domain string, vals map[string]interface{}) {
-	key := service.GetRedisTimeIPKey(domain)
-	txf := func(tx *redis.Tx) error {
-		// 更新值
-		for ip := range vals {
-			// 获取缓存的值
-			r := tx.HMGet(key, ip)
-			// 如果报错重新缓存数据
-			if r.Err() != nil && r.Err() != redis.Nil {
-				for k, v := range vals {
-					cm.addIPRealtime(domain, k, v.(int))
-				}
-				return r.Err()
-			}
-			// 更新值
-			if r.Val()[0] != nil {
-				switch r.Val()[0].(type) {
-				case int:
-					vals[ip] = vals[ip].(int) + r.Val()[0].(int)
-				case string:
-					v, _ := strconv.Atoi(r.Val()[0].(string))
-					vals[ip] = vals[ip].(int) + v
-				}
-			}
-			// 删除为0的field
-			if vals[ip].(int) <= 0 {
-				delete(vals, ip)
-				tx.HDel(key, ip)
-			}
-		}
-
-		// 更新新值
-		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
-			return pipe.HMSet(key, vals).Err()
-		})
-		return err
+	if len(r) == 0 {
+		return
 	}
-	// 获取锁并更新值
-	i, j := 0, 0
-	for {
-		i++
-		if i > 10 {
-			time.Sleep(1 * time.Second)
-			j++
-			if j > 10 {
-				break
-			}
-			i = 0
-		}
-		err := model.RedisCli.Watch(txf, key)
-		if err != redis.TxFailedErr {
-			return
+	failed, err := persistOnlineToRedis(service.GetRedisTimeIPKey, r)
+	if err != nil {
+		cm.log(err)
+	}
+	for domain, vals := range failed {
+		for ip, v := range vals {
+			cm.addIPRealtime(domain, ip, v.(int))
 		}
 	}
-	cm.log(errors.New("increment reached maximum number of retries"))
-
 }
+
+// flushUVRealtime2Redis 在线用户打开的页面数累加到redis,失败时重新缓存
 func (cm *ConnManager) flushUVRealtime2Redis() {
-	if len(cm.uvrealtime) == 0 {
-		return
-	}
 	cm.uvlock.Lock()
 	r := cm.uvrealtime
 	cm.uvrealtime = make(map[string]map[string]interface{})
 	cm.uvlock.Unlock()
-	for domain, vals := range r {
-		go cm.persistUVRealtimeToRedis(domain, vals)
-	}
-}
-func (cm *ConnManager) persistUVRealtimeToRedis(domain string, vals map[string]interface{}) {
-	key := service.GetRedisTimeUVKey(domain)
-	txf := func(tx *redis.Tx) error {
-		// 更新值
-		for uid := range vals {
-			// 获取缓存的值
-			r := tx.HMGet(key, uid)
-			// 如果报错重新缓存数据
-			if r.Err() != nil && r.Err() != redis.Nil {
-				for k, v := range vals {
-					cm.addUVRealtime(domain, k, v.(int))
-				}
-				return r.Err()
-			}
-			// 更新值
-			log.Println("uv:", r.Val())
-			if r.Val()[0] != nil {
-
-				switch r.Val()[0].(type) {
-				case int:
-					vals[uid] = vals[uid].(int) + r.Val()[0].(int)
-				case string:
-					v, _ := strconv.Atoi(r.Val()[0].(string))
-					vals[uid] = vals[uid].(int) + v
-				}
-			}
-			// 删除为0的field
-			if vals[uid].(int) <= 0 {
-				delete(vals, uid)
-				tx.HDel(key, uid)
+	if len(r) == 0 {
+		return
+	}
+	failed, err := persistOnlineToRedis(service.GetRedisTimeUVKey, r)
+	if err != nil {
+		cm.log(err)
+	}
+	for domain, vals := range failed {
+		for uid, v := range vals {
+			cm.addUVRealtime(domain, uid, v.(int))
+		}
+	}
+}
+
+// onlineScript 累加在线的ip或用户打开的页面数,ARGV 依次为 field 和增量,小于等于0时删除该 field
+var onlineScript = redis.NewScript(`
+for i = 1, #ARGV, 2 do
+	if redis.call('HINCRBY', KEYS[1], ARGV[i], ARGV[i + 1]) <= 0 then
+		redis.call('HDEL', KEYS[1], ARGV[i])
+	end
+end
+return 0`)
+
+// persistOnlineToRedis 每个域名执行一次 onlineScript,返回没有执行的域名的增量
+func persistOnlineToRedis(key func(domain string) string, vals map[string]map[string]interface{}) (map[string]map[string]interface{}, error) {
+	var domains []string
+	var calls []*scriptCall
+	for domain, fields := range vals {
+		var args []interface{}
+		for field, v := range fields {
+			if v.(int) != 0 {
+				args = append(args, field, v)
 			}
 		}
+		if len(args) == 0 {
+			continue
+		}
+		domains = append(domains, domain)
+		calls = append(calls, &scriptCall{keys: []string{key(domain)}, args: args})
+	}
+	failed := make(map[string]map[string]interface{})
+	errs := runScript(onlineScript, calls)
+	for i, err := range errs {
+		if err != nil {
+			failed[domains[i]] = vals[domains[i]]
+		}
+	}
+	return failed, firstError(errs)
+}
 
-		// 更新新值
-		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
-			return pipe.HMSet(key, vals).Err()
-		})
-		return err
+// scriptCall 对一个key执行脚本的参数
+type scriptCall struct {
+	keys []string
+	args []interface{}
+}
+
+// runScript 在一个管道中执行所有调用,每个调用是原子的,返回每个调用的错误
+// 脚本还没有加载到redis时改用 EVAL 重新执行这些调用,返回 NOSCRIPT 的调用没有执行
+func runScript(script *redis.Script, calls []*scriptCall) []error {
+	errs := make([]error, len(calls))
+	if len(calls) == 0 {
+		return errs
 	}
-	// 获取锁并更新值
-	i, j := 0, 0
-	for {
-		i++
-		if i > 10 {
-			time.Sleep(1 * time.Second)
-			j++
-			if j > 10 {
-				break
-			}
-			i = 0
+	pipe := model.RedisCli.Pipeline()
+	cmds := make([]*redis.Cmd, len(calls))
+	for i, c := range calls {
+		cmds[i] = script.EvalSha(pipe, c.keys, c.args...)
+	}
+	pipe.Exec()
+	var retry []int
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+			retry = append(retry, i)
+		} else {
+			errs[i] = err
 		}
-		err := model.RedisCli.Watch(txf, key)
-		if err != redis.TxFailedErr {
-			return
+	}
+	if len(retry) > 0 {
+		pipe = model.RedisCli.Pipeline()
+		for _, i := range retry {
+			cmds[i] = script.Eval(pipe, calls[i].keys, calls[i].args...)
+		}
+		pipe.Exec()
+		for _, i := range retry {
+			errs[i] = cmds[i].Err()
 		}
 	}
-	cm.log(errors.New("increment reached maximum number of retries"))
+	return errs
 }
 
-// handlePageinfo 保存page到redis和数据库,并发是否安全不影响,set只保留唯一值
-func (cm *ConnManager) handlePageinfo(p model.Pageinfo) {
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePageinfo 在管道中保存访问日期的page到redis,set只保留唯一值,url当天第一次加入set时在管道执行后保存到数据库
+func (cm *ConnManager) handlePageinfo(b *batch, date string, p model.Pageinfo) {
 	// 保存pageinfo至redis
-	defaultdate := util.GetDateAsDefaultStr()
-	pipe := model.RedisCli.Pipeline()
-	urlkey := service.GetRedisURLKey(defaultdate)
-	pipe.SAdd(urlkey, p.URL)
-	pageinfokey := service.GetRedisPageinfoKey(defaultdate, p.URL)
+	urlkey := service.GetRedisURLKey(date)
+	added := b.write.SAdd(urlkey, p.URL)
+	pageinfokey := service.GetRedisPageinfoKey(date, p.URL)
 	s, _ := util.ToJSONStr(p)
 	// fmt.Println(pageinfokey)
-	pipe.Set(pageinfokey, s, 3600*24)
-	_, err := pipe.Exec()
-	if err != nil {
-		cm.log(err)
-	}
-	// 保存到数据库
-	if err = p.FirstOrCreate(); err != nil {
-		cm.log(err)
+	b.write.Set(pageinfokey, s, time.Hour*24)
+	b.pages = append(b.pages, &pendingPageinfo{page: p, added: added})
+}
+
+// savePageinfos 保存本批中当天第一次出现的页面信息到数据库
+func (cm *ConnManager) savePageinfos(b *batch) {
+	for _, p := range b.newPageinfos() {
+		if err := model.Store.FirstOrCreatePageinfo(p); err != nil {
+			cm.log(err)
+		}
 	}
 }
-func (cm *ConnManager) handleDuration(d *Duration) {
+
+// handleDuration 统计浏览时长,域名已经转换为注册的域名,redis 命令写入 b.write
+func (cm *ConnManager) handleDuration(b *batch, d *Duration) {
+	reason, _ := service.DetectBot(d.UserAgent, d.IP)
+	hit := service.NewHit(service.HitTypeDuration)
+	hit.Domain, hit.URL, hit.UID, hit.IP = d.Domain, d.URL, d.UID, d.IP
+	hit.UserAgent, hit.Duration, hit.Bot = d.UserAgent, d.Duration, reason
+	cm.addHit(hit)
+	if len(reason) > 0 {
+		return
+	}
 	// 时段分析
 	cm.addPVRealtime(d.Domain, -1)
 	cm.addIPRealtime(d.Domain, d.IP, -1)
 	cm.addUVRealtime(d.Domain, d.UID, -1)
 	// 更新网页浏览时长
-	cm.addWebflow(&model.WebFlow{
+	b.addWebflow(&model.WebFlow{
 		URL:      d.URL,
 		Date:     d.Date,
 		Duration: d.Duration,
 		Domain:   d.Domain,
 	})
 	// 更新用户今日浏览时长
-	cm.addBrowsing(&model.Browsing{
+	b.addBrowsing(&model.Browsing{
 		UID:      d.UID,
 		Date:     d.Date,
 		Duration: d.Duration,
 		Domain:   d.Domain,
 	})
-
+	// 会话浏览时长
+	if len(d.UID) > 0 {
+		visit, err := b.hash(service.GetRedisVisitKey(d.Domain, d.UID))
+		if err != nil {
+			cm.log(err)
+		} else {
+			service.AddSessionDuration(b.write, visit["sid"], d.Duration, d.Time)
+		}
+	}
+	// 转化目标
+	if err := b.evaluateGoals(&service.GoalHit{
+		Type:     model.GoalStepDuration,
+		Domain:   d.Domain,
+		Date:     d.Date,
+		UID:      d.UID,
+		URL:      d.URL,
+		Duration: d.Duration,
+	}); err != nil {
+		cm.log(err)
+	}
 }
 
 // persistRealtimeWebflow 将实时网页流量持久化
@@ -884,7 +1660,11 @@ func (cm *ConnManager) persistRealtimeWebflow() {
 		return
 	}
 	for _, v := range result {
-		go cm.persistRealtimeWebflowWithDomain(v.Domain)
+		if !v.Enabled {
+			continue
+		}
+		domain := v.Domain
+		cm.goBackground(func() { cm.persistRealtimeWebflowWithDomain(domain) })
 	}
 }
 
@@ -896,6 +1676,10 @@ func (cm *ConnManager) persistRealtimeWebflowWithDomain(domain string) {
 		cm.log(p.Err())
 	}
 	pv, _ := strconv.Atoi(p.Val())
+	// 其它实例累加后还未归0
+	if pv < 0 {
+		pv = 0
+	}
 
 	i := model.RedisCli.HLen(service.GetRedisTimeIPKey(domain))
 	if i.Err() != nil {
@@ -922,9 +1706,60 @@ func (cm *ConnManager) persistRealtimeWebflowWithDomain(domain string) {
 	}
 }
 
-// getTimeOfTomorrowZero 获取明天0点的timestamp
-func getTimeOfTomorrowZero(datestr string) time.Time {
-	d, _ := util.ParseDate(datestr, util.YYYY_MM_DD)
-	d = d.Add(time.Hour * 24)
-	return d
+// webDataHit 页面浏览或自定义事件的原始访问纪录,reason 为爬虫识别原因
+func webDataHit(w *WebData, reason string) *service.Hit {
+	typ := service.HitTypePageview
+	if w.Type == HitEvent {
+		typ = service.HitTypeEvent
+	}
+	h := service.NewHit(typ)
+	b := &w.Browsing
+	h.Domain, h.URL, h.Title = b.Domain, w.Pageinfo.URL, w.Pageinfo.Title
+	h.UID, h.IP, h.UserAgent, h.Referrer = b.UID, b.IP, w.UserAgent, w.Referrer
+	h.Platform, h.Browser, h.DeviceType, h.SR, h.Region = b.Platform, b.Browser, b.DeviceType, b.SR, b.Region
+	if typ == service.HitTypeEvent {
+		h.Category, h.Action, h.Label, h.Value = w.Event.Category, w.Event.Action, w.Event.Label, w.Event.Value
+	}
+	h.Bot = reason
+	return h
+}
+
+// addHit 缓存原始访问纪录,达到 service.HitBatchSize 条时写入 ClickHouse
+func (cm *ConnManager) addHit(h *service.Hit) {
+	if !service.ClickHouseOpen() {
+		return
+	}
+	cm.hitsLock.Lock()
+	cm.hits = append(cm.hits, h)
+	full := len(cm.hits) >= service.HitBatchSize()
+	cm.hitsLock.Unlock()
+	if full {
+		cm.goBackground(cm.flushHits)
+	}
+}
+
+// flushHits 将缓存的原始访问纪录写入 ClickHouse,失败时放回缓存等待下次写入
+func (cm *ConnManager) flushHits() {
+	cm.hitsLock.Lock()
+	hits := cm.hits
+	cm.hits = nil
+	cm.hitsLock.Unlock()
+	if len(hits) == 0 {
+		return
+	}
+	if err := service.InsertHits(hits); err != nil {
+		cm.log(err)
+		cm.mergeHits(hits)
+	}
+}
+
+// mergeHits 将写入失败的纪录放回缓存,超过 maxBufferedHits 条时丢弃最早的纪录
+func (cm *ConnManager) mergeHits(hits []*service.Hit) {
+	cm.hitsLock.Lock()
+	defer cm.hitsLock.Unlock()
+	cm.hits = append(hits, cm.hits...)
+	if n := len(cm.hits) - maxBufferedHits; n > 0 {
+		log.Printf("ClickHouse 写入失败,丢弃%d条原始访问纪录\n", n)
+		cm.hits = cm.hits[n:]
+	}
 }
@@ -0,0 +1,847 @@
+package connmgr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/config"
+	"github.com/codepository/GoWebAnalytics/memredis"
+	"github.com/codepository/GoWebAnalytics/model"
+	"github.com/codepository/GoWebAnalytics/service"
+)
+
+// 过去日期的key会立即过期,测试使用今天和昨天
+var (
+	testDate  = util.GetDateAsDefaultStr()
+	yesterday = util.FormatDate(time.Now().Add(-time.Hour*24), util.YYYY_MM_DD)
+)
+
+// TestMain 测试使用项目根目录的配置
+func TestMain(m *testing.M) {
+	var c config.Configuration
+	b, err := ioutil.ReadFile("../config.json")
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.SetForTest(&c)
+	os.Exit(m.Run())
+}
+
+// setupFakes 使用进程内的 redis 和 sqlite 内存数据库
+func setupFakes(t testing.TB) *redis.Client {
+	c := *config.Config
+	c.DbType, c.DbName, c.DbLogMode = "sqlite3", ":memory:", "false"
+	model.SetupWith(&c)
+	rdb := memredis.NewClient()
+	model.RedisCli = rdb
+	t.Cleanup(func() {
+		rdb.Close()
+		model.GetDB().Close()
+	})
+	return rdb
+}
+
+// registerDomain 注册域名 example.com
+func registerDomain(t testing.TB) {
+	if err := (&model.Domainmgr{Domain: "example.com", Enabled: true}).Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.RefreshDomainCache(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pageview 用户 uid 访问 example.com 的页面
+func pageview(uid, url string) *WebData {
+	return &WebData{
+		Pageinfo:  model.Pageinfo{URL: url},
+		Browsing:  model.Browsing{Domain: "example.com", UID: uid, IP: "1.1.1.1"},
+		UserAgent: "Mozilla/5.0",
+	}
+}
+
+// eventually 异步处理完成前反复检查,超时后报告最后一次的结果
+func eventually(t *testing.T, check func() (got, want interface{})) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		got, want := check()
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("结果为 %+v,期望 %+v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// webflowsSnapshot 缓存中的网页流量,key为url+date
+func (cm *ConnManager) webflowsSnapshot() map[string]model.WebFlow {
+	cm.webflowsLock.Lock()
+	defer cm.webflowsLock.Unlock()
+	result := make(map[string]model.WebFlow)
+	for k, v := range cm.webflows {
+		result[k] = *v
+	}
+	return result
+}
+
+func TestAddWebflow(t *testing.T) {
+	cases := []struct {
+		name string
+		adds []model.WebFlow
+		want map[string]model.WebFlow
+	}{
+		{
+			name: "累加",
+			adds: []model.WebFlow{
+				{Domain: "example.com", URL: "/a", Date: testDate, PV: 1, IP: 1, UV: 1, Visits: 1, Entries: 1, Exits: 1, Bounce: 1},
+				{Domain: "example.com", URL: "/a", Date: testDate, PV: 1, Duration: 30, Exits: -1, Bounce: -1},
+			},
+			want: map[string]model.WebFlow{
+				"/a" + testDate: {Domain: "example.com", URL: "/a", Date: testDate, PV: 2, IP: 1, UV: 1, Visits: 1, Duration: 30, Entries: 1},
+			},
+		},
+		{
+			name: "不同日期分开统计",
+			adds: []model.WebFlow{
+				{Domain: "example.com", URL: "/a", Date: testDate, PV: 1},
+				{Domain: "example.com", URL: "/a", Date: yesterday, PV: 1},
+			},
+			want: map[string]model.WebFlow{
+				"/a" + testDate:  {Domain: "example.com", URL: "/a", Date: testDate, PV: 1},
+				"/a" + yesterday: {Domain: "example.com", URL: "/a", Date: yesterday, PV: 1},
+			},
+		},
+		{
+			name: "没有域名时保留原来的域名",
+			adds: []model.WebFlow{
+				{Domain: "example.com", URL: "/a", Date: testDate, PV: 1},
+				{URL: "/a", Date: testDate, Duration: 10},
+			},
+			want: map[string]model.WebFlow{
+				"/a" + testDate: {Domain: "example.com", URL: "/a", Date: testDate, PV: 1, Duration: 10},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cm := newConnManager()
+			for i := range c.adds {
+				w := c.adds[i]
+				cm.addWebflow(&w)
+			}
+			if got := cm.webflowsSnapshot(); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("缓存为 %+v,期望 %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestAddBrowsing(t *testing.T) {
+	cm := newConnManager()
+	cm.addBrowsing(&model.Browsing{UID: "u1", Domain: "example.com", Date: testDate, PV: 1, Visits: 1, Depth: 1})
+	cm.addBrowsing(&model.Browsing{UID: "u1", Domain: "example.com", Date: testDate, Duration: 30})
+	cm.addBrowsing(&model.Browsing{UID: "u1", Domain: "other.com", Date: testDate, PV: 1})
+	if len(cm.browsings) != 2 {
+		t.Fatalf("不同域名应分开统计,缓存了%d条", len(cm.browsings))
+	}
+	b := cm.browsings["u1"+testDate+"example.com"]
+	if b.PV != 1 || b.Duration != 30 {
+		t.Fatalf("累加后为 %+v", b)
+	}
+}
+
+func TestFlushWebflowsToRedis(t *testing.T) {
+	rdb := setupFakes(t)
+	cm := newConnManager()
+	// redis中已有的流量
+	old := model.WebFlow{Domain: "example.com", URL: "/a", Date: testDate, PV: 10, UV: 5}
+	key := service.GetRedisWebflowKey(old.Domain, old.Date, old.URL)
+	rdb.HMSet(key, service.WebflowRedisValues(&old))
+	cm.addWebflow(&model.WebFlow{Domain: "example.com", URL: "/a", Date: testDate, PV: 2, UV: 1, Exits: 1})
+	cm.addWebflow(&model.WebFlow{Domain: "example.com", URL: "/a", Date: yesterday, PV: 3})
+	cm.addWebflow(&model.WebFlow{Domain: "example.com", URL: "/b", Date: testDate, PV: 1})
+	if err := cm.flush(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.webflowsSnapshot()) != 0 {
+		t.Fatal("保存到redis后应清空缓存")
+	}
+	want := map[string]model.WebFlow{
+		key: {PV: 12, UV: 6, Exits: 1},
+		service.GetRedisWebflowKey("example.com", yesterday, "/a"): {PV: 3},
+		service.GetRedisWebflowKey("example.com", testDate, "/b"):  {PV: 1},
+	}
+	eventually(t, func() (interface{}, interface{}) {
+		got := make(map[string]model.WebFlow)
+		for k := range want {
+			var w model.WebFlow
+			service.AddRedisValsToWebflow(&w, rdb.HMGet(k, service.WebflowRedisFields...).Val())
+			got[k] = w
+		}
+		return got, want
+	})
+	if ttl := rdb.TTL(key).Val(); ttl <= 0 {
+		t.Fatalf("webflow key 应设置过期时间,ttl为%v", ttl)
+	}
+}
+
+func TestFlushBrowsingsToRedis(t *testing.T) {
+	rdb := setupFakes(t)
+	cm := newConnManager()
+	key := service.GetRedisBrowsingKey(testDate, "u1")
+	// 之前以json保存的浏览习惯
+	rdb.HSet(key, "other.com", `{"uid":"u1","domain":"other.com","pv":2,"duration":10,"ip":"2.2.2.2","nv":1}`)
+	cm.addBrowsing(&model.Browsing{UID: "u1", Domain: "example.com", Date: testDate, PV: 1, Visits: 1, Depth: 1, IP: "1.1.1.1", Browser: "Chrome", NV: 1})
+	cm.addBrowsing(&model.Browsing{UID: "u1", Domain: "other.com", Date: testDate, PV: 1, IP: "3.3.3.3"})
+	if err := cm.flush(0); err != nil {
+		t.Fatal(err)
+	}
+	// 关闭页面只累加时长,不覆盖属性
+	cm.addBrowsing(&model.Browsing{UID: "u1", Domain: "example.com", Date: testDate, Duration: 30})
+	if err := cm.flush(0); err != nil {
+		t.Fatal(err)
+	}
+	browsings, err := service.GetBrowsingsByUIDFromRedis(testDate, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]model.Browsing)
+	for _, b := range browsings {
+		got[b.Domain] = b
+	}
+	want := map[string]model.Browsing{
+		"example.com": {Domain: "example.com", PV: 1, Visits: 1, Depth: 1, Duration: 30, IP: "1.1.1.1", Browser: "Chrome", NV: 1},
+		"other.com":   {Domain: "other.com", PV: 3, Duration: 10, IP: "3.3.3.3", NV: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("redis中的浏览习惯为 %+v,期望 %+v", got, want)
+	}
+	if ttl := rdb.TTL(key).Val(); ttl <= 0 {
+		t.Fatalf("过期时间为%v", ttl)
+	}
+}
+
+func TestFlushRealtimeDataToRedis(t *testing.T) {
+	rdb := setupFakes(t)
+	cm := newConnManager()
+	ipKey := service.GetRedisTimeIPKey("example.com")
+	// 其它实例纪录的在线ip
+	rdb.HSet(ipKey, "2.2.2.2", 1)
+	cm.addPVRealtime("example.com", 2)
+	cm.addIPRealtime("example.com", "1.1.1.1", 2)
+	cm.addIPRealtime("example.com", "2.2.2.2", -1)
+	// 没有纪录打开的页面就关闭,不会小于0
+	cm.addIPRealtime("example.com", "3.3.3.3", -1)
+	cm.flushRealtimeDataToRedis()
+	cm.addPVRealtime("example.com", -3)
+	cm.addIPRealtime("example.com", "1.1.1.1", -1)
+	cm.flushRealtimeDataToRedis()
+	if pv := rdb.Get(service.GetRedisTimePVKey("example.com")).Val(); pv != "0" {
+		t.Fatalf("实时pv为%s,期望0", pv)
+	}
+	if got, want := rdb.HGetAll(ipKey).Val(), map[string]string{"1.1.1.1": "1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("在线ip为 %v,期望 %v", got, want)
+	}
+	// 归0后继续累加
+	cm.addPVRealtime("example.com", 1)
+	cm.flushRealtimeDataToRedis()
+	if pv := rdb.Get(service.GetRedisTimePVKey("example.com")).Val(); pv != "1" {
+		t.Fatalf("实时pv为%s,期望1", pv)
+	}
+	// 执行失败的域名重新缓存,执行成功的域名不会重复累加
+	badKey := service.GetRedisTimeIPKey("bad.com")
+	rdb.Set(badKey, "x", 0)
+	cm.addIPRealtime("bad.com", "4.4.4.4", 1)
+	cm.addIPRealtime("example.com", "5.5.5.5", 1)
+	cm.flushRealtimeDataToRedis()
+	if got := cm.iprealtime["bad.com"]["4.4.4.4"]; got != 1 {
+		t.Fatalf("执行失败的在线ip应重新缓存,实际为%v", got)
+	}
+	if _, ok := cm.iprealtime["example.com"]; ok {
+		t.Fatal("执行成功的在线ip不应重新缓存")
+	}
+	rdb.Del(badKey)
+	cm.flushRealtimeDataToRedis()
+	want := map[string]string{"1.1.1.1": "1", "5.5.5.5": "1"}
+	if got := rdb.HGetAll(ipKey).Val(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("在线ip为 %v,期望 %v", got, want)
+	}
+	if got := rdb.HGetAll(badKey).Val(); !reflect.DeepEqual(got, map[string]string{"4.4.4.4": "1"}) {
+		t.Fatalf("重新缓存的在线ip为 %v", got)
+	}
+}
+
+// TestFlushCountersToRedis 事务中执行失败的计数重新缓存,执行成功的计数不会重复累加
+func TestFlushCountersToRedis(t *testing.T) {
+	rdb := setupFakes(t)
+	cm := newConnManager()
+	// 昨天的key不是hash,累加会失败
+	badKeys := []string{service.GetRedisSourceKey(yesterday), service.GetRedisHourlyKey(yesterday), service.GetRedisEventKey(yesterday), service.GetRedisBotKey(yesterday)}
+	for _, key := range badKeys {
+		rdb.Set(key, "x", 0)
+	}
+	for _, date := range []string{testDate, yesterday} {
+		cm.addSource(&model.Source{Domain: "example.com", Date: date, Type: "search", Name: "google", PV: 2, Visits: 1})
+		cm.addHourly([]*service.HourlyIncr{{Key: service.GetRedisHourlyKey(date), Field: "example.com|10|pv", N: 2}})
+		cm.addEvent(&model.Event{Domain: "example.com", Date: date, Category: "video", Action: "play", Count: 2, Value: 5})
+		cm.addBot(&model.Bot{Domain: "example.com", Date: date, Reason: "ua", Name: "spider", PV: 2})
+	}
+	if err := cm.flush(0); err == nil {
+		t.Fatal("累加到不是hash的key应返回错误")
+	}
+	for name, n := range map[string]int{"sources": len(cm.sources), "hourly": len(cm.hourly), "events": len(cm.events), "bots": len(cm.bots)} {
+		if n != 1 {
+			t.Errorf("%s 重新缓存了%d项,期望只有昨天的1项", name, n)
+		}
+	}
+	rdb.Del(badKeys...)
+	if err := cm.flush(0); err != nil {
+		t.Fatal(err)
+	}
+	// 各项计数的值,排序后比较
+	values := func(key string) []string {
+		var vals []string
+		for _, v := range rdb.HGetAll(key).Val() {
+			vals = append(vals, v)
+		}
+		sort.Strings(vals)
+		return vals
+	}
+	for _, date := range []string{testDate, yesterday} {
+		got := [][]string{values(service.GetRedisSourceKey(date)), values(service.GetRedisHourlyKey(date)), values(service.GetRedisEventKey(date)), values(service.GetRedisBotKey(date))}
+		want := [][]string{{"1", "2"}, {"2"}, {"2", "5"}, {"2"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s 的来源、每小时流量、事件、爬虫为 %v,期望 %v", date, got, want)
+		}
+	}
+}
+
+// newReq 一次页面浏览
+func newReq(uid, ip, url string) *webFlowReq {
+	return &webFlowReq{
+		webflow:  &model.WebFlow{Domain: "example.com", URL: url, Date: testDate},
+		browsing: &model.Browsing{Domain: "example.com", UID: uid, IP: ip, Date: testDate},
+		time:     time.Now(),
+	}
+}
+
+func TestHandleWebFlow(t *testing.T) {
+	// 昨天的页面浏览
+	yesterdayReq := func(uid, ip, url string) *webFlowReq {
+		req := newReq(uid, ip, url)
+		req.webflow.Date, req.browsing.Date = yesterday, yesterday
+		return req
+	}
+	cases := []struct {
+		name string
+		reqs []*webFlowReq
+		want map[string]model.WebFlow // key为url,不是今天时为 url 日期
+	}{
+		{
+			name: "同一用户重复访问",
+			reqs: []*webFlowReq{newReq("u1", "1.1.1.1", "/a"), newReq("u1", "1.1.1.1", "/a")},
+			want: map[string]model.WebFlow{
+				"/a": {PV: 2, IP: 1, UV: 1, Visits: 1, Entries: 1, Exits: 1, Bounce: 0},
+			},
+		},
+		{
+			name: "同一ip的不同用户",
+			reqs: []*webFlowReq{newReq("u1", "1.1.1.1", "/a"), newReq("u2", "1.1.1.1", "/a")},
+			want: map[string]model.WebFlow{
+				"/a": {PV: 2, IP: 1, UV: 2, Visits: 2, Entries: 2, Exits: 2, Bounce: 2},
+			},
+		},
+		{
+			name: "访问第二个页面",
+			reqs: []*webFlowReq{newReq("u1", "1.1.1.1", "/a"), newReq("u1", "1.1.1.1", "/b")},
+			want: map[string]model.WebFlow{
+				"/a": {PV: 1, IP: 1, UV: 1, Visits: 1, Entries: 1},
+				"/b": {PV: 1, IP: 1, UV: 1, Visits: 1, Exits: 1},
+			},
+		},
+		{
+			name: "访问跨过0点",
+			reqs: []*webFlowReq{yesterdayReq("u1", "1.1.1.1", "/a"), newReq("u1", "1.1.1.1", "/b")},
+			want: map[string]model.WebFlow{
+				"/a " + yesterday: {PV: 1, IP: 1, UV: 1, Visits: 1, Entries: 1, Exits: 1, Bounce: 1},
+				// 昨天的流量已经保存到数据库,减少的计数算在今天
+				"/a": {Exits: -1, Bounce: -1},
+				"/b": {PV: 1, IP: 1, UV: 1, Visits: 1, Exits: 1},
+			},
+		},
+		{
+			name: "没有uid时只统计pv和ip",
+			reqs: []*webFlowReq{newReq("", "1.1.1.1", "/a"), newReq("", "2.2.2.2", "/a")},
+			want: map[string]model.WebFlow{
+				"/a": {PV: 2, IP: 2},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupFakes(t)
+			cm := newConnManager()
+			b := newBatch()
+			for _, req := range c.reqs {
+				cm.handleWebFlow(b, req)
+			}
+			if err := b.exec(); err != nil {
+				t.Fatal(err)
+			}
+			cm.commit(&b.fx)
+			eventually(t, func() (interface{}, interface{}) {
+				got := make(map[string]model.WebFlow)
+				for _, w := range cm.webflowsSnapshot() {
+					url := w.URL
+					if w.Date != testDate {
+						url += " " + w.Date
+					}
+					w.Domain, w.URL, w.Date = "", "", ""
+					got[url] = w
+				}
+				return got, c.want
+			})
+		})
+	}
+}
+
+// roundTrips 纪录 redis 往返次数,管道算一次
+type roundTrips struct{ n int64 }
+
+func (r *roundTrips) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&r.n, 1)
+	return ctx, nil
+}
+
+func (r *roundTrips) AfterProcess(context.Context, redis.Cmder) error { return nil }
+
+func (r *roundTrips) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&r.n, 1)
+	return ctx, nil
+}
+
+func (r *roundTrips) AfterProcessPipeline(context.Context, []redis.Cmder) error { return nil }
+
+// TestBatchRoundTrips 协程处理一批请求时 redis 读取、去重、写入各一次往返
+func TestBatchRoundTrips(t *testing.T) {
+	for _, mode := range []string{service.DedupModeSet, service.DedupModeHLL, service.DedupModeBloom} {
+		t.Run(mode, func(t *testing.T) {
+			rdb := setupFakes(t)
+			registerDomain(t)
+			oldMode, oldRate := config.Config.DedupMode, config.Config.BotMaxHitsPerMinute
+			config.Config.DedupMode, config.Config.BotMaxHitsPerMinute = mode, "100"
+			t.Cleanup(func() {
+				config.Config.DedupMode, config.Config.BotMaxHitsPerMinute = oldMode, oldRate
+				service.SetupDeduper()
+			})
+			if err := service.SetupDeduper(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := service.AddGoal(&service.GoalReq{Domain: "example.com", Name: "注册", Steps: []model.GoalStep{
+				{Seq: 1, Type: model.GoalStepURL, Pattern: "/a"},
+				{Seq: 2, Type: model.GoalStepEvent, Pattern: "signup/click"},
+				{Seq: 3, Type: model.GoalStepDuration, Threshold: 5},
+			}}); err != nil {
+				t.Fatal(err)
+			}
+			cm := newConnManager()
+			cm.setQueues(1, 100)
+			trips := &roundTrips{}
+			rdb.AddHook(trips)
+			var batches int
+			handle := cm.cfg.OnBatch
+			cm.cfg.OnBatch = func(reqs []interface{}) {
+				before := atomic.LoadInt64(&trips.n)
+				handle(reqs)
+				if n := atomic.LoadInt64(&trips.n) - before; n > 3 {
+					t.Errorf("%d个请求访问了%d次redis,期望最多3次", len(reqs), n)
+				}
+				batches++
+			}
+			// 启动前放入队列,协程一次取出全部请求
+			event := pageview("u1", "/b")
+			event.Type, event.Event = HitEvent, model.Event{Category: "signup", Action: "click"}
+			for _, w := range []*WebData{pageview("u1", "/a"), pageview("u2", "/a"), pageview("", "/a"), pageview("u1", "/b"), event} {
+				if err := cm.NewWebData(w); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := cm.CloseWeb(&Duration{Domain: "example.com", UID: "u1", URL: "/b", Date: testDate, Duration: 10, UserAgent: "Mozilla/5.0"}); err != nil {
+				t.Fatal(err)
+			}
+			cm.Start()
+			if !cm.drain(time.Second) {
+				t.Fatal("请求没有处理完")
+			}
+			if batches != 1 {
+				t.Fatalf("请求分%d批处理,期望1批", batches)
+			}
+			got := make(map[string]model.WebFlow)
+			for _, w := range cm.webflowsSnapshot() {
+				url := w.URL
+				w.Domain, w.URL, w.Date = "", "", ""
+				got[url] = w
+			}
+			want := map[string]model.WebFlow{
+				"/a": {PV: 3, IP: 1, UV: 2, Visits: 2, Entries: 2, Exits: 1, Bounce: 1},
+				"/b": {PV: 1, IP: 1, UV: 1, Visits: 1, Exits: 1, Duration: 10},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("网页流量为 %+v,期望 %+v", got, want)
+			}
+			stats, err := service.GetGoalStatsFromRedis(testDate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			visitors := make(map[int]int)
+			for _, s := range stats {
+				visitors[s.Step] = s.Visitors
+			}
+			if want := map[int]int{0: 2, 1: 2, 2: 1, 3: 1}; !reflect.DeepEqual(visitors, want) {
+				t.Fatalf("目标各步骤的用户数为 %v,期望 %v", visitors, want)
+			}
+		})
+	}
+}
+
+// pageinfoStore 纪录保存页面信息的次数
+type pageinfoStore struct {
+	model.Storage
+	saved map[string]int
+}
+
+func (s *pageinfoStore) FirstOrCreatePageinfo(p *model.Pageinfo) error {
+	s.saved[p.URL]++
+	return s.Storage.FirstOrCreatePageinfo(p)
+}
+
+// TestPageinfos 页面信息按访问日期写入redis,url当天第一次出现时才保存到数据库
+func TestPageinfos(t *testing.T) {
+	rdb := setupFakes(t)
+	registerDomain(t)
+	store := &pageinfoStore{Storage: model.Store, saved: make(map[string]int)}
+	model.Store = store
+	cm := newConnManager()
+	cm.setQueues(1, 100)
+	late := pageview("u2", "/c")
+	late.Time = time.Now().Add(-time.Hour * 24)
+	for _, w := range []*WebData{pageview("u1", "/a"), pageview("u2", "/a"), pageview("u1", "/b"), late} {
+		if err := cm.NewWebData(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cm.Start()
+	if !cm.drain(time.Second) {
+		t.Fatal("请求没有处理完")
+	}
+	// 之后的批次中已经纪录的url不再保存
+	cm = newConnManager()
+	cm.setQueues(1, 100)
+	if err := cm.NewWebData(pageview("u3", "/a")); err != nil {
+		t.Fatal(err)
+	}
+	cm.Start()
+	if !cm.drain(time.Second) {
+		t.Fatal("请求没有处理完")
+	}
+	if want := map[string]int{"/a": 1, "/b": 1, "/c": 1}; !reflect.DeepEqual(store.saved, want) {
+		t.Fatalf("保存页面信息的次数为 %v,期望 %v", store.saved, want)
+	}
+	urls := func(date string) []string {
+		members := rdb.SMembers(service.GetRedisURLKey(date)).Val()
+		sort.Strings(members)
+		return members
+	}
+	if got, want := [][]string{urls(testDate), urls(yesterday)}, [][]string{{"/a", "/b"}, {"/c"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("今天和昨天的url为 %v,期望 %v", got, want)
+	}
+	if n := rdb.Exists(service.GetRedisPageinfoKey(yesterday, "/c")).Val(); n != 1 {
+		t.Fatal("昨天访问的页面信息应写入昨天的key")
+	}
+}
+
+// TestStop 关闭时处理完队列中的请求并保存到redis
+func TestStop(t *testing.T) {
+	rdb := setupFakes(t)
+	registerDomain(t)
+	cm := newConnManager()
+	cm.Start()
+	for _, uid := range []string{"u1", "u2", "u3"} {
+		if err := cm.NewWebData(pageview(uid, "https://example.com/a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cm.Stop()
+	var w model.WebFlow
+	key := service.GetRedisWebflowKey("example.com", testDate, "https://example.com/a")
+	service.AddRedisValsToWebflow(&w, rdb.HMGet(key, service.WebflowRedisFields...).Val())
+	if w.PV != 3 || w.UV != 3 || w.IP != 1 {
+		t.Fatalf("关闭后redis中的流量为 %+v", w)
+	}
+	if pv := rdb.Get(service.GetRedisTimePVKey("example.com")).Val(); pv != "3" {
+		t.Fatalf("关闭后实时pv为%s,期望3", pv)
+	}
+}
+
+// event 用户 uid 在 example.com 的页面触发自定义事件
+func event(uid, url string, e model.Event) *WebData {
+	w := pageview(uid, url)
+	w.Type, w.Event = HitEvent, e
+	return w
+}
+
+// TestEvents 自定义事件不计入页面流量,按分组合并数据库和今天redis中的事件
+func TestEvents(t *testing.T) {
+	rdb := setupFakes(t)
+	registerDomain(t)
+	old := &model.Event{Domain: "example.com", Date: yesterday, URL: "/a", Category: "download", Action: "click", Label: "a.pdf", Count: 1, Value: 10}
+	if err := old.UpdateOrSave(); err != nil {
+		t.Fatal(err)
+	}
+	cm := newConnManager()
+	cm.Start()
+	long := strings.Repeat("长", 120)
+	for _, w := range []*WebData{
+		event("u1", "/a", model.Event{Category: " download ", Action: "click", Label: "a.pdf", Value: 2}),
+		event("u2", "/a", model.Event{Category: "download", Action: "click", Label: "b.pdf"}),
+		event("u1", "/b", model.Event{Category: "download", Action: "click", Label: "a.pdf", Value: 3}),
+		event("u1", "/b", model.Event{Category: "video", Action: long}),
+		// 没有动作的事件不统计
+		event("u1", "/b", model.Event{Category: "video"}),
+	} {
+		if err := cm.NewWebData(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cm.drain(time.Second) {
+		t.Fatal("请求没有处理完")
+	}
+	if err := cm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := rdb.Exists(service.GetRedisWebflowKey("example.com", testDate, "/a")).Val(); n != 0 {
+		t.Fatal("自定义事件不应计入页面流量")
+	}
+	truncated := strings.Repeat("长", 100)
+	cases := []struct {
+		name string
+		req  service.EventReq
+		want []model.Event
+	}{
+		{"按类别和动作", service.EventReq{}, []model.Event{
+			{Category: "download", Action: "click", Count: 4, Value: 15},
+			{Category: "video", Action: truncated, Count: 1},
+		}},
+		{"按标签", service.EventReq{Category: "download", Group: []string{"label"}}, []model.Event{
+			{Category: "download", Action: "click", Label: "a.pdf", Count: 3, Value: 15},
+			{Category: "download", Action: "click", Label: "b.pdf", Count: 1},
+		}},
+		{"指定页面按标签和页面", service.EventReq{URL: "/a", Group: []string{"label", "url"}}, []model.Event{
+			{URL: "/a", Category: "download", Action: "click", Label: "a.pdf", Count: 2, Value: 12},
+			{URL: "/a", Category: "download", Action: "click", Label: "b.pdf", Count: 1},
+		}},
+		{"分页", service.EventReq{RealtimeDataReq: service.RealtimeDataReq{Limit: 1, Offset: 1}}, []model.Event{
+			{Category: "video", Action: truncated, Count: 1},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.req.Domain, c.req.StartDate, c.req.EndDate = "example.com", yesterday, testDate
+			s, err := service.GetEvents(&c.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []model.Event
+			if err := json.Unmarshal([]byte(s), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("自定义事件为 %+v,期望 %+v", got, c.want)
+			}
+		})
+	}
+	req := &service.EventReq{Group: []string{"domain"}}
+	req.Domain, req.StartDate, req.EndDate = "example.com", yesterday, testDate
+	if _, err := service.GetEvents(req); err == nil {
+		t.Fatal("不支持的分组字段应返回错误")
+	}
+}
+
+// TestGoals 用户当天按顺序完成目标步骤,每次访问最多完成一步,报告合并数据库和今天redis中的进度
+func TestGoals(t *testing.T) {
+	setupFakes(t)
+	registerDomain(t)
+	_, err := service.AddGoal(&service.GoalReq{Domain: "example.com", Name: "注册", Steps: []model.GoalStep{
+		{Name: "价格", Type: model.GoalStepURL, Pattern: "/pricing"},
+		{Name: "提交", Type: model.GoalStepEvent, Pattern: "signup/submit"},
+		{Name: "阅读", Type: model.GoalStepDuration, Pattern: "/welcome", Threshold: 10},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeWeb := func(uid, url string, duration int) *Duration {
+		return &Duration{Domain: "example.com", Date: testDate, UID: uid, URL: url, Duration: duration, IP: "1.1.1.1", UserAgent: "Mozilla/5.0"}
+	}
+	run := func(reqs ...interface{}) {
+		t.Helper()
+		cm := newConnManager()
+		cm.setQueues(1, 100)
+		cm.Start()
+		for _, r := range reqs {
+			var err error
+			switch r := r.(type) {
+			case *WebData:
+				err = cm.NewWebData(r)
+			case *Duration:
+				err = cm.CloseWeb(r)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !cm.drain(time.Second) {
+			t.Fatal("请求没有处理完")
+		}
+	}
+	run(
+		pageview("u1", "https://example.com/"),
+		pageview("u1", "https://example.com/pricing?plan=pro"),
+		event("u1", "https://example.com/pricing", model.Event{Category: "signup", Action: "submit"}),
+		closeWeb("u1", "https://example.com/welcome", 5),
+		closeWeb("u1", "https://example.com/welcome", 15),
+		// 已完成的步骤不重复统计
+		pageview("u2", "https://example.com/pricing"),
+		pageview("u2", "https://example.com/pricing"),
+		event("u2", "https://example.com/pricing", model.Event{Category: "signup", Action: "click"}),
+		// 没有完成上一步时不统计下一步
+		event("u3", "https://example.com/", model.Event{Category: "signup", Action: "submit"}),
+	)
+	service.FlushGoals2DBFromRedis(testDate)
+	run(
+		event("u2", "https://example.com/pricing", model.Event{Category: "signup", Action: "submit"}),
+		pageview("u3", "https://example.com/pricing"),
+	)
+	req := &service.GoalReportReq{}
+	req.Domain, req.StartDate, req.EndDate = "example.com", testDate, testDate
+	s, err := service.GetGoalReports(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reports []service.GoalReport
+	if err := json.Unmarshal([]byte(s), &reports); err != nil {
+		t.Fatal(err)
+	}
+	want := []*service.GoalDay{{Date: testDate, Visitors: 3, Conversions: 1, ConversionRate: 1.0 / 3, Steps: []*service.GoalStepStat{
+		{Seq: 1, Name: "价格", Visitors: 3},
+		{Seq: 2, Name: "提交", Visitors: 2, DropOff: 1, DropOffRate: 1.0 / 3},
+		{Seq: 3, Name: "阅读", Visitors: 1, DropOff: 1, DropOffRate: 0.5},
+	}}}
+	if len(reports) != 1 || !reflect.DeepEqual(reports[0].Days, want) {
+		t.Fatalf("目标报告为 %s", s)
+	}
+}
+
+func TestOverload(t *testing.T) {
+	for _, policy := range []string{OverloadReject, OverloadSample} {
+		t.Run(policy, func(t *testing.T) {
+			cm := newConnManager()
+			cm.setQueues(1, 1)
+			cm.overload = policy
+			// 协程处理第一个请求时阻塞,第二个请求在队列中等待
+			release := make(chan struct{})
+			var handled int32
+			cm.cfg.OnBatch = func(reqs []interface{}) {
+				<-release
+				atomic.AddInt32(&handled, int32(len(reqs)))
+			}
+			cm.Start()
+			defer cm.Stop()
+			for i := 0; i < 2; i++ {
+				if err := cm.NewWebData(pageview("u1", "/a")); err != nil {
+					t.Fatal(err)
+				}
+				// 等待协程取走第一个请求
+				for i == 0 && atomic.LoadInt32(&cm.queued[0]) > 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			err := cm.NewWebData(pageview("u1", "/a"))
+			if policy == OverloadReject && err != ErrOverloaded {
+				t.Fatalf("队列已满时返回 %v,期望 ErrOverloaded", err)
+			}
+			if policy == OverloadSample && (err != nil || atomic.LoadUint64(&cm.dropped) != 1) {
+				t.Fatalf("采样时返回 %v,丢弃%d条", err, cm.dropped)
+			}
+			close(release)
+			if !cm.drain(time.Second) || atomic.LoadInt32(&handled) != 2 {
+				t.Fatalf("处理了%d条请求,期望2条", handled)
+			}
+			if err := cm.NewWebData(pageview("u1", "/a")); err != errStopped {
+				t.Fatalf("关闭后返回 %v", err)
+			}
+		})
+	}
+}
+
+// BenchmarkPipeline 采集请求经过队列、去重和缓存,最后全部保存到redis
+// 比较不同协程数的吞吐量、内存和协程数峰值,队列已满时重试,rejected/op 为每条请求被拒绝的次数
+func BenchmarkPipeline(b *testing.B) {
+	for _, workers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			setupFakes(b)
+			registerDomain(b)
+			cm := newConnManager()
+			cm.setQueues(workers, 100)
+			cm.Start()
+			var peak int64
+			stop := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					case <-time.After(time.Millisecond):
+						if n := int64(runtime.NumGoroutine()); n > atomic.LoadInt64(&peak) {
+							atomic.StoreInt64(&peak, n)
+						}
+					}
+				}
+			}()
+			rejected := 0
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := pageview(fmt.Sprintf("u%d", i%1000), fmt.Sprintf("https://example.com/%d", i%100))
+				for cm.NewWebData(w) == ErrOverloaded {
+					rejected++
+					runtime.Gosched()
+				}
+			}
+			cm.Stop()
+			b.StopTimer()
+			close(stop)
+			b.ReportMetric(float64(atomic.LoadInt64(&peak)), "goroutines")
+			b.ReportMetric(float64(rejected)/float64(b.N), "rejected/op")
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package connmgr
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 日志纪录类型
+const (
+	journalWebData  = "webdata"
+	journalDuration = "duration"
+	journalEffects  = "effects" // 一批请求处理后累加到缓存的增量
+)
+
+// journalRecord 一条日志,采集请求确认之前写入
+type journalRecord struct {
+	Type      string    `json:"t"`
+	ID        int64     `json:"id,omitempty"` // 采集请求的序号,写入时分配
+	WebData   *WebData  `json:"w,omitempty"`
+	Duration  *Duration `json:"d,omitempty"`
+	Effects   *effects  `json:"e,omitempty"`
+	UserAgent string    `json:"ua,omitempty"`
+	Time      time.Time `json:"time"`
+	seg       int64     // 所在的日志文件
+}
+
+// journal 采集请求的预写日志,按保存到redis的周期分为多个文件 <序号>.log
+// 每批请求处理后写入累加到缓存的增量,文件中的请求都已处理,且增量全部保存到redis后删除文件;启动时重放未删除的文件
+// 为nil时不写日志
+type journal struct {
+	dir     string
+	sync    bool // 每次写入后是否 fsync
+	mu      sync.Mutex
+	cond    *sync.Cond
+	f       *os.File
+	seg     int64           // 当前写入的文件序号
+	lastID  int64           // 最后分配的请求序号
+	pending map[int64]int64 // 每个文件中还未处理完的请求数
+	written int64           // 已写入的纪录数
+	syncMu  sync.Mutex
+	synced  int64 // 已 fsync 的纪录数
+	closed  bool
+}
+
+// openJournal 打开日志目录,返回需要重放的纪录,dir为空时不写日志
+func openJournal(dir string, fsync bool) (*journal, []*journalRecord, error) {
+	if len(dir) == 0 {
+		return nil, nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	j := &journal{dir: dir, sync: fsync, pending: make(map[int64]int64)}
+	j.cond = sync.NewCond(&j.mu)
+	segs, err := j.segments()
+	if err != nil {
+		return nil, nil, err
+	}
+	var records []*journalRecord
+	for _, seg := range segs {
+		rs, err := readJournalFile(j.path(seg))
+		if err != nil {
+			return nil, nil, err
+		}
+		j.pending[seg] = 0
+		for _, r := range rs {
+			r.seg = seg
+			if r.ID > j.lastID {
+				j.lastID = r.ID
+			}
+			if r.Type != journalEffects {
+				j.pending[seg]++
+			}
+		}
+		records = append(records, rs...)
+		j.seg = seg
+	}
+	j.seg++
+	if j.f, err = j.create(j.seg); err != nil {
+		return nil, nil, err
+	}
+	if len(records) > 0 {
+		log.Printf("重放预写日志:%d个文件,%d条采集请求\n", len(segs), len(records))
+	}
+	return j, records, nil
+}
+
+// readJournalFile 读取日志文件,跳过崩溃时没有写完的纪录
+func readJournalFile(path string) ([]*journalRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []*journalRecord
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			rec := &journalRecord{}
+			if err := json.Unmarshal(line, rec); err != nil {
+				log.Printf("跳过无法解析的日志:%s:%v\n", path, err)
+			} else {
+				records = append(records, rec)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return records, nil
+}
+
+// segments 目录中的日志文件序号,从小到大
+func (j *journal) segments() ([]int64, error) {
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []int64
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		seg, err := strconv.ParseInt(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		segs = append(segs, seg)
+	}
+	sort.Slice(segs, func(a, b int) bool { return segs[a] < segs[b] })
+	return segs, nil
+}
+
+func (j *journal) path(seg int64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%020d.log", seg))
+}
+
+func (j *journal) create(seg int64) (*os.File, error) {
+	return os.OpenFile(j.path(seg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// append 写入一条纪录,sync 为true时等待写入磁盘,返回纪录所在的文件序号
+// 采集请求分配序号 rec.ID 并计入未处理的请求;同时写入的纪录合并 fsync
+func (j *journal) append(rec *journalRecord) (int64, error) {
+	if j == nil {
+		return 0, nil
+	}
+	request := rec.Type != journalEffects
+	if request {
+		rec.ID = atomic.AddInt64(&j.lastID, 1)
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	b = append(b, '\n')
+	j.mu.Lock()
+	if j.closed {
+		j.mu.Unlock()
+		return 0, os.ErrClosed
+	}
+	if _, err := j.f.Write(b); err != nil {
+		j.mu.Unlock()
+		return 0, err
+	}
+	seg := j.seg
+	if request {
+		j.pending[seg]++
+	} else if _, ok := j.pending[seg]; !ok {
+		// 只有增量的文件也需要 rotate 和删除
+		j.pending[seg] = 0
+	}
+	j.written++
+	n := j.written
+	j.mu.Unlock()
+	if !j.sync {
+		return seg, nil
+	}
+	if err := j.syncTo(n); err != nil {
+		if request {
+			j.done(seg)
+		}
+		return 0, err
+	}
+	return seg, nil
+}
+
+// syncTo 等待前n条纪录写入磁盘
+func (j *journal) syncTo(n int64) error {
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	if j.synced >= n {
+		return nil
+	}
+	j.mu.Lock()
+	f, written := j.f, j.written
+	j.mu.Unlock()
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	j.synced = written
+	return nil
+}
+
+// done 一条纪录已经处理到缓存
+func (j *journal) done(seg int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.pending[seg]--
+	j.mu.Unlock()
+	j.cond.Broadcast()
+}
+
+// rotate 之后的纪录写入新的文件,返回之前的最后一个文件序号
+func (j *journal) rotate() (int64, error) {
+	if j == nil {
+		return 0, nil
+	}
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return 0, os.ErrClosed
+	}
+	// 当前文件没有纪录时不需要新建文件
+	if _, ok := j.pending[j.seg]; !ok {
+		return j.seg - 1, nil
+	}
+	f, err := j.create(j.seg + 1)
+	if err != nil {
+		return 0, err
+	}
+	old := j.f
+	if err := old.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, err
+	}
+	old.Close()
+	j.f = f
+	j.seg++
+	j.synced = j.written
+	return j.seg - 1, nil
+}
+
+// waitProcessed 等待 seg 及之前文件中的纪录全部处理到缓存,超时返回false
+func (j *journal) waitProcessed(seg int64, timeout time.Duration) bool {
+	if j == nil {
+		return true
+	}
+	timer := time.AfterFunc(timeout, j.cond.Broadcast)
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for {
+		processed := true
+		for s, n := range j.pending {
+			if s <= seg && n > 0 {
+				processed = false
+				break
+			}
+		}
+		if processed {
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		j.cond.Wait()
+	}
+}
+
+// remove 删除 seg 及之前的文件,文件中的纪录已经保存到redis
+func (j *journal) remove(seg int64) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for s := range j.pending {
+		if s <= seg {
+			delete(j.pending, s)
+		}
+	}
+	segs, err := j.segments()
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if s > seg || s == j.seg {
+			continue
+		}
+		if err := os.Remove(j.path(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close 关闭日志,未删除的文件在下次启动时重放
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	j.cond.Broadcast()
+	if err := j.f.Sync(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
@@ -0,0 +1,180 @@
+package connmgr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codepository/GoWebAnalytics/model"
+	"github.com/codepository/GoWebAnalytics/service"
+)
+
+func webDataRecord(uid string) *journalRecord {
+	w := &WebData{
+		Pageinfo: model.Pageinfo{URL: "https://example.com/a"},
+		Browsing: model.Browsing{Domain: "example.com", UID: uid, IP: "1.1.1.1"},
+	}
+	return &journalRecord{Type: journalWebData, WebData: w, UserAgent: "ua", Time: time.Now()}
+}
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	j, records, err := openJournal(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("新目录重放了%d条纪录", len(records))
+	}
+	seg, err := j.append(webDataRecord("u1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := j.rotate()
+	if err != nil || sealed != seg {
+		t.Fatalf("rotate 返回 %d,%v,期望 %d", sealed, err, seg)
+	}
+	if j.waitProcessed(sealed, 10*time.Millisecond) {
+		t.Fatal("纪录还未处理")
+	}
+	j.done(seg)
+	if !j.waitProcessed(sealed, time.Second) {
+		t.Fatal("纪录已经处理")
+	}
+	// 新文件中的纪录未保存到redis
+	if _, err := j.append(webDataRecord("u2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.remove(sealed); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.append(webDataRecord("u3")); err == nil {
+		t.Fatal("关闭后不能写入")
+	}
+	// 崩溃时没有写完的纪录
+	files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(files) != 1 {
+		t.Fatalf("剩余%d个日志文件,期望1个", len(files))
+	}
+	f, _ := os.OpenFile(files[0], os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"t":"webdata","w":{"p":`)
+	f.Close()
+
+	j, records, err = openJournal(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if len(records) != 1 || records[0].WebData.Browsing.UID != "u2" || records[0].UserAgent != "ua" {
+		t.Fatalf("重放的纪录为 %+v", records)
+	}
+	if seg, _ := j.append(webDataRecord("u4")); seg <= records[0].seg {
+		t.Fatalf("重新打开后写入文件%d,应大于%d", seg, records[0].seg)
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	rdb := setupFakes(t)
+	registerDomain(t)
+	// 上次运行时写入日志但未保存到redis的请求
+	dir := t.TempDir()
+	j, _, err := openJournal(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []string{"u1", "u2"} {
+		if _, err := j.append(webDataRecord(uid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.close()
+
+	j, records, err := openJournal(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := newConnManager()
+	cm.journal = j
+	cm.Start()
+	defer cm.Stop()
+	cm.replay(records)
+	// 重放的请求处理完成后保存
+	if !cm.drain(time.Second) {
+		t.Fatal("请求没有处理完")
+	}
+	if err := cm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var w model.WebFlow
+	key := service.GetRedisWebflowKey("example.com", testDate, "https://example.com/a")
+	service.AddRedisValsToWebflow(&w, rdb.HMGet(key, service.WebflowRedisFields...).Val())
+	if w.PV != 2 || w.UV != 2 || w.IP != 1 {
+		t.Fatalf("重放后的流量为 %+v", w)
+	}
+	if records, err := readJournalFile(j.path(records[0].seg)); err == nil {
+		t.Fatalf("保存到redis后应删除日志文件,剩余%d条纪录", len(records))
+	}
+}
+
+// TestReplayAfterCrash 处理后没有保存到redis时崩溃,重放时合并增量,ip、uv 不因redis中已经去重而少算,已保存的请求不重复累加
+func TestReplayAfterCrash(t *testing.T) {
+	rdb := setupFakes(t)
+	registerDomain(t)
+	dir := t.TempDir()
+	j, _, err := openJournal(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := newConnManager()
+	cm.journal = j
+	cm.Start()
+	for _, uid := range []string{"u1", "u2"} {
+		if err := cm.NewWebData(pageview(uid, "https://example.com/a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 保存之后处理的请求只在预写日志中
+	if err := cm.NewWebData(pageview("u3", "https://example.com/a")); err != nil {
+		t.Fatal(err)
+	}
+	if !cm.drain(time.Second) {
+		t.Fatal("请求没有处理完")
+	}
+	// 崩溃:不保存缓存
+	close(cm.quit)
+	cm.background.Wait()
+	j.close()
+
+	j, records, err := openJournal(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm = newConnManager()
+	cm.journal = j
+	records = cm.replayEffects(records)
+	if len(records) != 0 {
+		t.Fatalf("已处理的请求重新处理了%d条", len(records))
+	}
+	cm.Start()
+	defer cm.Stop()
+	cm.replay(records)
+	if err := cm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var w model.WebFlow
+	key := service.GetRedisWebflowKey("example.com", testDate, "https://example.com/a")
+	service.AddRedisValsToWebflow(&w, rdb.HMGet(key, service.WebflowRedisFields...).Val())
+	if w.PV != 3 || w.UV != 3 || w.IP != 1 || w.Entries != 3 {
+		t.Fatalf("重放后的流量为 %+v", w)
+	}
+	if segs, _ := j.segments(); len(segs) != 1 {
+		t.Fatalf("保存到redis后剩余%d个日志文件,期望1个", len(segs))
+	}
+}
@@ -0,0 +1,21 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/codepository/GoWebAnalytics/service"
+)
+
+// ReloadBotRules 重新加载爬虫规则,只有超级管理员可以访问
+func ReloadBotRules(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "只支持POST请求", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := service.LoadBotRules(); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(writer, "ok")
+}
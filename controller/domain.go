@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/codepository/GoWebAnalytics/model"
+	"github.com/codepository/GoWebAnalytics/service"
+	"github.com/mumushuiding/util"
+)
+
+// Domain 域名管理
+// GET 查询有权限的域名、POST 注册域名(root)、PUT 修改域名(admin)、DELETE 删除域名(admin,参数id)
+func Domain(writer http.ResponseWriter, request *http.Request) {
+	identity := service.GetIdentity(request.Context())
+	var result string
+	var err error
+	switch request.Method {
+	case http.MethodGet:
+		result, err = service.GetDomains(identity)
+	case http.MethodPost, http.MethodPut:
+		var req service.DomainReq
+		if err = util.Body2Struct(request, &req); err != nil {
+			break
+		}
+		if request.Method == http.MethodPost {
+			if !identity.HasRole(service.RoleRoot) {
+				http.Error(writer, "没有注册域名的权限", http.StatusForbidden)
+				return
+			}
+			result, err = service.AddDomain(&req)
+		} else {
+			if !identity.CanDomainID(model.RoleAdmin, req.ID) {
+				http.Error(writer, "没有修改该域名的权限", http.StatusForbidden)
+				return
+			}
+			result, err = service.UpdateDomain(&req)
+		}
+	case http.MethodDelete:
+		request.ParseForm()
+		var id int
+		if id, err = strconv.Atoi(request.Form.Get("id")); err != nil {
+			break
+		}
+		if !identity.CanDomainID(model.RoleAdmin, id) {
+			http.Error(writer, "没有删除该域名的权限", http.StatusForbidden)
+			return
+		}
+		err = service.DelDomain(id)
+		result = "ok"
+	case http.MethodOptions:
+		return
+	default:
+		http.Error(writer, "不支持的请求方法", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(writer, result)
+}
+
+// GetUnregisteredDomains 获取指定日期被拒绝统计的未注册域名及次数
+func GetUnregisteredDomains(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	result, err := service.GetUnregisteredDomains(request.Form.Get("date"))
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(writer, result)
+}
@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/codepository/GoWebAnalytics/model"
+	"github.com/codepository/GoWebAnalytics/service"
+	"github.com/mumushuiding/util"
+)
+
+// Goal 转化目标管理
+// GET 查询域名的目标(参数domain)、POST 创建目标(admin)、PUT 修改目标(admin)、DELETE 删除目标(admin,参数id)
+func Goal(writer http.ResponseWriter, request *http.Request) {
+	identity := service.GetIdentity(request.Context())
+	var result string
+	var err error
+	switch request.Method {
+	case http.MethodGet:
+		request.ParseForm()
+		result, err = service.GetGoals(request.Form.Get("domain"))
+	case http.MethodPost, http.MethodPut:
+		var req service.GoalReq
+		if err = util.Body2Struct(request, &req); err != nil {
+			break
+		}
+		if request.Method == http.MethodPut {
+			if req.Domain, err = service.GoalDomain(req.ID); err != nil {
+				break
+			}
+		}
+		if !identity.Can(model.RoleAdmin, req.Domain) {
+			http.Error(writer, "没有管理该域名目标的权限", http.StatusForbidden)
+			return
+		}
+		if request.Method == http.MethodPost {
+			result, err = service.AddGoal(&req)
+		} else {
+			result, err = service.UpdateGoal(&req)
+		}
+	case http.MethodDelete:
+		request.ParseForm()
+		var id int
+		if id, err = strconv.Atoi(request.Form.Get("id")); err != nil {
+			break
+		}
+		var domain string
+		if domain, err = service.GoalDomain(id); err != nil {
+			break
+		}
+		if !identity.Can(model.RoleAdmin, domain) {
+			http.Error(writer, "没有管理该域名目标的权限", http.StatusForbidden)
+			return
+		}
+		err = service.DelGoal(id)
+		result = "ok"
+	case http.MethodOptions:
+		return
+	default:
+		http.Error(writer, "不支持的请求方法", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(writer, result)
+}
+
+// GetGoalReports 获取目标每日转化人数、转化率和各步骤流失,可通过 id 参数查询单个目标
+func GetGoalReports(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	req := service.GoalReportReq{RealtimeDataReq: *getParams(request)}
+	req.ID, _ = strconv.Atoi(request.Form.Get("id"))
+	result, err := service.GetGoalReports(&req)
+	if err != nil {
+		fmt.Fprintln(writer, err)
+		return
+	}
+	fmt.Fprintln(writer, result)
+}
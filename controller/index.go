@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/codepository/GoWebAnalytics/service"
 )
@@ -20,7 +21,7 @@ func Test(writer http.ResponseWriter, request *http.Request) {
 
 // GetToken 获取token
 func GetToken(request *http.Request) (string, error) {
-	token := request.Header.Get("Authorization")
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
 	if len(token) == 0 {
 		request.ParseForm()
 		if len(request.Form["token"]) == 0 {
@@ -4,6 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codepository/GoWebAnalytics/service"
@@ -19,7 +22,102 @@ func WebData(writer http.ResponseWriter, request *http.Request) {
 	if err != nil {
 		fmt.Fprintln(writer, err)
 	}
-	connmgr.CM.NewWebData(&data)
+	if err := service.CheckSiteKey(data.Browsing.Domain, data.SiteKey, request); err != nil {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
+	enrichWebData(request, &data)
+	if err := connmgr.CM.NewWebData(&data); err != nil {
+		unavailable(writer, err)
+	}
+}
+
+// unavailable 队列已满或预写日志写入失败时返回503,由浏览器稍后重试
+func unavailable(writer http.ResponseWriter, err error) {
+	if err == connmgr.ErrOverloaded {
+		writer.Header().Set("Retry-After", "1")
+	} else {
+		service.Log(err)
+	}
+	http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+}
+
+// enrichWebData 由服务端填充ip、操作系统、浏览器、终端类型和区域,不采用客户端上传的值
+func enrichWebData(request *http.Request, data *connmgr.WebData) {
+	data.Browsing.IP = service.ClientIP(request)
+	data.UserAgent = request.UserAgent()
+	data.Browsing.Platform, data.Browsing.Browser, data.Browsing.DeviceType = service.ParseUserAgent(request.UserAgent())
+	data.Browsing.Region = service.Region(data.Browsing.IP)
+}
+
+// pixelGIF 1x1 透明 gif
+var pixelGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// Pixel 通过 <img> 获取页面流量信息,用于无js页面、AMP页面和邮件打开统计
+// 参数: url 网址(必填)、k 站点key、dm 域名、uid 用户id、sr 屏幕分辨率、title 标题、ref 来源、t 类型
+// t=event 时为自定义事件: ec 类别、ea 动作、el 标签、ev 值
+func Pixel(writer http.ResponseWriter, request *http.Request) {
+	// 无论是否统计成功都返回图片,且禁止缓存
+	writer.Header().Set("Content-Type", "image/gif")
+	writer.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, private")
+	writer.Header().Set("Pragma", "no-cache")
+	writer.Header().Set("Expires", "0")
+	writer.Write(pixelGIF)
+	data, err := getPixelParams(request)
+	if err != nil {
+		service.Log(err)
+		return
+	}
+	if err := service.CheckSiteKey(data.Browsing.Domain, data.SiteKey, request); err != nil {
+		return
+	}
+	enrichWebData(request, data)
+	// 图片已经返回,队列已满时不统计
+	if err := connmgr.CM.NewWebData(data); err != nil && err != connmgr.ErrOverloaded {
+		service.Log(err)
+	}
+}
+func getPixelParams(request *http.Request) (*connmgr.WebData, error) {
+	request.ParseForm()
+	var data connmgr.WebData
+	u, err := url.Parse(request.Form.Get("url"))
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Hostname()) == 0 {
+		return nil, errors.New("pixel 参数 url 必须是完整的http(s)地址")
+	}
+	data.Pageinfo.URL = u.String()
+	data.Pageinfo.Title = request.Form.Get("title")
+	data.Browsing.Domain = request.Form.Get("dm")
+	if len(data.Browsing.Domain) == 0 {
+		data.Browsing.Domain = u.Hostname()
+	}
+	data.Browsing.UID = request.Form.Get("uid")
+	if len(data.Browsing.UID) == 0 {
+		// 同域名下的页面可以读取统计脚本生成的cookie
+		if c, err := request.Cookie("_tj_uid"); err == nil {
+			data.Browsing.UID = c.Value
+		}
+	}
+	data.Browsing.SR = request.Form.Get("sr")
+	data.Referrer = request.Form.Get("ref")
+	data.SiteKey = request.Form.Get("k")
+	data.Type = request.Form.Get("t")
+	if len(data.Type) == 0 {
+		data.Type = connmgr.HitPageview
+	}
+	if data.Type == connmgr.HitEvent {
+		data.Event.Category = request.Form.Get("ec")
+		data.Event.Action = request.Form.Get("ea")
+		data.Event.Label = request.Form.Get("el")
+		data.Event.Value, _ = strconv.ParseInt(request.Form.Get("ev"), 10, 64)
+	}
+	return &data, nil
 }
 
 // CloseWeb 关闭页面
@@ -29,10 +127,18 @@ func CloseWeb(writer http.ResponseWriter, request *http.Request) {
 	if err != nil {
 		fmt.Fprintln(writer, err)
 	}
+	if err := service.CheckSiteKey(data.Domain, data.SiteKey, request); err != nil {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
 	data.Date = util.GetDateAsDefaultStr()
+	data.IP = service.ClientIP(request)
+	data.UserAgent = request.UserAgent()
 	// s, _ := util.ToJSONStr(data)
 	// fmt.Println("closeweb:", s)
-	connmgr.CM.CloseWeb(&data)
+	if err := connmgr.CM.CloseWeb(&data); err != nil {
+		unavailable(writer, err)
+	}
 }
 
 // GetRealtimeData 获取实时数据
@@ -45,8 +151,6 @@ func GetRealtimeData(writer http.ResponseWriter, request *http.Request) {
 	if len(request.Form["startDate"]) > 0 {
 		data.StartDate = request.Form["startDate"][0]
 	}
-	// 身份验证
-	service.CheckIdentity()
 	// 获取域名
 	result, err := service.GetRealtimeData(&data)
 	if err != nil {
@@ -55,19 +159,42 @@ func GetRealtimeData(writer http.ResponseWriter, request *http.Request) {
 	fmt.Fprintln(writer, result)
 }
 
-// GetTopContent 获取url流量排名
+// GetTopContent 获取url流量排名,可通过 sort 参数指定排序字段
 func GetTopContent(writer http.ResponseWriter, request *http.Request) {
 	request.ParseForm()
+	topContent(writer, request, request.Form.Get("sort"))
+}
+
+// GetTopEntries 获取入口页排名
+func GetTopEntries(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	topContent(writer, request, "Entries")
+}
+
+// GetTopExits 获取退出页排名
+func GetTopExits(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	topContent(writer, request, "Exits")
+}
+func topContent(writer http.ResponseWriter, request *http.Request, sort string) {
 	req := getParams(request)
+	req.Sort = sort
 	if len(req.Domain) == 0 || len(req.StartDate) == 0 || len(req.EndDate) == 0 {
 		fmt.Fprintln(writer, errors.New("domain 、 startDate、endDate 不能为空"))
 		return
 	}
-	// 身份验证
-	service.CheckIdentity()
 	// 判断是否是当天
 	req.StartDate = req.StartDate[0:10]
 	req.EndDate = req.EndDate[0:10]
+	if len(req.Granularity) > 0 && req.Granularity != "day" {
+		result, err := service.GetTopContentRollup(req)
+		if err != nil {
+			fmt.Fprintln(writer, err)
+			return
+		}
+		fmt.Fprintln(writer, result)
+		return
+	}
 	if req.StartDate == req.EndDate && req.StartDate == time.Now().Format("2006-01-02") {
 		result, err := service.GetTopContentFromRedis(req)
 		if err != nil {
@@ -82,6 +209,68 @@ func GetTopContent(writer http.ResponseWriter, request *http.Request) {
 		fmt.Fprintln(writer, result)
 	}
 }
+
+// GetSources 获取流量来源,可通过 type 参数筛选来源类型
+func GetSources(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	req := service.SourceReq{RealtimeDataReq: *getParams(request)}
+	if len(request.Form["type"]) > 0 {
+		req.Type = request.Form["type"][0]
+	}
+	result, err := service.GetSources(&req)
+	if err != nil {
+		fmt.Fprintln(writer, err)
+		return
+	}
+	fmt.Fprintln(writer, result)
+}
+
+// GetEvents 获取按类别、动作分组的自定义事件
+// 可选参数: category、action、url 筛选,group 额外分组字段(label、url,逗号分隔)
+func GetEvents(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	req := service.EventReq{RealtimeDataReq: *getParams(request)}
+	req.Category = request.Form.Get("category")
+	req.Action = request.Form.Get("action")
+	req.URL = request.Form.Get("url")
+	if g := request.Form.Get("group"); len(g) > 0 {
+		req.Group = strings.Split(g, ",")
+	}
+	result, err := service.GetEvents(&req)
+	if err != nil {
+		fmt.Fprintln(writer, err)
+		return
+	}
+	fmt.Fprintln(writer, result)
+}
+
+// GetTrend 获取每小时或每天的流量趋势
+// 参数: domain、startDate、endDate,可选 interval(hour默认、day)、url
+func GetTrend(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	req := service.TrendReq{RealtimeDataReq: *getParams(request)}
+	req.URL = request.Form.Get("url")
+	req.Interval = request.Form.Get("interval")
+	result, err := service.GetTrend(&req)
+	if err != nil {
+		fmt.Fprintln(writer, err)
+		return
+	}
+	fmt.Fprintln(writer, result)
+}
+
+// GetSessions 按开始时间倒序获取域名已结束的会话,可通过 uid 参数查询单个用户
+func GetSessions(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	req := service.SessionReq{RealtimeDataReq: *getParams(request)}
+	req.UID = request.Form.Get("uid")
+	result, err := service.GetSessions(&req)
+	if err != nil {
+		fmt.Fprintln(writer, err)
+		return
+	}
+	fmt.Fprintln(writer, result)
+}
 func getParams(request *http.Request) *service.RealtimeDataReq {
 	var data service.RealtimeDataReq
 	if len(request.Form["domain"]) > 0 {
@@ -93,5 +282,12 @@ func getParams(request *http.Request) *service.RealtimeDataReq {
 	if len(request.Form["endDate"]) > 0 {
 		data.EndDate = request.Form["endDate"][0]
 	}
+	data.Prefix = request.Form.Get("prefix")
+	data.Granularity = request.Form.Get("granularity")
+	data.Limit, _ = strconv.Atoi(request.Form.Get("limit"))
+	data.Offset, _ = strconv.Atoi(request.Form.Get("offset"))
+	if data.Offset < 0 {
+		data.Offset = 0
+	}
 	return &data
 }
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tongjiJSVersion 统计脚本版本号,修改脚本内容时必须同步修改
+const tongjiJSVersion = "1.3.0"
+
+// tongjiJS 前端统计脚本(已压缩)
+// 0、从 script 标签的 data-key 属性读取站点key,随每个请求发送
+// 1、生成并保存用户id到cookie(_tj_uid),有效期两年
+// 2、从 meta 标签读取页面信息,连同来源页面(document.referrer)发送到 /api/v1/tongji/webdata,格式与 connmgr.WebData 一致
+// 3、页面隐藏(pagehide)时通过 navigator.sendBeacon 发送浏览时长到 /api/v1/tongji/close,格式与 connmgr.Duration 一致
+// 4、tongji.event(category, action, label, value) 发送自定义事件(t:"event"),加载前可先压入队列 tongji=[["event",...]];
+// 点击带有 data-tj-category 属性的元素或提交带有该属性的表单时自动发送事件,
+// 动作和标签分别读取 data-tj-action(默认 click/submit)、data-tj-label,值读取 data-tj-value
+const tongjiJS = `/*! tongji.js v` + tongjiJSVersion + ` */
+(function(w,d,n){if(w.__tongji)return;w.__tongji="` + tongjiJSVersion + `";` +
+	`var s=d.currentScript||function(){var a=d.getElementsByTagName("script");return a[a.length-1]}(),` +
+	`base=s.src.split("/api/v1/tongji/")[0],key=s.getAttribute("data-key")||"",ua=n.userAgent,ck="_tj_uid";` +
+	`function uid(){var m=d.cookie.match(new RegExp("(?:^|; )"+ck+"=([^;]*)"));if(m)return m[1];` +
+	`var u=(new Date).getTime().toString(36)+Math.random().toString(36).slice(2,10);` +
+	`d.cookie=ck+"="+u+"; path=/; max-age=63072000; SameSite=Lax";return u}` +
+	`function meta(k){var e=d.querySelector('meta[name="'+k+'"]');return e&&e.getAttribute("content")||""}` +
+	`function num(k){return parseInt(meta(k),10)||0}` +
+	`function pick(a){for(var i=0;i<a.length;i+=2)if(new RegExp(a[i]).test(ua))return a[i+1];return"Other"}` +
+	`function send(p,o){o.k=key;var b=JSON.stringify(o);if(n.sendBeacon&&n.sendBeacon(base+p,b))return;` +
+	`var x=new XMLHttpRequest;x.open("POST",base+p,!0);x.setRequestHeader("Content-Type","text/plain;charset=UTF-8");x.send(b)}` +
+	`var dm=location.hostname,url=location.href.split("#")[0],id=uid(),st=(new Date).getTime(),sent=0,` +
+	`bi={uid:id,domain:dm,sr:screen.width+"x"+screen.height,` +
+	`platform:pick(["Windows","Windows","Android","Android","iPhone|iPad|iPod","iOS","Mac OS X","Mac OS","Linux","Linux"]),` +
+	`browser:pick(["MicroMessenger","WeChat","Edg","Edge","OPR|Opera","Opera","QQBrowser","QQBrowser","UCBrowser","UC",` +
+	`"Firefox","Firefox","Chrome","Chrome","Safari","Safari","MSIE|Trident","IE"]),` +
+	`devicetype:/Mobi|Android|iPhone|iPad|iPod/i.test(ua)?1:0};` +
+	`send("/api/v1/tongji/webdata",{t:"pageview",r:d.referrer,` +
+	`p:{dm:dm,url:url,title:d.title,keywords:meta("keywords"),description:meta("description"),author:meta("author"),` +
+	`source:meta("source"),catalogs:meta("catalogs"),contentid:meta("contentid"),publishdate:meta("publishdate"),` +
+	`filetype:num("filetype"),publishedtype:num("publishedtype"),pagetype:num("pagetype")},b:bi});` +
+	`function ev(c,a,l,v){if(!c||!a)return;send("/api/v1/tongji/webdata",{t:"event",` +
+	`p:{dm:dm,url:url,title:d.title},b:bi,e:{category:""+c,action:""+a,label:l?""+l:"",value:parseInt(v,10)||0}})}` +
+	`function attr(t,k){return t.getAttribute("data-tj-"+k)}` +
+	`var q=w.tongji;w.tongji={event:ev};if(q&&q.length)for(var i=0;i<q.length;i++)if(q[i][0]=="event")ev(q[i][1],q[i][2],q[i][3],q[i][4]);` +
+	`d.addEventListener("click",function(e){for(var t=e.target;t&&t.getAttribute;t=t.parentNode)` +
+	`if(t.tagName!="FORM"&&attr(t,"category")){ev(attr(t,"category"),attr(t,"action")||"click",attr(t,"label"),attr(t,"value"));return}},!0);` +
+	`d.addEventListener("submit",function(e){var t=e.target;if(t.getAttribute&&attr(t,"category"))` +
+	`ev(attr(t,"category"),attr(t,"action")||"submit",attr(t,"label"),attr(t,"value"))},!0);` +
+	`w.addEventListener("pagehide",function(){if(sent)return;sent=1;` +
+	`send("/api/v1/tongji/close",{domain:dm,uid:id,url:url,duration:Math.round(((new Date).getTime()-st)/1e3)})})` +
+	`})(window,document,navigator);
+`
+
+// TongjiJS 输出前端统计脚本
+// 带版本号(?v=<version>)的地址可长期缓存,不带版本号的地址缓存1小时
+func TongjiJS(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	writer.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	writer.Header().Set("ETag", `"tongji-`+tongjiJSVersion+`"`)
+	if request.Form.Get("v") == tongjiJSVersion {
+		writer.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		writer.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	http.ServeContent(writer, request, "tongji.js", time.Time{}, strings.NewReader(tongjiJS))
+}
@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/codepository/GoWebAnalytics/service"
+	"github.com/mumushuiding/util"
+)
+
+// User 用户管理,只有超级管理员可以访问
+// GET 查询所有用户、POST 创建用户并返回token、PUT 修改用户、DELETE 删除用户(参数id)
+func User(writer http.ResponseWriter, request *http.Request) {
+	var result string
+	var err error
+	switch request.Method {
+	case http.MethodGet:
+		result, err = service.GetUsers()
+	case http.MethodPost, http.MethodPut:
+		var req service.UserReq
+		if err = util.Body2Struct(request, &req); err != nil {
+			break
+		}
+		if request.Method == http.MethodPost {
+			result, err = service.AddUser(&req)
+		} else {
+			result, err = service.UpdateUser(&req)
+		}
+	case http.MethodDelete:
+		request.ParseForm()
+		var id int
+		if id, err = strconv.Atoi(request.Form.Get("id")); err != nil {
+			break
+		}
+		err = service.DelUser(id)
+		result = "ok"
+	case http.MethodOptions:
+		return
+	default:
+		http.Error(writer, "不支持的请求方法", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(writer, result)
+}
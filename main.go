@@ -16,6 +16,7 @@ import (
 
 	"github.com/codepository/GoWebAnalytics/config"
 	"github.com/codepository/GoWebAnalytics/model"
+	"github.com/codepository/GoWebAnalytics/service"
 )
 
 var conf = *config.Config
@@ -29,15 +30,34 @@ func waMain() error {
 		model.GetDB().Close()
 	}()
 	// 启动redis连接
-	model.SetRedis()
+	if err := model.SetRedis(); err != nil {
+		return err
+	}
 	defer func() {
 		log.Println("关闭redis连接")
-		if model.RedisOpen {
-			model.RedisCli.Close()
-		}
+		model.RedisCli.Close()
 	}()
-	// 连接管理器
-	connmgr.New()
+	// 打开ip数据库
+	service.OpenIPDB()
+	defer service.CloseIPDB()
+	// 加载爬虫规则,收到 SIGHUP 时重新加载
+	if err := service.LoadBotRules(); err != nil {
+		return err
+	}
+	reloadListener()
+	// 今日去重方式
+	if err := service.SetupDeduper(); err != nil {
+		return err
+	}
+	// 原始访问纪录写入 ClickHouse
+	if err := service.SetupClickHouse(); err != nil {
+		return err
+	}
+	// 连接管理器,重放预写日志
+	if err := connmgr.New(); err != nil {
+		return err
+	}
+	// http 服务关闭后等待请求处理完成并将缓存保存到redis,在关闭redis和数据库之前执行
 	defer func() {
 		log.Println("优雅的关闭连接管理器")
 		connmgr.CM.Stop()
@@ -67,7 +87,8 @@ func waMain() error {
 	} else {
 		err = server.ListenAndServe()
 	}
-	if err != nil {
+	// 关闭时 ListenAndServe 立即返回 ErrServerClosed,需要等待正在处理的请求完成
+	if err != nil && err != http.ErrServerClosed {
 		log.Printf("Server err: %v", err)
 		return err
 	}
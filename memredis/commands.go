@@ -0,0 +1,1177 @@
+package memredis
+
+import (
+	"math"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	errWrongType = "WRONGTYPE Operation against a key holding the wrong kind of value"
+	errNotInt    = "ERR value is not an integer or out of range"
+	errNotFloat  = "ERR value is not a valid float"
+	errSyntax    = "ERR syntax error"
+)
+
+// hllMagic GET HyperLogLog 时返回的值的前缀,SET 该值可以还原,元素以\n分隔
+const hllMagic = "MEMHLL\n"
+
+// maxBitOffset SETBIT 最大的位置,与 redis 一致为512MB
+const maxBitOffset = 1<<32 - 1
+
+// command 一个命令,arity 为最少参数个数(不含命令名)
+type command struct {
+	arity int
+	fn    func(s *Server, w *resp, args []string)
+}
+
+// commands 支持的命令
+var commands = map[string]*command{
+	"ping":          {0, cmdPing},
+	"echo":          {1, func(s *Server, w *resp, args []string) { w.bulk(args[0]) }},
+	"select":        {1, func(s *Server, w *resp, args []string) { w.ok() }},
+	"dbsize":        {0, func(s *Server, w *resp, args []string) { w.int(int64(len(s.keys("*")))) }},
+	"flushdb":       {0, cmdFlush},
+	"flushall":      {0, cmdFlush},
+	"info":          {0, cmdInfo},
+	"del":           {1, cmdDel},
+	"unlink":        {1, cmdDel},
+	"exists":        {1, cmdExists},
+	"type":          {1, cmdType},
+	"keys":          {1, func(s *Server, w *resp, args []string) { w.strings(s.keys(args[0])) }},
+	"scan":          {1, cmdScan},
+	"expire":        {2, cmdExpire(time.Second, false)},
+	"pexpire":       {2, cmdExpire(time.Millisecond, false)},
+	"expireat":      {2, cmdExpire(time.Second, true)},
+	"pexpireat":     {2, cmdExpire(time.Millisecond, true)},
+	"persist":       {1, cmdPersist},
+	"ttl":           {1, cmdTTL(time.Second)},
+	"pttl":          {1, cmdTTL(time.Millisecond)},
+	"get":           {1, cmdGet},
+	"set":           {2, cmdSet},
+	"incr":          {1, func(s *Server, w *resp, args []string) { s.incrBy(w, args[0], 1) }},
+	"decr":          {1, func(s *Server, w *resp, args []string) { s.incrBy(w, args[0], -1) }},
+	"incrby":        {2, cmdIncrBy(1)},
+	"decrby":        {2, cmdIncrBy(-1)},
+	"setbit":        {3, cmdSetBit},
+	"getbit":        {2, cmdGetBit},
+	"hget":          {2, cmdHGet},
+	"hset":          {3, cmdHSet(false)},
+	"hmset":         {3, cmdHSet(true)},
+	"hsetnx":        {3, cmdHSetNX},
+	"hmget":         {2, cmdHMGet},
+	"hgetall":       {1, cmdHGetAll},
+	"hdel":          {2, cmdHDel},
+	"hexists":       {2, cmdHExists},
+	"hincrby":       {3, cmdHIncrBy},
+	"hlen":          {1, cmdHLen},
+	"hkeys":         {1, cmdHKeys},
+	"hscan":         {2, cmdHScan},
+	"sadd":          {2, cmdSAdd},
+	"srem":          {2, cmdSRem},
+	"sismember":     {2, cmdSIsMember},
+	"scard":         {1, cmdSCard},
+	"smembers":      {1, cmdSMembers},
+	"spop":          {1, cmdSPop},
+	"zadd":          {3, cmdZAdd},
+	"zrem":          {2, cmdZRem},
+	"zcard":         {1, cmdZCard},
+	"zscore":        {2, cmdZScore},
+	"zrangebyscore": {3, cmdZRangeByScore},
+	"pfadd":         {1, cmdPFAdd},
+	"pfcount":       {1, cmdPFCount},
+	"sort":          {1, cmdSort},
+}
+
+// get 获取指定类型的值,key不存在时返回nil,类型不一致时回复错误并返回 ok=false
+func (s *Server) get(w *resp, key string, kind int) (v *value, ok bool) {
+	v = s.lookup(key)
+	if v != nil && v.kind != kind {
+		w.err(errWrongType)
+		return nil, false
+	}
+	return v, true
+}
+
+// getOrCreate 获取指定类型的值,不存在时创建
+func (s *Server) getOrCreate(w *resp, key string, kind int) (*value, bool) {
+	v, ok := s.get(w, key, kind)
+	if !ok || v != nil {
+		return v, ok
+	}
+	v = &value{kind: kind}
+	switch kind {
+	case kindHash:
+		v.hash = make(map[string]string)
+	case kindSet, kindHLL:
+		v.set = make(map[string]struct{})
+	case kindZSet:
+		v.zset = make(map[string]float64)
+	}
+	s.data[key] = v
+	return v, true
+}
+
+// removeIfEmpty 集合类型没有元素时删除key
+func (s *Server) removeIfEmpty(key string, v *value) {
+	if len(v.hash) == 0 && len(v.set) == 0 && len(v.zset) == 0 && v.kind != kindString && v.kind != kindHLL {
+		delete(s.data, key)
+	}
+}
+
+// keys 匹配的所有未过期的key,按字母顺序
+func (s *Server) keys(pattern string) []string {
+	re := globRegexp(pattern)
+	var keys []string
+	for key := range s.data {
+		if s.lookup(key) != nil && re.MatchString(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// globRegexp 将 redis 的 glob 模式转换为正则
+func globRegexp(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString("(?s:.*)")
+		case '?':
+			b.WriteString("(?s:.)")
+		case '[':
+			j := strings.IndexByte(pattern[i:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+j]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + regexp.QuoteMeta(class[1:])
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			b.WriteString("[" + strings.Replace(class, `\-`, "-", -1) + "]")
+			i += j
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return regexp.MustCompile("^" + regexp.QuoteMeta(pattern) + "$")
+	}
+	return re
+}
+
+func cmdPing(s *Server, w *resp, args []string) {
+	if len(args) > 0 {
+		w.bulk(args[0])
+		return
+	}
+	w.status("PONG")
+}
+
+func cmdFlush(s *Server, w *resp, args []string) {
+	for key := range s.data {
+		s.touch(key)
+	}
+	s.data = make(map[string]*value)
+	w.ok()
+}
+
+func cmdInfo(s *Server, w *resp, args []string) {
+	w.bulk("# Server\r\nredis_version:memredis\r\n# Keyspace\r\ndb0:keys=" + strconv.Itoa(len(s.data)) + "\r\n")
+}
+
+func cmdDel(s *Server, w *resp, args []string) {
+	var n int64
+	for _, key := range args {
+		if s.lookup(key) != nil {
+			delete(s.data, key)
+			s.touch(key)
+			n++
+		}
+	}
+	w.int(n)
+}
+
+func cmdExists(s *Server, w *resp, args []string) {
+	var n int64
+	for _, key := range args {
+		if s.lookup(key) != nil {
+			n++
+		}
+	}
+	w.int(n)
+}
+
+func cmdType(s *Server, w *resp, args []string) {
+	v := s.lookup(args[0])
+	if v == nil {
+		w.status("none")
+		return
+	}
+	w.status([]string{"string", "hash", "set", "zset", "string"}[v.kind])
+}
+
+// cmdScan 一次返回所有匹配的key
+func cmdScan(s *Server, w *resp, args []string) {
+	pattern := "*"
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.EqualFold(args[i], "match") {
+			pattern = args[i+1]
+		}
+	}
+	w.array(2)
+	w.bulk("0")
+	w.strings(s.keys(pattern))
+}
+
+func cmdExpire(unit time.Duration, at bool) func(s *Server, w *resp, args []string) {
+	return func(s *Server, w *resp, args []string) {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.err(errNotInt)
+			return
+		}
+		v := s.lookup(args[0])
+		if v == nil {
+			w.int(0)
+			return
+		}
+		if at {
+			v.expireAt = time.Unix(0, 0).Add(time.Duration(n) * unit)
+		} else {
+			v.expireAt = s.now().Add(time.Duration(n) * unit)
+		}
+		s.touch(args[0])
+		// 过去的时间立即删除
+		s.lookup(args[0])
+		w.int(1)
+	}
+}
+
+func cmdPersist(s *Server, w *resp, args []string) {
+	v := s.lookup(args[0])
+	if v == nil || v.expireAt.IsZero() {
+		w.int(0)
+		return
+	}
+	v.expireAt = time.Time{}
+	s.touch(args[0])
+	w.int(1)
+}
+
+func cmdTTL(unit time.Duration) func(s *Server, w *resp, args []string) {
+	return func(s *Server, w *resp, args []string) {
+		v := s.lookup(args[0])
+		switch {
+		case v == nil:
+			w.int(-2)
+		case v.expireAt.IsZero():
+			w.int(-1)
+		default:
+			w.int(int64((v.expireAt.Sub(s.now()) + unit - 1) / unit))
+		}
+	}
+}
+
+func cmdGet(s *Server, w *resp, args []string) {
+	v := s.lookup(args[0])
+	switch {
+	case v == nil:
+		w.null()
+	case v.kind == kindString:
+		w.bulk(string(v.str))
+	case v.kind == kindHLL:
+		w.bulk(hllMagic + strings.Join(members(v.set), "\n"))
+	default:
+		w.err(errWrongType)
+	}
+}
+
+// cmdSet 支持 EX、PX、NX、XX、KEEPTTL
+func cmdSet(s *Server, w *resp, args []string) {
+	key, val := args[0], args[1]
+	var expireAt time.Time
+	var nx, xx, keepTTL bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "keepttl":
+			keepTTL = true
+		case "ex", "px":
+			if i+1 >= len(args) {
+				w.err(errSyntax)
+				return
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				w.err("ERR invalid expire time in set")
+				return
+			}
+			unit := time.Second
+			if opt == "px" {
+				unit = time.Millisecond
+			}
+			expireAt = s.now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			w.err(errSyntax)
+			return
+		}
+	}
+	old := s.lookup(key)
+	if (nx && old != nil) || (xx && old == nil) {
+		w.null()
+		return
+	}
+	if keepTTL && old != nil {
+		expireAt = old.expireAt
+	}
+	v := &value{kind: kindString, str: []byte(val), expireAt: expireAt}
+	if strings.HasPrefix(val, hllMagic) {
+		v = &value{kind: kindHLL, set: make(map[string]struct{}), expireAt: expireAt}
+		for _, m := range strings.Split(val[len(hllMagic):], "\n") {
+			if len(m) > 0 {
+				v.set[m] = struct{}{}
+			}
+		}
+	}
+	s.data[key] = v
+	s.touch(key)
+	w.ok()
+}
+
+func cmdIncrBy(sign int64) func(s *Server, w *resp, args []string) {
+	return func(s *Server, w *resp, args []string) {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.err(errNotInt)
+			return
+		}
+		s.incrBy(w, args[0], sign*n)
+	}
+}
+
+func (s *Server) incrBy(w *resp, key string, incr int64) {
+	v, ok := s.getOrCreate(w, key, kindString)
+	if !ok {
+		return
+	}
+	n := int64(0)
+	if len(v.str) > 0 {
+		var err error
+		if n, err = strconv.ParseInt(string(v.str), 10, 64); err != nil {
+			w.err(errNotInt)
+			return
+		}
+	}
+	n += incr
+	v.str = []byte(strconv.FormatInt(n, 10))
+	s.touch(key)
+	w.int(n)
+}
+
+func parseBitOffset(w *resp, arg string) (int64, bool) {
+	off, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || off < 0 || off > maxBitOffset {
+		w.err("ERR bit offset is not an integer or out of range")
+		return 0, false
+	}
+	return off, true
+}
+
+func cmdSetBit(s *Server, w *resp, args []string) {
+	off, ok := parseBitOffset(w, args[1])
+	if !ok {
+		return
+	}
+	if args[2] != "0" && args[2] != "1" {
+		w.err("ERR bit is not an integer or out of range")
+		return
+	}
+	v, ok := s.getOrCreate(w, args[0], kindString)
+	if !ok {
+		return
+	}
+	i := int(off / 8)
+	if i >= len(v.str) {
+		v.str = append(v.str, make([]byte, i+1-len(v.str))...)
+	}
+	mask := byte(1) << uint(7-off%8)
+	old := int64(0)
+	if v.str[i]&mask != 0 {
+		old = 1
+	}
+	if args[2] == "1" {
+		v.str[i] |= mask
+	} else {
+		v.str[i] &^= mask
+	}
+	s.touch(args[0])
+	w.int(old)
+}
+
+func cmdGetBit(s *Server, w *resp, args []string) {
+	off, ok := parseBitOffset(w, args[1])
+	if !ok {
+		return
+	}
+	v, ok := s.get(w, args[0], kindString)
+	if !ok {
+		return
+	}
+	if v == nil || int(off/8) >= len(v.str) || v.str[off/8]&(byte(1)<<uint(7-off%8)) == 0 {
+		w.int(0)
+		return
+	}
+	w.int(1)
+}
+
+func cmdHGet(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindHash)
+	if !ok {
+		return
+	}
+	if v == nil {
+		w.null()
+		return
+	}
+	val, exists := v.hash[args[1]]
+	if !exists {
+		w.null()
+		return
+	}
+	w.bulk(val)
+}
+
+func cmdHSet(ok bool) func(s *Server, w *resp, args []string) {
+	return func(s *Server, w *resp, args []string) {
+		if len(args)%2 != 1 {
+			w.err("ERR wrong number of arguments for HMSET")
+			return
+		}
+		v, valid := s.getOrCreate(w, args[0], kindHash)
+		if !valid {
+			return
+		}
+		var n int64
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, exists := v.hash[args[i]]; !exists {
+				n++
+			}
+			v.hash[args[i]] = args[i+1]
+		}
+		s.touch(args[0])
+		if ok {
+			w.ok()
+			return
+		}
+		w.int(n)
+	}
+}
+
+func cmdHSetNX(s *Server, w *resp, args []string) {
+	v, ok := s.getOrCreate(w, args[0], kindHash)
+	if !ok {
+		return
+	}
+	if _, exists := v.hash[args[1]]; exists {
+		w.int(0)
+		return
+	}
+	v.hash[args[1]] = args[2]
+	s.touch(args[0])
+	w.int(1)
+}
+
+func cmdHMGet(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindHash)
+	if !ok {
+		return
+	}
+	w.array(len(args) - 1)
+	for _, f := range args[1:] {
+		if v == nil {
+			w.null()
+			continue
+		}
+		if val, exists := v.hash[f]; exists {
+			w.bulk(val)
+		} else {
+			w.null()
+		}
+	}
+}
+
+func cmdHGetAll(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindHash)
+	if !ok {
+		return
+	}
+	if v == nil {
+		w.array(0)
+		return
+	}
+	fields := make([]string, 0, len(v.hash))
+	for f := range v.hash {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	w.array(len(fields) * 2)
+	for _, f := range fields {
+		w.bulk(f)
+		w.bulk(v.hash[f])
+	}
+}
+
+func cmdHDel(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindHash)
+	if !ok {
+		return
+	}
+	var n int64
+	if v != nil {
+		for _, f := range args[1:] {
+			if _, exists := v.hash[f]; exists {
+				delete(v.hash, f)
+				n++
+			}
+		}
+		if n > 0 {
+			s.touch(args[0])
+			s.removeIfEmpty(args[0], v)
+		}
+	}
+	w.int(n)
+}
+
+func cmdHExists(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindHash)
+	if !ok {
+		return
+	}
+	if v == nil {
+		w.int(0)
+		return
+	}
+	if _, exists := v.hash[args[1]]; exists {
+		w.int(1)
+		return
+	}
+	w.int(0)
+}
+
+func cmdHIncrBy(s *Server, w *resp, args []string) {
+	incr, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		w.err(errNotInt)
+		return
+	}
+	v, ok := s.getOrCreate(w, args[0], kindHash)
+	if !ok {
+		return
+	}
+	n := int64(0)
+	if old, exists := v.hash[args[1]]; exists {
+		if n, err = strconv.ParseInt(old, 10, 64); err != nil {
+			w.err("ERR hash value is not an integer")
+			return
+		}
+	}
+	n += incr
+	v.hash[args[1]] = strconv.FormatInt(n, 10)
+	s.touch(args[0])
+	w.int(n)
+}
+
+func cmdHLen(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindHash)
+	if !ok {
+		return
+	}
+	if v == nil {
+		w.int(0)
+		return
+	}
+	w.int(int64(len(v.hash)))
+}
+
+func cmdHKeys(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindHash)
+	if !ok {
+		return
+	}
+	var fields []string
+	if v != nil {
+		for f := range v.hash {
+			fields = append(fields, f)
+		}
+	}
+	sort.Strings(fields)
+	w.strings(fields)
+}
+
+// cmdHScan 一次返回所有匹配的字段
+func cmdHScan(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindHash)
+	if !ok {
+		return
+	}
+	pattern := "*"
+	for i := 2; i+1 < len(args); i += 2 {
+		if strings.EqualFold(args[i], "match") {
+			pattern = args[i+1]
+		}
+	}
+	re := globRegexp(pattern)
+	var list []string
+	if v != nil {
+		var fields []string
+		for f := range v.hash {
+			if re.MatchString(f) {
+				fields = append(fields, f)
+			}
+		}
+		sort.Strings(fields)
+		for _, f := range fields {
+			list = append(list, f, v.hash[f])
+		}
+	}
+	w.array(2)
+	w.bulk("0")
+	w.strings(list)
+}
+
+func cmdSAdd(s *Server, w *resp, args []string) {
+	v, ok := s.getOrCreate(w, args[0], kindSet)
+	if !ok {
+		return
+	}
+	var n int64
+	for _, m := range args[1:] {
+		if _, exists := v.set[m]; !exists {
+			v.set[m] = struct{}{}
+			n++
+		}
+	}
+	s.touch(args[0])
+	w.int(n)
+}
+
+func cmdSRem(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindSet)
+	if !ok {
+		return
+	}
+	var n int64
+	if v != nil {
+		for _, m := range args[1:] {
+			if _, exists := v.set[m]; exists {
+				delete(v.set, m)
+				n++
+			}
+		}
+		if n > 0 {
+			s.touch(args[0])
+			s.removeIfEmpty(args[0], v)
+		}
+	}
+	w.int(n)
+}
+
+func cmdSIsMember(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindSet)
+	if !ok {
+		return
+	}
+	if v != nil {
+		if _, exists := v.set[args[1]]; exists {
+			w.int(1)
+			return
+		}
+	}
+	w.int(0)
+}
+
+func cmdSCard(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindSet)
+	if !ok {
+		return
+	}
+	if v == nil {
+		w.int(0)
+		return
+	}
+	w.int(int64(len(v.set)))
+}
+
+func cmdSMembers(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindSet)
+	if !ok {
+		return
+	}
+	if v == nil {
+		w.array(0)
+		return
+	}
+	w.strings(members(v.set))
+}
+
+// cmdSPop 随机移除元素,没有 count 时返回一个元素
+func cmdSPop(s *Server, w *resp, args []string) {
+	count := int64(1)
+	if len(args) > 1 {
+		var err error
+		if count, err = strconv.ParseInt(args[1], 10, 64); err != nil || count < 0 {
+			w.err(errNotInt)
+			return
+		}
+	}
+	v, ok := s.get(w, args[0], kindSet)
+	if !ok {
+		return
+	}
+	var popped []string
+	if v != nil {
+		for m := range v.set {
+			if int64(len(popped)) >= count {
+				break
+			}
+			popped = append(popped, m)
+			delete(v.set, m)
+		}
+		if len(popped) > 0 {
+			s.touch(args[0])
+			s.removeIfEmpty(args[0], v)
+		}
+	}
+	if len(args) > 1 {
+		w.strings(popped)
+		return
+	}
+	if len(popped) == 0 {
+		w.null()
+		return
+	}
+	w.bulk(popped[0])
+}
+
+// cmdZAdd 不支持 NX、XX、CH、INCR 选项
+func cmdZAdd(s *Server, w *resp, args []string) {
+	// 只支持 NX、XX 选项
+	key, nx, xx := args[0], false, false
+	for args = args[1:]; len(args) > 0; args = args[1:] {
+		if opt := strings.ToLower(args[0]); opt == "nx" {
+			nx = true
+		} else if opt == "xx" {
+			xx = true
+		} else {
+			break
+		}
+	}
+	args = append([]string{key}, args...)
+	if len(args)%2 != 1 || len(args) == 1 || nx && xx {
+		w.err(errSyntax)
+		return
+	}
+	scores := make([]float64, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		score, err := parseScore(args[i])
+		if err != nil {
+			w.err(errNotFloat)
+			return
+		}
+		scores = append(scores, score)
+	}
+	v, ok := s.getOrCreate(w, args[0], kindZSet)
+	if !ok {
+		return
+	}
+	var n int64
+	for i, score := range scores {
+		m := args[2+i*2]
+		_, exists := v.zset[m]
+		if exists && nx || !exists && xx {
+			continue
+		}
+		if !exists {
+			n++
+		}
+		v.zset[m] = score
+	}
+	s.removeIfEmpty(args[0], v)
+	s.touch(args[0])
+	w.int(n)
+}
+
+func parseScore(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func cmdZRem(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindZSet)
+	if !ok {
+		return
+	}
+	var n int64
+	if v != nil {
+		for _, m := range args[1:] {
+			if _, exists := v.zset[m]; exists {
+				delete(v.zset, m)
+				n++
+			}
+		}
+		if n > 0 {
+			s.touch(args[0])
+			s.removeIfEmpty(args[0], v)
+		}
+	}
+	w.int(n)
+}
+
+func cmdZCard(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindZSet)
+	if !ok {
+		return
+	}
+	if v == nil {
+		w.int(0)
+		return
+	}
+	w.int(int64(len(v.zset)))
+}
+
+func cmdZScore(s *Server, w *resp, args []string) {
+	v, ok := s.get(w, args[0], kindZSet)
+	if !ok {
+		return
+	}
+	if v == nil {
+		w.null()
+		return
+	}
+	score, exists := v.zset[args[1]]
+	if !exists {
+		w.null()
+		return
+	}
+	w.bulk(strconv.FormatFloat(score, 'g', -1, 64))
+}
+
+// scoreBound ZRANGEBYSCORE 的范围,(开头为不包含
+type scoreBound struct {
+	val       float64
+	exclusive bool
+}
+
+func parseBound(s string) (scoreBound, error) {
+	b := scoreBound{}
+	if strings.HasPrefix(s, "(") {
+		b.exclusive = true
+		s = s[1:]
+	}
+	var err error
+	b.val, err = parseScore(s)
+	return b, err
+}
+
+func cmdZRangeByScore(s *Server, w *resp, args []string) {
+	min, err1 := parseBound(args[1])
+	max, err2 := parseBound(args[2])
+	if err1 != nil || err2 != nil {
+		w.err("ERR min or max is not a float")
+		return
+	}
+	withScores := false
+	offset, count := 0, -1
+	for i := 3; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "withscores":
+			withScores = true
+		case "limit":
+			if i+2 >= len(args) {
+				w.err(errSyntax)
+				return
+			}
+			o, err1 := strconv.Atoi(args[i+1])
+			c, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				w.err(errNotInt)
+				return
+			}
+			offset, count = o, c
+			i += 2
+		default:
+			w.err(errSyntax)
+			return
+		}
+	}
+	v, ok := s.get(w, args[0], kindZSet)
+	if !ok {
+		return
+	}
+	type item struct {
+		member string
+		score  float64
+	}
+	var items []item
+	if v != nil {
+		for m, score := range v.zset {
+			if score < min.val || (min.exclusive && score == min.val) || score > max.val || (max.exclusive && score == max.val) {
+				continue
+			}
+			items = append(items, item{m, score})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].score != items[j].score {
+			return items[i].score < items[j].score
+		}
+		return items[i].member < items[j].member
+	})
+	if offset < 0 || offset >= len(items) {
+		items = nil
+	} else {
+		items = items[offset:]
+	}
+	if count >= 0 && count < len(items) {
+		items = items[:count]
+	}
+	var list []string
+	for _, it := range items {
+		list = append(list, it.member)
+		if withScores {
+			list = append(list, strconv.FormatFloat(it.score, 'g', -1, 64))
+		}
+	}
+	w.strings(list)
+}
+
+// cmdPFAdd HyperLogLog 保存了全部元素,有新的元素或创建了key时返回1
+func cmdPFAdd(s *Server, w *resp, args []string) {
+	created := s.lookup(args[0]) == nil
+	v, ok := s.getOrCreate(w, args[0], kindHLL)
+	if !ok {
+		return
+	}
+	changed := created
+	for _, m := range args[1:] {
+		if _, exists := v.set[m]; !exists {
+			v.set[m] = struct{}{}
+			changed = true
+		}
+	}
+	if !changed {
+		w.int(0)
+		return
+	}
+	s.touch(args[0])
+	w.int(1)
+}
+
+// cmdPFCount 多个key时为合并后的基数
+func cmdPFCount(s *Server, w *resp, args []string) {
+	union := make(map[string]struct{})
+	for _, key := range args {
+		v, ok := s.get(w, key, kindHLL)
+		if !ok {
+			return
+		}
+		if v == nil {
+			continue
+		}
+		if len(args) == 1 {
+			w.int(int64(len(v.set)))
+			return
+		}
+		for m := range v.set {
+			union[m] = struct{}{}
+		}
+	}
+	w.int(int64(len(union)))
+}
+
+// cmdSort 支持 set、zset,以及 BY、LIMIT、GET、ASC、DESC、ALPHA,不支持 STORE
+func cmdSort(s *Server, w *resp, args []string) {
+	var by string
+	var gets []string
+	offset, count := 0, -1
+	desc, alpha := false, false
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "by":
+			if i+1 >= len(args) {
+				w.err(errSyntax)
+				return
+			}
+			by = args[i+1]
+			i++
+		case "limit":
+			if i+2 >= len(args) {
+				w.err(errSyntax)
+				return
+			}
+			o, err1 := strconv.Atoi(args[i+1])
+			c, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				w.err(errNotInt)
+				return
+			}
+			offset, count = o, c
+			i += 2
+		case "get":
+			if i+1 >= len(args) {
+				w.err(errSyntax)
+				return
+			}
+			gets = append(gets, args[i+1])
+			i++
+		case "asc":
+			desc = false
+		case "desc":
+			desc = true
+		case "alpha":
+			alpha = true
+		default:
+			w.err(errSyntax)
+			return
+		}
+	}
+	var elems []string
+	if v := s.lookup(args[0]); v != nil {
+		switch v.kind {
+		case kindSet:
+			elems = members(v.set)
+		case kindZSet:
+			for m := range v.zset {
+				elems = append(elems, m)
+			}
+			sort.Strings(elems)
+		default:
+			w.err(errWrongType)
+			return
+		}
+	}
+	// BY 不含*时不排序
+	if len(by) == 0 || strings.Contains(by, "*") {
+		weights := make(map[string]string, len(elems))
+		for _, e := range elems {
+			weights[e] = e
+			if len(by) > 0 {
+				weights[e], _ = s.lookupPattern(by, e)
+			}
+		}
+		nums := make(map[string]float64, len(elems))
+		if !alpha {
+			for _, e := range elems {
+				if len(weights[e]) == 0 {
+					continue
+				}
+				n, err := strconv.ParseFloat(weights[e], 64)
+				if err != nil {
+					w.err("ERR One or more scores can't be converted into double")
+					return
+				}
+				nums[e] = n
+			}
+		}
+		sort.SliceStable(elems, func(i, j int) bool {
+			a, b := elems[i], elems[j]
+			if desc {
+				a, b = b, a
+			}
+			if alpha {
+				if weights[a] != weights[b] {
+					return weights[a] < weights[b]
+				}
+			} else if nums[a] != nums[b] {
+				return nums[a] < nums[b]
+			}
+			return a < b
+		})
+	}
+	if offset < 0 || offset >= len(elems) {
+		elems = nil
+	} else {
+		elems = elems[offset:]
+	}
+	if count >= 0 && count < len(elems) {
+		elems = elems[:count]
+	}
+	if len(gets) == 0 {
+		w.strings(elems)
+		return
+	}
+	w.array(len(elems) * len(gets))
+	for _, e := range elems {
+		for _, g := range gets {
+			if g == "#" {
+				w.bulk(e)
+				continue
+			}
+			if val, ok := s.lookupPattern(g, e); ok {
+				w.bulk(val)
+			} else {
+				w.null()
+			}
+		}
+	}
+}
+
+// lookupPattern 将模式中的第一个*替换为元素后获取值,key->field 获取 hash 的字段
+func (s *Server) lookupPattern(pattern, elem string) (string, bool) {
+	key, field := strings.Replace(pattern, "*", elem, 1), ""
+	if i := strings.LastIndex(key, "->"); i > 0 {
+		key, field = key[:i], key[i+2:]
+	}
+	v := s.lookup(key)
+	if v == nil {
+		return "", false
+	}
+	if len(field) > 0 {
+		if v.kind != kindHash {
+			return "", false
+		}
+		val, ok := v.hash[field]
+		return val, ok
+	}
+	if v.kind != kindString {
+		return "", false
+	}
+	return string(v.str), true
+}
+
+// members 集合的所有元素,随机顺序与 redis 一致
+func members(set map[string]struct{}) []string {
+	list := make([]string, 0, len(set))
+	for m := range set {
+		list = append(list, m)
+	}
+	rand.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+	return list
+}
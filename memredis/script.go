@@ -0,0 +1,245 @@
+package memredis
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// 脚本中调用的命令在同一个锁中执行,与 redis 一样整个脚本是原子的
+func init() {
+	commands["eval"] = &command{2, cmdEval}
+	commands["evalsha"] = &command{2, cmdEvalSha}
+	commands["script"] = &command{1, cmdScript}
+}
+
+// statusReply 状态回复,如 OK
+type statusReply string
+
+// errorReply 错误回复
+type errorReply string
+
+func scriptSha(src string) string {
+	h := sha1.Sum([]byte(src))
+	return hex.EncodeToString(h[:])
+}
+
+func cmdEval(s *Server, w *resp, args []string) {
+	s.scripts[scriptSha(args[0])] = args[0]
+	s.runScript(w, args[0], args[1:])
+}
+
+func cmdEvalSha(s *Server, w *resp, args []string) {
+	src, ok := s.scripts[strings.ToLower(args[0])]
+	if !ok {
+		w.err("NOSCRIPT No matching script. Please use EVAL.")
+		return
+	}
+	s.runScript(w, src, args[1:])
+}
+
+func cmdScript(s *Server, w *resp, args []string) {
+	switch strings.ToLower(args[0]) {
+	case "load":
+		if len(args) != 2 {
+			w.err(errSyntax)
+			return
+		}
+		sha := scriptSha(args[1])
+		s.scripts[sha] = args[1]
+		w.bulk(sha)
+	case "exists":
+		w.array(len(args) - 1)
+		for _, sha := range args[1:] {
+			if _, ok := s.scripts[strings.ToLower(sha)]; ok {
+				w.int(1)
+			} else {
+				w.int(0)
+			}
+		}
+	case "flush":
+		s.scripts = make(map[string]string)
+		w.ok()
+	default:
+		w.err(errSyntax)
+	}
+}
+
+// runScript 执行脚本,args 为 numkeys、key 和参数
+func (s *Server) runScript(w *resp, src string, args []string) {
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		w.err(errNotInt)
+		return
+	}
+	if n > len(args)-1 {
+		w.err("ERR Number of keys can't be greater than number of args")
+		return
+	}
+	L := lua.NewState()
+	defer L.Close()
+	L.SetGlobal("KEYS", luaStrings(L, args[1:1+n]))
+	L.SetGlobal("ARGV", luaStrings(L, args[1+n:]))
+	r := L.NewTable()
+	r.RawSetString("call", L.NewFunction(func(L *lua.LState) int { return s.luaCall(L, false) }))
+	r.RawSetString("pcall", L.NewFunction(func(L *lua.LState) int { return s.luaCall(L, true) }))
+	L.SetGlobal("redis", r)
+	if err := L.DoString(src); err != nil {
+		msg := err.Error()
+		if e, ok := err.(*lua.ApiError); ok {
+			msg = e.Object.String()
+		}
+		// 回复只能有一行
+		w.err("ERR Error running script: " + strings.Replace(msg, "\n", " ", -1))
+		return
+	}
+	writeLua(w, L.Get(-1))
+}
+
+func luaStrings(L *lua.LState, list []string) *lua.LTable {
+	t := L.CreateTable(len(list), 0)
+	for _, s := range list {
+		t.Append(lua.LString(s))
+	}
+	return t
+}
+
+// luaCall redis.call 和 redis.pcall,call 遇到错误回复时中止脚本,pcall 返回 {err=...}
+func (s *Server) luaCall(L *lua.LState, protected bool) int {
+	n := L.GetTop()
+	if n == 0 {
+		L.RaiseError("Please specify at least one argument for redis.call()")
+	}
+	args := make([]string, n)
+	for i := range args {
+		switch v := L.Get(i + 1).(type) {
+		case lua.LString:
+			args[i] = string(v)
+		case lua.LNumber:
+			args[i] = v.String()
+		default:
+			L.RaiseError("Lua redis() command arguments must be strings or integers")
+		}
+	}
+	var w resp
+	s.exec(&w, args)
+	reply, err := readReply(bufio.NewReader(bytes.NewReader(w.Bytes())))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	if e, ok := reply.(errorReply); ok && !protected {
+		L.RaiseError("%s", string(e))
+	}
+	L.Push(toLua(L, reply))
+	return 1
+}
+
+// readReply 解析 resp 编码的回复
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return statusReply(line[1:]), nil
+	case '-':
+		return errorReply(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("unknown reply: %s", line)
+}
+
+// toLua 按 redis 的规则转换回复:空值为 false,状态和错误为 {ok=...}、{err=...}
+func toLua(L *lua.LState, reply interface{}) lua.LValue {
+	switch v := reply.(type) {
+	case int64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case statusReply:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(v))
+		return t
+	case errorReply:
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(v))
+		return t
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			t.Append(toLua(L, item))
+		}
+		return t
+	}
+	return lua.LFalse
+}
+
+// writeLua 按 redis 的规则编码脚本的返回值:数字取整,数组遇到nil结束,false和nil为空值
+func writeLua(w *resp, v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		w.int(int64(v))
+	case lua.LString:
+		w.bulk(string(v))
+	case lua.LBool:
+		if v {
+			w.int(1)
+		} else {
+			w.null()
+		}
+	case *lua.LTable:
+		if ok, isStr := v.RawGetString("ok").(lua.LString); isStr {
+			w.status(string(ok))
+			return
+		}
+		if e, isStr := v.RawGetString("err").(lua.LString); isStr {
+			w.err(string(e))
+			return
+		}
+		var items []lua.LValue
+		for i := 1; v.RawGetInt(i) != lua.LNil; i++ {
+			items = append(items, v.RawGetInt(i))
+		}
+		w.array(len(items))
+		for _, item := range items {
+			writeLua(w, item)
+		}
+	default:
+		w.null()
+	}
+}
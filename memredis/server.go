@@ -0,0 +1,445 @@
+// Package memredis 进程内的 redis,数据只保存在内存中,用于单机部署和测试
+//
+// 客户端仍然是 go-redis,通过 net.Pipe 使用 redis 协议通信,因此管道、MULTI/EXEC 和 WATCH 与连接真实的 redis 一致。
+// 只实现了统计用到的命令,见 commands。lua 脚本使用 gopher-lua 执行,见 script.go
+package memredis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// 值的类型
+const (
+	kindString = iota
+	kindHash
+	kindSet
+	kindZSet
+	kindHLL // HyperLogLog,保存全部元素,基数是精确的
+)
+
+// value 一个key的值
+type value struct {
+	kind     int
+	str      []byte
+	hash     map[string]string
+	set      map[string]struct{} // set 和 HyperLogLog
+	zset     map[string]float64
+	expireAt time.Time // 为零时不过期
+}
+
+// Server 进程内的 redis
+type Server struct {
+	mu        sync.Mutex
+	data      map[string]*value
+	watched   map[string]map[*conn]bool // 被 WATCH 的key
+	lastSweep time.Time
+	now       func() time.Time
+	scripts   map[string]string // 加载过的 lua 脚本,key为sha1
+}
+
+// NewServer 创建一个空的 Server
+func NewServer() *Server {
+	return &Server{
+		data:    make(map[string]*value),
+		watched: make(map[string]map[*conn]bool),
+		now:     time.Now,
+		scripts: make(map[string]string),
+	}
+}
+
+// SetNow 设置当前时间,用于测试过期
+func (s *Server) SetNow(now func() time.Time) {
+	s.mu.Lock()
+	s.now = now
+	s.mu.Unlock()
+}
+
+// NewClient 连接到一个新的进程内 redis 的客户端
+func NewClient() *redis.Client {
+	return NewServer().NewClient()
+}
+
+// NewClient 连接到 Server 的客户端
+func (s *Server) NewClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr: "memredis",
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.Dial(), nil
+		},
+	})
+}
+
+// Dial 返回一个新的连接
+func (s *Server) Dial() net.Conn {
+	client, server := net.Pipe()
+	go s.serve(server)
+	return client
+}
+
+// conn 一个客户端连接的状态
+type conn struct {
+	multi   bool
+	queued  [][]string
+	aborted bool // MULTI 中有错误的命令,EXEC 时放弃
+	watch   []string
+	dirty   bool // WATCH 的key被修改过
+}
+
+// serve 处理一个连接的命令,回复由单独的 goroutine 写入,避免客户端写入管道时互相等待
+func (s *Server) serve(nc net.Conn) {
+	defer nc.Close()
+	c := &conn{}
+	defer func() {
+		s.mu.Lock()
+		s.unwatch(c)
+		s.mu.Unlock()
+	}()
+	out := newOutbox()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := bufio.NewWriter(nc)
+		for {
+			replies := out.take()
+			if replies == nil {
+				return
+			}
+			for _, r := range replies {
+				w.Write(r)
+			}
+			if err := w.Flush(); err != nil {
+				nc.Close()
+				return
+			}
+		}
+	}()
+	defer func() {
+		out.close()
+		<-done
+	}()
+	r := bufio.NewReader(nc)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				var w resp
+				w.err("ERR " + err.Error())
+				out.push(w.Bytes())
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		var w resp
+		quit := strings.EqualFold(args[0], "quit")
+		if quit {
+			w.ok()
+		} else {
+			s.handle(c, &w, args)
+		}
+		out.push(w.Bytes())
+		if quit {
+			return
+		}
+	}
+}
+
+// outbox 等待写入的回复,不限制数量,客户端写入很长的管道时服务端不会阻塞
+type outbox struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending [][]byte
+	closed  bool
+}
+
+func newOutbox() *outbox {
+	o := &outbox{}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+func (o *outbox) push(b []byte) {
+	o.mu.Lock()
+	o.pending = append(o.pending, b)
+	o.mu.Unlock()
+	o.cond.Signal()
+}
+
+func (o *outbox) close() {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+	o.cond.Signal()
+}
+
+// take 等待并取出所有回复,关闭且没有回复时返回nil
+func (o *outbox) take() [][]byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for len(o.pending) == 0 && !o.closed {
+		o.cond.Wait()
+	}
+	p := o.pending
+	o.pending = nil
+	return p
+}
+
+// readCommand 读取一个命令,只支持 go-redis 发送的数组格式
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, errors.New("Protocol error: invalid multibulk length")
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("Protocol error: expected '$', got '%s'", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errors.New("Protocol error: invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// handle 执行一个命令,MULTI 中的命令先排队,EXEC 时一起执行
+func (s *Server) handle(c *conn, w *resp, args []string) {
+	name := strings.ToLower(args[0])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	switch name {
+	case "multi":
+		if c.multi {
+			w.err("ERR MULTI calls can not be nested")
+			return
+		}
+		c.multi = true
+		w.ok()
+		return
+	case "exec":
+		if !c.multi {
+			w.err("ERR EXEC without MULTI")
+			return
+		}
+		queued, aborted, dirty := c.queued, c.aborted, c.dirty
+		c.multi, c.queued, c.aborted = false, nil, false
+		s.unwatch(c)
+		if aborted {
+			w.err("EXECABORT Transaction discarded because of previous errors.")
+			return
+		}
+		if dirty {
+			w.nullArray()
+			return
+		}
+		w.array(len(queued))
+		for _, q := range queued {
+			s.exec(w, q)
+		}
+		return
+	case "discard":
+		if !c.multi {
+			w.err("ERR DISCARD without MULTI")
+			return
+		}
+		c.multi, c.queued, c.aborted = false, nil, false
+		s.unwatch(c)
+		w.ok()
+		return
+	case "watch":
+		if c.multi {
+			w.err("ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		for _, key := range args[1:] {
+			if s.watched[key] == nil {
+				s.watched[key] = make(map[*conn]bool)
+			}
+			s.watched[key][c] = true
+			c.watch = append(c.watch, key)
+		}
+		w.ok()
+		return
+	case "unwatch":
+		s.unwatch(c)
+		w.ok()
+		return
+	}
+	if c.multi {
+		cmd := commands[name]
+		if cmd == nil || len(args)-1 < cmd.arity {
+			c.aborted = true
+			w.err(commandError(name, cmd))
+			return
+		}
+		c.queued = append(c.queued, args)
+		w.status("QUEUED")
+		return
+	}
+	s.exec(w, args)
+}
+
+// exec 执行一个普通命令,调用时已经加锁
+func (s *Server) exec(w *resp, args []string) {
+	name := strings.ToLower(args[0])
+	cmd := commands[name]
+	if cmd == nil || len(args)-1 < cmd.arity {
+		w.err(commandError(name, cmd))
+		return
+	}
+	cmd.fn(s, w, args[1:])
+}
+
+func commandError(name string, cmd *command) string {
+	if cmd == nil {
+		return fmt.Sprintf("ERR unknown command '%s'", name)
+	}
+	return fmt.Sprintf("ERR wrong number of arguments for '%s' command", name)
+}
+
+// unwatch 取消连接 WATCH 的key
+func (s *Server) unwatch(c *conn) {
+	for _, key := range c.watch {
+		if m := s.watched[key]; m != nil {
+			delete(m, c)
+			if len(m) == 0 {
+				delete(s.watched, key)
+			}
+		}
+	}
+	c.watch, c.dirty = nil, false
+}
+
+// touch key被修改,WATCH 该key的事务将失败
+func (s *Server) touch(key string) {
+	for c := range s.watched[key] {
+		c.dirty = true
+	}
+}
+
+// lookup 获取未过期的值
+func (s *Server) lookup(key string) *value {
+	v := s.data[key]
+	if v == nil {
+		return nil
+	}
+	if !v.expireAt.IsZero() && !s.now().Before(v.expireAt) {
+		delete(s.data, key)
+		s.touch(key)
+		return nil
+	}
+	return v
+}
+
+// sweep 每秒最多一次删除所有过期的key
+func (s *Server) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < time.Second {
+		return
+	}
+	s.lastSweep = now
+	for key, v := range s.data {
+		if !v.expireAt.IsZero() && !now.Before(v.expireAt) {
+			delete(s.data, key)
+			s.touch(key)
+		}
+	}
+}
+
+// resp 按 redis 协议编码的回复
+type resp struct {
+	buf []byte
+}
+
+func (w *resp) Bytes() []byte {
+	return w.buf
+}
+
+func (w *resp) ok() {
+	w.status("OK")
+}
+
+func (w *resp) status(s string) {
+	w.buf = append(w.buf, '+')
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, "\r\n"...)
+}
+
+func (w *resp) err(s string) {
+	w.buf = append(w.buf, '-')
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, "\r\n"...)
+}
+
+func (w *resp) int(n int64) {
+	w.buf = append(w.buf, ':')
+	w.buf = strconv.AppendInt(w.buf, n, 10)
+	w.buf = append(w.buf, "\r\n"...)
+}
+
+func (w *resp) bulk(s string) {
+	w.buf = append(w.buf, '$')
+	w.buf = strconv.AppendInt(w.buf, int64(len(s)), 10)
+	w.buf = append(w.buf, "\r\n"...)
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, "\r\n"...)
+}
+
+func (w *resp) null() {
+	w.buf = append(w.buf, "$-1\r\n"...)
+}
+
+func (w *resp) array(n int) {
+	w.buf = append(w.buf, '*')
+	w.buf = strconv.AppendInt(w.buf, int64(n), 10)
+	w.buf = append(w.buf, "\r\n"...)
+}
+
+func (w *resp) nullArray() {
+	w.buf = append(w.buf, "*-1\r\n"...)
+}
+
+func (w *resp) strings(list []string) {
+	w.array(len(list))
+	for _, s := range list {
+		w.bulk(s)
+	}
+}
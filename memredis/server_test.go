@@ -0,0 +1,176 @@
+package memredis
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestCommands(t *testing.T) {
+	cli := NewClient()
+	defer cli.Close()
+	if n := cli.SAdd("ip", "1.1.1.1", "2.2.2.2", "1.1.1.1").Val(); n != 2 {
+		t.Fatalf("SAdd 返回%d,期望2", n)
+	}
+	if !cli.SIsMember("ip", "2.2.2.2").Val() || cli.SCard("ip").Val() != 2 {
+		t.Fatal("set 内容错误")
+	}
+	cli.HIncrBy("webflow", "pv", 3)
+	cli.HIncrBy("webflow", "pv", 2)
+	if v := cli.HGet("webflow", "pv").Val(); v != "5" {
+		t.Fatalf("HIncrBy 后为%s,期望5", v)
+	}
+	if err := cli.Get("webflow").Err(); err == nil {
+		t.Fatal("类型不一致时应返回 WRONGTYPE 错误")
+	}
+	if err := cli.Get("none").Err(); err != redis.Nil {
+		t.Fatalf("key不存在时应返回 redis.Nil,实际为%v", err)
+	}
+	cli.PFAdd("hll1", "a", "b")
+	cli.PFAdd("hll2", "b", "c")
+	if n := cli.PFCount("hll1", "hll2").Val(); n != 3 {
+		t.Fatalf("PFCount 返回%d,期望3", n)
+	}
+	// GET/SET 可以复制 HyperLogLog
+	cli.Set("hll3", cli.Get("hll1").Val(), 0)
+	if n := cli.PFCount("hll3").Val(); n != 2 {
+		t.Fatalf("复制后 PFCount 返回%d,期望2", n)
+	}
+	if old := cli.SetBit("bits", 7, 1).Val(); old != 0 {
+		t.Fatal("SetBit 应返回原来的值0")
+	}
+	if old := cli.SetBit("bits", 7, 1).Val(); old != 1 {
+		t.Fatal("SetBit 应返回原来的值1")
+	}
+	cli.ZAdd("z", &redis.Z{Score: 1, Member: "a"}, &redis.Z{Score: 2, Member: "b"}, &redis.Z{Score: 3, Member: "c"})
+	got := cli.ZRangeByScore("z", &redis.ZRangeBy{Min: "(1", Max: "+inf"}).Val()
+	if !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("ZRangeByScore 返回%v", got)
+	}
+	// XX 只更新已有的成员,NX 只添加新成员
+	cli.ZAddXX("z", &redis.Z{Score: 5, Member: "a"}, &redis.Z{Score: 5, Member: "d"})
+	cli.ZAddNX("z", &redis.Z{Score: 6, Member: "b"}, &redis.Z{Score: 6, Member: "e"})
+	got = cli.ZRangeByScore("z", &redis.ZRangeBy{Min: "4", Max: "+inf"}).Val()
+	if !reflect.DeepEqual(got, []string{"a", "e"}) {
+		t.Fatalf("ZAddXX、ZAddNX 后 ZRangeByScore 返回%v", got)
+	}
+	if keys := cli.Keys("hll*").Val(); !reflect.DeepEqual(keys, []string{"hll1", "hll2", "hll3"}) {
+		t.Fatalf("Keys 返回%v", keys)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	s := NewServer()
+	now := time.Date(2020, 1, 1, 23, 0, 0, 0, time.Local)
+	s.SetNow(func() time.Time { return now })
+	cli := s.NewClient()
+	defer cli.Close()
+	cli.SAdd("uv", "u1")
+	cli.ExpireAt("uv", now.Add(time.Hour))
+	if ttl := cli.TTL("uv").Val(); ttl != time.Hour {
+		t.Fatalf("TTL 返回%v,期望1h", ttl)
+	}
+	now = now.Add(time.Hour)
+	if cli.Exists("uv").Val() != 0 {
+		t.Fatal("过期的key应被删除")
+	}
+}
+
+func TestPipelineAndWatch(t *testing.T) {
+	s := NewServer()
+	cli := s.NewClient()
+	defer cli.Close()
+	pipe := cli.Pipeline()
+	for i := 0; i < 10000; i++ {
+		pipe.Incr("n")
+	}
+	if _, err := pipe.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if v := cli.Get("n").Val(); v != "10000" {
+		t.Fatalf("管道执行后为%s,期望10000", v)
+	}
+	// 其它连接在 WATCH 后修改了key,事务失败
+	other := s.NewClient()
+	defer other.Close()
+	err := cli.Watch(func(tx *redis.Tx) error {
+		n, err := tx.Get("n").Int()
+		if err != nil {
+			return err
+		}
+		other.Incr("n")
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set("n", n+1, 0)
+			return nil
+		})
+		return err
+	}, "n")
+	if err != redis.TxFailedErr {
+		t.Fatalf("期望 TxFailedErr,实际为%v", err)
+	}
+	if v := cli.Get("n").Val(); v != "10001" {
+		t.Fatalf("事务失败后为%s,期望10001", v)
+	}
+}
+
+func TestSort(t *testing.T) {
+	cli := NewClient()
+	defer cli.Close()
+	cli.SAdd("urls", "a", "b", "c")
+	cli.HMSet("webflow_a", "pv", "5", "title", "A")
+	cli.HMSet("webflow_b", "pv", "20", "title", "B")
+	cli.HMSet("webflow_c", "pv", "10", "title", "C")
+	got := cli.Sort("urls", &redis.Sort{
+		By:    "webflow_*->pv",
+		Order: "DESC",
+		Count: 2,
+		Get:   []string{"#", "webflow_*->title"},
+	}).Val()
+	if !reflect.DeepEqual(got, []string{"b", "B", "c", "C"}) {
+		t.Fatalf("Sort 返回%v", got)
+	}
+}
+
+func TestScript(t *testing.T) {
+	cli := NewClient()
+	defer cli.Close()
+	script := redis.NewScript(`
+local n = redis.call('HINCRBY', KEYS[1], ARGV[1], ARGV[2])
+if n <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return {n, redis.call('HLEN', KEYS[1]), type(redis.pcall('GET', KEYS[1]))}`)
+	// 没有加载时 EVALSHA 返回 NOSCRIPT,Run 改用 EVAL
+	if err := script.EvalSha(cli, []string{"online"}, "1.1.1.1", 1).Err(); err == nil || err.Error()[:8] != "NOSCRIPT" {
+		t.Fatalf("脚本没有加载时应返回 NOSCRIPT,实际为%v", err)
+	}
+	got, err := script.Run(cli, []string{"online"}, "1.1.1.1", 2).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 错误回复转换为 {err=...},空值转换为 false
+	if want := []interface{}{int64(2), int64(1), "table"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("脚本返回%v,期望%v", got, want)
+	}
+	// EVAL 之后可以用 EVALSHA 执行
+	got, err = script.EvalSha(cli, []string{"online"}, "1.1.1.1", -2).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{int64(0), int64(0), "boolean"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("脚本返回%v,期望%v", got, want)
+	}
+	if cli.Exists("online").Val() != 0 {
+		t.Fatal("field 为0时应删除")
+	}
+	// redis.call 遇到错误时中止脚本
+	cli.Set("str", "a", 0)
+	if err := cli.Eval(`redis.call('HINCRBY', KEYS[1], 'f', 1) return 1`, []string{"str"}).Err(); err == nil {
+		t.Fatal("命令出错时脚本应返回错误")
+	}
+	if ok, err := cli.ScriptExists(script.Hash(), "none").Result(); err != nil || !reflect.DeepEqual(ok, []bool{true, false}) {
+		t.Fatalf("ScriptExists 返回%v %v", ok, err)
+	}
+}
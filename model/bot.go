@@ -0,0 +1,52 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 爬虫识别原因
+const (
+	BotReasonUA         = "ua"         // User-Agent 匹配爬虫规则
+	BotReasonDatacenter = "datacenter" // ip属于数据中心
+	BotReasonRate       = "rate"       // 访问频率过高
+)
+
+// Bot 每日爬虫访问量,不计入 WebFlow 和 Browsing
+type Bot struct {
+	Model
+	Domain string `json:"domain"` // 域名
+	Date   string `json:"date"`   // 日期yyyy-mm-dd
+	Reason string `json:"reason"` // 识别原因
+	Name   string `json:"name"`   // 匹配的规则
+	PV     int    `json:"pv"`     // 页面浏览量
+}
+
+// Save save
+func (b *Bot) Save() error {
+	return db.Save(b).Error
+}
+
+// UpdateOrSave 存在就更新否则就保存
+func (b *Bot) UpdateOrSave() error {
+	if len(b.Domain) == 0 || len(b.Date) == 0 || len(b.Reason) == 0 {
+		return errors.New("Bot的domain、date和reason不能为空")
+	}
+	fields := map[string]interface{}{
+		"domain": b.Domain,
+		"date":   b.Date,
+		"reason": b.Reason,
+		"name":   b.Name,
+	}
+	old := Bot{}
+	err := db.Where(fields).First(&old).Error
+	if err == gorm.ErrRecordNotFound {
+		return b.Save()
+	}
+	if err != nil {
+		return err
+	}
+	old.PV += b.PV
+	return db.Model(&old).Updates(&old).Error
+}
@@ -1,7 +1,6 @@
 package model
 
 import (
-	"errors"
 	"github.com/jinzhu/gorm"
 )
 
@@ -36,42 +35,3 @@ func IsNewVisitor(domain, uid string) (bool, error) {
 	}
 	return true, nil
 }
-
-// Save save
-func (b *Browsing) Save() error {
-	return db.Save(b).Error
-}
-
-// UpdateOrSave 存在就更新否则就保存
-func (b *Browsing) UpdateOrSave() error {
-	if len(b.UID) == 0 || len(b.Domain) == 0 || len(b.Date) == 0 {
-		return errors.New("Browsing的uid、date和domain不能为空")
-	}
-	fields := map[string]interface{}{
-		"uid":    b.UID,
-		"domain": b.Domain,
-		"date":   b.Date,
-	}
-	old, err := findFirstBrowsing(fields)
-	if err == gorm.ErrRecordNotFound {
-		print("未找到纪录")
-		return b.Save()
-	}
-	if err != nil {
-		return err
-	}
-	old.Duration += b.Duration
-	old.IP += b.IP
-	old.PV += b.PV
-	old.Pageopend += b.Pageopend
-	old.Visits += b.Visits
-	old.Depth += b.Depth
-	return db.Model(old).Updates(old).Error
-}
-
-// findFirstBrowsing 返回第一条纪录
-func findFirstBrowsing(fields map[string]interface{}) (*Browsing, error) {
-	b := Browsing{}
-	err := db.Where(fields).First(&b).Error
-	return &b, err
-}
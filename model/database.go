@@ -10,6 +10,10 @@ import (
 
 	// mysql
 	_ "github.com/go-sql-driver/mysql"
+	// postgres
+	_ "github.com/lib/pq"
+	// sqlite
+	_ "github.com/mattn/go-sqlite3"
 )
 
 var db *gorm.DB
@@ -22,11 +26,61 @@ type Model struct {
 // 配置
 var conf = *config.Config
 
+// dialect 不同数据库的连接方式和建表选项
+type dialect struct {
+	driver       string
+	dsn          func(c *config.Configuration) string
+	tableOptions string
+	maxOpenConns int // 大于0时限制最大连接数
+}
+
+// dialects 支持的数据库,key为 DbType
+var dialects = map[string]*dialect{
+	"mysql": {
+		driver: "mysql",
+		dsn: func(c *config.Configuration) string {
+			return fmt.Sprintf("%s:%s@(%s:%s)/%s?charset=utf8&parseTime=True&loc=Local", c.DbUser, c.DbPassword, c.DbHost, c.DbPort, c.DbName)
+		},
+		tableOptions: "ENGINE=Innodb DEFAULT CHARSET=utf8 AUTO_INCREMENT=1;",
+	},
+	"postgres": {
+		driver: "postgres",
+		dsn: func(c *config.Configuration) string {
+			sslmode := c.DbSSLMode
+			if len(sslmode) == 0 {
+				sslmode = "disable"
+			}
+			return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s", c.DbHost, c.DbPort, c.DbUser, c.DbPassword, c.DbName, sslmode)
+		},
+	},
+	// DbName 为数据库文件路径,:memory: 为内存数据库
+	"sqlite3": {
+		driver: "sqlite3",
+		dsn: func(c *config.Configuration) string {
+			return c.DbName + "?_busy_timeout=5000"
+		},
+		// sqlite 同时只能有一个写入,内存数据库每个连接是独立的
+		maxOpenConns: 1,
+	},
+}
+
 // Setup 初始化一个db连接
 func Setup() {
+	SetupWith(&conf)
+}
+
+// SetupWith 使用指定的配置初始化db连接,测试时可以使用 sqlite 内存数据库
+func SetupWith(conf *config.Configuration) {
 	var err error
 	log.Println("启动数据库")
-	db, err = gorm.Open(conf.DbType, fmt.Sprintf("%s:%s@(%s:%s)/%s?charset=utf8&parseTime=True&loc=Local", conf.DbUser, conf.DbPassword, conf.DbHost, conf.DbPort, conf.DbName))
+	d := dialects[conf.DbType]
+	if conf.DbType == "sqlite" {
+		d = dialects["sqlite3"]
+	}
+	if d == nil {
+		log.Fatalf("不支持的数据库类型:%s,只支持 mysql、postgres、sqlite3", conf.DbType)
+	}
+	db, err = gorm.Open(d.driver, d.dsn(conf))
 	if err != nil {
 		log.Fatalf("数据库连接失败 err: %v", err)
 	}
@@ -46,14 +100,26 @@ func Setup() {
 	if err != nil {
 		panic(err)
 	}
+	if d.maxOpenConns > 0 {
+		open = d.maxOpenConns
+	}
 	db.DB().SetMaxOpenConns(open)
 
-	db.Set("gorm:table_options", "ENGINE=InnoDB  DEFAULT CHARSET=utf8 AUTO_INCREMENT=1;").
-		AutoMigrate(&Browsing{})
-	db.Set("gorm:table_options", "ENGINE=Innodb DEFAULT CHARSET=utf8 AUTO_INCREMENT=1;").AutoMigrate(&RealtimeWebflow{})
-	db.Set("gorm:table_options", "ENGINE=Innodb DEFAULT CHARSET=utf8 AUTO_INCREMENT=1;").AutoMigrate(&Domainmgr{})
-	db.Set("gorm.table_options", "ENGINE=Innodb DEFAULT CHARSET=utf8 AUTO_INCREMENT=1;").AutoMigrate(&Pageinfo{})
-	db.Set("gorm.table_options", "ENGINE=Innodb DEFAULT CHARSET=utf8 AUTO_INCREMENT=1;").AutoMigrate(&WebFlow{})
+	migrate(d.tableOptions)
+	Store = &gormStore{db}
+}
+
+// migrate 创建或更新表结构
+func migrate(options string) {
+	// pageinfo.url 增加唯一索引之前删除重复的页面信息,保留最早的一条
+	if db.HasTable(&Pageinfo{}) && !db.Dialect().HasIndex("pageinfo", "uix_pageinfo_url") {
+		err := db.Exec("DELETE FROM pageinfo WHERE id NOT IN (SELECT id FROM (SELECT MIN(id) AS id FROM pageinfo GROUP BY url) AS t)").Error
+		if err != nil {
+			log.Printf("删除重复的页面信息失败:%v\n", err)
+		}
+	}
+	db.Set("gorm:table_options", options).AutoMigrate(&Browsing{}, &RealtimeWebflow{}, &Domainmgr{}, &Pageinfo{}, &WebFlow{},
+		&Source{}, &User{}, &Bot{}, &Event{}, &Goal{}, &GoalStep{}, &GoalStat{}, &Session{}, &Hourly{}, &Sketch{}, &Rollup{})
 }
 
 // CloseDB closes database connection (unnecessary)
@@ -1,22 +1,68 @@
 package model
 
+import "strings"
+
 // Domainmgr 域名管理
 type Domainmgr struct {
 	Model
-	Domain string `json:"domain"`
+	Domain  string `gorm:"unique_index" json:"domain"`
+	Aliases string `json:"aliases"`                              // 别名,逗号分隔,如 www.example.com
+	Enabled bool   `gorm:"not null;default:true" json:"enabled"` // 停用后不再统计该域名的流量
+	// SiteKey 站点key,统计脚本和采集请求必须携带
+	SiteKey string `gorm:"index" json:"siteKey"`
+	// CheckOrigin 是否校验采集请求的 Origin/Referer 属于该域名或别名
+	CheckOrigin bool `json:"checkOrigin"`
 }
 
 // Save save
 func (d *Domainmgr) Save() error {
-	return db.Create(d).Error
+	// 字段默认值为true,创建时 false 会被忽略并重新加载为true
+	enabled := d.Enabled
+	if err := db.Create(d).Error; err != nil {
+		return err
+	}
+	if !enabled {
+		return db.Model(d).Update("enabled", false).Error
+	}
+	return nil
+}
+
+// Update 更新所有字段
+func (d *Domainmgr) Update() error {
+	return db.Save(d).Error
+}
+
+// Delete 删除域名及其用户关联
+func (d *Domainmgr) Delete() error {
+	tx := db.Begin()
+	if err := tx.Exec("DELETE FROM user_domain WHERE domainmgr_id = ?", d.ID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(d).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Hosts 域名及其别名
+func (d *Domainmgr) Hosts() []string {
+	hosts := []string{d.Domain}
+	for _, a := range strings.Split(d.Aliases, ",") {
+		if a = strings.TrimSpace(a); len(a) > 0 {
+			hosts = append(hosts, a)
+		}
+	}
+	return hosts
 }
 
-// GetAllRegistryDomains 获取所有注册的域名
-func GetAllRegistryDomains() ([]*Domainmgr, error) {
-	var data []*Domainmgr
-	err := db.Find(&data).Error
+// FindDomainByID 根据id查询域名
+func FindDomainByID(id int) (*Domainmgr, error) {
+	var d Domainmgr
+	err := db.Where("id = ?", id).First(&d).Error
 	if err != nil {
 		return nil, err
 	}
-	return data, nil
+	return &d, nil
 }
@@ -0,0 +1,98 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Event 每日自定义事件统计,如点击、下载、视频播放、表单提交
+type Event struct {
+	Model
+	Domain   string `json:"domain,omitempty"` // 域名
+	Date     string `json:"date,omitempty"`   // 日期yyyy-mm-dd
+	URL      string `json:"url,omitempty"`    // 触发事件的页面
+	Category string `json:"category"`         // 事件类别,如 download、share、video
+	Action   string `json:"action"`           // 事件动作,如 click、play、submit
+	Label    string `json:"label,omitempty"`  // 事件标签,如文件名、分享平台
+	Count    int    `json:"count"`            // 触发次数
+	Value    int64  `json:"value"`            // 事件值之和
+}
+
+// Save save
+func (e *Event) Save() error {
+	return db.Save(e).Error
+}
+
+// UpdateOrSave 存在就更新否则就保存
+func (e *Event) UpdateOrSave() error {
+	if len(e.Domain) == 0 || len(e.Date) == 0 || len(e.Category) == 0 || len(e.Action) == 0 {
+		return errors.New("Event的domain、date、category和action不能为空")
+	}
+	fields := map[string]interface{}{
+		"domain":   e.Domain,
+		"date":     e.Date,
+		"url":      e.URL,
+		"category": e.Category,
+		"action":   e.Action,
+		"label":    e.Label,
+	}
+	old := Event{}
+	err := db.Where(fields).First(&old).Error
+	if err == gorm.ErrRecordNotFound {
+		return e.Save()
+	}
+	if err != nil {
+		return err
+	}
+	old.Count += e.Count
+	old.Value += e.Value
+	return db.Model(&old).Updates(&old).Error
+}
+
+// EventQuery 自定义事件查询条件
+type EventQuery struct {
+	Domain   string
+	Start    string // 开始日期yyyy-mm-dd,包含
+	End      string // 结束日期yyyy-mm-dd,包含
+	Category string // 为空时不过滤
+	Action   string // 为空时不过滤
+	URL      string // 为空时不过滤
+	// Group 分组字段,category、action 之外还可以按 label、url 分组
+	Group []string
+}
+
+// eventGroupFields 允许分组的字段
+var eventGroupFields = map[string]bool{
+	"category": true, "action": true, "label": true, "url": true,
+}
+
+// FindEvents 汇总指定日期范围内的自定义事件,按触发次数降序排序
+func FindEvents(q *EventQuery) ([]*Event, error) {
+	for _, g := range q.Group {
+		if !eventGroupFields[g] {
+			return nil, fmt.Errorf("不支持的分组字段:%s", g)
+		}
+	}
+	group := strings.Join(q.Group, ", ")
+	var data []*Event
+	query := db.Model(&Event{}).
+		Select(group+", SUM(count) AS count, SUM(value) AS value").
+		Where("domain = ? AND date >= ? AND date <= ?", q.Domain, q.Start, q.End)
+	if len(q.Category) > 0 {
+		query = query.Where("category = ?", q.Category)
+	}
+	if len(q.Action) > 0 {
+		query = query.Where("action = ?", q.Action)
+	}
+	if len(q.URL) > 0 {
+		query = query.Where("url = ?", q.URL)
+	}
+	err := query.Group(group).Order("count DESC").Scan(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,149 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 目标步骤类型
+const (
+	GoalStepURL      = "url"      // 访问的页面地址匹配 Pattern
+	GoalStepEvent    = "event"    // 触发的自定义事件匹配 Pattern(category 或 category/action)
+	GoalStepDuration = "duration" // 页面浏览时长不少于 Threshold 秒,Pattern 不为空时只匹配该页面
+)
+
+// Goal 转化目标,只有一个步骤时为目标,多个步骤时为漏斗
+type Goal struct {
+	Model
+	Domain string     `gorm:"index" json:"domain"`
+	Name   string     `json:"name"`
+	Steps  []GoalStep `gorm:"foreignkey:GoalID" json:"steps"`
+}
+
+// GoalStep 目标步骤,同一用户当天必须按顺序完成
+type GoalStep struct {
+	Model
+	GoalID    int    `gorm:"index" json:"-"`
+	Seq       int    `json:"seq"` // 顺序,从1开始
+	Name      string `json:"name"`
+	Type      string `json:"type"`      // url、event、duration
+	Pattern   string `json:"pattern"`   // 支持通配符*
+	Threshold int    `json:"threshold"` // 浏览时长(秒),类型为 duration 时有效
+}
+
+// GoalStat 每日到达目标各步骤的用户数,Step 为0时是当天访问该域名的用户数
+type GoalStat struct {
+	Model
+	GoalID   int    `gorm:"index" json:"goalId"`
+	Date     string `json:"date"`
+	Step     int    `json:"step"`
+	Visitors int    `json:"visitors"`
+}
+
+// orderSteps 按顺序加载步骤
+func orderSteps(db *gorm.DB) *gorm.DB {
+	return db.Order("seq")
+}
+
+// Save 保存目标及步骤
+func (g *Goal) Save() error {
+	return db.Create(g).Error
+}
+
+// Update 更新目标名称并替换所有步骤
+func (g *Goal) Update() error {
+	tx := db.Begin()
+	if err := tx.Model(g).Update("name", g.Name).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("goal_id = ?", g.ID).Delete(&GoalStep{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i := range g.Steps {
+		g.Steps[i].ID = 0
+		g.Steps[i].GoalID = g.ID
+		if err := tx.Create(&g.Steps[i]).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Delete 删除目标、步骤及统计
+func (g *Goal) Delete() error {
+	tx := db.Begin()
+	if err := tx.Where("goal_id = ?", g.ID).Delete(&GoalStep{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("goal_id = ?", g.ID).Delete(&GoalStat{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(g).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// FindGoalByID 根据id查询目标
+func FindGoalByID(id int) (*Goal, error) {
+	var g Goal
+	err := db.Preload("Steps", orderSteps).Where("id = ?", id).First(&g).Error
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// FindGoals 查询域名的所有目标,domain为空时查询所有域名
+func FindGoals(domain string) ([]*Goal, error) {
+	var data []*Goal
+	query := db.Preload("Steps", orderSteps)
+	if len(domain) > 0 {
+		query = query.Where("domain = ?", domain)
+	}
+	err := query.Order("id").Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Save save
+func (s *GoalStat) Save() error {
+	return db.Save(s).Error
+}
+
+// UpdateOrSave 存在就更新否则就保存
+func (s *GoalStat) UpdateOrSave() error {
+	if s.GoalID == 0 || len(s.Date) == 0 {
+		return errors.New("GoalStat的goalId和date不能为空")
+	}
+	old := GoalStat{}
+	err := db.Where("goal_id = ? AND date = ? AND step = ?", s.GoalID, s.Date, s.Step).First(&old).Error
+	if err == gorm.ErrRecordNotFound {
+		return s.Save()
+	}
+	if err != nil {
+		return err
+	}
+	old.Visitors += s.Visitors
+	return db.Model(&old).Updates(&old).Error
+}
+
+// FindGoalStats 查询目标在指定日期范围内的每日统计
+func FindGoalStats(goalID int, start, end string) ([]*GoalStat, error) {
+	var data []*GoalStat
+	err := db.Where("goal_id = ? AND date >= ? AND date <= ?", goalID, start, end).
+		Order("date, step").Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
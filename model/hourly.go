@@ -0,0 +1,64 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// HourAll Hourly.Hour 为该值时表示全天,UV、IP 为全天去重后的数量
+const HourAll = -1
+
+// Hourly 每小时流量,URL为空时为整个域名的流量
+type Hourly struct {
+	Model
+	Domain string `gorm:"index:idx_hourly" json:"domain,omitempty"`
+	URL    string `json:"url,omitempty"`
+	Date   string `gorm:"index:idx_hourly" json:"date"` // 日期yyyy-mm-dd
+	Hour   int    `json:"hour"`                         // 0-23,-1为全天
+	PV     int    `json:"pv"`
+	UV     int    `json:"uv"`
+	IP     int    `json:"ip"`
+	Visits int    `json:"visits"`
+}
+
+// Save save
+func (h *Hourly) Save() error {
+	return db.Save(h).Error
+}
+
+// UpdateOrSave 存在就更新否则就保存
+func (h *Hourly) UpdateOrSave() error {
+	if len(h.Domain) == 0 || len(h.Date) == 0 {
+		return errors.New("Hourly的domain和date不能为空")
+	}
+	old := Hourly{}
+	err := db.Where("domain = ? AND url = ? AND date = ? AND hour = ?", h.Domain, h.URL, h.Date, h.Hour).First(&old).Error
+	if err == gorm.ErrRecordNotFound {
+		return h.Save()
+	}
+	if err != nil {
+		return err
+	}
+	old.PV += h.PV
+	old.UV += h.UV
+	old.IP += h.IP
+	old.Visits += h.Visits
+	return db.Model(&old).Updates(&old).Error
+}
+
+// FindHourly 查询指定日期范围内域名或url的流量,daily为true时只查询全天的流量,否则只查询每小时的流量
+func FindHourly(domain, url, start, end string, daily bool) ([]*Hourly, error) {
+	var data []*Hourly
+	query := db.Where("domain = ? AND url = ? AND date >= ? AND date <= ?", domain, url, start, end)
+	if daily {
+		query = query.Where("hour = ?", HourAll)
+	} else {
+		query = query.Where("hour >= 0")
+	}
+	err := query.Order("date, hour").Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
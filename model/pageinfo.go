@@ -3,9 +3,9 @@ package model
 // Pageinfo 页面信息
 type Pageinfo struct {
 	Model
-	Dm    string `json:"dm"`    // 域名
-	URL   string `json:"url"`   // 网址
-	Title string `json:"title"` // 标题
+	Dm    string `json:"dm"`                      // 域名
+	URL   string `gorm:"unique_index" json:"url"` // 网址
+	Title string `json:"title"`                   // 标题
 	// Keywords 关键词
 	Keywords      string `json:"keywords"`
 	Description   string `json:"description"`
@@ -18,8 +18,3 @@ type Pageinfo struct {
 	Author        string `json:"author"`
 	Source        string `json:"source"`
 }
-
-// FirstOrCreate 存在就更新,不存在就创建
-func (p *Pageinfo) FirstOrCreate() error {
-	return db.Where(Pageinfo{URL: p.URL}).FirstOrCreate(p).Error
-}
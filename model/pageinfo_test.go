@@ -0,0 +1,65 @@
+package model
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/codepository/GoWebAnalytics/config"
+)
+
+func setupSqlite(t *testing.T) {
+	SetupWith(&config.Configuration{DbType: "sqlite3", DbName: ":memory:", DbLogMode: "false", DbMaxIdleConns: "1", DbMaxOpenConns: "1"})
+	t.Cleanup(func() { db.Close() })
+}
+
+// TestPageinfoUnique 同时保存相同的页面只保留一条,之前重复的页面信息不会使流量成倍增加
+func TestPageinfoUnique(t *testing.T) {
+	setupSqlite(t)
+	for _, w := range []*WebFlow{
+		{Domain: "example.com", URL: "/a", Date: "2020-01-01", PV: 2, UV: 1},
+		{Domain: "example.com", URL: "/a", Date: "2020-01-02", PV: 3, UV: 2},
+	} {
+		if err := db.Create(w).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := Store.FirstOrCreatePageinfo(&Pageinfo{URL: "/a", Title: "A"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	count := func() (n int) {
+		db.Model(&Pageinfo{}).Where("url = ?", "/a").Count(&n)
+		return
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("保存了%d条页面信息,期望1条", n)
+	}
+	// 增加唯一索引之前保存的重复页面信息
+	if err := db.Model(&Pageinfo{}).RemoveIndex("uix_pageinfo_url").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&Pageinfo{URL: "/a", Title: "A2"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	top, err := FindTopContent(&TopContentQuery{Domain: "example.com", Start: "2020-01-01", End: "2020-01-02", Sort: "pv", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 1 || top[0].PV != 5 || top[0].UV != 3 {
+		t.Fatalf("排名为 %+v,期望 /a 的 PV 5、UV 3", top)
+	}
+	migrate("")
+	if n := count(); n != 1 {
+		t.Fatalf("迁移后剩余%d条页面信息,期望1条", n)
+	}
+	if !db.Dialect().HasIndex("pageinfo", "uix_pageinfo_url") {
+		t.Fatal("迁移后应有唯一索引")
+	}
+}
@@ -1,9 +1,5 @@
 package model
 
-import (
-	"github.com/jinzhu/gorm"
-)
-
 // RealtimeWebflow 实时网页流量
 type RealtimeWebflow struct {
 	Model
@@ -13,18 +9,3 @@ type RealtimeWebflow struct {
 	UV     int64  `json:"uv"`
 	Date   string `json:"date"`
 }
-
-// Save 创建
-func (r *RealtimeWebflow) Save() error {
-	return db.Create(r).Error
-}
-
-// FindRealtimeDataByDomainAndStartDate 根据域名和开始日期查询实时网页流量
-func FindRealtimeDataByDomainAndStartDate(domain, startDate string) ([]*RealtimeWebflow, error) {
-	var data []*RealtimeWebflow
-	err := db.Where("domain = ? AND date > ?", domain, startDate).Find(&data).Error
-	if err != nil && err != gorm.ErrRecordNotFound {
-		return nil, err
-	}
-	return data, nil
-}
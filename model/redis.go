@@ -4,6 +4,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/codepository/GoWebAnalytics/memredis"
 	redis "github.com/go-redis/redis"
 )
 
@@ -23,6 +24,10 @@ type client interface {
 	ExpireAt(key string, tm time.Time) *redis.BoolCmd
 	HGet(key, field string) *redis.StringCmd
 	HGetAll(key string) *redis.StringStringMapCmd
+	// Incr 值加1
+	Incr(key string) *redis.IntCmd
+	// HIncrBy 字段值加上增量
+	HIncrBy(key, field string, incr int64) *redis.IntCmd
 	// HExists 判断是否存在
 	HExists(key, field string) *redis.BoolCmd
 	// HMset 设置值
@@ -44,38 +49,67 @@ type client interface {
 	SCard(key string) *redis.IntCmd
 	// SPopN 从集合中pop n个元素
 	SPopN(key string, count int64) *redis.StringSliceCmd
+	// SMembers 集合所有元素
+	SMembers(key string) *redis.StringSliceCmd
+	// PFAdd 添加值到 HyperLogLog
+	PFAdd(key string, els ...interface{}) *redis.IntCmd
+	// PFCount HyperLogLog 基数,多个key时为合并后的基数
+	PFCount(keys ...string) *redis.IntCmd
+	// SetBit 设置 bitmap 的位,返回原来的值
+	SetBit(key string, offset int64, value int) *redis.IntCmd
+	// Set 设置值
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	// ZAdd 添加值到有序集合
+	ZAdd(key string, members ...*redis.Z) *redis.IntCmd
+	// ZRangeByScore 按分数查询有序集合
+	ZRangeByScore(key string, opt *redis.ZRangeBy) *redis.StringSliceCmd
+	// ZRem 从有序集合删除值
+	ZRem(key string, members ...interface{}) *redis.IntCmd
 	// Pipeline 管道
 	Pipeline() redis.Pipeliner
+	// TxPipeline 事务管道
+	TxPipeline() redis.Pipeliner
 	Watch(fn func(*redis.Tx) error, keys ...string) error
 	Get(key string) *redis.StringCmd
+	// Eval、EvalSha、ScriptExists、ScriptLoad 执行 lua 脚本,用于 redis.Script
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+	EvalSha(sha1 string, keys []string, args ...interface{}) *redis.Cmd
+	ScriptExists(hashes ...string) *redis.BoolSliceCmd
+	ScriptLoad(script string) *redis.StringCmd
 }
 
-// SetRedis 设置redis
-func SetRedis() {
+// SetRedis 设置redis,配置 RedisInMemory 为 true 时使用进程内的 redis
+// 连接失败时返回错误,不改用进程内的 redis:缓存保存到进程内后其它实例和报表都看不到,预写日志也会被删除
+func SetRedis() error {
+	if conf.RedisInMemory == "true" {
+		useMemRedis()
+		return nil
+	}
 	log.Println("启动redis")
+	addr := conf.RedisHost + ":" + conf.RedisPort
 	if conf.RedisCluster == "true" {
-		// clusterIsOpen = true
 		RedisCli = redis.NewClusterClient(&redis.ClusterOptions{
-			Addrs:    []string{conf.RedisHost + ":" + conf.RedisPort},
+			Addrs:    []string{addr},
 			Password: conf.RedisPassword,
 		})
-		_, err := RedisCli.Ping().Result()
-		if err != nil {
-			log.Printf("连接 redis cluster：%s 失败,原因：%v\n", conf.RedisHost+":"+conf.RedisPort, err)
-		} else {
-			RedisOpen = true
-		}
-
 	} else {
 		RedisCli = redis.NewClient(&redis.Options{
-			Addr:     conf.RedisHost + ":" + conf.RedisPort,
+			Addr:     addr,
 			Password: conf.RedisPassword,
 		})
-		_, err := RedisCli.Ping().Result()
-		if err != nil {
-			log.Printf("连接 redis：%s 失败,原因：%v\n", conf.RedisHost+":"+conf.RedisPort, err)
-		} else {
-			RedisOpen = true
-		}
 	}
+	if err := RedisCli.Ping().Err(); err != nil {
+		log.Printf("连接 redis：%s 失败,原因：%v\n", addr, err)
+		RedisCli.Close()
+		return err
+	}
+	RedisOpen = true
+	return nil
+}
+
+// useMemRedis 使用进程内的 redis,数据只保存在内存中,重启后丢失
+func useMemRedis() {
+	log.Println("使用进程内的 redis,重启后未保存到数据库的数据将丢失")
+	RedisCli = memredis.NewClient()
+	RedisOpen = true
 }
@@ -0,0 +1,142 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 汇总周期
+const (
+	PeriodWeek  = "week"  // 周一至周日
+	PeriodMonth = "month" // 自然月
+)
+
+// 去重计数的类型
+const (
+	SketchUV = "uv"
+	SketchIP = "ip"
+)
+
+// Sketch 每日用户或ip的 HyperLogLog,URL为空时为整个域名,用于计算任意日期范围内去重后的 UV、IP
+type Sketch struct {
+	Model
+	Domain string `gorm:"index:idx_sketch" json:"domain"`
+	URL    string `json:"url"`
+	Date   string `gorm:"index:idx_sketch" json:"date"`
+	Kind   string `json:"kind"` // uv、ip
+	Data   []byte `json:"-"`    // redis HyperLogLog 序列化后的值
+}
+
+// Rollup 每周、每月汇总的流量,URL为空时为整个域名,UV、IP 由每日 Sketch 合并计算
+type Rollup struct {
+	Model
+	Domain   string `gorm:"index:idx_rollup" json:"domain"`
+	URL      string `json:"url"`
+	Period   string `gorm:"index:idx_rollup" json:"period"` // week、month
+	Start    string `gorm:"index:idx_rollup" json:"start"`  // 周期第一天yyyy-mm-dd
+	End      string `json:"end"`                            // 已汇总的最后一天
+	PV       int    `json:"pv"`
+	UV       int    `json:"uv"`
+	IP       int    `json:"ip"`
+	Visits   int    `json:"visits"`
+	Duration int    `json:"duration"`
+	Bounce   int    `json:"bounce"`
+	Entries  int    `json:"entries"`
+	Exits    int    `json:"exits"`
+}
+
+// Save 保存,已存在相同日期的 Sketch 时替换
+func (s *Sketch) Save() error {
+	err := db.Where("domain = ? AND url = ? AND date = ? AND kind = ?", s.Domain, s.URL, s.Date, s.Kind).
+		Delete(&Sketch{}).Error
+	if err != nil {
+		return err
+	}
+	return db.Create(s).Error
+}
+
+// FindSketches 查询指定日期范围内所有的 Sketch
+func FindSketches(start, end string) ([]*Sketch, error) {
+	var data []*Sketch
+	err := db.Where("date >= ? AND date <= ?", start, end).Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
+
+// FindDomainSketches 查询域名或url指定日期范围内的 Sketch
+func FindDomainSketches(domain, url, kind, start, end string) ([]*Sketch, error) {
+	var data []*Sketch
+	err := db.Where("domain = ? AND url = ? AND kind = ? AND date >= ? AND date <= ?", domain, url, kind, start, end).
+		Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Save 保存,已存在相同周期的汇总时替换
+func (r *Rollup) Save() error {
+	old := Rollup{}
+	err := db.Where("domain = ? AND url = ? AND period = ? AND start = ?", r.Domain, r.URL, r.Period, r.Start).First(&old).Error
+	if err == gorm.ErrRecordNotFound {
+		return db.Create(r).Error
+	}
+	if err != nil {
+		return err
+	}
+	r.ID = old.ID
+	return db.Save(r).Error
+}
+
+// FindRollups 查询域名或url开始日期在指定范围内的汇总
+func FindRollups(domain, url, period, start, end string) ([]*Rollup, error) {
+	var data []*Rollup
+	err := db.Where("domain = ? AND url = ? AND period = ? AND start >= ? AND start <= ?", domain, url, period, start, end).
+		Order("start").Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
+
+// FindTopRollups 查询域名一个周期内每个url的汇总,按排序字段降序分页返回
+func FindTopRollups(q *TopContentQuery, period string) ([]*Rollup, error) {
+	if !topContentSortFields[q.Sort] {
+		return nil, fmt.Errorf("不支持的排序字段:%s", q.Sort)
+	}
+	var data []*Rollup
+	query := db.Where("domain = ? AND url <> '' AND period = ? AND start = ?", q.Domain, period, q.Start)
+	if len(q.Prefix) > 0 {
+		query = query.Where("url LIKE ? ESCAPE '!'", escapeLike(q.Prefix)+"%")
+	}
+	err := query.Order(q.Sort + " DESC").Limit(q.Limit).Offset(q.Offset).Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
+
+// SumRollupCounters 汇总指定日期范围内域名(hourly 全天)和url(web_flow)的流量,不含 UV、IP
+func SumRollupCounters(start, end string) ([]*Rollup, error) {
+	var domains []*Rollup
+	err := db.Table("hourly").
+		Select("domain, '' AS url, SUM(pv) AS pv, SUM(visits) AS visits").
+		Where("url = '' AND hour = ? AND date >= ? AND date <= ?", HourAll, start, end).
+		Group("domain").Scan(&domains).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	var urls []*Rollup
+	err = db.Table("web_flow").
+		Select("domain, url, SUM(pv) AS pv, SUM(visits) AS visits, SUM(duration) AS duration, "+
+			"SUM(bounce) AS bounce, SUM(entries) AS entries, SUM(exits) AS exits").
+		Where("date >= ? AND date <= ?", start, end).
+		Group("domain, url").Scan(&urls).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return append(domains, urls...), nil
+}
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Session 用户的一次访问,半小时内没有新的访问时结束
+type Session struct {
+	Model
+	SID        string    `gorm:"unique_index" json:"sid"` // 会话id
+	UID        string    `gorm:"index" json:"uid"`        // 用户id
+	Domain     string    `gorm:"index" json:"domain"`     // 域名
+	StartTime  time.Time `json:"startTime"`               // 第一次访问时间
+	EndTime    time.Time `json:"endTime"`                 // 最后一次访问或关闭页面时间
+	EntryURL   string    `json:"entryUrl"`                // 入口页
+	ExitURL    string    `json:"exitUrl"`                 // 退出页
+	Pages      int       `json:"pages"`                   // 浏览页面数
+	Duration   int       `json:"duration"`                // 浏览时长(秒)
+	Referrer   string    `json:"referrer"`                // 来源页面
+	IP         string    `json:"ip"`
+	Region     string    `json:"region"`     // 区域
+	Platform   string    `json:"platform"`   // 操作系统
+	Browser    string    `json:"browser"`    // 浏览器
+	DeviceType int       `json:"devicetype"` // 终端类型 0为电脑、1为手机
+}
+
+// SaveSessions 批量保存会话
+func SaveSessions(sessions []*Session) error {
+	tx := db.Begin()
+	for _, s := range sessions {
+		if err := tx.Create(s).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// FindSessions 按开始时间倒序查询域名的会话,uid为空时查询所有用户
+func FindSessions(domain, uid string, limit, offset int) ([]*Session, error) {
+	var data []*Session
+	query := db.Where("domain = ?", domain)
+	if len(uid) > 0 {
+		query = query.Where("uid = ?", uid)
+	}
+	err := query.Order("start_time DESC").Limit(limit).Offset(offset).Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// 来源类型
+const (
+	SourceDirect   = "direct"   // 直接访问
+	SourceSearch   = "search"   // 搜索引擎
+	SourceSocial   = "social"   // 社交网站
+	SourceExternal = "external" // 外部链接
+	SourceInternal = "internal" // 站内跳转
+	SourceCampaign = "campaign" // 推广活动(utm_*)
+)
+
+// Source 每日流量来源
+type Source struct {
+	Model
+	Domain   string `json:"domain"`   // 域名
+	Date     string `json:"date"`     // 日期yyyy-mm-dd
+	Type     string `json:"type"`     // 来源类型
+	Name     string `json:"name"`     // 来源名称:搜索引擎、社交网站、外部链接域名或utm_source
+	Keyword  string `json:"keyword"`  // 搜索关键词或utm_term
+	Medium   string `json:"medium"`   // utm_medium
+	Campaign string `json:"campaign"` // utm_campaign
+	PV       int    `json:"pv"`       // 页面浏览量
+	Visits   int    `json:"visits"`   // 访问次数(半个小时内多次算一次)
+}
+
+// Save save
+func (s *Source) Save() error {
+	return db.Save(s).Error
+}
+
+// UpdateOrSave 存在就更新否则就保存
+func (s *Source) UpdateOrSave() error {
+	if len(s.Domain) == 0 || len(s.Date) == 0 || len(s.Type) == 0 {
+		return errors.New("Source的domain、date和type不能为空")
+	}
+	fields := map[string]interface{}{
+		"domain":   s.Domain,
+		"date":     s.Date,
+		"type":     s.Type,
+		"name":     s.Name,
+		"keyword":  s.Keyword,
+		"medium":   s.Medium,
+		"campaign": s.Campaign,
+	}
+	old := Source{}
+	err := db.Where(fields).First(&old).Error
+	if err == gorm.ErrRecordNotFound {
+		return s.Save()
+	}
+	if err != nil {
+		return err
+	}
+	old.PV += s.PV
+	old.Visits += s.Visits
+	return db.Model(&old).Updates(&old).Error
+}
+
+// FindSources 查询指定日期范围内的流量来源,sourceType为空时查询所有类型
+func FindSources(domain, sourceType, start, end string) ([]*Source, error) {
+	var data []*Source
+	query := db.Model(&Source{}).
+		Select("domain, type, name, keyword, medium, campaign, sum(pv) as pv, sum(visits) as visits").
+		Where("domain = ? AND date >= ? AND date <= ?", domain, start, end)
+	if len(sourceType) > 0 {
+		query = query.Where("type = ?", sourceType)
+	}
+	err := query.Group("domain, type, name, keyword, medium, campaign").Order("pv desc").Scan(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,111 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Storage 保存流量统计的存储,由配置 DbType 选择数据库
+type Storage interface {
+	// UpdateOrSaveWebFlow 存在就累加,否则就保存
+	UpdateOrSaveWebFlow(w *WebFlow) error
+	// UpdateOrSaveBrowsing 存在就累加,否则就保存
+	UpdateOrSaveBrowsing(b *Browsing) error
+	// FirstOrCreatePageinfo 不存在相同url的页面信息时创建
+	FirstOrCreatePageinfo(p *Pageinfo) error
+	// SaveRealtimeWebflow 保存实时网页流量
+	SaveRealtimeWebflow(r *RealtimeWebflow) error
+	// FindRealtimeWebflows 根据域名和开始日期查询实时网页流量
+	FindRealtimeWebflows(domain, startDate string) ([]*RealtimeWebflow, error)
+	// GetAllRegistryDomains 获取所有注册的域名
+	GetAllRegistryDomains() ([]*Domainmgr, error)
+	// Close 关闭连接
+	Close() error
+}
+
+// Store 当前使用的存储
+var Store Storage
+
+// gormStore 通过 gorm 访问 mysql、postgres 或 sqlite
+type gormStore struct {
+	db *gorm.DB
+}
+
+func (s *gormStore) UpdateOrSaveWebFlow(w *WebFlow) error {
+	if len(w.URL) == 0 || len(w.Domain) == 0 {
+		return errors.New("Webflow的url和domain不能为空")
+	}
+	old := WebFlow{}
+	err := s.db.Where("domain = ? AND url = ? AND date = ?", w.Domain, w.URL, w.Date).First(&old).Error
+	if err == gorm.ErrRecordNotFound {
+		return s.db.Save(w).Error
+	}
+	if err != nil {
+		return err
+	}
+	old.PV += w.PV
+	old.IP += w.IP
+	old.UV += w.UV
+	old.Duration += w.Duration
+	old.Visits += w.Visits
+	old.Bounce += w.Bounce
+	old.Entries += w.Entries
+	old.Exits += w.Exits
+	return s.db.Model(&old).Updates(&old).Error
+}
+
+func (s *gormStore) UpdateOrSaveBrowsing(b *Browsing) error {
+	if len(b.UID) == 0 || len(b.Domain) == 0 || len(b.Date) == 0 {
+		return errors.New("Browsing的uid、date和domain不能为空")
+	}
+	old := Browsing{}
+	err := s.db.Where("uid = ? AND domain = ? AND date = ?", b.UID, b.Domain, b.Date).First(&old).Error
+	if err == gorm.ErrRecordNotFound {
+		return s.db.Save(b).Error
+	}
+	if err != nil {
+		return err
+	}
+	old.Duration += b.Duration
+	old.IP += b.IP
+	old.PV += b.PV
+	old.Pageopend += b.Pageopend
+	old.Visits += b.Visits
+	old.Depth += b.Depth
+	return s.db.Model(&old).Updates(&old).Error
+}
+
+// FirstOrCreatePageinfo url 有唯一索引,同时保存相同的页面时保留已有的纪录
+func (s *gormStore) FirstOrCreatePageinfo(p *Pageinfo) error {
+	upsert := "ON CONFLICT (url) DO UPDATE SET url = excluded.url"
+	if s.db.Dialect().GetName() == "mysql" {
+		upsert = "ON DUPLICATE KEY UPDATE url = VALUES(url)"
+	}
+	return s.db.Set("gorm:insert_option", upsert).Create(p).Error
+}
+
+func (s *gormStore) SaveRealtimeWebflow(r *RealtimeWebflow) error {
+	return s.db.Create(r).Error
+}
+
+func (s *gormStore) FindRealtimeWebflows(domain, startDate string) ([]*RealtimeWebflow, error) {
+	var data []*RealtimeWebflow
+	err := s.db.Where("domain = ? AND date > ?", domain, startDate).Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *gormStore) GetAllRegistryDomains() ([]*Domainmgr, error) {
+	var data []*Domainmgr
+	if err := s.db.Find(&data).Error; err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *gormStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,96 @@
+package model
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// 用户角色
+const (
+	RoleRead  = "read"  // 查询所属域名的统计数据
+	RoleAdmin = "admin" // 查询并管理所属域名
+)
+
+// User 接口用户,通过 token 访问所属域名
+type User struct {
+	Model
+	Name      string      `json:"name"`
+	TokenHash string      `gorm:"unique_index" json:"-"` // token 的 sha256,不保存明文
+	Role      string      `json:"role"`
+	Domains   []Domainmgr `gorm:"many2many:user_domain" json:"domains"`
+}
+
+// Save 保存用户及所属域名
+func (u *User) Save() error {
+	return db.Create(u).Error
+}
+
+// Update 更新用户角色及所属域名
+func (u *User) Update() error {
+	tx := db.Begin()
+	if err := tx.Model(u).Updates(map[string]interface{}{"name": u.Name, "role": u.Role}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Model(u).Association("Domains").Replace(u.Domains).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Delete 删除用户及其域名关联
+func (u *User) Delete() error {
+	tx := db.Begin()
+	if err := tx.Model(u).Association("Domains").Clear().Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(u).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// FindUserByTokenHash 根据 token 的 sha256 查询用户
+func FindUserByTokenHash(hash string) (*User, error) {
+	var u User
+	err := db.Preload("Domains").Where("token_hash = ?", hash).First(&u).Error
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// FindUserByID 根据id查询用户
+func FindUserByID(id int) (*User, error) {
+	var u User
+	err := db.Preload("Domains").Where("id = ?", id).First(&u).Error
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// FindAllUsers 查询所有用户
+func FindAllUsers() ([]*User, error) {
+	var data []*User
+	err := db.Preload("Domains").Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
+
+// FindDomainsByName 根据域名查询
+func FindDomainsByName(names []string) ([]Domainmgr, error) {
+	var data []Domainmgr
+	if len(names) == 0 {
+		return data, nil
+	}
+	err := db.Where("domain IN (?)", names).Find(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
+}
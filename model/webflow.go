@@ -1,7 +1,10 @@
 package model
 
 import (
-	"errors"
+	"fmt"
+	"math"
+	"strings"
+
 	"github.com/jinzhu/gorm"
 )
 
@@ -15,56 +18,81 @@ type WebFlow struct {
 	UV       int    `json:"uv"`       // 独立访问者数
 	Duration int    `json:"duration"` // 浏览时长
 	Visits   int    `json:"visits"`   // 访问次数(半个小时内多次算一次)
-	Bounce   int    `json:"bounce"`   // Bounce 只访问一次就跳出
+	Bounce   int    `json:"bounce"`   // Bounce 以该页面为入口且只访问一个页面的访问次数
+	Entries  int    `json:"entries"`  // 以该页面为入口的访问次数
+	Exits    int    `json:"exits"`    // 以该页面为最后一个页面的访问次数
 	Date     string `json:"date"`     // 日期yyyy-mm-dd
+	// BounceRate 跳出率 Bounce/Entries,不保存
+	BounceRate float64 `gorm:"-" json:"bounceRate"`
 }
 
-// Save Save
-func (w *WebFlow) Save() error {
-	return db.Save(w).Error
-}
-
-// UpdateOrSave 如果存在就更新，否则就保存
-func (w *WebFlow) UpdateOrSave() error {
-	if len(w.URL) == 0 || len(w.Domain) == 0 {
-		return errors.New("Webflow的url和domain不能为空")
+// SetBounceRate 计算跳出率
+func (w *WebFlow) SetBounceRate() {
+	if w.Entries <= 0 {
+		w.BounceRate = 0
+		return
 	}
-	fields := map[string]interface{}{
-		"domain": w.Domain,
-		"url":    w.URL,
-		"date":   w.Date,
-	}
-	wf, err := findFirst(fields)
+	w.BounceRate = math.Round(float64(w.Bounce)/float64(w.Entries)*10000) / 10000
+}
 
-	if err == gorm.ErrRecordNotFound {
-		return w.Save()
-	}
-	if err != nil {
-		return err
-	}
-	wf.PV += w.PV
-	wf.IP += w.IP
-	wf.UV += w.UV
-	wf.Duration += w.Duration
-	wf.Visits += w.Visits
-	wf.Bounce += w.Bounce
-	return wf.Update()
+// TopContentQuery url流量排名查询条件
+type TopContentQuery struct {
+	Domain string
+	Start  string // 开始日期yyyy-mm-dd,包含
+	End    string // 结束日期yyyy-mm-dd,包含
+	Prefix string // url前缀,为空时不过滤
+	Sort   string // 排序字段,必须是 pv、ip、uv、visits、duration、bounce、entries、exits 之一
+	Limit  int
+	Offset int
+}
 
+// TopContent 汇总后的url流量
+type TopContent struct {
+	URL      string `json:"url"`
+	Title    string `json:"title"`
+	PV       int    `json:"pv"`
+	IP       int    `json:"ip"`
+	UV       int    `json:"uv"`
+	Duration int    `json:"duration"`
+	Visits   int    `json:"visits"`
+	Bounce   int    `json:"bounce"`
+	Entries  int    `json:"entries"`
+	Exits    int    `json:"exits"`
 }
 
-// Update update
-func (w *WebFlow) Update() error {
-	return db.Model(w).Updates(w).Error
+// topContentSortFields 允许排序的字段
+var topContentSortFields = map[string]bool{
+	"pv": true, "ip": true, "uv": true, "visits": true, "duration": true, "bounce": true, "entries": true, "exits": true,
 }
 
-// findFirst 查找一第个
-func findFirst(fields map[string]interface{}) (*WebFlow, error) {
-	w := WebFlow{}
-	err := db.Where(fields).First(&w).Error
-	return &w, err
+// FindTopContent 汇总指定日期范围内每个url的流量,按排序字段降序分页返回
+func FindTopContent(q *TopContentQuery) ([]*TopContent, error) {
+	if !topContentSortFields[q.Sort] {
+		return nil, fmt.Errorf("不支持的排序字段:%s", q.Sort)
+	}
+	var data []*TopContent
+	query := db.Table("web_flow AS w").
+		Select("w.url AS url, MAX(p.title) AS title, SUM(w.pv) AS pv, SUM(w.ip) AS ip, SUM(w.uv) AS uv, "+
+			"SUM(w.duration) AS duration, SUM(w.visits) AS visits, SUM(w.bounce) AS bounce, "+
+			"SUM(w.entries) AS entries, SUM(w.exits) AS exits").
+		// 每个url只取一个标题,重复的页面信息不会使流量成倍增加
+		Joins("LEFT JOIN (SELECT url, MAX(title) AS title FROM pageinfo GROUP BY url) AS p ON p.url = w.url").
+		Where("w.domain = ? AND w.date >= ? AND w.date <= ?", q.Domain, q.Start, q.End)
+	if len(q.Prefix) > 0 {
+		query = query.Where("w.url LIKE ? ESCAPE '!'", escapeLike(q.Prefix)+"%")
+	}
+	err := query.Group("w.url").
+		Order(q.Sort + " DESC").
+		Limit(q.Limit).
+		Offset(q.Offset).
+		Scan(&data).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return data, nil
 }
 
-// FindTopContent FindTopContent
-func FindTopContent(domain, start, end string) ([]*WebFlow, error) {
-	return nil, nil
+// escapeLike 转义 LIKE 中的通配符,使用 ESCAPE '!',不同数据库对反斜杠的处理不一致
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
 }
@@ -1,19 +1,58 @@
 package router
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/codepository/GoWebAnalytics/config"
 	"github.com/codepository/GoWebAnalytics/controller"
+	"github.com/codepository/GoWebAnalytics/model"
+	"github.com/codepository/GoWebAnalytics/service"
 )
 
 // Mux 路由
 var Mux = http.NewServeMux()
 var conf = *config.Config
 
+// interceptor 公开接口,只处理跨域
 func interceptor(h http.HandlerFunc) http.HandlerFunc {
 	return crossOrigin(h)
 }
+
+// authInterceptor 需要身份认证的接口,role 为访问所需的最低角色
+func authInterceptor(role string, h http.HandlerFunc) http.HandlerFunc {
+	return crossOrigin(authorize(role, h))
+}
+
+// authorize 验证token,请求带有 domain 参数时验证是否有该域名的权限
+func authorize(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 跨域预检请求不带token
+		if r.Method == http.MethodOptions {
+			return
+		}
+		token, err := controller.GetToken(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		identity, err := service.CheckIdentity(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !identity.HasRole(role) {
+			http.Error(w, "没有访问权限", http.StatusForbidden)
+			return
+		}
+		r.ParseForm()
+		if domain := r.Form.Get("domain"); len(domain) > 0 && !identity.Can(role, domain) {
+			http.Error(w, "没有访问该域名的权限", http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(service.WithIdentity(r.Context(), identity)))
+	}
+}
 func crossOrigin(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", conf.AccessControlAllowOrigin)
@@ -26,10 +65,25 @@ func init() {
 	setMux()
 }
 func setMux() {
-	Mux.HandleFunc("/api/v1/test/test", controller.Test)
+	Mux.HandleFunc("/api/v1/test/test", authInterceptor(service.RoleRoot, controller.Test))
 	Mux.HandleFunc("/api/v1/test/index", interceptor(controller.Index))
+	Mux.HandleFunc("/api/v1/tongji/tongji.js", interceptor(controller.TongjiJS))
 	Mux.HandleFunc("/api/v1/tongji/webdata", interceptor(controller.WebData))
+	Mux.HandleFunc("/api/v1/tongji/pixel.gif", interceptor(controller.Pixel))
 	Mux.HandleFunc("/api/v1/tongji/close", interceptor(controller.CloseWeb))
-	Mux.HandleFunc("/api/v1/tongji/getRealtimeData", interceptor(controller.GetRealtimeData))
-	Mux.HandleFunc("/api/v1/tongji/getTopContent", interceptor(controller.GetTopContent))
+	Mux.HandleFunc("/api/v1/tongji/getRealtimeData", authInterceptor(model.RoleRead, controller.GetRealtimeData))
+	Mux.HandleFunc("/api/v1/tongji/getTopContent", authInterceptor(model.RoleRead, controller.GetTopContent))
+	Mux.HandleFunc("/api/v1/tongji/getTopEntries", authInterceptor(model.RoleRead, controller.GetTopEntries))
+	Mux.HandleFunc("/api/v1/tongji/getTopExits", authInterceptor(model.RoleRead, controller.GetTopExits))
+	Mux.HandleFunc("/api/v1/tongji/getSources", authInterceptor(model.RoleRead, controller.GetSources))
+	Mux.HandleFunc("/api/v1/tongji/getEvents", authInterceptor(model.RoleRead, controller.GetEvents))
+	Mux.HandleFunc("/api/v1/tongji/trend", authInterceptor(model.RoleRead, controller.GetTrend))
+	Mux.HandleFunc("/api/v1/tongji/getSessions", authInterceptor(model.RoleRead, controller.GetSessions))
+	Mux.HandleFunc("/api/v1/tongji/getGoals", authInterceptor(model.RoleRead, controller.GetGoalReports))
+	Mux.HandleFunc("/api/v1/domain", authInterceptor(model.RoleRead, controller.Domain))
+	Mux.HandleFunc("/api/v1/goal", authInterceptor(model.RoleRead, controller.Goal))
+	Mux.HandleFunc("/api/v1/domain/unregistered", authInterceptor(service.RoleRoot, controller.GetUnregisteredDomains))
+	Mux.HandleFunc("/api/v1/user", authInterceptor(service.RoleRoot, controller.User))
+	Mux.HandleFunc("/api/v1/bot/reload", authInterceptor(service.RoleRoot, controller.ReloadBotRules))
+	Mux.HandleFunc("/debug/vars", authInterceptor(service.RoleRoot, expvar.Handler().ServeHTTP))
 }
@@ -0,0 +1,241 @@
+package router
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/config"
+	"github.com/codepository/GoWebAnalytics/connmgr"
+	"github.com/codepository/GoWebAnalytics/memredis"
+	"github.com/codepository/GoWebAnalytics/model"
+	"github.com/codepository/GoWebAnalytics/service"
+)
+
+const userAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// TestMain 测试使用项目根目录的配置
+func TestMain(m *testing.M) {
+	var c config.Configuration
+	b, err := ioutil.ReadFile("../config.json")
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.SetForTest(&c)
+	os.Exit(m.Run())
+}
+
+// post 模拟浏览器发送采集请求
+func post(path, ip string, body interface{}) int {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(b)))
+	req.RemoteAddr = ip + ":52000"
+	req.Header.Set("User-Agent", userAgent)
+	w := httptest.NewRecorder()
+	Mux.ServeHTTP(w, req)
+	return w.Code
+}
+
+// waitFor 等待异步处理完成
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// setupFakes 使用进程内的 redis 和 sqlite 内存数据库,注册域名 example.com
+func setupFakes(t *testing.T) *redis.Client {
+	c := *config.Config
+	c.DbType, c.DbName, c.DbLogMode = "sqlite3", ":memory:", "false"
+	model.SetupWith(&c)
+	rdb := memredis.NewClient()
+	model.RedisCli = rdb
+	d := &model.Domainmgr{Domain: "example.com", Enabled: true, SiteKey: "sitekey"}
+	if err := d.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.RefreshDomainCache(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rdb.Close()
+		model.GetDB().Close()
+	})
+	return rdb
+}
+
+// TestAuthorize 接口按角色和所属域名授权
+func TestAuthorize(t *testing.T) {
+	setupFakes(t)
+	other := &model.Domainmgr{Domain: "other.com", Enabled: true}
+	if err := other.Save(); err != nil {
+		t.Fatal(err)
+	}
+	old := config.Config.AdminToken
+	config.Config.AdminToken = "roottoken"
+	defer func() { config.Config.AdminToken = old }()
+	tokens := map[string]string{"root": "roottoken"}
+	for _, u := range []service.UserReq{
+		{Name: "reader", Role: model.RoleRead, Domains: []string{"example.com"}},
+		{Name: "admin", Role: model.RoleAdmin, Domains: []string{"example.com"}},
+	} {
+		s, err := service.AddUser(&u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r struct{ Token string }
+		json.Unmarshal([]byte(s), &r)
+		tokens[u.Name] = r.Token
+	}
+	cases := []struct {
+		name   string
+		role   string
+		method string
+		user   string
+		domain string
+		want   int
+	}{
+		{"没有token", model.RoleRead, http.MethodGet, "", "", http.StatusUnauthorized},
+		{"token无效", model.RoleRead, http.MethodGet, "bad", "", http.StatusUnauthorized},
+		{"跨域预检不验证", model.RoleAdmin, http.MethodOptions, "", "", http.StatusOK},
+		{"查询所属域名", model.RoleRead, http.MethodGet, "reader", "example.com", http.StatusOK},
+		{"查询其它域名", model.RoleRead, http.MethodGet, "reader", "other.com", http.StatusForbidden},
+		{"只读用户管理域名", model.RoleAdmin, http.MethodPost, "reader", "example.com", http.StatusForbidden},
+		{"管理员管理所属域名", model.RoleAdmin, http.MethodPost, "admin", "example.com", http.StatusOK},
+		{"管理员不能管理用户", service.RoleRoot, http.MethodGet, "admin", "", http.StatusForbidden},
+		{"超级管理员管理用户", service.RoleRoot, http.MethodGet, "root", "", http.StatusOK},
+		{"超级管理员查询任意域名", model.RoleRead, http.MethodGet, "root", "other.com", http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var called *service.Identity
+			h := authorize(c.role, func(w http.ResponseWriter, r *http.Request) {
+				called = service.GetIdentity(r.Context())
+			})
+			req := httptest.NewRequest(c.method, "/api?domain="+c.domain, nil)
+			if token, ok := tokens[c.user]; ok {
+				req.Header.Set("Authorization", "Bearer "+token)
+			} else if len(c.user) > 0 {
+				req.Header.Set("Authorization", "Bearer "+c.user)
+			}
+			w := httptest.NewRecorder()
+			h(w, req)
+			if w.Code != c.want {
+				t.Fatalf("返回%d,期望%d:%s", w.Code, c.want, w.Body.String())
+			}
+			if c.method != http.MethodOptions && (called != nil) != (c.want == http.StatusOK) {
+				t.Fatalf("返回%d时接口调用为 %v", w.Code, called)
+			}
+		})
+	}
+}
+
+// TestWebDataToDB 采集请求经过连接管理器和redis,最终保存到数据库
+func TestWebDataToDB(t *testing.T) {
+	rdb := setupFakes(t)
+	config.Config.JournalDir = t.TempDir()
+	if err := connmgr.New(); err != nil {
+		t.Fatal(err)
+	}
+	defer connmgr.CM.Stop()
+
+	date := util.GetDateAsDefaultStr()
+	pageA, pageB := "https://example.com/a", "https://example.com/b"
+	hits := []struct {
+		uid, ip, url, title string
+	}{
+		{"u1", "10.0.0.1", pageA, "A"},
+		{"u1", "10.0.0.1", pageB, "B"},
+		{"u2", "10.0.0.2", pageA, "A"},
+	}
+	for _, h := range hits {
+		code := post("/api/v1/tongji/webdata", h.ip, map[string]interface{}{
+			"p": map[string]string{"url": h.url, "title": h.title},
+			"b": map[string]string{"domain": "example.com", "uid": h.uid},
+			"k": "sitekey",
+		})
+		if code != http.StatusOK {
+			t.Fatalf("采集请求返回%d", code)
+		}
+		// 同一用户的访问按顺序处理
+		waitFor(t, "处理采集请求", func() bool {
+			return rdb.HGet(service.GetRedisVisitKey("example.com", h.uid), "last").Val() == h.url
+		})
+	}
+	code := post("/api/v1/tongji/close", "10.0.0.2", map[string]interface{}{
+		"domain": "example.com", "uid": "u2", "url": pageA, "duration": 30, "k": "sitekey",
+	})
+	if code != http.StatusOK {
+		t.Fatalf("关闭页面请求返回%d", code)
+	}
+	// 站点key错误的请求不统计
+	code = post("/api/v1/tongji/webdata", "10.0.0.3", map[string]interface{}{
+		"p": map[string]string{"url": pageA},
+		"b": map[string]string{"domain": "example.com", "uid": "u3"},
+		"k": "wrong",
+	})
+	if code != http.StatusForbidden {
+		t.Fatalf("站点key错误时返回%d,期望403", code)
+	}
+
+	want := map[string]model.WebFlow{
+		pageA: {Domain: "example.com", URL: pageA, Date: date, PV: 2, IP: 2, UV: 2, Visits: 2, Duration: 30, Entries: 2, Exits: 1, Bounce: 1},
+		pageB: {Domain: "example.com", URL: pageB, Date: date, PV: 1, IP: 1, UV: 1, Visits: 1, Exits: 1},
+	}
+	// 缓存定时保存到redis,这里直接保存
+	waitFor(t, "保存到redis", func() bool {
+		connmgr.CM.Flush()
+		for url, w := range want {
+			var got model.WebFlow
+			vals := rdb.HMGet(service.GetRedisWebflowKey("example.com", date, url), service.WebflowRedisFields...).Val()
+			service.AddRedisValsToWebflow(&got, vals)
+			got.Domain, got.URL, got.Date = w.Domain, w.URL, w.Date
+			if got != w {
+				return false
+			}
+		}
+		return true
+	})
+
+	s, err := service.GetTopContentFromRedis(&service.RealtimeDataReq{Domain: "example.com", StartDate: date})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var top []service.WebData
+	json.Unmarshal([]byte(s), &top)
+	if len(top) != 2 || top[0].Pageinfo.URL != pageA || top[0].Pageinfo.Title != "A" || top[1].Pageinfo.URL != pageB {
+		t.Fatalf("今日排名错误:%s", s)
+	}
+
+	service.FlushWebflow2DBFromRedis(date)
+	var rows []model.WebFlow
+	if err := model.GetDB().Where("domain = ?", "example.com").Order("url").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]model.WebFlow)
+	for _, r := range rows {
+		r.ID = 0
+		got[r.URL] = r
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("数据库中的流量为 %+v,期望 %+v", got, want)
+	}
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// defaultBotPatterns 未配置 BotPatternsPath 时使用的爬虫 User-Agent 规则
+var defaultBotPatterns = []string{
+	`bot\b`, `crawl`, `spider`, `slurp`, `Googlebot`, `bingbot`, `Baiduspider`, `YisouSpider`, `Sogou`,
+	`360Spider`, `Bytespider`, `facebookexternalhit`, `HeadlessChrome`, `PhantomJS`, `Lighthouse`,
+	`UptimeRobot`, `Pingdom`, `StatusCake`, `monitor`, `curl/`, `Wget`, `python-requests`, `Go-http-client`,
+	`Java/`, `okhttp`, `axios`, `node-fetch`,
+}
+
+// botRules 爬虫识别规则
+type botRules struct {
+	patterns []uaPattern
+	networks []*net.IPNet
+}
+
+// currentBotRules 当前使用的规则,重新加载时整体替换
+var currentBotRules atomic.Value
+
+// LoadBotRules 加载爬虫 User-Agent 规则和数据中心ip,可以在运行时重新加载
+func LoadBotRules() error {
+	lines := defaultBotPatterns
+	if len(conf.BotPatternsPath) > 0 {
+		var err error
+		if lines, err = readRuleFile(conf.BotPatternsPath); err != nil {
+			return err
+		}
+	}
+	rules := &botRules{}
+	for _, l := range lines {
+		re, err := regexp.Compile("(?i)" + l)
+		if err != nil {
+			log.Printf("爬虫规则 %s 错误:%v\n", l, err)
+			continue
+		}
+		rules.patterns = append(rules.patterns, uaPattern{re, l})
+	}
+	if len(conf.DatacenterIPPath) > 0 {
+		lines, err := readRuleFile(conf.DatacenterIPPath)
+		if err != nil {
+			return err
+		}
+		rules.networks = parseNetworks(strings.Join(lines, ","))
+	}
+	currentBotRules.Store(rules)
+	log.Printf("加载爬虫规则 %d 条,数据中心ip段 %d 条\n", len(rules.patterns), len(rules.networks))
+	return nil
+}
+
+// readRuleFile 按行读取规则,忽略空行和#开头的注释
+func readRuleFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return lines, scanner.Err()
+}
+
+// getBotRules 获取当前规则,未加载时加载默认规则
+func getBotRules() *botRules {
+	if r, ok := currentBotRules.Load().(*botRules); ok {
+		return r
+	}
+	if err := LoadBotRules(); err != nil {
+		Log(err)
+		currentBotRules.Store(&botRules{})
+	}
+	return currentBotRules.Load().(*botRules)
+}
+
+// DetectBot 根据 User-Agent 和ip识别爬虫,返回识别原因和匹配的规则,不是爬虫时原因为空
+func DetectBot(ua, ip string) (reason, name string) {
+	if len(strings.TrimSpace(ua)) == 0 {
+		return model.BotReasonUA, "empty"
+	}
+	rules := getBotRules()
+	for _, p := range rules.patterns {
+		if p.re.MatchString(ua) {
+			return model.BotReasonUA, p.name
+		}
+	}
+	if x := net.ParseIP(ip); x != nil {
+		for _, n := range rules.networks {
+			if n.Contains(x) {
+				return model.BotReasonDatacenter, n.String()
+			}
+		}
+	}
+	return "", ""
+}
+
+// IsBotRate 在管道中累加用户这一分钟的访问次数,管道执行后调用返回的函数判断是否是爬虫
+// 每分钟访问次数超过 BotMaxHitsPerMinute 后当天的访问都视为爬虫,第一次超过时在 write 中纪录该用户
+func IsBotRate(pipe redis.Pipeliner, date, uid string) func(write redis.Pipeliner) bool {
+	limit, _ := strconv.ParseInt(conf.BotMaxHitsPerMinute, 10, 64)
+	if limit <= 0 || len(uid) == 0 {
+		return func(redis.Pipeliner) bool { return false }
+	}
+	ratekey := GetRedisBotRateKey(uid, time.Now().Format("200601021504"))
+	uidkey := GetRedisBotUIDKey(date)
+	incr := pipe.Incr(ratekey)
+	pipe.Expire(ratekey, 2*time.Minute)
+	member := pipe.SIsMember(uidkey, uid)
+	return func(write redis.Pipeliner) bool {
+		// 管道执行失败时不视为爬虫
+		if incr.Err() != nil || member.Err() != nil {
+			return false
+		}
+		if member.Val() {
+			return true
+		}
+		if incr.Val() > limit {
+			write.SAdd(uidkey, uid)
+			tm, _ := util.ParseDate(date, util.YYYY_MM_DD)
+			write.ExpireAt(uidkey, tm.Add(time.Hour*24))
+			return true
+		}
+		return false
+	}
+}
+
+// GetBotsFromRedis 从redis获取指定日期的爬虫访问量
+func GetBotsFromRedis(date string) ([]*model.Bot, error) {
+	r := model.RedisCli.HGetAll(GetRedisBotKey(date))
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+	var result []*model.Bot
+	for field, val := range r.Val() {
+		b := &model.Bot{}
+		if err := util.Str2Struct(field, b); err != nil {
+			Log(err)
+			continue
+		}
+		b.Date = date
+		b.PV, _ = strconv.Atoi(val)
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+// GetRedisBotField 爬虫在 tongji_bot_<yyyy-mm-dd> 中的 field
+func GetRedisBotField(b *model.Bot) string {
+	s, _ := util.ToJSONStr(model.Bot{Domain: b.Domain, Reason: b.Reason, Name: b.Name})
+	return s
+}
+
+// FlushBots2DBFromRedis 将redis中保存的爬虫访问量保存到数据库
+func FlushBots2DBFromRedis(date string) {
+	bots, err := GetBotsFromRedis(date)
+	if err != nil {
+		Log(err)
+		return
+	}
+	for _, b := range bots {
+		if err := b.UpdateOrSave(); err != nil {
+			Log(err)
+			return
+		}
+	}
+	if err := model.RedisCli.Del(GetRedisBotKey(date)).Err(); err != nil {
+		Log(err)
+	}
+}
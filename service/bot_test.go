@@ -0,0 +1,102 @@
+package service
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+const chromeUA = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+// TestDetectBot 内置规则、规则文件和数据中心ip,重新加载规则文件后立即生效
+func TestDetectBot(t *testing.T) {
+	oldPatterns, oldDatacenter := conf.BotPatternsPath, conf.DatacenterIPPath
+	defer func() {
+		conf.BotPatternsPath, conf.DatacenterIPPath = oldPatterns, oldDatacenter
+		LoadBotRules()
+	}()
+	conf.BotPatternsPath, conf.DatacenterIPPath = "", ""
+	if err := LoadBotRules(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(name, ua, ip, wantReason, wantName string) {
+		t.Helper()
+		if reason, rule := DetectBot(ua, ip); reason != wantReason || rule != wantName {
+			t.Errorf("%s:识别为 %q %q,期望 %q %q", name, reason, rule, wantReason, wantName)
+		}
+	}
+	check("浏览器", chromeUA, "1.2.3.4", "", "")
+	check("空 User-Agent", " ", "1.2.3.4", model.BotReasonUA, "empty")
+	check("内置规则忽略大小写", "Mozilla/5.0 (X11; Linux x86_64) headlesschrome/120.0", "1.2.3.4", model.BotReasonUA, "HeadlessChrome")
+	check("没有配置数据中心ip", chromeUA, "34.1.2.3", "", "")
+
+	dir := t.TempDir()
+	conf.BotPatternsPath = filepath.Join(dir, "bots.txt")
+	conf.DatacenterIPPath = filepath.Join(dir, "datacenter.txt")
+	ioutil.WriteFile(conf.BotPatternsPath, []byte("# 注释\n\nMyCrawler\n(bad\n"), 0644)
+	ioutil.WriteFile(conf.DatacenterIPPath, []byte("34.0.0.0/8\n# 注释\n2001:db8::/32\n"), 0644)
+	if err := LoadBotRules(); err != nil {
+		t.Fatal(err)
+	}
+	check("规则文件替换内置规则", "Mozilla/5.0 (X11; Linux x86_64) headlesschrome/120.0", "1.2.3.4", "", "")
+	check("规则文件", "MyCrawler/1.0", "1.2.3.4", model.BotReasonUA, "MyCrawler")
+	check("数据中心ip", chromeUA, "34.1.2.3", model.BotReasonDatacenter, "34.0.0.0/8")
+	check("数据中心 IPv6", chromeUA, "2001:db8::1", model.BotReasonDatacenter, "2001:db8::/32")
+
+	// 规则文件不存在时保留原来的规则
+	conf.BotPatternsPath = filepath.Join(dir, "missing.txt")
+	if err := LoadBotRules(); err == nil {
+		t.Fatal("规则文件不存在时应返回错误")
+	}
+	check("加载失败保留原规则", "MyCrawler/1.0", "1.2.3.4", model.BotReasonUA, "MyCrawler")
+}
+
+// TestIsBotRate 每分钟访问次数超过限制后当天都视为爬虫
+func TestIsBotRate(t *testing.T) {
+	rdb := setupFakes(t)
+	old := conf.BotMaxHitsPerMinute
+	conf.BotMaxHitsPerMinute = "3"
+	defer func() { conf.BotMaxHitsPerMinute = old }()
+	date := util.GetDateAsDefaultStr()
+	hit := func(uid string) bool {
+		pipe := rdb.Pipeline()
+		isBot := IsBotRate(pipe, date, uid)
+		if _, err := pipe.Exec(); err != nil {
+			t.Fatal(err)
+		}
+		write := rdb.Pipeline()
+		bot := isBot(write)
+		if _, err := write.Exec(); err != nil {
+			t.Fatal(err)
+		}
+		return bot
+	}
+	for i := 1; i <= 3; i++ {
+		if hit("u1") {
+			t.Fatalf("第%d次访问被识别为爬虫", i)
+		}
+	}
+	if !hit("u1") {
+		t.Fatal("第4次访问应识别为爬虫")
+	}
+	if !rdb.SIsMember(GetRedisBotUIDKey(date), "u1").Val() {
+		t.Fatal("第一次超过限制时应纪录该用户")
+	}
+	// 下一分钟的计数重新开始,但当天仍然视为爬虫
+	rdb.Del(GetRedisBotRateKey("u1", time.Now().Format("200601021504")))
+	if !hit("u1") {
+		t.Fatal("当天已识别为爬虫的用户应继续视为爬虫")
+	}
+	if hit("u2") {
+		t.Fatal("其它用户不应视为爬虫")
+	}
+	conf.BotMaxHitsPerMinute = "0"
+	if hit("u1") {
+		t.Fatal("BotMaxHitsPerMinute 为0时不限制")
+	}
+}
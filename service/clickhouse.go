@@ -0,0 +1,194 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 原始访问纪录的类型
+const (
+	HitTypePageview = "pageview"
+	HitTypeEvent    = "event"
+	HitTypeDuration = "duration" // 关闭页面时的浏览时长
+)
+
+// Hit 一次原始访问纪录,写入 ClickHouse 用于临时分析
+type Hit struct {
+	Time       string `json:"time"` // yyyy-mm-dd hh:mm:ss
+	Date       string `json:"date"`
+	Type       string `json:"type"`
+	Domain     string `json:"domain"`
+	URL        string `json:"url"`
+	Title      string `json:"title"`
+	UID        string `json:"uid"`
+	IP         string `json:"ip"`
+	UserAgent  string `json:"ua"`
+	Platform   string `json:"platform"`
+	Browser    string `json:"browser"`
+	DeviceType int    `json:"devicetype"`
+	SR         string `json:"sr"`
+	Region     string `json:"region"`
+	Referrer   string `json:"referrer"`
+	Duration   int    `json:"duration"`
+	Category   string `json:"category"`
+	Action     string `json:"action"`
+	Label      string `json:"label"`
+	Value      int64  `json:"value"`
+	Bot        string `json:"bot"` // 爬虫识别原因,为空时不是爬虫
+}
+
+// NewHit 当前时间的访问纪录
+func NewHit(typ string) *Hit {
+	now := time.Now()
+	return &Hit{
+		Time: now.Format("2006-01-02 15:04:05"),
+		Date: now.Format("2006-01-02"),
+		Type: typ,
+	}
+}
+
+// clickHouseSchema 原始访问纪录的表结构,%s 为表名
+const clickHouseSchema = `CREATE TABLE IF NOT EXISTS %s (
+	time DateTime,
+	date Date,
+	type LowCardinality(String),
+	domain LowCardinality(String),
+	url String,
+	title String,
+	uid String,
+	ip String,
+	ua String,
+	platform LowCardinality(String),
+	browser LowCardinality(String),
+	devicetype UInt8,
+	sr LowCardinality(String),
+	region LowCardinality(String),
+	referrer String,
+	duration UInt32,
+	category String,
+	action String,
+	label String,
+	value Int64,
+	bot LowCardinality(String)
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(date)
+ORDER BY (domain, date, time)`
+
+// ClickHouseSink 通过 ClickHouse 的 http 接口批量写入原始访问纪录
+type ClickHouseSink struct {
+	URL      string // 如 http://localhost:8123
+	Database string
+	Table    string
+	User     string
+	Password string
+	Client   *http.Client
+}
+
+// hitSink 配置 ClickHouseOpen 为 true 时写入的 ClickHouse
+var hitSink *ClickHouseSink
+
+// hitBatchSize 每批写入的纪录数
+var hitBatchSize = 1000
+
+// SetupClickHouse 根据配置连接 ClickHouse 并创建表
+func SetupClickHouse() error {
+	if conf.ClickHouseOpen != "true" {
+		return nil
+	}
+	if n, err := strconv.Atoi(conf.ClickHouseBatchSize); err == nil && n > 0 {
+		hitBatchSize = n
+	}
+	s := &ClickHouseSink{
+		URL:      conf.ClickHouseURL,
+		Database: conf.ClickHouseDatabase,
+		Table:    conf.ClickHouseTable,
+		User:     conf.ClickHouseUser,
+		Password: conf.ClickHousePassword,
+		Client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	if err := s.CreateTable(); err != nil {
+		return fmt.Errorf("创建 ClickHouse 表 %s 失败:%v", s.Table, err)
+	}
+	hitSink = s
+	log.Printf("原始访问纪录写入 ClickHouse:%s.%s\n", s.Database, s.Table)
+	return nil
+}
+
+// ClickHouseOpen 是否写入原始访问纪录
+func ClickHouseOpen() bool {
+	return hitSink != nil
+}
+
+// HitBatchSize 每批写入的纪录数
+func HitBatchSize() int {
+	return hitBatchSize
+}
+
+// InsertHits 将原始访问纪录写入 ClickHouse
+func InsertHits(hits []*Hit) error {
+	if hitSink == nil || len(hits) == 0 {
+		return nil
+	}
+	return hitSink.Insert(hits)
+}
+
+// CreateTable 表不存在时创建
+func (s *ClickHouseSink) CreateTable() error {
+	return s.exec("", []byte(fmt.Sprintf(clickHouseSchema, s.Table)))
+}
+
+// Insert 以 JSONEachRow 格式写入一批纪录
+func (s *ClickHouseSink) Insert(hits []*Hit) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, h := range hits {
+		if err := enc.Encode(h); err != nil {
+			return err
+		}
+	}
+	return s.exec(fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", s.Table), body.Bytes())
+}
+
+// exec 执行sql,query 为空时 body 为sql,否则 body 为写入的数据
+func (s *ClickHouseSink) exec(query string, body []byte) error {
+	params := url.Values{}
+	if len(s.Database) > 0 {
+		params.Set("database", s.Database)
+	}
+	if len(query) > 0 {
+		params.Set("query", query)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/?"+params.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if len(s.User) > 0 {
+		req.Header.Set("X-ClickHouse-User", s.User)
+		req.Header.Set("X-ClickHouse-Key", s.Password)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		if len(msg) == 0 {
+			return errors.New(resp.Status)
+		}
+		return fmt.Errorf("%s:%s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeClickHouse 代替 ClickHouse 的 http 接口,纪录收到的sql和数据
+type fakeClickHouse struct {
+	queries []string
+	rows    []map[string]interface{}
+	fail    bool
+}
+
+func (f *fakeClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-ClickHouse-User") != "tongji" || r.Header.Get("X-ClickHouse-Key") != "secret" {
+		http.Error(w, "Code: 516. Authentication failed", http.StatusUnauthorized)
+		return
+	}
+	if f.fail {
+		http.Error(w, "Code: 241. Memory limit exceeded", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query().Get("query")
+	if len(query) == 0 {
+		body, _ := ioutil.ReadAll(r.Body)
+		f.queries = append(f.queries, string(body))
+		return
+	}
+	f.queries = append(f.queries, query)
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		row := make(map[string]interface{})
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.rows = append(f.rows, row)
+	}
+}
+
+func TestClickHouseSink(t *testing.T) {
+	fake := &fakeClickHouse{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	s := &ClickHouseSink{URL: server.URL, Database: "default", Table: "tongji_hits", User: "tongji", Password: "secret"}
+	if err := s.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.queries) != 1 || !strings.HasPrefix(fake.queries[0], "CREATE TABLE IF NOT EXISTS tongji_hits") {
+		t.Fatalf("建表sql错误:%v", fake.queries)
+	}
+	pv := NewHit(HitTypePageview)
+	pv.Domain, pv.URL, pv.UID, pv.Referrer = "example.com", "example.com/a", "u1", "https://www.baidu.com/s?wd=go"
+	d := NewHit(HitTypeDuration)
+	d.Domain, d.URL, d.UID, d.Duration, d.Bot = "example.com", "example.com/a", "u1", 30, "ua"
+	if err := s.Insert([]*Hit{pv, d}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.queries[1] != "INSERT INTO tongji_hits FORMAT JSONEachRow" {
+		t.Fatalf("写入sql错误:%s", fake.queries[1])
+	}
+	if len(fake.rows) != 2 {
+		t.Fatalf("写入%d条纪录,期望2条", len(fake.rows))
+	}
+	if fake.rows[0]["referrer"] != pv.Referrer || fake.rows[0]["type"] != HitTypePageview {
+		t.Fatalf("纪录错误:%v", fake.rows[0])
+	}
+	if fake.rows[1]["duration"] != float64(30) || fake.rows[1]["bot"] != "ua" {
+		t.Fatalf("纪录错误:%v", fake.rows[1])
+	}
+	fake.fail = true
+	if err := s.Insert([]*Hit{pv}); err == nil || !strings.Contains(err.Error(), "Memory limit exceeded") {
+		t.Fatalf("期望返回 ClickHouse 的错误,实际为:%v", err)
+	}
+}
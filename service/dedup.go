@@ -0,0 +1,342 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// 去重的类型
+const (
+	DedupIP      = "ip"      // ip今天是否访问过url
+	DedupUV      = "uv"      // 用户今天是否访问过url
+	DedupVisitor = "visitor" // 用户今天是否访问过域名
+)
+
+// 去重方式(DedupMode)
+const (
+	DedupModeSet   = "set"   // 每个ip、用户一个集合,精确
+	DedupModeHLL   = "hll"   // ip、uv 使用每个url的 HyperLogLog,visitor 使用布隆过滤器
+	DedupModeBloom = "bloom" // 全部使用布隆过滤器
+)
+
+// bloomShards 布隆过滤器拆分的 bitmap 数,分散到 redis 集群的不同节点
+const bloomShards = 16
+
+// Deduper 统计 IP、UV 和新用户时判断今天是否已经纪录过
+type Deduper interface {
+	// Add 纪录今天访问的成员,返回需要累加的去重计数,0表示今天已经纪录过
+	// kind 为 DedupVisitor 时 url 为空
+	Add(kind, date, domain, url, member string) (int64, error)
+	// AddPipe 在事务管道中纪录访问的成员,管道执行后调用返回的函数得到去重计数
+	// period 为空时在当天去重,为 <hh> 或 all 时在该小时或全天单独去重,用于每小时流量
+	AddPipe(pipe redis.Pipeliner, kind, date, period, domain, url, member string) func() int64
+}
+
+// deduper 当前使用的去重方式
+var deduper Deduper = setDeduper{}
+
+// SetupDeduper 根据配置 DedupMode 选择去重方式
+func SetupDeduper() error {
+	d, err := NewDeduper(conf.DedupMode, conf.BloomCapacity, conf.BloomErrorRate)
+	if err != nil {
+		return err
+	}
+	deduper = d
+	capacity, _ := strconv.ParseUint(conf.BloomCapacity, 10, 64)
+	errorRate, err := strconv.ParseFloat(conf.BloomErrorRate, 64)
+	if err != nil || errorRate <= 0 || errorRate >= 1 {
+		errorRate = 0.001
+	}
+	visited = newVisitedFilter(capacity, errorRate)
+	log.Printf("去重方式:%s\n", conf.DedupMode)
+	return nil
+}
+
+// NewDeduper 创建去重方式,mode 为空时为 set
+func NewDeduper(mode, capacity, errorRate string) (Deduper, error) {
+	switch mode {
+	case "", DedupModeSet:
+		return setDeduper{}, nil
+	case DedupModeHLL, DedupModeBloom:
+		n, err := strconv.ParseUint(capacity, 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("BloomCapacity 必须是正整数:%s", capacity)
+		}
+		p, err := strconv.ParseFloat(errorRate, 64)
+		if err != nil || p <= 0 || p >= 1 {
+			return nil, fmt.Errorf("BloomErrorRate 必须在0和1之间:%s", errorRate)
+		}
+		bloom := newBloomDeduper(n, p)
+		if mode == DedupModeBloom {
+			return bloom, nil
+		}
+		return hllDeduper{bloom}, nil
+	}
+	return nil, fmt.Errorf("不支持的去重方式:%s", mode)
+}
+
+// Dedup 使用当前的去重方式纪录今天访问的成员
+func Dedup(kind, date, domain, url, member string) (int64, error) {
+	return deduper.Add(kind, date, domain, url, member)
+}
+
+// addOne 单独执行一次 AddPipe
+func addOne(d Deduper, kind, date, domain, url, member string) (int64, error) {
+	pipe := model.RedisCli.TxPipeline()
+	n := d.AddPipe(pipe, kind, date, "", domain, url, member)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return n(), nil
+}
+
+// DedupHit 一次页面浏览需要去重的信息
+type DedupHit struct {
+	Date   string
+	Domain string
+	URL    string
+	UID    string    // 为空时不统计 UV、访问次数和新用户
+	IP     string    // 为空时不统计 IP
+	Time   time.Time // 访问时间,用于判断半小时内是否访问过
+}
+
+// DedupResult 一次页面浏览的去重结果
+type DedupResult struct {
+	IP       int64 // 需要累加的 IP
+	UV       int64 // 需要累加的 UV
+	Visitor  int64 // 用户今天第一次访问域名时大于0
+	Visited  bool  // 用户半小时内访问过url
+	KnownURL bool  // url 今天已经保存过页面信息
+}
+
+// DedupBatch 在事务管道中为一批页面浏览去重,管道执行后调用返回的函数按顺序得到每次浏览的结果
+// 同一批中重复的访问按顺序判断,后面的访问为已经纪录过;管道执行失败时结果全部为0
+func DedupBatch(pipe redis.Pipeliner, hits []*DedupHit) func() []*DedupResult {
+	type pending struct {
+		ip, uv, visitor func() int64
+		visited         func() bool
+		known           *redis.BoolCmd
+	}
+	ps := make([]pending, len(hits))
+	for i, h := range hits {
+		p := &ps[i]
+		if len(h.IP) > 0 {
+			p.ip = deduper.AddPipe(pipe, DedupIP, h.Date, "", h.Domain, h.URL, h.IP)
+		}
+		if len(h.UID) > 0 {
+			p.uv = deduper.AddPipe(pipe, DedupUV, h.Date, "", h.Domain, h.URL, h.UID)
+			p.visitor = deduper.AddPipe(pipe, DedupVisitor, h.Date, "", h.Domain, "", h.UID)
+			p.visited = visited.addPipe(pipe, h.Time, h.UID+"|"+h.URL)
+		}
+		p.known = pipe.SIsMember(GetRedisURLKey(h.Date), h.URL)
+	}
+	return func() []*DedupResult {
+		results := make([]*DedupResult, len(hits))
+		for i, p := range ps {
+			r := &DedupResult{}
+			results[i] = r
+			if p.known.Err() != nil {
+				continue
+			}
+			if p.ip != nil {
+				r.IP = p.ip()
+			}
+			if p.uv != nil {
+				r.UV, r.Visitor = p.uv(), p.visitor()
+				r.Visited = p.visited()
+			}
+			r.KnownURL = p.known.Val()
+		}
+		return results
+	}
+}
+
+// setDeduper 每个ip、用户每天一个集合
+type setDeduper struct{}
+
+func (d setDeduper) Add(kind, date, domain, url, member string) (int64, error) {
+	return addOne(d, kind, date, domain, url, member)
+}
+
+func (setDeduper) AddPipe(pipe redis.Pipeliner, kind, date, period, domain, url, member string) func() int64 {
+	var key string
+	switch {
+	case len(period) > 0:
+		key, member = GetRedisHourlySetKey(date, period), strings.Join([]string{kind, domain, url, member}, "|")
+	case kind == DedupIP:
+		key, member = GetRedisIPKey(date, member), url
+	case kind == DedupUV:
+		key, member = GetRedisVisitorKey(date, member), url
+	default:
+		key = GetredisNewVisitorKey(date, domain)
+	}
+	n := pipe.SAdd(key, member)
+	// 明日凌晨过期
+	pipe.ExpireAt(key, GetTimeOfTomorrowZero(date))
+	return n.Val
+}
+
+// hllDeduper ip、uv 加入每个url的 HyperLogLog,返回基数的增量,当天去重与 AddSketches 使用相同的key
+// 累加的增量等于当天 HyperLogLog 的基数,误差约0.81%;每小时流量使用每小时和全天单独的 HyperLogLog
+type hllDeduper struct {
+	visitor *bloomDeduper
+}
+
+func (d hllDeduper) Add(kind, date, domain, url, member string) (int64, error) {
+	return addOne(d, kind, date, domain, url, member)
+}
+
+func (d hllDeduper) AddPipe(pipe redis.Pipeliner, kind, date, period, domain, url, member string) func() int64 {
+	if kind == DedupVisitor {
+		return d.visitor.AddPipe(pipe, kind, date, period, domain, url, member)
+	}
+	key := GetRedisSketchKey(date, kind, domain, url)
+	expire := GetTimeOfTomorrowZero(date).Add(time.Hour * 24)
+	if len(period) > 0 {
+		key, expire = GetRedisHourlySketchKey(date, period, kind, domain, url), GetTimeOfTomorrowZero(date)
+	}
+	// 事务内计算前后基数,并发时增量不会重复
+	before := pipe.PFCount(key)
+	pipe.PFAdd(key, member)
+	after := pipe.PFCount(key)
+	pipe.ExpireAt(key, expire)
+	return func() int64 {
+		return after.Val() - before.Val()
+	}
+}
+
+// bloomDeduper 每天一个布隆过滤器,拆分成 bloomShards 个 bitmap
+// 误判时把今天没有纪录过的成员当作已经纪录过,计数略少
+type bloomDeduper struct {
+	bits   uint64 // 每个 bitmap 的位数
+	hashes int    // 每个成员设置的位数
+}
+
+// newBloomDeduper 根据每天预计的成员数和误判率计算布隆过滤器的大小
+func newBloomDeduper(capacity uint64, errorRate float64) *bloomDeduper {
+	m := math.Ceil(-float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomDeduper{bits: uint64(m)/bloomShards + 1, hashes: k}
+}
+
+// locate 成员所在的 bitmap 和需要设置的位
+func (d *bloomDeduper) locate(member string) (int, []int64) {
+	h := fnv.New128a()
+	h.Write([]byte(member))
+	sum := h.Sum(nil)
+	h1 := mix64(binary.BigEndian.Uint64(sum[:8]))
+	h2 := mix64(binary.BigEndian.Uint64(sum[8:])) | 1
+	offsets := make([]int64, d.hashes)
+	for i := range offsets {
+		offsets[i] = int64((h1 + uint64(i)*h2) % d.bits)
+	}
+	return int((h2 >> 32) % bloomShards), offsets
+}
+
+// mix64 打散 fnv 的结果,相似的成员 fnv 的低位分布不均匀
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (d *bloomDeduper) Add(kind, date, domain, url, member string) (int64, error) {
+	return addOne(d, kind, date, domain, url, member)
+}
+
+func (d *bloomDeduper) AddPipe(pipe redis.Pipeliner, kind, date, period, domain, url, member string) func() int64 {
+	if len(period) > 0 {
+		kind += "|" + period
+	}
+	shard, offsets := d.locate(kind + "|" + domain + "|" + url + "|" + member)
+	key := GetRedisBloomKey(date, shard)
+	// 所有位原来都是1时为已经纪录过
+	olds := make([]*redis.IntCmd, len(offsets))
+	for i, off := range offsets {
+		olds[i] = pipe.SetBit(key, off, 1)
+	}
+	pipe.ExpireAt(key, GetTimeOfTomorrowZero(date))
+	return func() int64 {
+		for _, old := range olds {
+			if old.Val() == 0 {
+				return 1
+			}
+		}
+		return 0
+	}
+}
+
+// 半小时内访问过的url按10分钟分段纪录在布隆过滤器中,检查当前和之前两段
+const (
+	visitedSlot  = 10 * time.Minute
+	visitedSlots = 3
+)
+
+// minVisitedCapacity 每段布隆过滤器最少纪录的成员数
+const minVisitedCapacity = 100000
+
+// visitedFilter 判断用户半小时内是否访问过url,代替每个用户一个集合
+// 上次访问在20到30分钟之前时可能已经不在检查的分段中,误判时视为访问过
+type visitedFilter struct {
+	bloom *bloomDeduper
+}
+
+// visited 当前使用的半小时内访问过滤器
+var visited = newVisitedFilter(0, 0.001)
+
+// newVisitedFilter 每段按 BloomCapacity 的1/24(约一小时的成员数)计算大小
+func newVisitedFilter(dailyCapacity uint64, errorRate float64) *visitedFilter {
+	capacity := dailyCapacity / 24
+	if capacity < minVisitedCapacity {
+		capacity = minVisitedCapacity
+	}
+	return &visitedFilter{newBloomDeduper(capacity, errorRate)}
+}
+
+// addPipe 在管道中纪录访问,管道执行后调用返回的函数判断半小时内是否访问过
+func (v *visitedFilter) addPipe(pipe redis.Pipeliner, t time.Time, member string) func() bool {
+	shard, offsets := v.bloom.locate(member)
+	slot := t.Unix() / int64(visitedSlot/time.Second)
+	checks := make([][]*redis.IntCmd, visitedSlots)
+	for i := range checks {
+		key := GetRedisVisitedKey(slot-int64(i), shard)
+		for _, off := range offsets {
+			if i == 0 {
+				checks[i] = append(checks[i], pipe.SetBit(key, off, 1))
+			} else {
+				checks[i] = append(checks[i], pipe.GetBit(key, off))
+			}
+		}
+		if i == 0 {
+			pipe.Expire(key, visitedSlot*(visitedSlots+1))
+		}
+	}
+	return func() bool {
+	next:
+		for _, cmds := range checks {
+			for _, c := range cmds {
+				if c.Err() != nil || c.Val() == 0 {
+					continue next
+				}
+			}
+			return true
+		}
+		return false
+	}
+}
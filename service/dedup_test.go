@@ -0,0 +1,213 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// 比较不同去重方式的耗时和 redis 内存,需要一个可以清空数据的 redis:
+// TONGJI_BENCH_REDIS=localhost:6379 go test ./service -run none -bench Dedup -benchmem
+// 每次访问执行页面浏览在redis中的全部写入:去重、半小时内访问、每小时流量、HyperLogLog、uid 和访问纪录
+// redis-bytes/hit 为每次访问增加的 redis 内存,keys 为新增的key数
+
+// benchVisitorPages 每个访客浏览的页面数
+const benchVisitorPages = 5
+
+func benchmarkDedup(b *testing.B, mode string) {
+	addr := os.Getenv("TONGJI_BENCH_REDIS")
+	if len(addr) == 0 {
+		b.Skip("未设置 TONGJI_BENCH_REDIS")
+	}
+	cli := redis.NewClient(&redis.Options{Addr: addr})
+	if err := cli.Ping().Err(); err != nil {
+		b.Skipf("连接 redis %s 失败:%v", addr, err)
+	}
+	defer cli.Close()
+	if err := cli.FlushDB().Err(); err != nil {
+		b.Fatal(err)
+	}
+	old := model.RedisCli
+	model.RedisCli = cli
+	defer func() { model.RedisCli = old }()
+	d, err := NewDeduper(mode, strconv.Itoa(b.N*3), "0.001")
+	if err != nil {
+		b.Fatal(err)
+	}
+	oldDeduper, oldVisited := deduper, visited
+	deduper, visited = d, newVisitedFilter(uint64(b.N*3), 0.001)
+	defer func() { deduper, visited = oldDeduper, oldVisited }()
+	now := time.Now()
+	date := now.Format("2006-01-02")
+	before := usedMemory(b, cli)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		visitor := i / benchVisitorPages
+		uid := fmt.Sprintf("uid%d", visitor)
+		ip := fmt.Sprintf("10.%d.%d.%d", visitor>>16&255, visitor>>8&255, visitor&255)
+		url := fmt.Sprintf("example.com/page/%d", i%1000)
+		pipe := cli.TxPipeline()
+		hourly := CountHourly(pipe, &HourlyHit{Domain: "example.com", URL: url, UID: uid, IP: ip, Date: date, Hour: now.Hour()})
+		DedupBatch(pipe, []*DedupHit{{Date: date, Domain: "example.com", URL: url, UID: uid, IP: ip, Time: now}})
+		if _, err := pipe.Exec(); err != nil {
+			b.Fatal(err)
+		}
+		write := cli.Pipeline()
+		for _, incr := range hourly() {
+			write.HIncrBy(incr.Key, incr.Field, incr.N)
+		}
+		AddSketches(write, date, "example.com", url, uid, ip)
+		AddUID2Redis(write, date, uid)
+		visit := GetRedisVisitKey("example.com", uid)
+		write.HMSet(visit, map[string]interface{}{"last": url, "pages": i%benchVisitorPages + 1})
+		write.Expire(visit, 30*time.Minute)
+		if _, err := write.Exec(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(usedMemory(b, cli)-before)/float64(b.N), "redis-bytes/hit")
+	b.ReportMetric(float64(cli.DBSize().Val()), "keys")
+	cli.FlushDB()
+}
+
+// usedMemory redis 使用的内存
+func usedMemory(b *testing.B, cli *redis.Client) int64 {
+	info, err := cli.Info("memory").Result()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, l := range strings.Split(info, "\r\n") {
+		if strings.HasPrefix(l, "used_memory:") {
+			n, _ := strconv.ParseInt(strings.TrimPrefix(l, "used_memory:"), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+func BenchmarkDedupSet(b *testing.B) {
+	benchmarkDedup(b, DedupModeSet)
+}
+
+func BenchmarkDedupHLL(b *testing.B) {
+	benchmarkDedup(b, DedupModeHLL)
+}
+
+func BenchmarkDedupBloom(b *testing.B) {
+	benchmarkDedup(b, DedupModeBloom)
+}
+
+func TestBloomFalsePositiveRate(t *testing.T) {
+	const n = 100000
+	d := newBloomDeduper(n, 0.01)
+	bits := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		shard, offsets := d.locate(fmt.Sprintf("uv|example.com|/a|uid%d", i))
+		for _, off := range offsets {
+			bits[fmt.Sprintf("%d_%d", shard, off)] = true
+		}
+	}
+	fp := 0
+	for i := 0; i < n; i++ {
+		shard, offsets := d.locate(fmt.Sprintf("uv|example.com|/b|uid%d", i))
+		seen := true
+		for _, off := range offsets {
+			seen = seen && bits[fmt.Sprintf("%d_%d", shard, off)]
+		}
+		if seen {
+			fp++
+		}
+	}
+	if rate := float64(fp) / n; rate > 0.015 {
+		t.Fatalf("误判率 %.4f 超过 0.01", rate)
+	}
+}
+
+func TestCountHourly(t *testing.T) {
+	today := util.GetDateAsDefaultStr()
+	hits := []*HourlyHit{
+		{URL: "/a", UID: "u1", IP: "1.1.1.1", Hour: 10},
+		{URL: "/a", UID: "u1", IP: "1.1.1.1", Hour: 11},
+		{URL: "/b", UID: "u2", IP: "1.1.1.1", Hour: 10},
+	}
+	want := map[string]int64{
+		"example.com|10|uv": 2, "example.com|10|ip": 1, "example.com|10|pv": 2,
+		"example.com|11|uv": 1, "example.com|11|ip": 1, "example.com|11|pv": 1,
+		"example.com|all|uv": 2, "example.com|all|ip": 1, "example.com|all|pv": 3,
+		"example.com|all|/a|uv": 1, "example.com|all|/a|pv": 2, "example.com|all|/b|ip": 1,
+	}
+	for _, mode := range []string{DedupModeSet, DedupModeHLL, DedupModeBloom} {
+		t.Run(mode, func(t *testing.T) {
+			cli := setupFakes(t)
+			d, err := NewDeduper(mode, "1000", "0.001")
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := deduper
+			deduper = d
+			defer func() { deduper = old }()
+			got := make(map[string]int64)
+			for _, h := range hits {
+				h.Domain, h.Date = "example.com", today
+				pipe := model.RedisCli.TxPipeline()
+				incrs := CountHourly(pipe, h)
+				if _, err := pipe.Exec(); err != nil {
+					t.Fatal(err)
+				}
+				for _, i := range incrs() {
+					got[i.Field] += i.N
+				}
+			}
+			for field, n := range want {
+				if got[field] != n {
+					t.Errorf("%s 为 %d,期望 %d", field, got[field], n)
+				}
+			}
+			// 每小时去重不再为每个用户和ip建立集合
+			if mode != DedupModeSet {
+				if n := cli.Exists(GetRedisHourlySetKey(today, "10"), GetRedisHourlySetKey(today, hourlyAll)).Val(); n != 0 {
+					t.Errorf("%s 方式不应使用 tongji_hourly_set", mode)
+				}
+			}
+		})
+	}
+}
+
+func TestDedupVisited(t *testing.T) {
+	cli := setupFakes(t)
+	today := util.GetDateAsDefaultStr()
+	start := time.Unix(time.Now().Unix()/600*600, 0)
+	cases := []struct {
+		after   time.Duration
+		url     string
+		visited bool
+	}{
+		{0, "/a", false},
+		{5 * time.Minute, "/a", true},
+		{5 * time.Minute, "/b", false},
+		{25 * time.Minute, "/b", true},
+		{70 * time.Minute, "/a", false},
+	}
+	for _, c := range cases {
+		pipe := model.RedisCli.TxPipeline()
+		results := DedupBatch(pipe, []*DedupHit{{Date: today, Domain: "example.com", URL: c.url, UID: "u1", Time: start.Add(c.after)}})
+		if _, err := pipe.Exec(); err != nil {
+			t.Fatal(err)
+		}
+		if r := results()[0]; r.Visited != c.visited {
+			t.Errorf("%v 后访问 %s:半小时内访问过为 %v,期望 %v", c.after, c.url, r.Visited, c.visited)
+		}
+	}
+	if n := len(cli.Keys("tongji_visitnumbers_*").Val()); n != 0 {
+		t.Fatalf("不应为用户建立 visitnumbers 集合,有%d个", n)
+	}
+}
@@ -0,0 +1,315 @@
+package service
+
+import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// domainCacheTTL 域名缓存过期时间
+const domainCacheTTL = 60 * time.Second
+
+// domainCache 已注册域名缓存,key为域名或别名
+var domainCache = struct {
+	sync.RWMutex
+	hosts map[string]*model.Domainmgr
+	refresher
+}{}
+
+// refresher 缓存过期后在后台重新加载,加载期间和加载失败时继续使用旧的缓存,失败后等到下次过期再重试
+type refresher struct {
+	once    sync.Once
+	running int32
+	mu      sync.Mutex
+	checked time.Time // 最后一次加载的时间,无论是否成功
+}
+
+// check 第一次使用时同步加载,之后过期时在后台加载
+func (r *refresher) check(load func() error) {
+	r.once.Do(func() { r.refresh(load) })
+	r.mu.Lock()
+	expired := time.Since(r.checked) > domainCacheTTL
+	r.mu.Unlock()
+	if expired && atomic.CompareAndSwapInt32(&r.running, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&r.running, 0)
+			r.refresh(load)
+		}()
+	}
+}
+
+func (r *refresher) refresh(load func() error) {
+	if err := load(); err != nil {
+		Log(err)
+	}
+	r.mu.Lock()
+	r.checked = time.Now()
+	r.mu.Unlock()
+}
+
+var hostnameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
+// DomainReq 域名注册请求
+type DomainReq struct {
+	ID      int    `json:"id"`
+	Domain  string `json:"domain"`
+	Aliases string `json:"aliases"`
+	Enabled *bool  `json:"enabled"` // 为空时默认启用
+	// CheckOrigin 是否校验采集请求的 Origin/Referer
+	CheckOrigin bool `json:"checkOrigin"`
+	// ResetSiteKey 修改时重新生成站点key
+	ResetSiteKey bool `json:"resetSiteKey"`
+}
+
+// rejectedHits 被丢弃的采集请求数,key为 <原因>_<域名>,通过 /debug/vars 查看
+var rejectedHits = expvar.NewMap("tongji_rejected_hits")
+
+// GetDomains 获取用户有权限查询的域名
+func GetDomains(id *Identity) (string, error) {
+	datas, err := model.Store.GetAllRegistryDomains()
+	if err != nil {
+		return "", err
+	}
+	result := []*model.Domainmgr{}
+	for _, d := range datas {
+		if id.CanDomainID(model.RoleRead, d.ID) {
+			result = append(result, d)
+		}
+	}
+	return util.ToJSONStr(result)
+}
+
+// AddDomain 注册域名
+func AddDomain(req *DomainReq) (string, error) {
+	d := &model.Domainmgr{Enabled: true}
+	if err := req.fill(d); err != nil {
+		return "", err
+	}
+	if err := checkDomainUnique(d); err != nil {
+		return "", err
+	}
+	if err := d.Save(); err != nil {
+		return "", err
+	}
+	RefreshDomainCache()
+	return util.ToJSONStr(d)
+}
+
+// UpdateDomain 修改域名
+func UpdateDomain(req *DomainReq) (string, error) {
+	d, err := model.FindDomainByID(req.ID)
+	if err != nil {
+		return "", fmt.Errorf("域名id:%d 不存在:%v", req.ID, err)
+	}
+	if err := req.fill(d); err != nil {
+		return "", err
+	}
+	if err := checkDomainUnique(d); err != nil {
+		return "", err
+	}
+	if err := d.Update(); err != nil {
+		return "", err
+	}
+	RefreshDomainCache()
+	return util.ToJSONStr(d)
+}
+
+// DelDomain 删除域名
+func DelDomain(id int) error {
+	d, err := model.FindDomainByID(id)
+	if err != nil {
+		return fmt.Errorf("域名id:%d 不存在:%v", id, err)
+	}
+	if err := d.Delete(); err != nil {
+		return err
+	}
+	RefreshDomainCache()
+	return nil
+}
+
+// fill 校验并填充域名信息
+func (req *DomainReq) fill(d *model.Domainmgr) error {
+	domain := normalizeHost(req.Domain)
+	if !IsValidHostname(domain) {
+		return fmt.Errorf("域名不合法:%s", req.Domain)
+	}
+	var aliases []string
+	for _, a := range strings.Split(req.Aliases, ",") {
+		a = normalizeHost(a)
+		if len(a) == 0 || a == domain {
+			continue
+		}
+		if !IsValidHostname(a) {
+			return fmt.Errorf("域名别名不合法:%s", a)
+		}
+		aliases = append(aliases, a)
+	}
+	d.Domain = domain
+	d.Aliases = strings.Join(aliases, ",")
+	if req.Enabled != nil {
+		d.Enabled = *req.Enabled
+	}
+	d.CheckOrigin = req.CheckOrigin
+	if len(d.SiteKey) == 0 || req.ResetSiteKey {
+		key, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+		d.SiteKey = key
+	}
+	return nil
+}
+
+// checkDomainUnique 域名和别名不能与其它域名重复
+func checkDomainUnique(d *model.Domainmgr) error {
+	datas, err := model.Store.GetAllRegistryDomains()
+	if err != nil {
+		return err
+	}
+	for _, other := range datas {
+		if other.ID == d.ID {
+			continue
+		}
+		for _, h := range other.Hosts() {
+			for _, x := range d.Hosts() {
+				if h == x {
+					return fmt.Errorf("域名 %s 已被注册", x)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// IsValidHostname 是否是合法的主机名
+func IsValidHostname(host string) bool {
+	return len(host) > 0 && len(host) <= 253 && hostnameRegexp.MatchString(host)
+}
+
+// normalizeHost 转小写并去掉端口和末尾的点
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// RefreshDomainCache 重新加载域名缓存
+func RefreshDomainCache() error {
+	datas, err := model.Store.GetAllRegistryDomains()
+	if err != nil {
+		return err
+	}
+	hosts := make(map[string]*model.Domainmgr)
+	for _, d := range datas {
+		// 为以前注册的域名生成站点key
+		if len(d.SiteKey) == 0 {
+			if d.SiteKey, err = randomHex(16); err != nil {
+				return err
+			}
+			if err = d.Update(); err != nil {
+				return err
+			}
+		}
+		for _, h := range d.Hosts() {
+			hosts[h] = d
+		}
+	}
+	domainCache.Lock()
+	domainCache.hosts = hosts
+	domainCache.Unlock()
+	return nil
+}
+
+// LookupDomain 根据域名或别名查找注册的域名,未注册时返回nil
+func LookupDomain(host string) *model.Domainmgr {
+	domainCache.check(RefreshDomainCache)
+	domainCache.RLock()
+	defer domainCache.RUnlock()
+	return domainCache.hosts[normalizeHost(host)]
+}
+
+// ResolveDomain 将域名或别名转换为注册的域名
+// 未注册或已停用的域名纪录到 tongji_unregistered_<yyyy-mm-dd>,除非配置 AcceptUnregisteredDomain 为true,否则返回false
+func ResolveDomain(date, host string) (string, bool) {
+	d := LookupDomain(host)
+	if d != nil && d.Enabled {
+		return d.Domain, true
+	}
+	if conf.AcceptUnregisteredDomain == "true" {
+		return host, true
+	}
+	rejectedHits.Add("unregistered", 1)
+	key := GetRedisUnregisteredKey(date)
+	pipe := model.RedisCli.Pipeline()
+	pipe.HIncrBy(key, host, 1)
+	tm, _ := util.ParseDate(date, util.YYYY_MM_DD)
+	pipe.ExpireAt(key, tm.Add(time.Hour*24*7))
+	if _, err := pipe.Exec(); err != nil {
+		Log(err)
+	}
+	return "", false
+}
+
+// CheckSiteKey 校验采集请求的站点key,域名开启 CheckOrigin 时校验 Origin/Referer
+// 未注册的域名不在这里校验,由 ResolveDomain 处理
+func CheckSiteKey(host, key string, request *http.Request) error {
+	d := LookupDomain(host)
+	if d == nil {
+		return nil
+	}
+	if conf.RequireSiteKey == "true" && subtle.ConstantTimeCompare([]byte(key), []byte(d.SiteKey)) != 1 {
+		rejectedHits.Add("sitekey_"+d.Domain, 1)
+		return fmt.Errorf("域名 %s 的站点key错误", host)
+	}
+	if d.CheckOrigin && !isAllowedOrigin(d, request) {
+		rejectedHits.Add("origin_"+d.Domain, 1)
+		return fmt.Errorf("域名 %s 的采集请求来源不合法", host)
+	}
+	return nil
+}
+
+// isAllowedOrigin Origin 或 Referer 是否属于域名或别名
+func isAllowedOrigin(d *model.Domainmgr, request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if len(origin) == 0 {
+		origin = request.Referer()
+	}
+	u, err := url.Parse(origin)
+	if err != nil || len(u.Hostname()) == 0 {
+		return false
+	}
+	host := normalizeHost(u.Hostname())
+	for _, h := range d.Hosts() {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// GetUnregisteredDomains 获取指定日期被拒绝统计的域名及次数
+func GetUnregisteredDomains(date string) (string, error) {
+	if len(date) == 0 {
+		return "", errors.New("date 不能为空")
+	}
+	r := model.RedisCli.HGetAll(GetRedisUnregisteredKey(date))
+	if r.Err() != nil && r.Err() != redis.Nil {
+		return "", r.Err()
+	}
+	return util.ToJSONStr(r.Val())
+}
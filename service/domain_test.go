@@ -0,0 +1,59 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+func TestCheckSiteKey(t *testing.T) {
+	setupFakes(t)
+	shop := &model.Domainmgr{Domain: "shop.com", Aliases: "m.shop.com", Enabled: true, SiteKey: "shopkey", CheckOrigin: true}
+	if err := shop.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := RefreshDomainCache(); err != nil {
+		t.Fatal(err)
+	}
+	old := conf.RequireSiteKey
+	defer func() { conf.RequireSiteKey = old }()
+	cases := []struct {
+		name       string
+		require    string
+		host, key  string
+		origin     string
+		referer    string
+		wantReject bool
+	}{
+		{"站点key正确", "true", "example.com", "key", "", "", false},
+		{"别名使用域名的站点key", "true", "www.example.com", "key", "", "", false},
+		{"站点key错误", "true", "example.com", "wrong", "", "", true},
+		{"没有站点key", "true", "example.com", "", "", "", true},
+		{"暂时不要求站点key", "false", "example.com", "", "", "", false},
+		{"未注册的域名由 ResolveDomain 处理", "true", "unknown.com", "", "", "", false},
+		{"其它域名的站点key", "true", "shop.com", "key", "https://shop.com", "", true},
+		{"Origin 属于域名", "true", "shop.com", "shopkey", "https://shop.com", "", false},
+		{"Origin 属于别名", "true", "shop.com", "shopkey", "https://m.shop.com:8443", "", false},
+		{"没有 Origin 时使用 Referer", "true", "shop.com", "shopkey", "", "https://m.shop.com/a?b=c", false},
+		{"Origin 不属于域名", "true", "shop.com", "shopkey", "https://evil.com", "https://shop.com/", true},
+		{"没有 Origin 和 Referer", "true", "shop.com", "shopkey", "", "", true},
+		{"不要求站点key时仍然校验来源", "false", "shop.com", "", "https://evil.com", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf.RequireSiteKey = c.require
+			r, _ := http.NewRequest("POST", "/api/v1/tongji/webdata", nil)
+			if len(c.origin) > 0 {
+				r.Header.Set("Origin", c.origin)
+			}
+			if len(c.referer) > 0 {
+				r.Header.Set("Referer", c.referer)
+			}
+			err := CheckSiteKey(c.host, c.key, r)
+			if (err != nil) != c.wantReject {
+				t.Fatalf("CheckSiteKey 返回 %v,期望拒绝:%v", err, c.wantReject)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// ipdb 离线ip数据库(mmdb格式),未配置时不解析区域
+var ipdb *maxminddb.Reader
+
+// trustedProxies 可信代理,只有来自可信代理的 X-Forwarded-For 才会被采用
+var trustedProxies []*net.IPNet
+var trustedProxiesOnce sync.Once
+
+// uaPattern 根据 User-Agent 识别平台或浏览器,按顺序匹配
+type uaPattern struct {
+	re   *regexp.Regexp
+	name string
+}
+
+var platformPatterns = []uaPattern{
+	{regexp.MustCompile(`Windows Phone`), "Windows Phone"},
+	{regexp.MustCompile(`Windows`), "Windows"},
+	{regexp.MustCompile(`Android`), "Android"},
+	{regexp.MustCompile(`iPhone|iPad|iPod`), "iOS"},
+	{regexp.MustCompile(`Mac OS X|Macintosh`), "Mac OS"},
+	{regexp.MustCompile(`CrOS`), "Chrome OS"},
+	{regexp.MustCompile(`Linux`), "Linux"},
+}
+var browserPatterns = []uaPattern{
+	{regexp.MustCompile(`MicroMessenger`), "WeChat"},
+	{regexp.MustCompile(`Edg(e|A|iOS)?/`), "Edge"},
+	{regexp.MustCompile(`OPR/|Opera`), "Opera"},
+	{regexp.MustCompile(`QQBrowser`), "QQBrowser"},
+	{regexp.MustCompile(`UCBrowser`), "UC"},
+	{regexp.MustCompile(`Firefox/|FxiOS/`), "Firefox"},
+	{regexp.MustCompile(`Chrome/|CriOS/`), "Chrome"},
+	{regexp.MustCompile(`Safari/`), "Safari"},
+	{regexp.MustCompile(`MSIE|Trident/`), "IE"},
+}
+var mobilePattern = regexp.MustCompile(`(?i)Mobi|Android|iPhone|iPad|iPod|Windows Phone`)
+
+// OpenIPDB 打开离线ip数据库
+func OpenIPDB() {
+	if len(conf.IPDBPath) == 0 {
+		return
+	}
+	log.Println("打开ip数据库")
+	r, err := maxminddb.Open(conf.IPDBPath)
+	if err != nil {
+		log.Printf("打开ip数据库：%s 失败,原因：%v\n", conf.IPDBPath, err)
+		return
+	}
+	ipdb = r
+}
+
+// CloseIPDB 关闭离线ip数据库
+func CloseIPDB() {
+	if ipdb != nil {
+		ipdb.Close()
+	}
+}
+
+// ClientIP 获取客户端ip
+// 只有当请求来自可信代理时,才从 X-Forwarded-For 由右向左查找第一个不可信的ip
+func ClientIP(request *http.Request) string {
+	ip, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		ip = request.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	forwarded := strings.Split(request.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		x := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(x) == nil {
+			break
+		}
+		ip = x
+		if !isTrustedProxy(x) {
+			break
+		}
+	}
+	return ip
+}
+func isTrustedProxy(ip string) bool {
+	trustedProxiesOnce.Do(func() {
+		trustedProxies = parseNetworks(conf.TrustedProxies)
+	})
+	x := net.ParseIP(ip)
+	if x == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(x) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks 解析以逗号分隔的ip或CIDR
+func parseNetworks(s string) []*net.IPNet {
+	var result []*net.IPNet
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Printf("ip或CIDR配置错误:%v\n", err)
+			continue
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+// ParseUserAgent 从 User-Agent 解析操作系统、浏览器和终端类型(0为电脑、1为手机)
+func ParseUserAgent(ua string) (platform, browser string, deviceType int) {
+	platform = matchUserAgent(ua, platformPatterns)
+	browser = matchUserAgent(ua, browserPatterns)
+	if mobilePattern.MatchString(ua) {
+		deviceType = 1
+	}
+	return platform, browser, deviceType
+}
+func matchUserAgent(ua string, patterns []uaPattern) string {
+	for _, p := range patterns {
+		if p.re.MatchString(ua) {
+			return p.name
+		}
+	}
+	return "Other"
+}
+
+// Region 根据ip从离线数据库获取区域,格式:国家-省份-城市
+func Region(ip string) string {
+	if ipdb == nil {
+		return ""
+	}
+	x := net.ParseIP(ip)
+	if x == nil {
+		return ""
+	}
+	var record ipRecord
+	if err := ipdb.Lookup(x, &record); err != nil {
+		Log(err)
+		return ""
+	}
+	places := []ipPlace{record.Country}
+	if len(record.Subdivisions) > 0 {
+		places = append(places, record.Subdivisions[0])
+	}
+	places = append(places, record.City)
+	var names []string
+	for _, p := range places {
+		if name := p.localName(); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "-")
+}
+
+// ipRecord mmdb 城市数据库中的一条纪录
+type ipRecord struct {
+	Country      ipPlace   `maxminddb:"country"`
+	Subdivisions []ipPlace `maxminddb:"subdivisions"`
+	City         ipPlace   `maxminddb:"city"`
+}
+type ipPlace struct {
+	Names map[string]string `maxminddb:"names"`
+}
+
+// localName 优先使用中文名称
+func (p ipPlace) localName() string {
+	if n, ok := p.Names["zh-CN"]; ok {
+		return n
+	}
+	return p.Names["en"]
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxiesOnce.Do(func() {})
+	old := trustedProxies
+	trustedProxies = parseNetworks("10.0.0.0/8, 127.0.0.1, ::1, bad")
+	defer func() { trustedProxies = old }()
+	cases := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"没有代理", "1.2.3.4:5678", "", "1.2.3.4"},
+		{"不可信的来源伪造 X-Forwarded-For", "1.2.3.4:5678", "9.9.9.9", "1.2.3.4"},
+		{"可信代理", "127.0.0.1:80", "1.2.3.4", "1.2.3.4"},
+		{"客户端伪造的ip在可信代理链之前", "127.0.0.1:80", "9.9.9.9, 1.2.3.4, 10.0.0.2", "1.2.3.4"},
+		{"全部是可信代理时取最左边的ip", "10.0.0.1:80", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"IPv6 的 host:port", "[::1]:443", "2001:db8::1", "2001:db8::1"},
+		{"不可信的 IPv6", "[2001:db8::2]:443", "1.2.3.4", "2001:db8::2"},
+		{"没有端口", "127.0.0.1", "1.2.3.4", "1.2.3.4"},
+		{"可信代理没有 X-Forwarded-For", "127.0.0.1:80", "", "127.0.0.1"},
+		{"X-Forwarded-For 不是ip", "127.0.0.1:80", "unknown", "127.0.0.1"},
+		{"不是ip时停止查找", "127.0.0.1:80", "1.2.3.4, garbage", "127.0.0.1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.RemoteAddr = c.remoteAddr
+			if len(c.xff) > 0 {
+				r.Header.Set("X-Forwarded-For", c.xff)
+			}
+			if got := ClientIP(r); got != c.want {
+				t.Fatalf("ClientIP 为 %s,期望 %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseUserAgent(t *testing.T) {
+	cases := []struct {
+		ua                string
+		platform, browser string
+		deviceType        int
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.93 Safari/537.36", "Windows", "Chrome", 0},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.93 Safari/537.36 Edg/90.0.818.56", "Windows", "Edge", 0},
+		{"Mozilla/5.0 (Windows NT 6.1; WOW64; Trident/7.0; rv:11.0) like Gecko", "Windows", "IE", 0},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.93 Safari/537.36 OPR/76.0.4017.123", "Windows", "Opera", 0},
+		{"Mozilla/5.0 (Windows Phone 10.0; Android 6.0.1; Microsoft; Lumia 950) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/52.0.2743.116 Mobile Safari/537.36 Edge/15.15063", "Windows Phone", "Edge", 1},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:88.0) Gecko/20100101 Firefox/88.0", "Mac OS", "Firefox", 0},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1 Safari/605.1.15", "Mac OS", "Safari", 0},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 14_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Mobile/15E148 Safari/604.1", "iOS", "Safari", 1},
+		{"Mozilla/5.0 (iPad; CPU OS 14_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/90.0.4430.78 Mobile/15E148 Safari/604.1", "iOS", "Chrome", 1},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 14_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) FxiOS/33.0 Mobile/15E148 Safari/605.1.15", "iOS", "Firefox", 1},
+		{"Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.91 Mobile Safari/537.36", "Android", "Chrome", 1},
+		{"Mozilla/5.0 (Linux; Android 10; V2001A) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/78.0.3904.62 XWEB/2691 MMWEBSDK/200901 Mobile Safari/537.36 MMWEBID/6040 MicroMessenger/7.0.19.1760(0x27001339) Process/toolsmp WeChat/arm64 NetType/WIFI Language/zh_CN ABI/arm64", "Android", "WeChat", 1},
+		{"Mozilla/5.0 (Linux; U; Android 10; zh-cn; MI 9) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/66.0.3359.126 MQQBrowser/10.1 Mobile Safari/537.36", "Android", "QQBrowser", 1},
+		{"Mozilla/5.0 (Linux; U; Android 9; zh-CN; SM-G9600) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/57.0.2987.108 UCBrowser/13.0.0.1080 Mobile Safari/537.36", "Android", "UC", 1},
+		{"Mozilla/5.0 (X11; CrOS x86_64 13904.55.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.87 Safari/537.36", "Chrome OS", "Chrome", 0},
+		{"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:88.0) Gecko/20100101 Firefox/88.0", "Linux", "Firefox", 0},
+		{"curl/7.68.0", "Other", "Other", 0},
+		{"", "Other", "Other", 0},
+	}
+	for _, c := range cases {
+		platform, browser, deviceType := ParseUserAgent(c.ua)
+		if platform != c.platform || browser != c.browser || deviceType != c.deviceType {
+			t.Errorf("%q 解析为 %s、%s、%d,期望 %s、%s、%d", c.ua, platform, browser, deviceType, c.platform, c.browser, c.deviceType)
+		}
+	}
+}
+
+func TestRegion(t *testing.T) {
+	old := ipdb
+	defer func() { ipdb = old }()
+	// 没有配置ip数据库时不解析区域
+	ipdb = nil
+	if r := Region("1.2.3.4"); r != "" {
+		t.Fatalf("没有ip数据库时区域为 %q", r)
+	}
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	if err := ioutil.WriteFile(path, testCityDB(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ipdb = r
+	cases := []struct{ ip, want string }{
+		{"1.2.3.4", "中国-Guangdong-Shenzhen"},
+		{"garbage", ""},
+		{"", ""},
+		// 数据库只有 IPv4
+		{"2001:db8::1", ""},
+	}
+	for _, c := range cases {
+		if got := Region(c.ip); got != c.want {
+			t.Errorf("%q 的区域为 %q,期望 %q", c.ip, got, c.want)
+		}
+	}
+}
+
+// testCityDB 所有 IPv4 都指向同一条纪录的 mmdb 城市数据库,国家有中文名称,省份和城市只有英文名称
+func testCityDB() []byte {
+	str := func(s string) []byte { return append([]byte{2<<5 | byte(len(s))}, s...) }
+	u16 := func(v uint16) []byte { return []byte{5<<5 | 2, byte(v >> 8), byte(v)} }
+	u32 := func(v uint32) []byte { return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)} }
+	u64 := func(v uint64) []byte {
+		b := []byte{8, 9 - 7}
+		for i := 7; i >= 0; i-- {
+			b = append(b, byte(v>>(8*uint(i))))
+		}
+		return b
+	}
+	array := func(items ...[]byte) []byte {
+		return bytes.Join(append([][]byte{{byte(len(items)), 11 - 7}}, items...), nil)
+	}
+	dict := func(kvs ...[]byte) []byte {
+		return bytes.Join(append([][]byte{{7<<5 | byte(len(kvs)/2)}}, kvs...), nil)
+	}
+	names := func(kvs ...[]byte) []byte { return dict(str("names"), dict(kvs...)) }
+	record := dict(
+		str("country"), names(str("zh-CN"), str("中国"), str("en"), str("China")),
+		str("subdivisions"), array(names(str("en"), str("Guangdong"))),
+		str("city"), names(str("en"), str("Shenzhen")),
+	)
+	metadata := dict(
+		str("node_count"), u32(1),
+		str("record_size"), u16(24),
+		str("ip_version"), u16(4),
+		str("database_type"), str("Test-City"),
+		str("languages"), array(str("en"), str("zh-CN")),
+		str("binary_format_major_version"), u16(2),
+		str("binary_format_minor_version"), u16(0),
+		str("build_epoch"), u64(0),
+		str("description"), dict(str("en"), str("test")),
+	)
+	// 只有一个节点,左右两个纪录都是 node_count+16,指向数据区的第一条纪录
+	tree := []byte{0, 0, 17, 0, 0, 17}
+	return bytes.Join([][]byte{tree, make([]byte, 16), record, []byte("\xab\xcd\xefMaxMind.com"), metadata}, nil)
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// maxEventFieldLength 事件类别、动作、标签的最大长度
+const maxEventFieldLength = 100
+
+// CheckEvent 校验自定义事件,类别和动作不能为空,过长的字段会被截断
+func CheckEvent(e *model.Event) error {
+	e.Category = truncate(strings.TrimSpace(e.Category), maxEventFieldLength)
+	e.Action = truncate(strings.TrimSpace(e.Action), maxEventFieldLength)
+	e.Label = truncate(strings.TrimSpace(e.Label), maxEventFieldLength)
+	if len(e.Category) == 0 || len(e.Action) == 0 {
+		return errors.New("事件的 category 和 action 不能为空")
+	}
+	return nil
+}
+
+// truncate 按字符截断字符串
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// GetRedisEventField 自定义事件在 tongji_event_<yyyy-mm-dd> 中的 field: <count|value>_<事件json>
+func GetRedisEventField(counter string, e *model.Event) string {
+	key := model.Event{
+		Domain:   e.Domain,
+		URL:      e.URL,
+		Category: e.Category,
+		Action:   e.Action,
+		Label:    e.Label,
+	}
+	str, _ := util.ToJSONStr(key)
+	return counter + "_" + str
+}
+
+// GetEventsFromRedis 从redis获取指定日期的自定义事件
+func GetEventsFromRedis(date string) ([]*model.Event, error) {
+	r := model.RedisCli.HGetAll(GetRedisEventKey(date))
+	if r.Err() != nil && r.Err() != redis.Nil {
+		return nil, r.Err()
+	}
+	events := make(map[string]*model.Event)
+	for field, val := range r.Val() {
+		i := strings.Index(field, "_")
+		if i < 0 {
+			continue
+		}
+		counter, key := field[:i], field[i+1:]
+		e := events[key]
+		if e == nil {
+			e = &model.Event{}
+			if err := util.Str2Struct(key, e); err != nil {
+				Log(err)
+				continue
+			}
+			e.Date = date
+			events[key] = e
+		}
+		n, _ := strconv.ParseInt(val, 10, 64)
+		switch counter {
+		case "count":
+			e.Count += int(n)
+		case "value":
+			e.Value += n
+		}
+	}
+	result := make([]*model.Event, 0, len(events))
+	for _, e := range events {
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// FlushEvents2DBFromRedis 将redis中保存的自定义事件保存到数据库
+func FlushEvents2DBFromRedis(date string) {
+	events, err := GetEventsFromRedis(date)
+	if err != nil {
+		Log(err)
+		return
+	}
+	for _, e := range events {
+		if err := e.UpdateOrSave(); err != nil {
+			Log(err)
+			return
+		}
+	}
+	if err := model.RedisCli.Del(GetRedisEventKey(date)).Err(); err != nil {
+		Log(err)
+	}
+}
+
+// EventReq 自定义事件查询请求
+type EventReq struct {
+	RealtimeDataReq
+	Category string   `json:"category"`
+	Action   string   `json:"action"`
+	URL      string   `json:"url"`
+	Group    []string `json:"group"` // 除 category、action 外的分组字段:label、url
+}
+
+// GetEvents 获取指定日期范围内按类别、动作分组的自定义事件,包含今天时合并redis中今日数据
+func GetEvents(req *EventReq) (string, error) {
+	if len(req.Domain) == 0 || len(req.StartDate) == 0 || len(req.EndDate) == 0 {
+		return "", errors.New("domain 、 startDate、endDate 不能为空")
+	}
+	q := &model.EventQuery{
+		Domain:   req.Domain,
+		Start:    req.StartDate,
+		End:      req.EndDate,
+		Category: req.Category,
+		Action:   req.Action,
+		URL:      req.URL,
+		Group:    []string{"category", "action"},
+	}
+	for _, g := range req.Group {
+		if g != "label" && g != "url" {
+			return "", fmt.Errorf("不支持的分组字段:%s", g)
+		}
+		q.Group = append(q.Group, g)
+	}
+	datas, err := model.FindEvents(q)
+	if err != nil {
+		return "", err
+	}
+	today := util.GetDateAsDefaultStr()
+	if req.StartDate <= today && today <= req.EndDate {
+		todays, err := GetEventsFromRedis(today)
+		if err != nil {
+			return "", err
+		}
+		datas = mergeEvents(datas, todays, q)
+	}
+	if req.Offset >= len(datas) {
+		datas = datas[:0]
+	} else {
+		datas = datas[req.Offset:]
+	}
+	if limit := req.getLimit(); len(datas) > limit {
+		datas = datas[:limit]
+	}
+	return util.ToJSONStr(datas)
+}
+
+// mergeEvents 按查询条件筛选今日事件,合并相同分组并按触发次数降序排序
+func mergeEvents(datas, todays []*model.Event, q *model.EventQuery) []*model.Event {
+	merged := make(map[string]*model.Event)
+	for _, e := range datas {
+		merged[GetRedisEventField("", e)] = e
+	}
+	for _, e := range todays {
+		if e.Domain != q.Domain || (len(q.Category) > 0 && e.Category != q.Category) ||
+			(len(q.Action) > 0 && e.Action != q.Action) || (len(q.URL) > 0 && e.URL != q.URL) {
+			continue
+		}
+		// 只保留分组字段
+		g := &model.Event{Category: e.Category, Action: e.Action, Count: e.Count, Value: e.Value}
+		for _, f := range q.Group {
+			switch f {
+			case "label":
+				g.Label = e.Label
+			case "url":
+				g.URL = e.URL
+			}
+		}
+		k := GetRedisEventField("", g)
+		if old := merged[k]; old != nil {
+			old.Count += g.Count
+			old.Value += g.Value
+			continue
+		}
+		merged[k] = g
+	}
+	result := make([]*model.Event, 0, len(merged))
+	for _, e := range merged {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Count > result[j].Count
+	})
+	return result
+}
@@ -0,0 +1,440 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/jinzhu/gorm"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// maxGoalSteps 漏斗最多步骤数
+const maxGoalSteps = 10
+
+// GoalReq 目标创建和修改请求
+type GoalReq struct {
+	ID     int              `json:"id"`
+	Domain string           `json:"domain"`
+	Name   string           `json:"name"`
+	Steps  []model.GoalStep `json:"steps"`
+}
+
+// GoalHit 用于判断目标是否完成的访问
+type GoalHit struct {
+	Type     string // url、event、duration
+	Domain   string
+	Date     string
+	UID      string
+	URL      string
+	Event    string // category/action
+	Duration int
+}
+
+// goalMatcher 编译后的目标
+type goalMatcher struct {
+	id    int
+	steps []*stepMatcher
+}
+
+// stepMatcher 编译后的目标步骤
+type stepMatcher struct {
+	typ       string
+	re        *regexp.Regexp // Pattern 为空时为nil
+	pathOnly  bool           // Pattern 以/开头时只匹配页面路径
+	action    bool           // 事件规则含有/时匹配 category/action,否则只匹配 category
+	threshold int
+}
+
+// goalCache 目标缓存,key为域名
+var goalCache = struct {
+	sync.RWMutex
+	goals map[string][]*goalMatcher
+	refresher
+}{}
+
+// GetGoals 获取域名的所有目标
+func GetGoals(domain string) (string, error) {
+	if len(domain) == 0 {
+		return "", errors.New("domain 不能为空")
+	}
+	datas, err := model.FindGoals(domain)
+	if err != nil {
+		return "", err
+	}
+	return util.ToJSONStr(datas)
+}
+
+// GoalDomain 获取目标所属域名
+func GoalDomain(id int) (string, error) {
+	g, err := model.FindGoalByID(id)
+	if err != nil {
+		return "", fmt.Errorf("目标id:%d 不存在:%v", id, err)
+	}
+	return g.Domain, nil
+}
+
+// AddGoal 创建目标
+func AddGoal(req *GoalReq) (string, error) {
+	g := &model.Goal{}
+	if err := req.fill(g); err != nil {
+		return "", err
+	}
+	if err := g.Save(); err != nil {
+		return "", err
+	}
+	RefreshGoalCache()
+	return util.ToJSONStr(g)
+}
+
+// UpdateGoal 修改目标名称和步骤,所属域名不能修改
+func UpdateGoal(req *GoalReq) (string, error) {
+	g, err := model.FindGoalByID(req.ID)
+	if err != nil {
+		return "", fmt.Errorf("目标id:%d 不存在:%v", req.ID, err)
+	}
+	req.Domain = g.Domain
+	if err := req.fill(g); err != nil {
+		return "", err
+	}
+	if err := g.Update(); err != nil {
+		return "", err
+	}
+	RefreshGoalCache()
+	return util.ToJSONStr(g)
+}
+
+// DelGoal 删除目标
+func DelGoal(id int) error {
+	g, err := model.FindGoalByID(id)
+	if err != nil {
+		return fmt.Errorf("目标id:%d 不存在:%v", id, err)
+	}
+	if err := g.Delete(); err != nil {
+		return err
+	}
+	RefreshGoalCache()
+	return nil
+}
+
+// fill 校验并填充目标信息
+func (req *GoalReq) fill(g *model.Goal) error {
+	d := LookupDomain(req.Domain)
+	if d == nil {
+		return fmt.Errorf("域名 %s 未注册", req.Domain)
+	}
+	if len(strings.TrimSpace(req.Name)) == 0 {
+		return errors.New("name 不能为空")
+	}
+	if len(req.Steps) == 0 || len(req.Steps) > maxGoalSteps {
+		return fmt.Errorf("steps 必须有1到%d个步骤", maxGoalSteps)
+	}
+	steps := make([]model.GoalStep, len(req.Steps))
+	for i, s := range req.Steps {
+		s.ID = 0
+		s.Seq = i + 1
+		if _, err := compileStep(&s); err != nil {
+			return fmt.Errorf("第%d步:%v", s.Seq, err)
+		}
+		steps[i] = s
+	}
+	g.Domain = d.Domain
+	g.Name = strings.TrimSpace(req.Name)
+	g.Steps = steps
+	return nil
+}
+
+// compileStep 校验并编译目标步骤
+func compileStep(s *model.GoalStep) (*stepMatcher, error) {
+	m := &stepMatcher{typ: s.Type, threshold: s.Threshold}
+	switch s.Type {
+	case model.GoalStepURL, model.GoalStepEvent:
+		if len(s.Pattern) == 0 {
+			return nil, errors.New("pattern 不能为空")
+		}
+	case model.GoalStepDuration:
+		if s.Threshold <= 0 {
+			return nil, errors.New("threshold 必须大于0")
+		}
+	default:
+		return nil, fmt.Errorf("type 必须是 %s、%s 或 %s", model.GoalStepURL, model.GoalStepEvent, model.GoalStepDuration)
+	}
+	if len(s.Pattern) > 0 {
+		m.pathOnly = s.Type != model.GoalStepEvent && strings.HasPrefix(s.Pattern, "/")
+		m.action = s.Type == model.GoalStepEvent && strings.Contains(s.Pattern, "/")
+		re, err := regexp.Compile("^" + strings.Replace(regexp.QuoteMeta(s.Pattern), `\*`, ".*", -1) + "$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// match 访问是否完成该步骤
+func (m *stepMatcher) match(h *GoalHit) bool {
+	if m.typ != h.Type {
+		return false
+	}
+	switch m.typ {
+	case model.GoalStepEvent:
+		if m.action {
+			return m.re.MatchString(h.Event)
+		}
+		return m.re.MatchString(strings.SplitN(h.Event, "/", 2)[0])
+	case model.GoalStepDuration:
+		if h.Duration < m.threshold {
+			return false
+		}
+	}
+	if m.re == nil {
+		return true
+	}
+	if m.pathOnly {
+		u, err := url.Parse(h.URL)
+		return err == nil && m.re.MatchString(u.Path)
+	}
+	return m.re.MatchString(h.URL)
+}
+
+// RefreshGoalCache 重新加载目标缓存
+func RefreshGoalCache() error {
+	datas, err := model.FindGoals("")
+	if err != nil {
+		return err
+	}
+	goals := make(map[string][]*goalMatcher)
+	for _, g := range datas {
+		gm := &goalMatcher{id: g.ID}
+		for i := range g.Steps {
+			m, err := compileStep(&g.Steps[i])
+			if err != nil {
+				Log(fmt.Errorf("目标id:%d 第%d步:%v", g.ID, g.Steps[i].Seq, err))
+				gm = nil
+				break
+			}
+			gm.steps = append(gm.steps, m)
+		}
+		if gm != nil && len(gm.steps) > 0 {
+			goals[g.Domain] = append(goals[g.Domain], gm)
+		}
+	}
+	goalCache.Lock()
+	goalCache.goals = goals
+	goalCache.Unlock()
+	return nil
+}
+
+// getGoals 获取域名的目标
+func getGoals(domain string) []*goalMatcher {
+	goalCache.check(RefreshGoalCache)
+	goalCache.RLock()
+	defer goalCache.RUnlock()
+	return goalCache.goals[domain]
+}
+
+// HasGoals 域名是否设置了转化目标
+func HasGoals(domain string) bool {
+	return len(getGoals(domain)) > 0
+}
+
+// EvaluateGoals 根据用户当天的目标进度判断访问是否完成下一步,更新 progress 并在管道中保存
+// progress 为 GetRedisGoalProgressKey 中的进度,用户当天第一次访问时计入第0步,每次访问最多完成一步
+func EvaluateGoals(pipe redis.Pipeliner, h *GoalHit, progress map[string]string) {
+	if len(h.UID) == 0 {
+		return
+	}
+	goals := getGoals(h.Domain)
+	if len(goals) == 0 {
+		return
+	}
+	key := GetRedisGoalProgressKey(h.Date, h.UID)
+	statKey := GetRedisGoalKey(h.Date)
+	changed := false
+	for _, g := range goals {
+		field := strconv.Itoa(g.id)
+		reached, seen := progress[field]
+		n, _ := strconv.Atoi(reached)
+		if !seen {
+			pipe.HIncrBy(statKey, GetRedisGoalField(g.id, 0), 1)
+		}
+		advanced := n < len(g.steps) && g.steps[n].match(h)
+		if advanced {
+			n++
+			pipe.HIncrBy(statKey, GetRedisGoalField(g.id, n), 1)
+		}
+		if !seen || advanced {
+			progress[field] = strconv.Itoa(n)
+			pipe.HSet(key, field, n)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	tomorrow, _ := util.ParseDate(h.Date, util.YYYY_MM_DD)
+	tomorrow = tomorrow.Add(time.Hour * 24)
+	pipe.ExpireAt(key, tomorrow)
+	// 每日0点保存到数据库后删除,保留至第二天24点
+	pipe.ExpireAt(statKey, tomorrow.Add(time.Hour*24))
+}
+
+// GetRedisGoalField 目标步骤在 tongji_goal_<yyyy-mm-dd> 中的 field: <目标id>_<步骤>
+func GetRedisGoalField(goalID, step int) string {
+	return fmt.Sprintf("%d_%d", goalID, step)
+}
+
+// GetGoalStatsFromRedis 从redis获取指定日期的目标统计
+func GetGoalStatsFromRedis(date string) ([]*model.GoalStat, error) {
+	r := model.RedisCli.HGetAll(GetRedisGoalKey(date))
+	if r.Err() != nil && r.Err() != redis.Nil {
+		return nil, r.Err()
+	}
+	var result []*model.GoalStat
+	for field, val := range r.Val() {
+		s := &model.GoalStat{Date: date}
+		if _, err := fmt.Sscanf(field, "%d_%d", &s.GoalID, &s.Step); err != nil {
+			Log(err)
+			continue
+		}
+		s.Visitors, _ = strconv.Atoi(val)
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// FlushGoals2DBFromRedis 将redis中保存的目标统计保存到数据库
+func FlushGoals2DBFromRedis(date string) {
+	stats, err := GetGoalStatsFromRedis(date)
+	if err != nil {
+		Log(err)
+		return
+	}
+	for _, s := range stats {
+		if err := s.UpdateOrSave(); err != nil {
+			Log(err)
+			return
+		}
+	}
+	if err := model.RedisCli.Del(GetRedisGoalKey(date)).Err(); err != nil {
+		Log(err)
+	}
+}
+
+// GoalReport 目标每日转化报告
+type GoalReport struct {
+	Goal *model.Goal `json:"goal"`
+	Days []*GoalDay  `json:"days"`
+}
+
+// GoalDay 目标一天的转化
+type GoalDay struct {
+	Date           string          `json:"date"`
+	Visitors       int             `json:"visitors"`       // 当天访问该域名的用户数
+	Conversions    int             `json:"conversions"`    // 完成所有步骤的用户数
+	ConversionRate float64         `json:"conversionRate"` // Conversions / Visitors
+	Steps          []*GoalStepStat `json:"steps"`
+}
+
+// GoalStepStat 步骤的到达人数和流失
+type GoalStepStat struct {
+	Seq         int     `json:"seq"`
+	Name        string  `json:"name"`
+	Visitors    int     `json:"visitors"`    // 到达该步骤的用户数
+	DropOff     int     `json:"dropOff"`     // 到达上一步但未到达该步骤的用户数
+	DropOffRate float64 `json:"dropOffRate"` // DropOff / 上一步用户数
+}
+
+// GoalReportReq 目标转化查询请求
+type GoalReportReq struct {
+	RealtimeDataReq
+	ID int `json:"id"` // 为0时查询域名的所有目标
+}
+
+// GetGoalReports 获取指定日期范围内目标的每日转化,包含今天时合并redis中今日数据
+func GetGoalReports(req *GoalReportReq) (string, error) {
+	if len(req.Domain) == 0 || len(req.StartDate) == 0 || len(req.EndDate) == 0 {
+		return "", errors.New("domain 、 startDate、endDate 不能为空")
+	}
+	var goals []*model.Goal
+	if req.ID > 0 {
+		g, err := model.FindGoalByID(req.ID)
+		if err == gorm.ErrRecordNotFound || (err == nil && g.Domain != req.Domain) {
+			return "", fmt.Errorf("域名 %s 不存在目标id:%d", req.Domain, req.ID)
+		}
+		if err != nil {
+			return "", err
+		}
+		goals = append(goals, g)
+	} else {
+		var err error
+		if goals, err = model.FindGoals(req.Domain); err != nil {
+			return "", err
+		}
+	}
+	var todays []*model.GoalStat
+	today := util.GetDateAsDefaultStr()
+	if req.StartDate <= today && today <= req.EndDate {
+		var err error
+		if todays, err = GetGoalStatsFromRedis(today); err != nil {
+			return "", err
+		}
+	}
+	reports := make([]*GoalReport, 0, len(goals))
+	for _, g := range goals {
+		stats, err := model.FindGoalStats(g.ID, req.StartDate, req.EndDate)
+		if err != nil {
+			return "", err
+		}
+		for _, s := range todays {
+			if s.GoalID == g.ID {
+				stats = append(stats, s)
+			}
+		}
+		reports = append(reports, newGoalReport(g, stats))
+	}
+	return util.ToJSONStr(reports)
+}
+
+// newGoalReport 按日期汇总目标统计
+func newGoalReport(g *model.Goal, stats []*model.GoalStat) *GoalReport {
+	report := &GoalReport{Goal: g, Days: []*GoalDay{}}
+	visitors := make(map[string][]int)
+	var dates []string
+	for _, s := range stats {
+		if s.Step < 0 || s.Step > len(g.Steps) {
+			continue
+		}
+		v := visitors[s.Date]
+		if v == nil {
+			v = make([]int, len(g.Steps)+1)
+			visitors[s.Date] = v
+			dates = append(dates, s.Date)
+		}
+		v[s.Step] += s.Visitors
+	}
+	for _, date := range dates {
+		v := visitors[date]
+		day := &GoalDay{Date: date, Visitors: v[0], Conversions: v[len(v)-1]}
+		if day.Visitors > 0 {
+			day.ConversionRate = float64(day.Conversions) / float64(day.Visitors)
+		}
+		for i, s := range g.Steps {
+			st := &GoalStepStat{Seq: s.Seq, Name: s.Name, Visitors: v[i+1], DropOff: v[i] - v[i+1]}
+			if v[i] > 0 {
+				st.DropOffRate = float64(st.DropOff) / float64(v[i])
+			}
+			day.Steps = append(day.Steps, st)
+		}
+		report.Days = append(report.Days, day)
+	}
+	return report
+}
@@ -0,0 +1,326 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// hourlyTopURLs 每个域名保存每小时流量的url数,按全天pv降序
+const hourlyTopURLs = 100
+
+// 趋势查询最大天数
+const (
+	maxHourlyTrendDays = 31
+	maxDailyTrendDays  = 366
+	maxRollupTrendDays = 366 * 3
+)
+
+// hourlyAll 全天在 field 中的表示
+const hourlyAll = "all"
+
+// HourlyHit 用于统计每小时流量的访问
+type HourlyHit struct {
+	Domain      string
+	URL         string
+	UID         string
+	IP          string
+	Date        string
+	Hour        int
+	NewVisit    bool // 域名新的访问
+	NewURLVisit bool // url半小时内第一次访问
+}
+
+// HourlyIncr 每小时流量的增量
+type HourlyIncr struct {
+	Key   string
+	Field string
+	N     int64
+}
+
+// CountHourly 在管道中判断访问在该小时和全天是否是新的用户和ip,管道执行后调用返回的函数得到需要累加到redis的计数
+// 用户和ip使用当前的去重方式在该小时和全天去重;NewVisit、NewURLVisit 在调用返回的函数之前设置即可
+func CountHourly(pipe redis.Pipeliner, h *HourlyHit) func() []*HourlyIncr {
+	type check struct {
+		n          func() int64
+		key, field string
+	}
+	type counted struct {
+		key, field string
+		url        bool
+	}
+	var fields []counted
+	var checks []check
+	for _, period := range []string{fmt.Sprintf("%02d", h.Hour), hourlyAll} {
+		targets := []struct {
+			key, field, url string
+		}{
+			{GetRedisHourlyKey(h.Date), h.Domain + "|" + period, ""},
+			{GetRedisHourlyURLKey(h.Date), h.Domain + "|" + period, h.URL},
+		}
+		for _, t := range targets {
+			field := t.field
+			if len(t.url) > 0 {
+				field += "|" + t.url
+			}
+			fields = append(fields, counted{t.key, field, len(t.url) > 0})
+			for _, c := range []struct{ kind, counter, id string }{{DedupUV, "uv", h.UID}, {DedupIP, "ip", h.IP}} {
+				if len(c.id) == 0 {
+					continue
+				}
+				n := deduper.AddPipe(pipe, c.kind, h.Date, period, h.Domain, t.url, c.id)
+				checks = append(checks, check{n, t.key, field + "|" + c.counter})
+			}
+		}
+	}
+	return func() []*HourlyIncr {
+		var incrs []*HourlyIncr
+		for _, f := range fields {
+			incrs = append(incrs, &HourlyIncr{f.key, f.field + "|pv", 1})
+			if (f.url && h.NewURLVisit) || (!f.url && h.NewVisit) {
+				incrs = append(incrs, &HourlyIncr{f.key, f.field + "|visits", 1})
+			}
+		}
+		// 管道执行失败时不统计新的用户和ip
+		for _, c := range checks {
+			if c.n() > 0 {
+				incrs = append(incrs, &HourlyIncr{c.key, c.field, 1})
+			}
+		}
+		return incrs
+	}
+}
+
+// parseHourlyField 解析 <domain>|<hh|all>[|<url>]|<pv|uv|ip|visits>
+func parseHourlyField(field string, withURL bool) (h *model.Hourly, counter string, ok bool) {
+	n := 3
+	if withURL {
+		n = 4
+	}
+	// url 中可能含有|,计数在最后
+	i := strings.LastIndex(field, "|")
+	if i < 0 {
+		return nil, "", false
+	}
+	counter = field[i+1:]
+	parts := strings.SplitN(field[:i], "|", n-1)
+	if len(parts) != n-1 {
+		return nil, "", false
+	}
+	h = &model.Hourly{Domain: parts[0], Hour: model.HourAll}
+	if parts[1] != hourlyAll {
+		hour, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, "", false
+		}
+		h.Hour = hour
+	}
+	if withURL {
+		h.URL = parts[2]
+	}
+	return h, counter, true
+}
+
+// GetHourlyFromRedis 从redis获取指定日期所有域名和url的每小时流量
+func GetHourlyFromRedis(date string) ([]*model.Hourly, error) {
+	rows := make(map[string]*model.Hourly)
+	for _, k := range []struct {
+		key     string
+		withURL bool
+	}{{GetRedisHourlyKey(date), false}, {GetRedisHourlyURLKey(date), true}} {
+		r := model.RedisCli.HGetAll(k.key)
+		if r.Err() != nil && r.Err() != redis.Nil {
+			return nil, r.Err()
+		}
+		for field, val := range r.Val() {
+			h, counter, ok := parseHourlyField(field, k.withURL)
+			if !ok {
+				continue
+			}
+			id := fmt.Sprintf("%s|%d|%s", h.Domain, h.Hour, h.URL)
+			if old := rows[id]; old != nil {
+				h = old
+			} else {
+				h.Date = date
+				rows[id] = h
+			}
+			n, _ := strconv.Atoi(val)
+			switch counter {
+			case "pv":
+				h.PV += n
+			case "uv":
+				h.UV += n
+			case "ip":
+				h.IP += n
+			case "visits":
+				h.Visits += n
+			}
+		}
+	}
+	result := make([]*model.Hourly, 0, len(rows))
+	for _, h := range rows {
+		result = append(result, h)
+	}
+	return result, nil
+}
+
+// FlushHourly2DBFromRedis 将redis中保存的每小时流量保存到数据库,url只保存每个域名全天pv最高的 hourlyTopURLs 个
+func FlushHourly2DBFromRedis(date string) {
+	rows, err := GetHourlyFromRedis(date)
+	if err != nil {
+		Log(err)
+		return
+	}
+	// 每个域名全天pv降序的url
+	urls := make(map[string][]*model.Hourly)
+	for _, h := range rows {
+		if len(h.URL) > 0 && h.Hour == model.HourAll {
+			urls[h.Domain] = append(urls[h.Domain], h)
+		}
+	}
+	top := make(map[string]bool)
+	for _, list := range urls {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].PV > list[j].PV
+		})
+		for i := 0; i < len(list) && i < hourlyTopURLs; i++ {
+			top[list[i].Domain+"|"+list[i].URL] = true
+		}
+	}
+	for _, h := range rows {
+		if len(h.URL) > 0 && !top[h.Domain+"|"+h.URL] {
+			continue
+		}
+		if err := h.UpdateOrSave(); err != nil {
+			Log(err)
+			return
+		}
+	}
+	if err := model.RedisCli.Del(GetRedisHourlyKey(date), GetRedisHourlyURLKey(date)).Err(); err != nil {
+		Log(err)
+	}
+}
+
+// TrendReq 流量趋势查询请求
+type TrendReq struct {
+	RealtimeDataReq
+	URL      string `json:"url"`      // 为空时查询整个域名
+	Interval string `json:"interval"` // hour(默认)、day、week 或 month
+}
+
+// TrendPoint 趋势中的一个时间点
+type TrendPoint struct {
+	Time   string `json:"time"` // yyyy-mm-dd hh:00 或 yyyy-mm-dd
+	PV     int    `json:"pv"`
+	UV     int    `json:"uv"`
+	IP     int    `json:"ip"`
+	Visits int    `json:"visits"`
+}
+
+// GetTrend 获取指定日期范围内每小时或每天的流量,没有流量的时间点补0,包含今天时合并redis中今日数据
+func GetTrend(req *TrendReq) (string, error) {
+	if len(req.Domain) == 0 || len(req.StartDate) == 0 || len(req.EndDate) == 0 {
+		return "", errors.New("domain 、 startDate、endDate 不能为空")
+	}
+	if len(req.Interval) == 0 {
+		req.Interval = "hour"
+	}
+	if req.Interval != "hour" && req.Interval != "day" && checkPeriod(req.Interval) != nil {
+		return "", errors.New("interval 必须是 hour、day、week 或 month")
+	}
+	daily := req.Interval == "day"
+	rollup := req.Interval == model.PeriodWeek || req.Interval == model.PeriodMonth
+	start, err := util.ParseDate(req.StartDate, util.YYYY_MM_DD)
+	if err != nil {
+		return "", fmt.Errorf("startDate 格式错误:%v", err)
+	}
+	end, err := util.ParseDate(req.EndDate, util.YYYY_MM_DD)
+	if err != nil {
+		return "", fmt.Errorf("endDate 格式错误:%v", err)
+	}
+	if end.Before(start) {
+		return "", errors.New("endDate 不能早于 startDate")
+	}
+	days := int(end.Sub(start).Hours()/24+0.5) + 1
+	maxDays := maxHourlyTrendDays
+	if daily {
+		maxDays = maxDailyTrendDays
+	} else if rollup {
+		maxDays = maxRollupTrendDays
+	}
+	if days > maxDays {
+		return "", fmt.Errorf("interval 为 %s 时最多查询%d天", req.Interval, maxDays)
+	}
+	// 每周、每月的流量从汇总表查询
+	if rollup {
+		result, err := getRollupTrend(req, start, end)
+		if err != nil {
+			return "", err
+		}
+		return util.ToJSONStr(result)
+	}
+	rows, err := model.FindHourly(req.Domain, req.URL, req.StartDate, req.EndDate, daily)
+	if err != nil {
+		return "", err
+	}
+	today := util.GetDateAsDefaultStr()
+	if req.StartDate <= today && today <= req.EndDate {
+		todays, err := GetHourlyFromRedis(today)
+		if err != nil {
+			return "", err
+		}
+		for _, h := range todays {
+			if h.Domain == req.Domain && h.URL == req.URL && (h.Hour == model.HourAll) == daily {
+				rows = append(rows, h)
+			}
+		}
+	}
+	points := make(map[string]*TrendPoint)
+	for _, h := range rows {
+		t := trendTime(h.Date, h.Hour, daily)
+		p := points[t]
+		if p == nil {
+			p = &TrendPoint{Time: t}
+			points[t] = p
+		}
+		p.PV += h.PV
+		p.UV += h.UV
+		p.IP += h.IP
+		p.Visits += h.Visits
+	}
+	var result []*TrendPoint
+	for d := 0; d < days; d++ {
+		date := util.FormatDate(start.AddDate(0, 0, d), util.YYYY_MM_DD)
+		hours := []int{model.HourAll}
+		if !daily {
+			hours = make([]int, 24)
+			for i := range hours {
+				hours[i] = i
+			}
+		}
+		for _, hour := range hours {
+			t := trendTime(date, hour, daily)
+			if p := points[t]; p != nil {
+				result = append(result, p)
+			} else {
+				result = append(result, &TrendPoint{Time: t})
+			}
+		}
+	}
+	return util.ToJSONStr(result)
+}
+
+// trendTime 趋势时间点
+func trendTime(date string, hour int, daily bool) string {
+	if daily {
+		return date
+	}
+	return fmt.Sprintf("%s %02d:00", date, hour)
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// TestFlushHourly2DBFromRedis url只保存每个域名全天pv最高的 hourlyTopURLs 个,整个域名全部保存
+func TestFlushHourly2DBFromRedis(t *testing.T) {
+	rdb := setupFakes(t)
+	fields := map[string]interface{}{
+		"example.com|all|pv": 1000, "example.com|10|pv": 600, "example.com|10|uv": 3,
+		"other.com|all|pv": 3,
+	}
+	urlFields := map[string]interface{}{
+		"other.com|all|/x|pv": 1, "other.com|all|/y|pv": 2,
+	}
+	for i := 0; i <= hourlyTopURLs; i++ {
+		url := fmt.Sprintf("/p%03d", i)
+		urlFields["example.com|all|"+url+"|pv"] = i + 1
+		urlFields["example.com|10|"+url+"|pv"] = 1
+	}
+	rdb.HMSet(GetRedisHourlyKey(testDate), fields)
+	rdb.HMSet(GetRedisHourlyURLKey(testDate), urlFields)
+	FlushHourly2DBFromRedis(testDate)
+	count := func(domain, where string, args ...interface{}) int {
+		var n int
+		model.GetDB().Model(&model.Hourly{}).Where("domain = ? AND date = ?", domain, testDate).Where(where, args...).Count(&n)
+		return n
+	}
+	got := map[string]int{
+		"example.com 整个域名": count("example.com", "url = ''"),
+		"example.com url":  count("example.com", "url <> ''"),
+		"最少的url":           count("example.com", "url = ?", "/p000"),
+		"other.com url":    count("other.com", "url <> ''"),
+	}
+	want := map[string]int{
+		"example.com 整个域名": 2,
+		"example.com url":  hourlyTopURLs * 2,
+		"最少的url":           0,
+		"other.com url":    2,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("保存的纪录数为 %v,期望 %v", got, want)
+	}
+	if n := rdb.Exists(GetRedisHourlyKey(testDate), GetRedisHourlyURLKey(testDate)).Val(); n != 0 {
+		t.Fatal("保存到数据库后应删除redis中的每小时流量")
+	}
+}
+
+func TestGetTrend(t *testing.T) {
+	rdb := setupFakes(t)
+	for _, h := range []*model.Hourly{
+		{Domain: "example.com", Date: "2020-01-01", Hour: 3, PV: 5, UV: 2},
+		{Domain: "example.com", Date: "2020-01-01", Hour: model.HourAll, PV: 9, UV: 4},
+		{Domain: "example.com", Date: "2020-01-02", Hour: model.HourAll, PV: 7},
+		{Domain: "example.com", URL: "/a", Date: "2020-01-01", Hour: model.HourAll, PV: 1},
+		{Domain: "other.com", Date: "2020-01-01", Hour: model.HourAll, PV: 100},
+	} {
+		if err := h.UpdateOrSave(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []*model.Rollup{
+		{Domain: "example.com", Period: model.PeriodWeek, Start: "2020-01-06", PV: 30, UV: 10},
+		{Domain: "example.com", Period: model.PeriodMonth, Start: "2020-02-01", PV: 300},
+	} {
+		if err := r.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	today := util.GetDateAsDefaultStr()
+	rdb.HSet(GetRedisHourlyKey(today), "example.com|all|pv", 8, "example.com|12|pv", 2)
+	// 24个小时补0
+	hours := make([]TrendPoint, 24)
+	for i := range hours {
+		hours[i] = TrendPoint{Time: fmt.Sprintf("2020-01-01 %02d:00", i)}
+	}
+	hours[3].PV, hours[3].UV = 5, 2
+	cases := []struct {
+		name       string
+		interval   string
+		url        string
+		start, end string
+		want       []TrendPoint
+	}{
+		{"每小时", "hour", "", "2020-01-01", "2020-01-01", hours},
+		{"每天", "day", "", "2020-01-01", "2020-01-03", []TrendPoint{{Time: "2020-01-01", PV: 9, UV: 4}, {Time: "2020-01-02", PV: 7}, {Time: "2020-01-03"}}},
+		{"url", "day", "/a", "2020-01-01", "2020-01-03", []TrendPoint{{Time: "2020-01-01", PV: 1}, {Time: "2020-01-02"}, {Time: "2020-01-03"}}},
+		{"今天从redis读取", "day", "", today, today, []TrendPoint{{Time: today, PV: 8}}},
+		{"每周", model.PeriodWeek, "", "2020-01-01", "2020-01-15", []TrendPoint{{Time: "2019-12-30"}, {Time: "2020-01-06", PV: 30, UV: 10}, {Time: "2020-01-13"}}},
+		{"每月", model.PeriodMonth, "", "2020-01-15", "2020-03-02", []TrendPoint{{Time: "2020-01-01"}, {Time: "2020-02-01", PV: 300}, {Time: "2020-03-01"}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := &TrendReq{Interval: c.interval, URL: c.url}
+			req.Domain, req.StartDate, req.EndDate = "example.com", c.start, c.end
+			s, err := GetTrend(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []TrendPoint
+			if err := json.Unmarshal([]byte(s), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("趋势为 %+v,期望 %+v", got, c.want)
+			}
+		})
+	}
+	for _, req := range []TrendReq{
+		{Interval: "year"},
+		{Interval: "hour", RealtimeDataReq: RealtimeDataReq{StartDate: "2020-01-02", EndDate: "2020-01-01"}},
+		{Interval: "hour", RealtimeDataReq: RealtimeDataReq{StartDate: "2020-01-01", EndDate: "2020-03-01"}},
+	} {
+		req.Domain = "example.com"
+		if len(req.StartDate) == 0 {
+			req.StartDate, req.EndDate = "2020-01-01", "2020-01-01"
+		}
+		if _, err := GetTrend(&req); err == nil {
+			t.Errorf("%+v 应返回错误", req)
+		}
+	}
+}
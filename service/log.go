@@ -1,6 +1,13 @@
 package service
 
-import "log"
+import (
+	"log"
+
+	"github.com/codepository/GoWebAnalytics/config"
+)
+
+// 配置,与 config.Config 指向同一个配置,测试时 config.SetForTest 修改后生效
+var conf = config.Config
 
 // Log 日志
 func Log(err error) {
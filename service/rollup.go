@@ -0,0 +1,275 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// AddSketches 在管道中将用户和ip加入当天域名和url的 HyperLogLog
+func AddSketches(pipe redis.Pipeliner, date, domain, url, uid, ip string) {
+	expire := GetTimeOfTomorrowZero(date).Add(time.Hour * 24)
+	for _, u := range []string{"", url} {
+		for kind, id := range map[string]string{model.SketchUV: uid, model.SketchIP: ip} {
+			if len(id) == 0 {
+				continue
+			}
+			key := GetRedisSketchKey(date, kind, domain, u)
+			pipe.PFAdd(key, id)
+			pipe.ExpireAt(key, expire)
+		}
+	}
+	index := GetRedisSketchIndexKey(date)
+	pipe.SAdd(index, domain+"|"+url)
+	pipe.ExpireAt(index, expire)
+}
+
+// PeriodRange 日期所在周期的第一天和最后一天,周从周一开始
+func PeriodRange(period string, date time.Time) (time.Time, time.Time) {
+	date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	if period == model.PeriodMonth {
+		start := date.AddDate(0, 0, 1-date.Day())
+		return start, start.AddDate(0, 1, -1)
+	}
+	start := date.AddDate(0, 0, -(int(date.Weekday())+6)%7)
+	return start, start.AddDate(0, 0, 6)
+}
+
+// unionCount 合并多个 HyperLogLog 后的基数,先写入同一个 hash slot 的临时key,兼容 redis 集群
+func unionCount(datas [][]byte) (int64, error) {
+	if len(datas) == 0 {
+		return 0, nil
+	}
+	tag, err := randomHex(8)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, len(datas))
+	pipe := model.RedisCli.Pipeline()
+	for i, d := range datas {
+		keys[i] = fmt.Sprintf("tongji_hll_tmp_{%s}_%d", tag, i)
+		pipe.Set(keys[i], d, time.Minute)
+	}
+	count := pipe.PFCount(keys...)
+	pipe.Del(keys...)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// FlushSketches2DBFromRedis 将redis中保存的 HyperLogLog 保存到数据库并更新所在周、月的汇总
+// url只保存每个域名 UV 最高的 hourlyTopURLs 个
+func FlushSketches2DBFromRedis(date string) {
+	members, err := model.RedisCli.SMembers(GetRedisSketchIndexKey(date)).Result()
+	if err != nil && err != redis.Nil {
+		Log(err)
+		return
+	}
+	urls := make(map[string][]string)
+	for _, m := range members {
+		i := strings.Index(m, "|")
+		if i < 0 {
+			continue
+		}
+		urls[m[:i]] = append(urls[m[:i]], m[i+1:])
+	}
+	for domain, list := range urls {
+		pipe := model.RedisCli.Pipeline()
+		counts := make([]*redis.IntCmd, len(list))
+		for i, u := range list {
+			counts[i] = pipe.PFCount(GetRedisSketchKey(date, model.SketchUV, domain, u))
+		}
+		if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+			Log(err)
+			continue
+		}
+		idx := make([]int, len(list))
+		for i := range idx {
+			idx[i] = i
+		}
+		sort.Slice(idx, func(a, b int) bool {
+			return counts[idx[a]].Val() > counts[idx[b]].Val()
+		})
+		keep := []string{""}
+		for i := 0; i < len(idx) && i < hourlyTopURLs; i++ {
+			keep = append(keep, list[idx[i]])
+		}
+		for _, u := range keep {
+			for _, kind := range []string{model.SketchUV, model.SketchIP} {
+				data, err := model.RedisCli.Get(GetRedisSketchKey(date, kind, domain, u)).Bytes()
+				if err == redis.Nil {
+					continue
+				}
+				if err != nil {
+					Log(err)
+					continue
+				}
+				s := &model.Sketch{Domain: domain, URL: u, Date: date, Kind: kind, Data: data}
+				if err := s.Save(); err != nil {
+					Log(err)
+				}
+			}
+		}
+	}
+	tm, err := util.ParseDate(date, util.YYYY_MM_DD)
+	if err != nil {
+		Log(err)
+		return
+	}
+	for _, period := range []string{model.PeriodWeek, model.PeriodMonth} {
+		if err := BuildRollups(period, tm); err != nil {
+			Log(err)
+		}
+	}
+}
+
+// BuildRollups 重新计算日期所在周或月截至该日期的汇总
+func BuildRollups(period string, date time.Time) error {
+	start, _ := PeriodRange(period, date)
+	startStr := util.FormatDate(start, util.YYYY_MM_DD)
+	endStr := util.FormatDate(date, util.YYYY_MM_DD)
+	rollups := make(map[string]*model.Rollup)
+	get := func(domain, url string) *model.Rollup {
+		k := domain + "|" + url
+		r := rollups[k]
+		if r == nil {
+			r = &model.Rollup{Domain: domain, URL: url, Period: period, Start: startStr, End: endStr}
+			rollups[k] = r
+		}
+		return r
+	}
+	sketches, err := model.FindSketches(startStr, endStr)
+	if err != nil {
+		return err
+	}
+	datas := make(map[string][][]byte)
+	for _, s := range sketches {
+		get(s.Domain, s.URL)
+		k := s.Domain + "|" + s.URL + "|" + s.Kind
+		datas[k] = append(datas[k], s.Data)
+	}
+	counters, err := model.SumRollupCounters(startStr, endStr)
+	if err != nil {
+		return err
+	}
+	for _, c := range counters {
+		// 只汇总保存了 Sketch 的url
+		r := rollups[c.Domain+"|"+c.URL]
+		if r == nil {
+			continue
+		}
+		r.PV, r.Visits, r.Duration = c.PV, c.Visits, c.Duration
+		r.Bounce, r.Entries, r.Exits = c.Bounce, c.Entries, c.Exits
+	}
+	for _, r := range rollups {
+		uv, err := unionCount(datas[r.Domain+"|"+r.URL+"|"+model.SketchUV])
+		if err != nil {
+			return err
+		}
+		ip, err := unionCount(datas[r.Domain+"|"+r.URL+"|"+model.SketchIP])
+		if err != nil {
+			return err
+		}
+		r.UV, r.IP = int(uv), int(ip)
+		if err := r.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPeriod 校验汇总周期
+func checkPeriod(period string) error {
+	if period != model.PeriodWeek && period != model.PeriodMonth {
+		return fmt.Errorf("汇总周期必须是 %s 或 %s", model.PeriodWeek, model.PeriodMonth)
+	}
+	return nil
+}
+
+// GetTopContentRollup 获取 startDate 所在周或月的url流量排名,UV、IP 为整个周期去重后的数量
+func GetTopContentRollup(req *RealtimeDataReq) (string, error) {
+	if err := checkPeriod(req.Granularity); err != nil {
+		return "", err
+	}
+	field, err := getSortField(req.Sort)
+	if err != nil {
+		return "", err
+	}
+	tm, err := util.ParseDate(req.StartDate, util.YYYY_MM_DD)
+	if err != nil {
+		return "", fmt.Errorf("startDate 格式错误:%v", err)
+	}
+	start, _ := PeriodRange(req.Granularity, tm)
+	datas, err := model.FindTopRollups(&model.TopContentQuery{
+		Domain: req.Domain,
+		Start:  util.FormatDate(start, util.YYYY_MM_DD),
+		Prefix: req.Prefix,
+		Sort:   strings.ToLower(field),
+		Limit:  req.getLimit(),
+		Offset: req.Offset,
+	}, req.Granularity)
+	if err != nil {
+		return "", err
+	}
+	result := []WebData{}
+	for _, d := range datas {
+		var webdata WebData
+		webdata.Pageinfo = model.Pageinfo{Dm: req.Domain, URL: d.URL}
+		webdata.WebFlow = model.WebFlow{
+			Domain:   req.Domain,
+			URL:      d.URL,
+			PV:       d.PV,
+			IP:       d.IP,
+			UV:       d.UV,
+			Duration: d.Duration,
+			Visits:   d.Visits,
+			Bounce:   d.Bounce,
+			Entries:  d.Entries,
+			Exits:    d.Exits,
+		}
+		webdata.WebFlow.SetBounceRate()
+		result = append(result, webdata)
+	}
+	return util.ToJSONStr(result)
+}
+
+// getRollupTrend 获取每周或每月的流量趋势,没有汇总的周期补0
+func getRollupTrend(req *TrendReq, start, end time.Time) ([]*TrendPoint, error) {
+	if err := checkPeriod(req.Interval); err != nil {
+		return nil, err
+	}
+	first, _ := PeriodRange(req.Interval, start)
+	last, _ := PeriodRange(req.Interval, end)
+	firstStr := util.FormatDate(first, util.YYYY_MM_DD)
+	lastStr := util.FormatDate(last, util.YYYY_MM_DD)
+	rows, err := model.FindRollups(req.Domain, req.URL, req.Interval, firstStr, lastStr)
+	if err != nil {
+		return nil, err
+	}
+	points := make(map[string]*TrendPoint)
+	for _, r := range rows {
+		points[r.Start] = &TrendPoint{Time: r.Start, PV: r.PV, UV: r.UV, IP: r.IP, Visits: r.Visits}
+	}
+	var result []*TrendPoint
+	for t := first; !t.After(last); {
+		s := util.FormatDate(t, util.YYYY_MM_DD)
+		if p := points[s]; p != nil {
+			result = append(result, p)
+		} else {
+			result = append(result, &TrendPoint{Time: s})
+		}
+		if req.Interval == model.PeriodMonth {
+			t = t.AddDate(0, 1, 0)
+		} else {
+			t = t.AddDate(0, 0, 7)
+		}
+	}
+	return result, nil
+}
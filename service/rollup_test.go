@@ -0,0 +1,115 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+func TestPeriodRange(t *testing.T) {
+	cases := []struct {
+		period, date string
+		start, end   string
+	}{
+		{model.PeriodWeek, "2020-01-06", "2020-01-06", "2020-01-12"},
+		{model.PeriodWeek, "2020-01-12", "2020-01-06", "2020-01-12"},
+		{model.PeriodWeek, "2020-01-01", "2019-12-30", "2020-01-05"},
+		{model.PeriodMonth, "2020-02-15", "2020-02-01", "2020-02-29"},
+		{model.PeriodMonth, "2020-12-31", "2020-12-01", "2020-12-31"},
+	}
+	for _, c := range cases {
+		tm, _ := util.ParseDate(c.date, util.YYYY_MM_DD)
+		start, end := PeriodRange(c.period, tm)
+		if s, e := util.FormatDate(start, util.YYYY_MM_DD), util.FormatDate(end, util.YYYY_MM_DD); s != c.start || e != c.end {
+			t.Errorf("%s %s 所在周期为 %s 至 %s,期望 %s 至 %s", c.date, c.period, s, e, c.start, c.end)
+		}
+	}
+}
+
+// TestRollups 每天保存 HyperLogLog 后重新计算所在周的汇总,UV、IP 为整周去重后的数量
+func TestRollups(t *testing.T) {
+	rdb := setupFakes(t)
+	// 过去日期的key会立即过期,使用本周的今天和前一天,今天是周一时使用今天和明天
+	d2 := time.Now()
+	d1 := d2.AddDate(0, 0, -1)
+	if d2.Weekday() == time.Monday {
+		d1, d2 = d2, d2.AddDate(0, 0, 1)
+	}
+	day1, day2 := util.FormatDate(d1, util.YYYY_MM_DD), util.FormatDate(d2, util.YYYY_MM_DD)
+	start, _ := PeriodRange(model.PeriodWeek, d2)
+	week := util.FormatDate(start, util.YYYY_MM_DD)
+	hits := map[string][][3]string{
+		day1: {{"/a", "u1", "1.1.1.1"}, {"/a", "u2", "2.2.2.2"}},
+		day2: {{"/a", "u2", "2.2.2.2"}, {"/a", "u3", "1.1.1.1"}, {"/b", "u3", "1.1.1.1"}},
+	}
+	for date, list := range hits {
+		pipe := rdb.Pipeline()
+		for _, h := range list {
+			AddSketches(pipe, date, "example.com", h[0], h[1], h[2])
+		}
+		if _, err := pipe.Exec(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := model.GetDB()
+	for _, h := range []*model.Hourly{
+		{Domain: "example.com", Date: day1, Hour: model.HourAll, PV: 2, Visits: 2},
+		{Domain: "example.com", Date: day2, Hour: model.HourAll, PV: 3, Visits: 2},
+	} {
+		if err := h.UpdateOrSave(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, w := range []*model.WebFlow{
+		{Domain: "example.com", URL: "/a", Date: day1, PV: 2, Visits: 2, Duration: 10, Entries: 2, Bounce: 1},
+		{Domain: "example.com", URL: "/a", Date: day2, PV: 2, Visits: 2, Duration: 20, Entries: 2},
+		{Domain: "example.com", URL: "/b", Date: day2, PV: 1, Exits: 1},
+	} {
+		if err := db.Create(w).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	rollup := func(url string) model.Rollup {
+		rows, err := model.FindRollups("example.com", url, model.PeriodWeek, week, week)
+		if err != nil || len(rows) != 1 {
+			t.Fatalf("%q 的每周汇总为 %v %v", url, rows, err)
+		}
+		r := *rows[0]
+		r.ID = 0
+		return r
+	}
+	FlushSketches2DBFromRedis(day1)
+	want := model.Rollup{Domain: "example.com", Period: model.PeriodWeek, Start: week, End: day1, PV: 2, UV: 2, IP: 2, Visits: 2}
+	if got := rollup(""); got != want {
+		t.Fatalf("第一天的每周汇总为 %+v,期望 %+v", got, want)
+	}
+	FlushSketches2DBFromRedis(day2)
+	want.End, want.PV, want.UV, want.Visits = day2, 5, 3, 4
+	if got := rollup(""); got != want {
+		t.Fatalf("第二天的每周汇总为 %+v,期望 %+v", got, want)
+	}
+	wantA := model.Rollup{Domain: "example.com", URL: "/a", Period: model.PeriodWeek, Start: week, End: day2, PV: 4, UV: 3, IP: 2, Visits: 4, Duration: 30, Entries: 4, Bounce: 1}
+	if got := rollup("/a"); got != wantA {
+		t.Fatalf("/a 的每周汇总为 %+v,期望 %+v", got, wantA)
+	}
+	req := &RealtimeDataReq{Domain: "example.com", StartDate: day2, Granularity: model.PeriodWeek, Sort: "UV"}
+	s, err := GetTopContentRollup(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var top []WebData
+	if err := json.Unmarshal([]byte(s), &top); err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].WebFlow.URL != "/a" || top[0].WebFlow.UV != 3 || top[1].WebFlow.URL != "/b" || top[1].WebFlow.UV != 1 {
+		t.Fatalf("每周排名为 %s", s)
+	}
+	req.Granularity = "year"
+	if _, err := GetTopContentRollup(req); err == nil {
+		t.Fatal("不支持的汇总周期应返回错误")
+	}
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// SessionTimeout 超过该时间没有新的访问时会话结束,与访问次数的统计一致
+const SessionTimeout = 30 * time.Minute
+
+// sessionKeep 会话在redis中的保存时间,必须大于 SessionTimeout,留出时间等待保存到数据库
+const sessionKeep = 2 * time.Hour
+
+// closeSessionsPerTime 每次最多结束的会话数
+const closeSessionsPerTime = 500
+
+// NewSession 在管道中开始新的会话,返回会话id,s.StartTime 为第一次访问的时间
+func NewSession(pipe redis.Pipeliner, s *model.Session) (string, error) {
+	sid, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	start := s.StartTime.Unix()
+	key := GetRedisSessionKey(sid)
+	pipe.HMSet(key, map[string]interface{}{
+		"uid":        s.UID,
+		"domain":     s.Domain,
+		"start":      start,
+		"end":        start,
+		"entry":      s.EntryURL,
+		"exit":       s.EntryURL,
+		"pages":      1,
+		"referrer":   s.Referrer,
+		"ip":         s.IP,
+		"region":     s.Region,
+		"platform":   s.Platform,
+		"browser":    s.Browser,
+		"devicetype": s.DeviceType,
+	})
+	pipe.Expire(key, sessionKeep)
+	pipe.ZAdd(GetRedisActiveSessionKey(), &redis.Z{Score: float64(start), Member: sid})
+	return sid, nil
+}
+
+// touchSessionScript 会话还没有结束时纪录访问的页面,ARGV 为 url、访问时间和保存时间
+// 迟到的访问不会使结束时间和最后页面倒退
+var touchSessionScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+if tonumber(ARGV[2]) >= (tonumber(redis.call('HGET', KEYS[1], 'end')) or 0) then
+	redis.call('HSET', KEYS[1], 'exit', ARGV[1], 'end', ARGV[2])
+end
+redis.call('HINCRBY', KEYS[1], 'pages', 1)
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return 1`)
+
+// TouchSession 在管道中纪录会话在 t 时访问了新的页面
+// 会话已经结束并保存时不再修改,只更新 tongji_session_active 中已有的会话,避免重新建立不完整的会话
+func TouchSession(pipe redis.Pipeliner, sid, url string, t time.Time) {
+	if len(sid) == 0 {
+		return
+	}
+	touchSessionScript.Eval(pipe, []string{GetRedisSessionKey(sid)}, url, t.Unix(), int64(sessionKeep/time.Second))
+	pipe.ZAddXX(GetRedisActiveSessionKey(), &redis.Z{Score: float64(t.Unix()), Member: sid})
+}
+
+// sessionDurationScript 会话还没有结束时累加浏览时长,ARGV 为时长和关闭页面的时间
+var sessionDurationScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], 'duration', ARGV[1])
+if tonumber(ARGV[2]) > (tonumber(redis.call('HGET', KEYS[1], 'end')) or 0) then
+	redis.call('HSET', KEYS[1], 'end', ARGV[2])
+end
+return 1`)
+
+// AddSessionDuration 页面在 t 时关闭时在管道中累加会话的浏览时长,sid 为用户半小时内访问纪录中的会话id
+func AddSessionDuration(pipe redis.Pipeliner, sid string, duration int, t time.Time) {
+	if len(sid) == 0 {
+		return
+	}
+	sessionDurationScript.Eval(pipe, []string{GetRedisSessionKey(sid)}, duration, t.Unix())
+}
+
+// CloseIdleSessions 结束超时的会话并批量保存到数据库
+// 多个实例同时执行时,只有从 tongji_session_active 中成功移除会话的实例负责保存
+func CloseIdleSessions() {
+	active := GetRedisActiveSessionKey()
+	deadline := time.Now().Add(-SessionTimeout).Unix()
+	sids, err := model.RedisCli.ZRangeByScore(active, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(deadline, 10),
+		Count: closeSessionsPerTime,
+	}).Result()
+	if err != nil {
+		Log(err)
+		return
+	}
+	var sessions []*model.Session
+	var keys []string
+	for _, sid := range sids {
+		if n, err := model.RedisCli.ZRem(active, sid).Result(); err != nil || n == 0 {
+			continue
+		}
+		key := GetRedisSessionKey(sid)
+		r, err := model.RedisCli.HGetAll(key).Result()
+		if err != nil {
+			Log(err)
+			continue
+		}
+		if len(r) == 0 {
+			continue
+		}
+		sessions = append(sessions, parseSession(sid, r))
+		keys = append(keys, key)
+	}
+	if len(sessions) == 0 {
+		return
+	}
+	if err := model.SaveSessions(sessions); err != nil {
+		Log(err)
+		// 重新加入,等待下次保存
+		for _, s := range sessions {
+			model.RedisCli.ZAdd(active, &redis.Z{Score: float64(s.EndTime.Unix()), Member: s.SID})
+		}
+		return
+	}
+	if err := model.RedisCli.Del(keys...).Err(); err != nil {
+		Log(err)
+	}
+}
+
+// parseSession 将redis中的会话转换为 model.Session
+func parseSession(sid string, r map[string]string) *model.Session {
+	s := &model.Session{
+		SID:      sid,
+		UID:      r["uid"],
+		Domain:   r["domain"],
+		EntryURL: r["entry"],
+		ExitURL:  r["exit"],
+		Referrer: r["referrer"],
+		IP:       r["ip"],
+		Region:   r["region"],
+		Platform: r["platform"],
+		Browser:  r["browser"],
+	}
+	start, _ := strconv.ParseInt(r["start"], 10, 64)
+	end, _ := strconv.ParseInt(r["end"], 10, 64)
+	s.StartTime = time.Unix(start, 0)
+	s.EndTime = time.Unix(end, 0)
+	s.Pages, _ = strconv.Atoi(r["pages"])
+	s.Duration, _ = strconv.Atoi(r["duration"])
+	s.DeviceType, _ = strconv.Atoi(r["devicetype"])
+	return s
+}
+
+// SessionReq 会话查询请求
+type SessionReq struct {
+	RealtimeDataReq
+	UID string `json:"uid"`
+}
+
+// GetSessions 按开始时间倒序获取域名已结束的会话
+func GetSessions(req *SessionReq) (string, error) {
+	if len(req.Domain) == 0 {
+		return "", errors.New("domain 不能为空")
+	}
+	datas, err := model.FindSessions(req.Domain, req.UID, req.getLimit(), req.Offset)
+	if err != nil {
+		return "", err
+	}
+	return util.ToJSONStr(datas)
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// TestSessionLateHit 会话超时结束并保存后,迟到的访问和关闭页面不会重新建立不完整的会话
+func TestSessionLateHit(t *testing.T) {
+	rdb := setupFakes(t)
+	start := time.Unix(time.Now().Add(-40*time.Minute).Unix(), 0)
+	pipe := rdb.Pipeline()
+	sid, err := NewSession(pipe, &model.Session{UID: "u1", Domain: "example.com", EntryURL: "/a", StartTime: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	TouchSession(pipe, sid, "/b", start.Add(5*time.Minute))
+	// 晚到的较早访问不会使结束时间和退出页倒退
+	TouchSession(pipe, sid, "/c", start.Add(3*time.Minute))
+	if _, err := pipe.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	CloseIdleSessions()
+	pipe = rdb.Pipeline()
+	TouchSession(pipe, sid, "/d", start.Add(8*time.Minute))
+	AddSessionDuration(pipe, sid, 30, start.Add(9*time.Minute))
+	if _, err := pipe.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if n := rdb.Exists(GetRedisSessionKey(sid)).Val(); n != 0 {
+		t.Fatal("已结束的会话不应重新写入redis")
+	}
+	if n := rdb.ZCard(GetRedisActiveSessionKey()).Val(); n != 0 {
+		t.Fatalf("已结束的会话不应重新加入未结束的会话,有%d个", n)
+	}
+	sessions, err := model.FindSessions("example.com", "", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("保存了%d个会话,期望1个", len(sessions))
+	}
+	s := sessions[0]
+	if !s.StartTime.Equal(start) || !s.EndTime.Equal(start.Add(5*time.Minute)) || s.ExitURL != "/b" || s.Pages != 3 || s.Duration != 0 {
+		t.Fatalf("会话为 %+v", s)
+	}
+	// 再次检查超时的会话不会重复保存
+	CloseIdleSessions()
+	if sessions, _ := model.FindSessions("example.com", "", 10, 0); len(sessions) != 1 {
+		t.Fatalf("保存了%d个会话,期望1个", len(sessions))
+	}
+}
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// searchEngine 搜索引擎域名及关键词参数
+type searchEngine struct {
+	host   string
+	name   string
+	params []string
+}
+
+var searchEngines = []searchEngine{
+	{"baidu.com", "baidu", []string{"wd", "word", "kw"}},
+	{"google.", "google", []string{"q"}},
+	{"bing.com", "bing", []string{"q"}},
+	{"sogou.com", "sogou", []string{"query", "keyword"}},
+	{"so.com", "360", []string{"q"}},
+	{"sm.cn", "shenma", []string{"q"}},
+}
+
+// socialSites 社交网站域名及名称
+var socialSites = [][2]string{
+	{"weibo.com", "weibo"},
+	{"weibo.cn", "weibo"},
+	{"t.cn", "weibo"},
+	{"weixin.qq.com", "weixin"},
+	{"qzone.qq.com", "qzone"},
+	{"douban.com", "douban"},
+	{"zhihu.com", "zhihu"},
+	{"bilibili.com", "bilibili"},
+	{"douyin.com", "douyin"},
+	{"xiaohongshu.com", "xiaohongshu"},
+	{"facebook.com", "facebook"},
+	{"twitter.com", "twitter"},
+	{"t.co", "twitter"},
+	{"x.com", "twitter"},
+	{"linkedin.com", "linkedin"},
+	{"reddit.com", "reddit"},
+}
+
+// ClassifySource 根据页面地址和来源页面判断流量来源
+// 页面地址带有 utm_source 时为推广活动,否则根据来源页面判断
+func ClassifySource(pageURL, referrer string) *model.Source {
+	s := &model.Source{}
+	page, _ := url.Parse(pageURL)
+	if page != nil {
+		q := page.Query()
+		if len(q.Get("utm_source")) > 0 {
+			s.Type = model.SourceCampaign
+			s.Name = q.Get("utm_source")
+			s.Medium = q.Get("utm_medium")
+			s.Campaign = q.Get("utm_campaign")
+			s.Keyword = q.Get("utm_term")
+			return s
+		}
+	}
+	ref, err := url.Parse(referrer)
+	if len(referrer) == 0 || err != nil || len(ref.Hostname()) == 0 {
+		s.Type = model.SourceDirect
+		return s
+	}
+	host := strings.ToLower(ref.Hostname())
+	if page != nil && isSameSite(host, strings.ToLower(page.Hostname())) {
+		s.Type = model.SourceInternal
+		s.Name = host
+		return s
+	}
+	for _, e := range searchEngines {
+		if matchHost(host, e.host) {
+			s.Type = model.SourceSearch
+			s.Name = e.name
+			q := ref.Query()
+			for _, p := range e.params {
+				if len(q.Get(p)) > 0 {
+					s.Keyword = q.Get(p)
+					break
+				}
+			}
+			return s
+		}
+	}
+	for _, site := range socialSites {
+		if matchHost(host, site[0]) {
+			s.Type = model.SourceSocial
+			s.Name = site[1]
+			return s
+		}
+	}
+	s.Type = model.SourceExternal
+	s.Name = host
+	return s
+}
+
+// matchHost host 是否为 pattern 或其子域名,pattern 以.结尾时匹配任意后缀(如 google.com.hk)
+func matchHost(host, pattern string) bool {
+	if strings.HasSuffix(pattern, ".") {
+		return strings.HasPrefix(host, pattern) || strings.Contains(host, "."+pattern)
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// isSameSite 忽略 www 前缀比较域名
+func isSameSite(a, b string) bool {
+	return strings.TrimPrefix(a, "www.") == strings.TrimPrefix(b, "www.")
+}
+
+// GetRedisSourceField 流量来源在 tongji_source_<yyyy-mm-dd> 中的 field: <pv|visits>_<来源json>
+func GetRedisSourceField(counter string, s *model.Source) string {
+	key := model.Source{
+		Domain:   s.Domain,
+		Type:     s.Type,
+		Name:     s.Name,
+		Keyword:  s.Keyword,
+		Medium:   s.Medium,
+		Campaign: s.Campaign,
+	}
+	str, _ := util.ToJSONStr(key)
+	return counter + "_" + str
+}
+
+// GetSourcesFromRedis 从redis获取指定日期的流量来源
+func GetSourcesFromRedis(date string) ([]*model.Source, error) {
+	r := model.RedisCli.HGetAll(GetRedisSourceKey(date))
+	if r.Err() != nil && r.Err() != redis.Nil {
+		return nil, r.Err()
+	}
+	sources := make(map[string]*model.Source)
+	for field, val := range r.Val() {
+		i := strings.Index(field, "_")
+		if i < 0 {
+			continue
+		}
+		counter, key := field[:i], field[i+1:]
+		s := sources[key]
+		if s == nil {
+			s = &model.Source{}
+			if err := util.Str2Struct(key, s); err != nil {
+				Log(err)
+				continue
+			}
+			s.Date = date
+			sources[key] = s
+		}
+		n, _ := strconv.Atoi(val)
+		switch counter {
+		case "pv":
+			s.PV += n
+		case "visits":
+			s.Visits += n
+		}
+	}
+	result := make([]*model.Source, 0, len(sources))
+	for _, s := range sources {
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// FlushSources2DBFromRedis 将redis中保存的流量来源保存到数据库
+func FlushSources2DBFromRedis(date string) {
+	sources, err := GetSourcesFromRedis(date)
+	if err != nil {
+		Log(err)
+		return
+	}
+	for _, s := range sources {
+		if err := s.UpdateOrSave(); err != nil {
+			Log(err)
+			return
+		}
+	}
+	if err := model.RedisCli.Del(GetRedisSourceKey(date)).Err(); err != nil {
+		Log(err)
+	}
+}
+
+// SourceReq 流量来源查询请求
+type SourceReq struct {
+	RealtimeDataReq
+	Type string `json:"type"`
+}
+
+// GetSources 获取指定日期范围内的流量来源,包含今天时合并redis中今日数据
+func GetSources(req *SourceReq) (string, error) {
+	if len(req.Domain) == 0 || len(req.StartDate) == 0 || len(req.EndDate) == 0 {
+		return "", errors.New("domain 、 startDate、endDate 不能为空")
+	}
+	datas, err := model.FindSources(req.Domain, req.Type, req.StartDate, req.EndDate)
+	if err != nil {
+		return "", err
+	}
+	today := util.GetDateAsDefaultStr()
+	if req.StartDate <= today && today <= req.EndDate {
+		todays, err := GetSourcesFromRedis(today)
+		if err != nil {
+			return "", err
+		}
+		datas = mergeSources(datas, todays, req.Domain, req.Type)
+	}
+	r, err := util.ToJSONStr(datas)
+	if err != nil {
+		return "", err
+	}
+	return r, nil
+}
+
+// mergeSources 合并相同来源并按pv降序排序
+func mergeSources(datas, todays []*model.Source, domain, sourceType string) []*model.Source {
+	merged := make(map[string]*model.Source)
+	for _, s := range datas {
+		merged[GetRedisSourceField("", s)] = s
+	}
+	for _, s := range todays {
+		if s.Domain != domain || (len(sourceType) > 0 && s.Type != sourceType) {
+			continue
+		}
+		k := GetRedisSourceField("", s)
+		if old := merged[k]; old != nil {
+			old.PV += s.PV
+			old.Visits += s.Visits
+			continue
+		}
+		s.Date = ""
+		merged[k] = s
+	}
+	result := make([]*model.Source, 0, len(merged))
+	for _, s := range merged {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].PV > result[j].PV
+	})
+	return result
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+func TestClassifySource(t *testing.T) {
+	cases := []struct {
+		name     string
+		page     string
+		referrer string
+		want     model.Source
+	}{
+		{"直接访问", "https://example.com/a", "", model.Source{Type: model.SourceDirect}},
+		{"来源不是网址", "https://example.com/a", "android-app", model.Source{Type: model.SourceDirect}},
+		{"推广活动优先", "https://example.com/a?utm_source=newsletter&utm_medium=email&utm_campaign=spring&utm_term=shoes", "https://www.baidu.com/s?wd=x",
+			model.Source{Type: model.SourceCampaign, Name: "newsletter", Medium: "email", Campaign: "spring", Keyword: "shoes"}},
+		{"站内跳转忽略www", "https://example.com/a", "https://WWW.example.com/b", model.Source{Type: model.SourceInternal, Name: "www.example.com"}},
+		{"百度关键词", "https://example.com/a", "https://www.baidu.com/s?ie=utf-8&wd=%E7%BB%9F%E8%AE%A1", model.Source{Type: model.SourceSearch, Name: "baidu", Keyword: "统计"}},
+		{"百度第二个关键词参数", "https://example.com/a", "https://m.baidu.com/s?word=go", model.Source{Type: model.SourceSearch, Name: "baidu", Keyword: "go"}},
+		{"google 国家域名", "https://example.com/a", "https://www.google.com.hk/search?q=go", model.Source{Type: model.SourceSearch, Name: "google", Keyword: "go"}},
+		{"搜索引擎没有关键词", "https://example.com/a", "https://cn.bing.com/", model.Source{Type: model.SourceSearch, Name: "bing"}},
+		{"360 不匹配 xso.com", "https://example.com/a", "https://xso.com/", model.Source{Type: model.SourceExternal, Name: "xso.com"}},
+		{"社交网站子域名", "https://example.com/a", "https://m.weibo.cn/status/1", model.Source{Type: model.SourceSocial, Name: "weibo"}},
+		{"twitter 短链接", "https://example.com/a", "https://t.co/abc", model.Source{Type: model.SourceSocial, Name: "twitter"}},
+		{"外部链接", "https://example.com/a", "https://blog.other.com/post", model.Source{Type: model.SourceExternal, Name: "blog.other.com"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := ClassifySource(c.page, c.referrer); !reflect.DeepEqual(*got, c.want) {
+				t.Fatalf("来源为 %+v,期望 %+v", *got, c.want)
+			}
+		})
+	}
+}
+
+// TestGetSources 数据库中的来源与redis中今天的来源合并,按pv降序
+func TestGetSources(t *testing.T) {
+	rdb := setupFakes(t)
+	today := util.GetDateAsDefaultStr()
+	baidu := &model.Source{Domain: "example.com", Type: model.SourceSearch, Name: "baidu", Keyword: "go"}
+	weibo := &model.Source{Domain: "example.com", Type: model.SourceSocial, Name: "weibo"}
+	other := &model.Source{Domain: "other.com", Type: model.SourceSearch, Name: "baidu", Keyword: "go"}
+	for date, fields := range map[string]map[string]interface{}{
+		testDate: {GetRedisSourceField("pv", baidu): 3, GetRedisSourceField("visits", baidu): 2, GetRedisSourceField("pv", weibo): 4},
+		today:    {GetRedisSourceField("pv", baidu): 5, GetRedisSourceField("visits", baidu): 1, GetRedisSourceField("pv", other): 100},
+	} {
+		rdb.HMSet(GetRedisSourceKey(date), fields)
+	}
+	FlushSources2DBFromRedis(testDate)
+	if n := rdb.Exists(GetRedisSourceKey(testDate)).Val(); n != 0 {
+		t.Fatal("保存到数据库后应删除redis中的流量来源")
+	}
+	cases := []struct {
+		name       string
+		sourceType string
+		end        string
+		want       []model.Source
+	}{
+		{"不包含今天", "", testDate, []model.Source{{Domain: "example.com", Type: model.SourceSocial, Name: "weibo", PV: 4}, {Domain: "example.com", Type: model.SourceSearch, Name: "baidu", Keyword: "go", PV: 3, Visits: 2}}},
+		{"合并今天", "", today, []model.Source{{Domain: "example.com", Type: model.SourceSearch, Name: "baidu", Keyword: "go", PV: 8, Visits: 3}, {Domain: "example.com", Type: model.SourceSocial, Name: "weibo", PV: 4}}},
+		{"按类型", model.SourceSocial, today, []model.Source{{Domain: "example.com", Type: model.SourceSocial, Name: "weibo", PV: 4}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := &SourceReq{Type: c.sourceType}
+			req.Domain, req.StartDate, req.EndDate = "example.com", testDate, c.end
+			s, err := GetSources(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []model.Source
+			if err := json.Unmarshal([]byte(s), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("流量来源为 %+v,期望 %+v", got, c.want)
+			}
+		})
+	}
+}
@@ -3,11 +3,11 @@ package service
 import (
 	"errors"
 	"fmt"
-	"github.com/go-redis/redis"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/mumushuiding/util"
 
 	"github.com/codepository/GoWebAnalytics/model"
@@ -25,6 +25,29 @@ type RealtimeDataReq struct {
 	Domain    string `json:"domain"`
 	StartDate string `json:"startDate"`
 	EndDate   string `json:"endDate"`
+	Sort      string `json:"sort"`   // 排序字段:PV、IP、UV、Visits、Duration、Bounce、Entries、Exits,默认PV
+	Prefix    string `json:"prefix"` // url前缀
+	Limit     int    `json:"limit"`  // 默认100,最大1000
+	Offset    int    `json:"offset"`
+	// Granularity 排名的汇总周期:day(默认,按日期范围汇总每日数据)、week、month(startDate 所在周期,UV、IP 去重)
+	Granularity string `json:"granularity"`
+}
+
+// 排名默认和最大返回条数
+const (
+	defaultTopLimit = 100
+	maxTopLimit     = 1000
+)
+
+// getLimit 获取返回条数
+func (req *RealtimeDataReq) getLimit() int {
+	if req.Limit <= 0 {
+		return defaultTopLimit
+	}
+	if req.Limit > maxTopLimit {
+		return maxTopLimit
+	}
+	return req.Limit
 }
 
 // IsNewVisitor 是否是新用户
@@ -37,7 +60,7 @@ func GetRealtimeData(req *RealtimeDataReq) (string, error) {
 	if len(req.Domain) == 0 || len(req.StartDate) == 0 {
 		return "", errors.New("domain 和 startDate 不能为空")
 	}
-	datas, err := model.FindRealtimeDataByDomainAndStartDate(req.Domain, req.StartDate)
+	datas, err := model.Store.FindRealtimeWebflows(req.Domain, req.StartDate)
 	if err != nil {
 		return "", err
 	}
@@ -48,13 +71,44 @@ func GetRealtimeData(req *RealtimeDataReq) (string, error) {
 	return r, nil
 }
 
-// GetTopContent 获取url流量排名
+// GetTopContent 从数据库获取指定日期范围内的url流量排名
 func GetTopContent(req *RealtimeDataReq) (string, error) {
-	datas, err := model.FindTopContent(req.Domain, req.StartDate, req.EndDate)
+	field, err := getSortField(req.Sort)
 	if err != nil {
 		return "", err
 	}
-	r, err := util.ToJSONStr(datas)
+	datas, err := model.FindTopContent(&model.TopContentQuery{
+		Domain: req.Domain,
+		Start:  req.StartDate,
+		End:    req.EndDate,
+		Prefix: req.Prefix,
+		Sort:   strings.ToLower(field),
+		Limit:  req.getLimit(),
+		Offset: req.Offset,
+	})
+	if err != nil {
+		return "", err
+	}
+	result := []WebData{}
+	for _, d := range datas {
+		var webdata WebData
+		webdata.Pageinfo = model.Pageinfo{Dm: req.Domain, URL: d.URL, Title: d.Title}
+		webdata.WebFlow = model.WebFlow{
+			Domain:   req.Domain,
+			URL:      d.URL,
+			PV:       d.PV,
+			IP:       d.IP,
+			UV:       d.UV,
+			Duration: d.Duration,
+			Visits:   d.Visits,
+			Bounce:   d.Bounce,
+			Entries:  d.Entries,
+			Exits:    d.Exits,
+		}
+		webdata.WebFlow.SetBounceRate()
+		result = append(result, webdata)
+	}
+	r, err := util.ToJSONStr(result)
 	if err != nil {
 		return "", err
 	}
@@ -63,25 +117,49 @@ func GetTopContent(req *RealtimeDataReq) (string, error) {
 
 // GetTopContentFromRedis 从redis获取当日流量排名
 func GetTopContentFromRedis(req *RealtimeDataReq) (string, error) {
+	field, err := getSortField(req.Sort)
+	if err != nil {
+		return "", err
+	}
 	sort := &redis.Sort{}
-	sort.By = GetRedisWebflowKey(req.Domain, req.StartDate, "*") + "->PV"
+	sort.By = GetRedisWebflowKey(req.Domain, req.StartDate, "*") + "->" + field
 	sort.Order = "desc"
-	sort.Offset = 0
-	sort.Count = 100
+	// 按前缀过滤时需要获取全部url后再分页
+	if len(req.Prefix) == 0 {
+		sort.Offset = int64(req.Offset)
+		sort.Count = int64(req.getLimit())
+	}
 	sort.Get = []string{GetRedisPageinfoKey(req.StartDate, "*")}
 	r := model.RedisCli.Sort(GetRedisURLKey(req.StartDate), sort)
 	if r.Err() != nil {
 		return "", r.Err()
 	}
 	var result []WebData
-	fmt.Println("page:", r.Val())
+	skip := 0
 	for _, val := range r.Val() {
 		page := model.Pageinfo{}
 		util.Str2Struct(val, &page)
+		if len(req.Prefix) > 0 && !strings.HasPrefix(page.URL, req.Prefix) {
+			continue
+		}
 		webflow, err := getWebflowFromRedis(GetRedisWebflowKey(req.Domain, req.StartDate, page.URL))
 		if err != nil {
 			return "", err
 		}
+		// 跳过其它域名的页面
+		if webflow.PV == 0 {
+			continue
+		}
+		if len(req.Prefix) > 0 {
+			if skip < req.Offset {
+				skip++
+				continue
+			}
+			if len(result) >= req.getLimit() {
+				break
+			}
+		}
+		webflow.SetBounceRate()
 		var webdata WebData
 		webdata.Pageinfo = page
 		webdata.WebFlow = *webflow
@@ -90,35 +168,68 @@ func GetTopContentFromRedis(req *RealtimeDataReq) (string, error) {
 	s, _ := util.ToJSONStr(result)
 	return s, nil
 }
+
+// getSortField 校验排序字段
+func getSortField(sort string) (string, error) {
+	if len(sort) == 0 {
+		return "PV", nil
+	}
+	for _, f := range WebflowRedisFields {
+		if strings.EqualFold(f, sort) {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("不支持的排序字段:%s", sort)
+}
 func getWebflowFromRedis(key string) (*model.WebFlow, error) {
 	var webflow model.WebFlow
-	r := model.RedisCli.HMGet(key, "PV", "IP", "UV", "Visits", "Duration")
+	r := model.RedisCli.HMGet(key, WebflowRedisFields...)
 	if r.Err() != nil && r.Err() != redis.Nil {
 		return nil, r.Err()
 	}
-	// s2, _ := util.ToJSONStr(webflow)
-	// log.Printf("webflow-before-val:%s\n", s2)
-	if r.Val()[0] != nil {
-		// s, _ := util.ToJSONStr(r.Val())
-		// log.Printf("hmget-key:%s,val:%s\n", key, s)
-		var vals []int
-		for _, v := range r.Val() {
-			switch v.(type) {
-			case string:
-				x, _ := strconv.Atoi(v.(string))
-				vals = append(vals, x)
-			case int:
-				vals = append(vals, v.(int))
-			}
+	AddRedisValsToWebflow(&webflow, r.Val())
+	return &webflow, nil
+}
+
+// WebflowRedisFields webflow 保存在redis中的字段
+var WebflowRedisFields = []string{"PV", "IP", "UV", "Visits", "Duration", "Bounce", "Entries", "Exits"}
+
+// AddRedisValsToWebflow 将按 WebflowRedisFields 顺序获取的值累加到webflow,不存在的字段按0计算
+func AddRedisValsToWebflow(webflow *model.WebFlow, vals []interface{}) {
+	ints := make([]int, len(WebflowRedisFields))
+	for i, v := range vals {
+		if i >= len(ints) {
+			break
+		}
+		switch v.(type) {
+		case string:
+			ints[i], _ = strconv.Atoi(v.(string))
+		case int:
+			ints[i] = v.(int)
 		}
-		// log.Println("vals", vals)
-		webflow.PV += vals[0]
-		webflow.IP += vals[1]
-		webflow.UV += vals[2]
-		webflow.Visits += vals[3]
-		webflow.Duration += vals[4]
 	}
-	return &webflow, nil
+	webflow.PV += ints[0]
+	webflow.IP += ints[1]
+	webflow.UV += ints[2]
+	webflow.Visits += ints[3]
+	webflow.Duration += ints[4]
+	webflow.Bounce += ints[5]
+	webflow.Entries += ints[6]
+	webflow.Exits += ints[7]
+}
+
+// WebflowRedisValues webflow 保存到redis的值
+func WebflowRedisValues(webflow *model.WebFlow) map[string]interface{} {
+	return map[string]interface{}{
+		"PV":       webflow.PV,
+		"IP":       webflow.IP,
+		"UV":       webflow.UV,
+		"Visits":   webflow.Visits,
+		"Duration": webflow.Duration,
+		"Bounce":   webflow.Bounce,
+		"Entries":  webflow.Entries,
+		"Exits":    webflow.Exits,
+	}
 }
 
 // FlushBrowsings2DBFromRedis 将redis中保存的用户浏览习惯保存到数据库
@@ -157,7 +268,7 @@ func FlushBrowsings2DBFromRedis(date string) {
 				browsing.UID = uid
 				browsing.Date = date
 				// 存储到数据库
-				if err := browsing.UpdateOrSave(); err != nil {
+				if err := model.Store.UpdateOrSaveBrowsing(&browsing); err != nil {
 					Log(err)
 					continue
 				}
@@ -169,6 +280,135 @@ func FlushBrowsings2DBFromRedis(date string) {
 	}
 }
 
+// BrowsingRedisCounters 用户浏览习惯在redis中累加的计数
+var BrowsingRedisCounters = []string{"depth", "pv", "visits", "duration", "pageopend"}
+
+// BrowsingRedisAttrNames 用户浏览习惯在redis中覆盖保存的属性
+var BrowsingRedisAttrNames = []string{"ip", "region", "platform", "browser", "devicetype", "sr", "nv"}
+
+// GetRedisBrowsingField <计数或属性>_<domain> 用户浏览习惯hash中的field
+func GetRedisBrowsingField(name, domain string) string {
+	return name + "_" + domain
+}
+
+// BrowsingRedisIncrs 用户浏览习惯需要累加到redis的计数,不包含为0的计数
+func BrowsingRedisIncrs(b *model.Browsing) map[string]int64 {
+	incrs := make(map[string]int64)
+	for i, n := range []int{b.Depth, b.PV, b.Visits, b.Duration, b.Pageopend} {
+		if n != 0 {
+			incrs[GetRedisBrowsingField(BrowsingRedisCounters[i], b.Domain)] = int64(n)
+		}
+	}
+	return incrs
+}
+
+// BrowsingRedisAttrs 页面浏览时的ip、系统等属性,覆盖之前的值;关闭页面时没有属性,返回nil
+// 新用户标记只在为1时写入,当天之后的访问不会覆盖
+func BrowsingRedisAttrs(b *model.Browsing) map[string]interface{} {
+	if len(b.IP) == 0 {
+		return nil
+	}
+	attrs := map[string]interface{}{
+		GetRedisBrowsingField("ip", b.Domain):         b.IP,
+		GetRedisBrowsingField("region", b.Domain):     b.Region,
+		GetRedisBrowsingField("platform", b.Domain):   b.Platform,
+		GetRedisBrowsingField("browser", b.Domain):    b.Browser,
+		GetRedisBrowsingField("devicetype", b.Domain): b.DeviceType,
+		GetRedisBrowsingField("sr", b.Domain):         b.SR,
+	}
+	if b.NV > 0 {
+		attrs[GetRedisBrowsingField("nv", b.Domain)] = b.NV
+	}
+	return attrs
+}
+
+// splitRedisBrowsingField 拆分 <计数或属性>_<domain>,不是已知的计数或属性时返回false
+func splitRedisBrowsingField(field string) (name, domain string, ok bool) {
+	parts := strings.SplitN(field, "_", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	for _, names := range [][]string{BrowsingRedisCounters, BrowsingRedisAttrNames} {
+		for _, n := range names {
+			if n == parts[0] {
+				return parts[0], parts[1], true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// browsingsFromRedisVals 将用户浏览习惯hash中的值按域名汇总
+// 兼容之前以域名为field、整个 Browsing 的json为值的格式,域名中可能包含下划线
+func browsingsFromRedisVals(vals map[string]string) map[string]*model.Browsing {
+	result := make(map[string]*model.Browsing)
+	get := func(domain string) *model.Browsing {
+		b := result[domain]
+		if b == nil {
+			b = &model.Browsing{Domain: domain}
+			result[domain] = b
+		}
+		return b
+	}
+	// 先合并旧格式的json,新格式的属性覆盖旧的属性
+	for field, val := range vals {
+		if _, _, ok := splitRedisBrowsingField(field); !ok {
+			old := model.Browsing{}
+			if err := util.Str2Struct(val, &old); err != nil {
+				Log(err)
+				continue
+			}
+			b := get(field)
+			b.Depth += old.Depth
+			b.PV += old.PV
+			b.Visits += old.Visits
+			b.Duration += old.Duration
+			b.Pageopend += old.Pageopend
+			if len(b.IP) == 0 {
+				b.IP, b.Region, b.Platform, b.Browser, b.DeviceType, b.SR = old.IP, old.Region, old.Platform, old.Browser, old.DeviceType, old.SR
+			}
+			if old.NV > 0 {
+				b.NV = old.NV
+			}
+		}
+	}
+	for field, val := range vals {
+		name, domain, ok := splitRedisBrowsingField(field)
+		if !ok {
+			continue
+		}
+		b := get(domain)
+		n, _ := strconv.Atoi(val)
+		switch name {
+		case "depth":
+			b.Depth += n
+		case "pv":
+			b.PV += n
+		case "visits":
+			b.Visits += n
+		case "duration":
+			b.Duration += n
+		case "pageopend":
+			b.Pageopend += n
+		case "ip":
+			b.IP = val
+		case "region":
+			b.Region = val
+		case "platform":
+			b.Platform = val
+		case "browser":
+			b.Browser = val
+		case "devicetype":
+			b.DeviceType = n
+		case "sr":
+			b.SR = val
+		case "nv":
+			b.NV = n
+		}
+	}
+	return result
+}
+
 // GetBrowsingsByUIDFromRedis 获取用户在所有域名的访问习惯
 func GetBrowsingsByUIDFromRedis(date, uid string) ([]model.Browsing, error) {
 	key := GetRedisBrowsingKey(date, uid)
@@ -177,45 +417,22 @@ func GetBrowsingsByUIDFromRedis(date, uid string) ([]model.Browsing, error) {
 		return nil, r.Err()
 	}
 	result := []model.Browsing{}
-	for domain, str := range r.Val() {
-		b := model.Browsing{}
-		util.Str2Struct(str, &b)
-		b.Domain = domain
-		result = append(result, b)
+	for _, b := range browsingsFromRedisVals(r.Val()) {
+		result = append(result, *b)
 	}
 	return result, nil
 }
 
-// GetBrowsingFromRedis 根据键值从redis获取值
+// GetBrowsingFromRedis 根据键值从redis获取用户在域名的访问习惯
 func GetBrowsingFromRedis(key, domain string) (model.Browsing, error) {
-	browsing := model.Browsing{}
-	r := model.RedisCli.HGet(key, domain)
+	r := model.RedisCli.HGetAll(key)
 	if r.Err() != nil && r.Err() != redis.Nil {
-		return browsing, r.Err()
+		return model.Browsing{}, r.Err()
 	}
-	if len(r.Val()) > 0 {
-		if err := util.Str2Struct(r.Val(), &browsing); err != nil {
-			return browsing, err
-		}
+	if b := browsingsFromRedisVals(r.Val())[domain]; b != nil {
+		return *b, nil
 	}
-	// if r.Val()[0] != nil {
-	// 	var vals []int
-	// 	for _, v := range r.Val() {
-	// 		switch v.(type) {
-	// 		case string:
-	// 			x, _ := strconv.Atoi(v.(string))
-	// 			vals = append(vals, x)
-	// 		case int:
-	// 			vals = append(vals, v.(int))
-	// 		}
-	// 	}
-	// 	browsing.Depth += vals[0]
-	// 	browsing.PV += vals[1]
-	// 	browsing.Visits += vals[2]
-	// 	browsing.Duration += vals[3]
-	// }
-	return browsing, nil
-
+	return model.Browsing{Domain: domain}, nil
 }
 
 // FlushWebflow2DBFromRedis 将redis中保存的网页流量保存到数据库
@@ -244,8 +461,11 @@ func FlushWebflow2DBFromRedis(date string) {
 		urls := sp.Val()
 		pipe := model.RedisCli.Pipeline()
 		for _, url := range urls {
-			// 获取webflow值
+			// 获取webflow值,别名转换为注册的域名
 			domain := getDomainFromURL(url)
+			if d := LookupDomain(domain); d != nil {
+				domain = d.Domain
+			}
 			wkey := GetRedisWebflowKey(domain, date, url)
 			webfow, err := getWebflowFromRedis(wkey)
 			if err != nil {
@@ -256,7 +476,7 @@ func FlushWebflow2DBFromRedis(date string) {
 			webfow.Domain = domain
 			webfow.Date = date
 			webfow.URL = url
-			if err := webfow.UpdateOrSave(); err != nil {
+			if err := model.Store.UpdateOrSaveWebFlow(webfow); err != nil {
 				Log(err)
 				continue
 			}
@@ -267,36 +487,36 @@ func FlushWebflow2DBFromRedis(date string) {
 	}
 }
 
-// getDomainFromURL 从url获取domain
+// getDomainFromURL 从url获取domain,url可以不带协议
 func getDomainFromURL(url string) string {
-	a1 := strings.Split(url, "//")[1]
-	a2 := strings.Split(a1, "/")[0]
-	a3 := strings.Split(a2, ":")[0]
-	return a3
+	if i := strings.Index(url, "//"); i >= 0 {
+		url = url[i+2:]
+	}
+	if i := strings.IndexAny(url, "/?#"); i >= 0 {
+		url = url[:i]
+	}
+	return strings.Split(url, ":")[0]
+}
+
+// GetTimeOfTomorrowZero 获取指定日期第二天零点,按天统计的key在此之后过期
+func GetTimeOfTomorrowZero(date string) time.Time {
+	tm, _ := util.ParseDate(date, util.YYYY_MM_DD)
+	return tm.Add(time.Hour * 24)
 }
 
 // GetRegistryDomains 获取所有注册的域名
 func GetRegistryDomains() ([]*model.Domainmgr, error) {
-	return model.GetAllRegistryDomains()
+	return model.Store.GetAllRegistryDomains()
 }
 
 // SaveRealtimeWebflow 存储网页流量
 func SaveRealtimeWebflow(data *model.RealtimeWebflow) error {
-	return data.Save()
+	return model.Store.SaveRealtimeWebflow(data)
 }
 
 // AddUID2Redis 将uid存储到redis
-func AddUID2Redis(date, uid string) error {
-	key := GetRedisUIDKey(date)
-	r := model.RedisCli.SIsMember(key, uid)
-	if r.Err() != nil {
-		Log(r.Err())
-		return r.Err()
-	}
-	if !r.Val() {
-		return model.RedisCli.SAdd(key, uid).Err()
-	}
-	return nil
+func AddUID2Redis(pipe redis.Pipeliner, date, uid string) {
+	pipe.SAdd(GetRedisUIDKey(date), uid)
 }
 
 // RedisKeyWithTongjiAboutTodayExpireAtTomorrow 关于tongji的key在明日凌晨过期
@@ -346,9 +566,9 @@ func GetRedisBrowsingKey(defaultdate, uid string) string {
 	return fmt.Sprintf("tongji_browsing_%s_%s", defaultdate, uid)
 }
 
-// GetRedisVisitNumbersKey tongji_visitnumbers_url_<yyyy-mm-dd>_<visitor> 统计用户访问次数的key
-func GetRedisVisitNumbersKey(defaultdate, uid string) string {
-	return fmt.Sprintf("tongji_visitnumbers_url_%s_%s", defaultdate, uid)
+// GetRedisVisitedKey tongji_visited_<10分钟序号>_<shard> 纪录10分钟内访问过的用户和url的布隆过滤器
+func GetRedisVisitedKey(slot int64, shard int) string {
+	return fmt.Sprintf("tongji_visited_%d_%d", slot, shard)
 }
 
 // GetredisNewVisitorKey tongji_newvisitor_<yyyy-mm-dd>_<domain> 统计某个域名今日新用户的key
@@ -356,6 +576,96 @@ func GetredisNewVisitorKey(defaultdate, domain string) string {
 	return fmt.Sprintf("tongji_newvisitor_%s_%s", defaultdate, domain)
 }
 
+// GetRedisVisitKey tongji_visit_<domain>_<visitor> 纪录用户半小时内访问的入口页和最后访问页面
+func GetRedisVisitKey(domain, uid string) string {
+	return fmt.Sprintf("tongji_visit_%s_%s", domain, uid)
+}
+
+// GetRedisUnregisteredKey tongji_unregistered_<yyyy-mm-dd> 统计未注册或已停用域名的访问次数
+func GetRedisUnregisteredKey(defaultdate string) string {
+	return fmt.Sprintf("tongji_unregistered_%s", defaultdate)
+}
+
+// GetRedisHourlyKey tongji_hourly_<yyyy-mm-dd> 统计所有域名今日每小时流量的key
+func GetRedisHourlyKey(defaultdate string) string {
+	return fmt.Sprintf("tongji_hourly_%s", defaultdate)
+}
+
+// GetRedisHourlyURLKey tongji_hourly_url_<yyyy-mm-dd> 统计所有url今日每小时流量的key
+func GetRedisHourlyURLKey(defaultdate string) string {
+	return fmt.Sprintf("tongji_hourly_url_%s", defaultdate)
+}
+
+// GetRedisHourlySetKey tongji_hourly_set_<yyyy-mm-dd>_<hh|all> 纪录每小时和全天访问过的用户和ip,用于去重
+func GetRedisHourlySetKey(defaultdate, period string) string {
+	return fmt.Sprintf("tongji_hourly_set_%s_%s", defaultdate, period)
+}
+
+// GetRedisSketchKey tongji_hll_<yyyy-mm-dd>_<uv|ip>_<domain>_<url> 今日域名或url的 HyperLogLog,url为空时为整个域名
+func GetRedisSketchKey(defaultdate, kind, domain, url string) string {
+	return fmt.Sprintf("tongji_hll_%s_%s_%s_%s", defaultdate, kind, domain, url)
+}
+
+// GetRedisHourlySketchKey tongji_hll_hourly_<yyyy-mm-dd>_<hh|all>_<uv|ip>_<domain>_<url> 每小时流量去重的 HyperLogLog,url为空时为整个域名
+func GetRedisHourlySketchKey(defaultdate, period, kind, domain, url string) string {
+	return fmt.Sprintf("tongji_hll_hourly_%s_%s_%s_%s_%s", defaultdate, period, kind, domain, url)
+}
+
+// GetRedisBloomKey tongji_bloom_<yyyy-mm-dd>_<shard> 今日去重使用的布隆过滤器
+func GetRedisBloomKey(defaultdate string, shard int) string {
+	return fmt.Sprintf("tongji_bloom_%s_%d", defaultdate, shard)
+}
+
+// GetRedisSketchIndexKey tongji_hll_index_<yyyy-mm-dd> 今日有 HyperLogLog 的域名和url
+func GetRedisSketchIndexKey(defaultdate string) string {
+	return fmt.Sprintf("tongji_hll_index_%s", defaultdate)
+}
+
+// GetRedisSessionKey tongji_session_<sid> 纪录会话信息
+func GetRedisSessionKey(sid string) string {
+	return fmt.Sprintf("tongji_session_%s", sid)
+}
+
+// GetRedisActiveSessionKey tongji_session_active 未结束的会话,分数为最后访问时间
+func GetRedisActiveSessionKey() string {
+	return "tongji_session_active"
+}
+
+// GetRedisGoalKey tongji_goal_<yyyy-mm-dd> 统计所有目标今日各步骤用户数的key
+func GetRedisGoalKey(defaultdate string) string {
+	return fmt.Sprintf("tongji_goal_%s", defaultdate)
+}
+
+// GetRedisGoalProgressKey tongji_goal_progress_<yyyy-mm-dd>_<visitor> 纪录用户今日完成的目标步骤
+func GetRedisGoalProgressKey(defaultdate, uid string) string {
+	return fmt.Sprintf("tongji_goal_progress_%s_%s", defaultdate, uid)
+}
+
+// GetRedisEventKey tongji_event_<yyyy-mm-dd> 统计所有域名今日自定义事件的key
+func GetRedisEventKey(defaultdate string) string {
+	return fmt.Sprintf("tongji_event_%s", defaultdate)
+}
+
+// GetRedisBotKey tongji_bot_<yyyy-mm-dd> 统计所有域名今日爬虫访问量的key
+func GetRedisBotKey(defaultdate string) string {
+	return fmt.Sprintf("tongji_bot_%s", defaultdate)
+}
+
+// GetRedisBotRateKey tongji_bot_rate_<visitor>_<yyyymmddhhmm> 统计用户每分钟访问次数的key
+func GetRedisBotRateKey(uid, minute string) string {
+	return fmt.Sprintf("tongji_bot_rate_%s_%s", uid, minute)
+}
+
+// GetRedisBotUIDKey tongji_bot_uid_<yyyy-mm-dd> 今日因访问频率过高被识别为爬虫的用户
+func GetRedisBotUIDKey(defaultdate string) string {
+	return fmt.Sprintf("tongji_bot_uid_%s", defaultdate)
+}
+
+// GetRedisSourceKey tongji_source_<yyyy-mm-dd> 统计所有域名今日流量来源的key
+func GetRedisSourceKey(defaultdate string) string {
+	return fmt.Sprintf("tongji_source_%s", defaultdate)
+}
+
 // GetRedisTimePVKey tongji_time_<domain>_pv 统计某个域名实时打开页面数
 func GetRedisTimePVKey(domain string) string {
 	return fmt.Sprintf("tongji_time_%s_pv", domain)
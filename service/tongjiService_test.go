@@ -0,0 +1,279 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/config"
+	"github.com/codepository/GoWebAnalytics/memredis"
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+const testDate = "2020-01-02"
+
+// TestMain 测试使用项目根目录的配置
+func TestMain(m *testing.M) {
+	var c config.Configuration
+	b, err := ioutil.ReadFile("../config.json")
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.SetForTest(&c)
+	os.Exit(m.Run())
+}
+
+// setupFakes 使用进程内的 redis 和 sqlite 内存数据库,注册域名 example.com(别名 www.example.com)
+func setupFakes(t *testing.T) *redis.Client {
+	c := *config.Config
+	c.DbType, c.DbName, c.DbLogMode = "sqlite3", ":memory:", "false"
+	model.SetupWith(&c)
+	rdb := memredis.NewClient()
+	model.RedisCli = rdb
+	d := &model.Domainmgr{Domain: "example.com", Aliases: "www.example.com", Enabled: true, SiteKey: "key"}
+	if err := d.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := RefreshDomainCache(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		model.RedisCli.Close()
+		model.GetDB().Close()
+	})
+	return rdb
+}
+
+// fakeStore 纪录保存的网页流量,其它方法使用 sqlite
+type fakeStore struct {
+	model.Storage
+	webflows map[string]model.WebFlow // key为url
+	fail     bool
+}
+
+func (s *fakeStore) UpdateOrSaveWebFlow(w *model.WebFlow) error {
+	if s.fail {
+		return errors.New("数据库不可用")
+	}
+	old := s.webflows[w.URL]
+	old.Domain, old.URL, old.Date = w.Domain, w.URL, w.Date
+	old.PV += w.PV
+	old.IP += w.IP
+	old.UV += w.UV
+	old.Visits += w.Visits
+	old.Duration += w.Duration
+	old.Bounce += w.Bounce
+	old.Entries += w.Entries
+	old.Exits += w.Exits
+	s.webflows[w.URL] = old
+	return nil
+}
+
+func TestGetDomainFromURL(t *testing.T) {
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{"https://example.com/a/b", "example.com"},
+		{"http://example.com", "example.com"},
+		{"http://example.com:8080/a", "example.com"},
+		{"https://www.example.com?from=mail", "www.example.com"},
+		{"https://example.com#top", "example.com"},
+		{"//example.com/a", "example.com"},
+		{"example.com/a", "example.com"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := getDomainFromURL(c.url); got != c.want {
+			t.Errorf("getDomainFromURL(%q) = %q,期望 %q", c.url, got, c.want)
+		}
+	}
+}
+
+// setWebflow 将网页流量写入redis,与 connmgr 保存的格式一致
+func setWebflow(t *testing.T, w model.WebFlow) {
+	key := GetRedisWebflowKey(w.Domain, w.Date, w.URL)
+	if err := model.RedisCli.HMSet(key, WebflowRedisValues(&w)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.RedisCli.SAdd(GetRedisURLKey(w.Date), w.URL).Err(); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := util.ToJSONStr(model.Pageinfo{Dm: w.Domain, URL: w.URL, Title: "title " + w.URL})
+	if err := model.RedisCli.Set(GetRedisPageinfoKey(w.Date, w.URL), p, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlushWebflow2DBFromRedis(t *testing.T) {
+	a := model.WebFlow{Domain: "example.com", URL: "https://example.com/a", Date: testDate, PV: 5, IP: 2, UV: 3, Visits: 4, Duration: 60, Bounce: 1, Entries: 2, Exits: 2}
+	// 别名的流量保存在注册的域名下
+	b := model.WebFlow{Domain: "example.com", URL: "https://www.example.com:443/b", Date: testDate, PV: 1, IP: 1, UV: 1, Visits: 1}
+	cases := []struct {
+		name     string
+		webflows []model.WebFlow
+		fail     bool
+		want     map[string]model.WebFlow
+		keysLeft int // 剩余的 webflow key 数
+	}{
+		{name: "空", want: map[string]model.WebFlow{}},
+		{name: "域名和别名", webflows: []model.WebFlow{a, b}, want: map[string]model.WebFlow{a.URL: a, b.URL: b}},
+		{name: "保存失败时保留redis中的流量", webflows: []model.WebFlow{a}, fail: true, want: map[string]model.WebFlow{}, keysLeft: 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rdb := setupFakes(t)
+			store := &fakeStore{Storage: model.Store, webflows: make(map[string]model.WebFlow), fail: c.fail}
+			model.Store = store
+			for _, w := range c.webflows {
+				setWebflow(t, w)
+			}
+			FlushWebflow2DBFromRedis(testDate)
+			if !reflect.DeepEqual(store.webflows, c.want) {
+				t.Fatalf("保存的流量为 %+v,期望 %+v", store.webflows, c.want)
+			}
+			if n := len(rdb.Keys("tongji_webflow_*").Val()); n != c.keysLeft {
+				t.Fatalf("剩余%d个 webflow key,期望%d个", n, c.keysLeft)
+			}
+			if rdb.Exists(GetRedisURLKey(testDate)).Val() != 0 {
+				t.Fatal("url集合应被删除")
+			}
+		})
+	}
+}
+
+func TestGetTopContentFromRedis(t *testing.T) {
+	setupFakes(t)
+	for _, w := range []model.WebFlow{
+		{Domain: "example.com", URL: "https://example.com/news/1", Date: testDate, PV: 10, UV: 2, Entries: 4, Bounce: 1},
+		{Domain: "example.com", URL: "https://example.com/news/2", Date: testDate, PV: 30, UV: 1},
+		{Domain: "example.com", URL: "https://example.com/about", Date: testDate, PV: 20, UV: 5},
+		{Domain: "other.com", URL: "https://other.com/", Date: testDate, PV: 100, UV: 100},
+	} {
+		setWebflow(t, w)
+	}
+	cases := []struct {
+		name string
+		req  RealtimeDataReq
+		want []string
+		err  bool
+	}{
+		{name: "默认按PV", req: RealtimeDataReq{}, want: []string{"https://example.com/news/2", "https://example.com/about", "https://example.com/news/1"}},
+		{name: "按UV", req: RealtimeDataReq{Sort: "uv"}, want: []string{"https://example.com/about", "https://example.com/news/1", "https://example.com/news/2"}},
+		{name: "分页", req: RealtimeDataReq{Offset: 1, Limit: 1}, want: []string{"https://example.com/about"}},
+		{name: "前缀", req: RealtimeDataReq{Prefix: "https://example.com/news/"}, want: []string{"https://example.com/news/2", "https://example.com/news/1"}},
+		{name: "前缀分页", req: RealtimeDataReq{Prefix: "https://example.com/news/", Offset: 1}, want: []string{"https://example.com/news/1"}},
+		{name: "不支持的排序字段", req: RealtimeDataReq{Sort: "title"}, err: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.req.Domain, c.req.StartDate = "example.com", testDate
+			s, err := GetTopContentFromRedis(&c.req)
+			if c.err {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result []WebData
+			if err := json.Unmarshal([]byte(s), &result); err != nil {
+				t.Fatal(err)
+			}
+			var urls []string
+			for _, d := range result {
+				if d.Pageinfo.Title != "title "+d.Pageinfo.URL {
+					t.Errorf("页面信息错误:%+v", d.Pageinfo)
+				}
+				urls = append(urls, d.Pageinfo.URL)
+			}
+			if !reflect.DeepEqual(urls, c.want) {
+				t.Fatalf("排名为 %v,期望 %v", urls, c.want)
+			}
+		})
+	}
+}
+
+// TestBrowsingsFromRedisVals 新旧两种格式混合的用户浏览习惯hash,旧格式的域名可能包含下划线
+func TestBrowsingsFromRedisVals(t *testing.T) {
+	legacy := func(b model.Browsing) string {
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	vals := map[string]string{
+		"example.com": legacy(model.Browsing{Domain: "example.com", Depth: 2, PV: 3, Visits: 1, Duration: 30,
+			IP: "1.1.1.1", Region: "杭州", NV: 1}),
+		"my_site.com":            legacy(model.Browsing{Domain: "my_site.com", PV: 1, IP: "2.2.2.2"}),
+		"pv_example.com":         "2",
+		"depth_example.com":      "1",
+		"duration_example.com":   "15",
+		"ip_example.com":         "3.3.3.3",
+		"devicetype_example.com": "1",
+		"pv_a_b.com":             "4",
+		"sr_a_b.com":             "1920x1080",
+	}
+	got := browsingsFromRedisVals(vals)
+	if len(got) != 3 {
+		t.Fatalf("期望3个域名,得到 %d: %v", len(got), got)
+	}
+	b := got["example.com"]
+	if b == nil || b.PV != 5 || b.Depth != 3 || b.Visits != 1 || b.Duration != 45 || b.DeviceType != 1 || b.NV != 1 {
+		t.Errorf("example.com 的计数不正确: %+v", b)
+	}
+	if b != nil && b.IP != "3.3.3.3" && b.IP != "1.1.1.1" {
+		t.Errorf("example.com 的ip不正确: %s", b.IP)
+	}
+	if b := got["my_site.com"]; b == nil || b.PV != 1 || b.IP != "2.2.2.2" {
+		t.Errorf("旧格式的 my_site.com 不正确: %+v", b)
+	}
+	if b := got["a_b.com"]; b == nil || b.PV != 4 || b.SR != "1920x1080" {
+		t.Errorf("新格式的 a_b.com 不正确: %+v", b)
+	}
+}
+
+// TestLookupDomainStale 缓存过期后数据库不可用时继续使用旧的缓存
+func TestLookupDomainStale(t *testing.T) {
+	setupFakes(t)
+	if LookupDomain("example.com") == nil {
+		t.Fatal("未找到已注册的域名")
+	}
+	expired := time.Now().Add(-2 * domainCacheTTL)
+	domainCache.mu.Lock()
+	domainCache.checked = expired
+	domainCache.mu.Unlock()
+	model.GetDB().Close()
+
+	if d := LookupDomain("www.example.com"); d == nil || d.Domain != "example.com" {
+		t.Fatalf("数据库不可用时应使用旧的缓存,得到 %v", d)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&domainCache.running) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	domainCache.mu.Lock()
+	checked := domainCache.checked
+	domainCache.mu.Unlock()
+	if !checked.After(expired) {
+		t.Error("加载失败后应等到下次过期再重试")
+	}
+	if LookupDomain("example.com") == nil {
+		t.Error("加载失败后旧的缓存被清空")
+	}
+}
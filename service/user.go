@@ -1,8 +1,203 @@
 package service
 
-import "log"
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
 
-// CheckIdentity 用户身份认证
-func CheckIdentity() {
-	log.Println("用户身份认证，未完成")
+	"github.com/jinzhu/gorm"
+	"github.com/mumushuiding/util"
+
+	"github.com/codepository/GoWebAnalytics/model"
+)
+
+// RoleRoot 超级管理员,使用配置 AdminToken 访问,可以管理用户和所有域名
+const RoleRoot = "root"
+
+// roleLevels 角色权限等级
+var roleLevels = map[string]int{
+	model.RoleRead:  1,
+	model.RoleAdmin: 2,
+	RoleRoot:        3,
+}
+
+// Identity 通过身份认证的用户
+type Identity struct {
+	Name    string
+	Role    string
+	domains map[int]string // 所属域名 id:domain
+}
+
+type identityKey struct{}
+
+// UserReq 用户创建和修改请求
+type UserReq struct {
+	ID      int      `json:"id"`
+	Name    string   `json:"name"`
+	Role    string   `json:"role"`
+	Domains []string `json:"domains"`
+}
+
+// CheckIdentity 用户身份认证,token 为配置的 AdminToken 时为超级管理员
+func CheckIdentity(token string) (*Identity, error) {
+	if len(token) == 0 {
+		return nil, errors.New("token 不能为空")
+	}
+	if len(conf.AdminToken) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(conf.AdminToken)) == 1 {
+		return &Identity{Name: RoleRoot, Role: RoleRoot}, nil
+	}
+	u, err := model.FindUserByTokenHash(hashToken(token))
+	if err == gorm.ErrRecordNotFound {
+		return nil, errors.New("token 无效")
+	}
+	if err != nil {
+		return nil, err
+	}
+	id := &Identity{Name: u.Name, Role: u.Role, domains: make(map[int]string)}
+	for _, d := range u.Domains {
+		id.domains[d.ID] = d.Domain
+	}
+	return id, nil
+}
+
+// WithIdentity 将用户保存到 context
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// GetIdentity 从 context 获取用户,未认证时返回nil
+func GetIdentity(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// HasRole 是否拥有指定角色
+func (id *Identity) HasRole(role string) bool {
+	return id != nil && roleLevels[id.Role] >= roleLevels[role]
+}
+
+// Can 是否可以以指定角色访问域名
+func (id *Identity) Can(role, domain string) bool {
+	if !id.HasRole(role) {
+		return false
+	}
+	if id.Role == RoleRoot {
+		return true
+	}
+	for _, d := range id.domains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// CanDomainID 是否可以以指定角色访问指定id的域名
+func (id *Identity) CanDomainID(role string, domainID int) bool {
+	if !id.HasRole(role) {
+		return false
+	}
+	if id.Role == RoleRoot {
+		return true
+	}
+	_, ok := id.domains[domainID]
+	return ok
+}
+
+// GetUsers 获取所有用户
+func GetUsers() (string, error) {
+	datas, err := model.FindAllUsers()
+	if err != nil {
+		return "", err
+	}
+	return util.ToJSONStr(datas)
+}
+
+// AddUser 创建用户,返回的 token 只显示这一次
+func AddUser(req *UserReq) (string, error) {
+	u := &model.User{}
+	if err := req.fill(u); err != nil {
+		return "", err
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	u.TokenHash = hashToken(token)
+	if err := u.Save(); err != nil {
+		return "", err
+	}
+	return util.ToJSONStr(map[string]interface{}{
+		"user":  u,
+		"token": token,
+	})
+}
+
+// UpdateUser 修改用户角色及所属域名
+func UpdateUser(req *UserReq) (string, error) {
+	u, err := model.FindUserByID(req.ID)
+	if err != nil {
+		return "", fmt.Errorf("用户id:%d 不存在:%v", req.ID, err)
+	}
+	if err := req.fill(u); err != nil {
+		return "", err
+	}
+	if err := u.Update(); err != nil {
+		return "", err
+	}
+	return util.ToJSONStr(u)
+}
+
+// DelUser 删除用户
+func DelUser(id int) error {
+	u, err := model.FindUserByID(id)
+	if err != nil {
+		return fmt.Errorf("用户id:%d 不存在:%v", id, err)
+	}
+	return u.Delete()
+}
+
+// fill 校验并填充用户信息
+func (req *UserReq) fill(u *model.User) error {
+	if len(req.Name) == 0 {
+		return errors.New("name 不能为空")
+	}
+	if req.Role != model.RoleRead && req.Role != model.RoleAdmin {
+		return fmt.Errorf("role 必须是 %s 或 %s", model.RoleRead, model.RoleAdmin)
+	}
+	domains, err := model.FindDomainsByName(req.Domains)
+	if err != nil {
+		return err
+	}
+	if len(domains) != len(req.Domains) {
+		return errors.New("domains 中存在未注册的域名")
+	}
+	u.Name = req.Name
+	u.Role = req.Role
+	u.Domains = domains
+	return nil
+}
+
+// newToken 生成随机 token
+func newToken() (string, error) {
+	return randomHex(24)
+}
+
+// randomHex 生成n个随机字节的十六进制字符串
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken token 的 sha256
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
 }
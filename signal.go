@@ -1,19 +1,27 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/codepository/GoWebAnalytics/service"
 )
 
 // shutdownRequestChannel 用于关闭初始化
 var shutdownRequestChannel = make(chan struct{})
 
-// interruptSignals 定义默认的关闭触发信号
-var interruptSignals = []os.Signal{os.Interrupt}
+// interruptSignals 定义默认的关闭触发信号,容器编排系统发送 SIGTERM
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// shutdownTimeout 关闭时等待正在处理的http请求完成的最长时间
+const shutdownTimeout = 10 * time.Second
 
-// interruptListener 监听关闭信号(Ctrl+C)
+// interruptListener 监听关闭信号(Ctrl+C、SIGTERM),停止接收请求并等待正在处理的请求完成后关闭返回的channel
 func interruptListener(s *http.Server) <-chan struct{} {
 	c := make(chan struct{})
 	go func() {
@@ -22,11 +30,10 @@ func interruptListener(s *http.Server) <-chan struct{} {
 		select {
 		case sig := <-interruptChannel:
 			log.Printf("收到关闭信号 (%s). 关闭...\n", sig)
-			s.Close()
 		case <-shutdownRequestChannel:
 			log.Println("关闭请求.关闭...")
-			s.Close()
 		}
+		shutdown(s)
 		close(c)
 		// 重复关闭信号处理
 		for {
@@ -42,6 +49,30 @@ func interruptListener(s *http.Server) <-chan struct{} {
 	}()
 	return c
 }
+
+// shutdown 停止接收新的请求,等待正在处理的请求完成,超时后强制关闭
+func shutdown(s *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("等待http请求完成超时:%v\n", err)
+		s.Close()
+	}
+}
+
+// reloadListener 收到 SIGHUP 时重新加载爬虫规则
+func reloadListener() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			log.Println("收到 SIGHUP,重新加载爬虫规则")
+			if err := service.LoadBotRules(); err != nil {
+				log.Printf("加载爬虫规则失败:%v\n", err)
+			}
+		}
+	}()
+}
 func interruptRequested(interrupted <-chan struct{}) bool {
 	select {
 	case <-interrupted:
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/codepository/GoWebAnalytics/config"
+	"github.com/codepository/GoWebAnalytics/model"
+	"github.com/codepository/GoWebAnalytics/service"
+)
+
+// TestReloadListener 收到 SIGHUP 后重新读取爬虫规则文件
+func TestReloadListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bots.txt")
+	ioutil.WriteFile(path, []byte("FirstBot\n"), 0644)
+	config.Config.BotPatternsPath = path
+	defer func() { config.Config.BotPatternsPath = "" }()
+	if err := service.LoadBotRules(); err != nil {
+		t.Fatal(err)
+	}
+	reloadListener()
+	if reason, _ := service.DetectBot("SecondBot/1.0", "1.2.3.4"); len(reason) > 0 {
+		t.Fatal("修改规则文件前不应识别为爬虫")
+	}
+	ioutil.WriteFile(path, []byte("SecondBot\n"), 0644)
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if reason, _ := service.DetectBot("SecondBot/1.0", "1.2.3.4"); reason == model.BotReasonUA {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("收到 SIGHUP 后没有重新加载爬虫规则")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if reason, _ := service.DetectBot("FirstBot/1.0", "1.2.3.4"); len(reason) > 0 {
+		t.Fatal("重新加载后旧规则不应生效")
+	}
+}